@@ -1,15 +1,31 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
-	"github.com/gumbees/cfwg-zt/src/cloudflare"
 	"github.com/gumbees/cfwg-zt/src/config"
-	"github.com/gumbees/cfwg-zt/src/udm"
+	"github.com/gumbees/cfwg-zt/src/control"
+	"github.com/gumbees/cfwg-zt/src/diff"
+	"github.com/gumbees/cfwg-zt/src/doctor"
+	"github.com/gumbees/cfwg-zt/src/exitcode"
+	"github.com/gumbees/cfwg-zt/src/logging"
+	"github.com/gumbees/cfwg-zt/src/persist"
+	"github.com/gumbees/cfwg-zt/src/probe"
+	"github.com/gumbees/cfwg-zt/src/redact"
+	"github.com/gumbees/cfwg-zt/src/routing"
+	"github.com/gumbees/cfwg-zt/src/service"
+	"github.com/gumbees/cfwg-zt/src/status"
+	"github.com/gumbees/cfwg-zt/src/wireguard"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
 )
 
 var rootCmd = &cobra.Command{
@@ -19,8 +35,20 @@ var rootCmd = &cobra.Command{
 }
 
 var (
-	configFile string
-	debugMode  bool
+	configFile   string
+	debugMode    bool
+	doctorJSON   bool
+	statusOutput string
+	ctlOutput    string
+	refreshForce bool
+	dryRun       bool
+	exportFormat string
+	exportDir    string
+	exportOpts   wireguard.ExportOptions
+	persistData  string
+	persistBoot  string
+	persistJSON  bool
+	routingPlan  bool
 )
 
 func init() {
@@ -34,6 +62,50 @@ func init() {
 	rootCmd.AddCommand(setupCmd)
 	rootCmd.AddCommand(configWizardCmd)
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(doctorCmd)
+	rootCmd.AddCommand(ctlCmd)
+	rootCmd.AddCommand(refreshCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(persistCmd)
+	persistCmd.AddCommand(persistInstallCmd)
+	persistCmd.AddCommand(persistRemoveCmd)
+	persistCmd.AddCommand(persistStatusCmd)
+	rootCmd.AddCommand(routingCmd)
+	routingCmd.AddCommand(routingApplyCmd)
+	routingCmd.AddCommand(routingRemoveCmd)
+
+	// Status command flags
+	statusCmd.Flags().StringVarP(&statusOutput, "output", "o", "text", "Output format: text, json or yaml")
+
+	// Doctor command flags
+	doctorCmd.Flags().BoolVar(&doctorJSON, "json", false, "Print the report as JSON")
+
+	// Start and refresh command flags
+	startCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show the changes to the WireGuard configuration without applying them, then exit")
+	refreshCmd.Flags().BoolVar(&refreshForce, "force", false, "Rewrite the configuration and restart WireGuard even if nothing changed")
+	refreshCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show the changes to the WireGuard configuration without applying them")
+
+	// Export command flags
+	exportCmd.Flags().StringVarP(&exportFormat, "format", "f", wireguard.ExportWgQuick, "Output format: wg-quick, json, networkd or nmconnection")
+	exportCmd.Flags().StringVar(&exportDir, "output-dir", "", "Write the files to this directory instead of stdout")
+	exportCmd.Flags().StringVar(&exportOpts.InterfaceName, "interface", "", "Interface name (default is the configured interface name)")
+	exportCmd.Flags().StringSliceVar(&exportOpts.Addresses, "address", nil, "Interface addresses (default is the addresses assigned by Cloudflare)")
+	exportCmd.Flags().StringSliceVar(&exportOpts.AllowedIPs, "allowed-ips", nil, "Allowed IPs of the peer (default is the list issued by Cloudflare)")
+	exportCmd.Flags().StringSliceVar(&exportOpts.DNS, "dns", nil, "DNS servers (default is the list issued by Cloudflare)")
+	exportCmd.Flags().StringVar(&exportOpts.EndpointPreference, "endpoint-preference", "", "Endpoint address family: auto, ipv4 or ipv6 (default is wireguard.endpoint_preference)")
+	exportCmd.Flags().IntVar(&exportOpts.MTU, "mtu", 0, "Interface MTU (default is wireguard.mtu)")
+	exportCmd.Flags().IntVar(&exportOpts.PersistentKeepalive, "keepalive", 0, "Persistent keepalive interval in seconds, 0 disables (default is wireguard.persistent_keepalive)")
+
+	// Ctl command flags
+	ctlCmd.Flags().StringVarP(&ctlOutput, "output", "o", "text", "Output format for the state command: text, json or yaml")
+
+	// Persist command flags
+	persistCmd.PersistentFlags().StringVar(&persistData, "data-dir", persist.DefaultDataDir, "Directory on the persistent partition that holds the copies")
+	persistCmd.PersistentFlags().StringVar(&persistBoot, "boot-dir", persist.DefaultBootDir, "Directory of the scripts run on boot")
+	persistStatusCmd.Flags().BoolVar(&persistJSON, "json", false, "Print the status as JSON")
+
+	// Routing command flags
+	routingApplyCmd.Flags().BoolVar(&routingPlan, "dry-run", false, "Print the ip commands that would run without running them")
 }
 
 // startCmd represents the start command for running the service
@@ -41,76 +113,323 @@ var startCmd = &cobra.Command{
 	Use:   "start",
 	Short: "Start the service",
 	Run: func(cmd *cobra.Command, args []string) {
+		if dryRun {
+			runDryRun()
+			return
+		}
+
 		// This simply calls the main function which starts the service
 		runService()
 	},
 }
 
-// statusCmd checks the status of the WireGuard connection
-var statusCmd = &cobra.Command{
-	Use:   "status",
-	Short: "Check the status of the WireGuard connection",
+// refreshCmd performs a single refresh pass and exits
+var refreshCmd = &cobra.Command{
+	Use:   "refresh",
+	Short: "Refresh the WireGuard configuration once and exit",
+	Long: `Authenticates with Cloudflare Zero Trust, fetches the WireGuard configuration, updates the
+configuration file and restarts WireGuard, then exits. An unchanged configuration is left
+alone unless --force is given. Useful from cron, on_boot scripts or after a firmware update.
+If the daemon is running, prefer 'cfwg-zt ctl refresh'.
+
+Exit codes, shared with 'cfwg-zt status':
+  0  configuration up to date or applied
+  1  unexpected error
+  2  configuration error
+  3  Cloudflare authentication failed
+  4  fetching the WireGuard configuration failed
+  5  WireGuard service state could not be checked
+  6  writing the WireGuard configuration failed
+  7  applying the WireGuard configuration failed
+  8  connectivity verification failed
+  9  WireGuard service not running
+
+With --dry-run, fresh credentials are fetched and a unified diff of the WireGuard
+configuration is printed with keys redacted; nothing is written, backed up or restarted.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		if dryRun {
+			runDryRun()
+			return
+		}
+
 		cfg, err := loadConfigWithFlags()
 		if err != nil {
-			log.Fatalf("Error loading configuration: %v", err)
+			fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+			os.Exit(exitcode.Config)
 		}
 
-		// Initialize components
-		cfClient, err := cloudflare.NewClient(cfg)
+		logOutput := logging.Configure(cfg)
+		defer logOutput.Close()
+
+		c, err := newComponents(cfg)
 		if err != nil {
-			log.Fatalf("Error initializing Cloudflare client: %v", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitcode.Config)
 		}
 
-		udmClient := udm.NewClient(cfg)
-		
-		// First check if the config file exists
-		configPath := cfg.WireGuard.ConfigPath
-		if _, err := os.Stat(configPath); os.IsNotExist(err) {
-			fmt.Printf("WireGuard configuration file not found at %s\n", configPath)
-			fmt.Println("If you created a configuration through the UDM Pro UI, make sure this application")
-			fmt.Printf("is configured with the correct path to the UI-created WireGuard configuration file.\n")
-			os.Exit(1)
+		var prober *probe.Prober
+		if cfg.Probe.Enabled {
+			prober = probe.New(cfg.WireGuard.InterfaceName, cfg.Probe.URL, cfg.Probe.Expect,
+				time.Duration(cfg.Probe.TimeoutSeconds)*time.Second)
 		}
 
-		// Check if WireGuard is running
-		isRunning, err := udmClient.IsWireGuardRunning()
+		ctx := logging.WithCycle(context.Background(), logging.NewCycleID())
+		reconciler := service.NewReconciler(cfg, c.cfClient, c.wgManager, c.platform, prober)
+		result, err := reconciler.Reconcile(ctx, service.Options{Force: refreshForce})
 		if err != nil {
-			log.Fatalf("Error checking WireGuard status: %v", err)
+			fmt.Fprintf(os.Stderr, "Refresh failed: %v\n", err)
+			var reconcileErr *service.Error
+			if errors.As(err, &reconcileErr) && reconcileErr.RolledBack {
+				fmt.Fprintln(os.Stderr, "The previous WireGuard configuration was restored")
+			}
+			os.Exit(service.ExitCode(err))
 		}
 
-		if !isRunning {
-			fmt.Println("WireGuard is not running. Please check your UDM Pro UI settings.")
-			fmt.Println("You may need to enable the WireGuard interface in the UDM Pro UI.")
-			os.Exit(1)
+		// Restarting the interface removed its routes
+		c.applyRouting(ctx)
+
+		if result.Changed {
+			fmt.Println("WireGuard configuration updated and applied")
+		} else {
+			fmt.Println("WireGuard configuration is up to date; use --force to apply it anyway")
+		}
+	},
+}
+
+// runDryRun fetches fresh credentials and prints the changes a refresh would make to the WireGuard configuration
+// Nothing is written, backed up or restarted
+func runDryRun() {
+	cfg, err := loadConfigWithFlags()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		os.Exit(exitcode.Config)
+	}
+
+	// Logs go to stderr only, so the diff on stdout can be piped or saved
+	cfg.Logging.Output = logging.OutputStderr
+	logOutput := logging.Configure(cfg)
+	defer logOutput.Close()
+
+	c, err := newComponents(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitcode.Config)
+	}
+
+	ctx := logging.WithCycle(context.Background(), logging.NewCycleID())
+	reconciler := service.NewReconciler(cfg, c.cfClient, c.wgManager, c.platform, nil)
+	result, err := reconciler.Reconcile(ctx, service.Options{DryRun: true})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Dry run failed: %v\n", err)
+		os.Exit(service.ExitCode(err))
+	}
+
+	path := cfg.WireGuard.ConfigPath
+	unified := diff.Unified(path, path+" (proposed)", result.Current, result.Proposed, 3)
+	if unified == "" {
+		fmt.Printf("No changes to %s\n", path)
+		return
+	}
+	fmt.Print(redact.String(unified))
+}
+
+// exportCmd renders the Cloudflare-authenticated configuration for another Linux host
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the WireGuard configuration for another Linux host",
+	Long: `Authenticates with Cloudflare Zero Trust and prints a standalone WireGuard configuration
+for use on other Linux hosts. Supported formats:
+  wg-quick      a wg-quick configuration file
+  json          a JSON document for scripts and configuration management
+  networkd      a systemd-networkd .netdev and .network pair
+  nmconnection  a NetworkManager keyfile
+
+The output contains the private key; files written with --output-dir are only readable by their owner.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := loadConfigWithFlags()
+		if err != nil {
+			log.Fatalf("Error loading configuration: %v", err)
+		}
+
+		// Logs go to stderr only, so the exported configuration on stdout can be redirected
+		cfg.Logging.Output = logging.OutputStderr
+		logOutput := logging.Configure(cfg)
+		defer logOutput.Close()
+
+		if exportOpts.InterfaceName == "" {
+			exportOpts.InterfaceName = cfg.WireGuard.InterfaceName
+		}
+		if exportOpts.EndpointPreference == "" {
+			exportOpts.EndpointPreference = cfg.WireGuard.EndpointPreference
+		}
+		// The manager selects the endpoint, so it has to know about a preference given on the command line
+		cfg.WireGuard.EndpointPreference = exportOpts.EndpointPreference
+		if !cmd.Flags().Changed("mtu") {
+			exportOpts.MTU = cfg.WireGuard.MTU
+		}
+		if !cmd.Flags().Changed("keepalive") {
+			exportOpts.PersistentKeepalive = cfg.WireGuard.PersistentKeepalive
 		}
 
-		// Authenticate to check device status
-		deviceToken, err := cfClient.AuthenticateDevice()
+		c, err := newComponents(cfg)
 		if err != nil {
-			log.Fatalf("Error authenticating with Cloudflare: %v", err)
+			log.Fatalf("Error: %v", err)
 		}
 
-		// Check device status
-		active, err := cfClient.GetDeviceStatus(deviceToken)
+		// The configuration goes through the same steps as the one the service writes
+		ctx := context.Background()
+		reconciler := service.NewReconciler(cfg, c.cfClient, c.wgManager, c.platform, nil)
+		wgConfig, _, err := reconciler.Fetch(ctx)
 		if err != nil {
-			fmt.Println("WireGuard is running but Cloudflare Zero Trust status is unknown")
-			fmt.Printf("Error: %v\n", err)
-			os.Exit(1)
+			log.Fatalf("Error getting WireGuard configuration: %v", err)
+		}
+
+		files, err := c.wgManager.Export(wgConfig, exportFormat, exportOpts)
+		if err != nil {
+			log.Fatalf("Error exporting configuration: %v", err)
 		}
 
-		if active {
-			fmt.Println("WireGuard is running and connected to Cloudflare Zero Trust")
-			fmt.Println("The UDM Pro UI-created WireGuard configuration is being maintained successfully.")
-			fmt.Println("You can use policy-based routing in the UDM Pro UI to route traffic through this tunnel.")
+		if exportDir != "" {
+			if err := os.MkdirAll(exportDir, 0755); err != nil {
+				log.Fatalf("Error creating output directory: %v", err)
+			}
+			for _, file := range files {
+				path := filepath.Join(exportDir, file.Name)
+				if err := os.WriteFile(path, []byte(file.Content), 0600); err != nil {
+					log.Fatalf("Error writing %s: %v", path, err)
+				}
+				fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+			}
+			return
+		}
+
+		for i, file := range files {
+			// Label the files when there is more than one, so they can be told apart
+			if len(files) > 1 {
+				if i > 0 {
+					fmt.Println()
+				}
+				fmt.Printf("# %s\n", file.Name)
+			}
+			fmt.Print(file.Content)
+		}
+	},
+}
+
+// statusCmd checks the status of the WireGuard connection
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Check the status of the WireGuard connection",
+	Long: `Checks the WireGuard service and the Cloudflare Zero Trust device status.
+
+The exit code identifies the first problem found, with the codes 'cfwg-zt refresh' uses:
+  0   connected
+  1   unexpected error
+  2   configuration error
+  3   Cloudflare authentication failed
+  5   WireGuard service state could not be checked
+  9   WireGuard service not running
+  10  WireGuard configuration file missing
+  11  Cloudflare device status unknown
+  12  device not active in Cloudflare Zero Trust
+
+When the daemon is running, its live view is reported through the control socket.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var report *status.Report
+		cfg, err := loadConfigWithFlags()
+		if err != nil {
+			report = &status.Report{
+				ConfigPath: viper.ConfigFileUsed(),
+				Failure:    status.FailureConfig,
+				Error:      err.Error(),
+			}
 		} else {
-			fmt.Println("WireGuard is running but not active in Cloudflare Zero Trust")
-			fmt.Println("The application will attempt to reconnect automatically.")
+			report = daemonStatus(cfg)
+			if report == nil {
+				report = status.Collect(context.Background(), cfg, viper.ConfigFileUsed())
+			}
+		}
+
+		if err := writeStatusReport(report, statusOutput); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing status: %v\n", err)
+			os.Exit(exitcode.Error)
+		}
+		os.Exit(report.ExitCode())
+	},
+}
+
+// daemonStatus asks the running daemon for its live status
+// It returns nil when no daemon is reachable, so the caller can collect the status itself
+func daemonStatus(cfg *config.Config) *status.Report {
+	if cfg.Control.SocketPath == "" || !control.Available(cfg.Control.SocketPath) {
+		return nil
+	}
+
+	resp, err := control.Send(cfg.Control.SocketPath, control.CommandState)
+	if err != nil || resp.Status == nil {
+		fmt.Fprintf(os.Stderr, "Daemon status unavailable (%v), checking directly\n", err)
+		return nil
+	}
+	return resp.Status
+}
+
+// ctlCmd sends a command to the running daemon over its control socket
+var ctlCmd = &cobra.Command{
+	Use:   "ctl <command>",
+	Short: "Control the running daemon",
+	Long: `Sends a command to the running daemon over its control socket.
+
+Commands:
+  refresh  fetch and apply the WireGuard configuration now
+  rotate   register the device again to obtain new keys, then apply them
+  pause    stop refreshing the configuration until resumed
+  resume   resume refreshing and refresh now
+  state    print the daemon's live status
+  reload   reload the configuration file`,
+	Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	ValidArgs: control.Commands,
+	Run: func(cmd *cobra.Command, args []string) {
+		socketPath := control.DefaultSocketPath
+		if cfg, err := loadConfigWithFlags(); err == nil && cfg.Control.SocketPath != "" {
+			socketPath = cfg.Control.SocketPath
+		}
+
+		resp, err := control.Send(socketPath, args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
+
+		if resp.Status != nil {
+			if err := writeStatusReport(resp.Status, ctlOutput); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing status: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+		fmt.Println(resp.Message)
 	},
 }
 
+// writeStatusReport prints the status report in the requested output format
+func writeStatusReport(report *status.Report, format string) error {
+	switch format {
+	case "text", "":
+		report.WriteText(os.Stdout)
+		return nil
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case "yaml":
+		encoder := yaml.NewEncoder(os.Stdout)
+		defer encoder.Close()
+		return encoder.Encode(report)
+	default:
+		return fmt.Errorf("unsupported output format %q (expected text, json or yaml)", format)
+	}
+}
+
 // setupCmd creates a new configuration file
 var setupCmd = &cobra.Command{
 	Use:   "setup",
@@ -199,6 +518,194 @@ var configWizardCmd = &cobra.Command{
 	},
 }
 
+// doctorCmd runs end-to-end diagnostics and prints remediation hints
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose common configuration and connectivity problems",
+	Long:  `Runs a checklist covering the configuration, file permissions, WireGuard tools and service, endpoint DNS, Cloudflare API access, dummy keys, handshake age and backup directory size.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := loadConfigWithFlags()
+		if err != nil {
+			log.Fatalf("Error loading configuration: %v", err)
+		}
+
+		report := doctor.Run(context.Background(), cfg, viper.ConfigFileUsed())
+
+		if doctorJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(report); err != nil {
+				log.Fatalf("Error encoding report: %v", err)
+			}
+		} else {
+			report.WriteText(os.Stdout)
+		}
+
+		if report.Failed() {
+			os.Exit(1)
+		}
+	},
+}
+
+// persistCmd keeps cfwg-zt installed across UniFi OS firmware upgrades
+var persistCmd = &cobra.Command{
+	Use:   "persist",
+	Short: "Keep cfwg-zt installed across firmware upgrades",
+	Long: `UniFi OS firmware upgrades wipe everything outside of /data, including the cfwg-zt binary,
+its systemd unit and its configuration. 'persist install' copies them to /data/cfwg-zt and writes
+a boot hook to /data/on_boot.d that restores whatever is missing and re-enables the service.
+The boot hooks are run by udm-boot, which must be installed separately.
+
+Run 'persist install' again after upgrading cfwg-zt or changing its configuration.`,
+}
+
+// persistInstallCmd copies the files to the persistent partition and writes the boot hook
+var persistInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Copy cfwg-zt to the persistent partition and install the boot hook",
+	Run: func(cmd *cobra.Command, args []string) {
+		p := newPersister()
+		if err := p.Install(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		status := p.Status()
+		fmt.Printf("Boot hook installed at %s\n", status.Hook)
+		if status.BootRunner == "" {
+			fmt.Printf("Warning: udm-boot was not found; install it so the scripts in %s run on boot\n", persistBoot)
+		}
+	},
+}
+
+// persistRemoveCmd undoes persistInstallCmd
+var persistRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "Remove the boot hook and the persisted copies",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := newPersister().Remove(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Boot hook and persisted copies removed")
+	},
+}
+
+// persistStatusCmd reports what is persisted; it exits with 1 unless everything is installed and current
+var persistStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show whether the boot hook and persisted copies are installed and current",
+	Run: func(cmd *cobra.Command, args []string) {
+		status := newPersister().Status()
+
+		if persistJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(status); err != nil {
+				log.Fatalf("Error encoding status: %v", err)
+			}
+		} else {
+			status.WriteText(os.Stdout)
+		}
+
+		if !status.Installed() {
+			os.Exit(1)
+		}
+	},
+}
+
+// newPersister creates a persister for the configuration file in use
+func newPersister() *persist.Persister {
+	if _, err := loadConfigWithFlags(); err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+
+	configPath := viper.ConfigFileUsed()
+	if configPath == "" {
+		log.Fatalf("No configuration file found; create one with 'cfwg-zt setup' first")
+	}
+	if absPath, err := filepath.Abs(configPath); err == nil {
+		configPath = absPath
+	}
+	return persist.New(persistData, persistBoot, configPath)
+}
+
+// routingCmd manages the policy-based routing through the WireGuard interface
+var routingCmd = &cobra.Command{
+	Use:   "routing",
+	Short: "Manage policy-based routing through the WireGuard interface",
+	Long: `Routes the configured source subnets, VLAN interfaces, destination subnets and marked packets
+through the WireGuard interface, using a routing table of its own and rules that look it up.
+The daemon applies the routing on start and after every configuration update; these commands
+apply it on demand or remove it after routing was disabled.`,
+}
+
+// routingApplyCmd brings the rules and routes in line with the configuration
+var routingApplyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Add the missing rules and routes and delete stale ones",
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, m := newRouting()
+		if !cfg.Routing.Enabled {
+			fmt.Fprintln(os.Stderr, "Error: routing is disabled; set routing.enabled in the configuration")
+			os.Exit(1)
+		}
+
+		ctx := context.Background()
+		var commands []routing.Command
+		var err error
+		if routingPlan {
+			commands, err = m.Plan(ctx)
+		} else {
+			commands, err = m.Apply(ctx)
+		}
+		printRoutingCommands(commands)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// routingRemoveCmd deletes everything routingApplyCmd added
+var routingRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "Delete the rules that look up the routing table and flush it",
+	Run: func(cmd *cobra.Command, args []string) {
+		_, m := newRouting()
+		commands, err := m.Remove(context.Background())
+		printRoutingCommands(commands)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// newRouting creates the routing manager for the configuration, whether or not routing is enabled
+func newRouting() (*config.Config, *routing.Manager) {
+	cfg, err := loadConfigWithFlags()
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+	m, err := routing.New(cfg)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	return cfg, m
+}
+
+// printRoutingCommands prints the ip commands, or that there was nothing to do
+func printRoutingCommands(commands []routing.Command) {
+	if len(commands) == 0 {
+		fmt.Println("Routing is up to date")
+		return
+	}
+	for _, command := range commands {
+		fmt.Println(command)
+	}
+}
+
 // versionCmd displays version information
 var versionCmd = &cobra.Command{
 	Use:   "version",
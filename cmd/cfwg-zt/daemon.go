@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/control"
+	"github.com/gumbees/cfwg-zt/src/logging"
+	"github.com/gumbees/cfwg-zt/src/notify"
+	"github.com/gumbees/cfwg-zt/src/platform"
+	"github.com/gumbees/cfwg-zt/src/probe"
+	"github.com/gumbees/cfwg-zt/src/routing"
+	"github.com/gumbees/cfwg-zt/src/sdnotify"
+	"github.com/gumbees/cfwg-zt/src/service"
+	"github.com/gumbees/cfwg-zt/src/state"
+	"github.com/gumbees/cfwg-zt/src/status"
+	"github.com/gumbees/cfwg-zt/src/wireguard"
+)
+
+// components are the clients the service loop works with; they are rebuilt together on reload
+type components struct {
+	cfg       *config.Config
+	cfClient  *cloudflare.Client
+	wgManager *wireguard.Manager
+	platform  platform.Platform
+	notifier  *notify.Notifier
+	failover  *wireguard.Failover
+	// routing is nil unless policy-based routing is enabled
+	routing *routing.Manager
+}
+
+// newComponents creates the clients for a configuration
+func newComponents(cfg *config.Config) (*components, error) {
+	cfClient, err := cloudflare.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing Cloudflare client: %w", err)
+	}
+
+	notifier, err := notify.NewNotifier(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing notifications: %w", err)
+	}
+
+	wgManager := wireguard.NewManager(cfg)
+	p, err := platform.New(cfg, wgManager)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing platform backend: %w", err)
+	}
+
+	var router *routing.Manager
+	if cfg.Routing.Enabled {
+		if router, err = routing.New(cfg); err != nil {
+			return nil, fmt.Errorf("error initializing routing: %w", err)
+		}
+	}
+
+	return &components{
+		cfg:       cfg,
+		cfClient:  cfClient,
+		wgManager: wgManager,
+		platform:  p,
+		notifier:  notifier,
+		failover:  wireguard.NewFailover(wgManager),
+		routing:   router,
+	}, nil
+}
+
+// applyRouting brings the routing rules and routes in line with the configuration, if routing is enabled
+func (c *components) applyRouting(ctx context.Context) {
+	if c.routing == nil {
+		return
+	}
+	if _, err := c.routing.Apply(ctx); err != nil {
+		logger.WarnContext(ctx, "Failed to update routing", "error", err)
+	}
+}
+
+// daemon is the running service: the refresh loop plus the state the control socket inspects and changes
+type daemon struct {
+	configPath string
+	systemd    *sdnotify.Notifier
+	prober     *probe.Prober
+	// watcher, if set, is told the private key of every configuration applied
+	watcher *wireguard.Watcher
+
+	// wake interrupts the wait between refreshes; forceRegistration makes the next refresh register anew
+	wake              chan struct{}
+	forceRegistration atomic.Bool
+
+	mu      sync.Mutex
+	current *components
+	pending *components
+	status  status.DaemonStatus
+}
+
+// newDaemon creates a daemon around the initial components
+func newDaemon(c *components, configPath string, systemd *sdnotify.Notifier, prober *probe.Prober, watcher *wireguard.Watcher) *daemon {
+	return &daemon{
+		configPath: configPath,
+		systemd:    systemd,
+		prober:     prober,
+		watcher:    watcher,
+		wake:       make(chan struct{}, 1),
+		current:    c,
+		status:     status.DaemonStatus{PID: os.Getpid(), Activity: "Starting"},
+	}
+}
+
+// components returns the components currently in use
+func (d *daemon) components() *components {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.current
+}
+
+// trigger wakes the loop for an early refresh, optionally forcing a new device registration
+func (d *daemon) trigger(register bool) {
+	if register {
+		d.forceRegistration.Store(true)
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// setActivity records what the loop is doing and reports it to systemd
+func (d *daemon) setActivity(format string, args ...interface{}) {
+	activity := fmt.Sprintf(format, args...)
+	d.mu.Lock()
+	d.status.Activity = activity
+	d.mu.Unlock()
+	d.systemd.Status("%s", activity)
+}
+
+// update changes the daemon status under the lock
+func (d *daemon) update(change func(s *status.DaemonStatus)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	change(&d.status)
+}
+
+// paused reports whether updates are paused
+func (d *daemon) paused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status.Paused
+}
+
+// applyPending switches to reloaded components, if any, and returns the components to use
+func (d *daemon) applyPending(ctx context.Context) *components {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.pending != nil {
+		d.current = d.pending
+		d.pending = nil
+		logger.InfoContext(ctx, "Switched to the reloaded configuration")
+	}
+	return d.current
+}
+
+// handshakeStale moves the tunnel to the next endpoint candidate, or forces a new registration once all were tried
+func (d *daemon) handshakeStale(age time.Duration) {
+	ctx := context.Background()
+	if d.paused() {
+		return
+	}
+
+	if d.components().failover.Next(ctx) {
+		logger.WarnContext(ctx, "WireGuard handshake is stale, trying the next endpoint", "age", age.Round(time.Second))
+		return
+	}
+
+	logger.WarnContext(ctx, "WireGuard handshake is stale, triggering re-authentication", "age", age.Round(time.Second))
+	d.trigger(true)
+}
+
+// handshakeRecovered remembers the endpoint in use once handshakes succeed again
+func (d *daemon) handshakeRecovered() {
+	d.components().failover.Confirm(context.Background())
+}
+
+// configReverted records that re-provisioning reverted the keys of the configuration file and re-applies it right away
+func (d *daemon) configReverted(reason string) {
+	ctx := context.Background()
+	if d.paused() {
+		logger.WarnContext(ctx, "WireGuard configuration was reverted while updates are paused", "reason", reason)
+		return
+	}
+
+	logger.WarnContext(ctx, "WireGuard configuration was reverted, re-applying it", "reason", reason)
+	now := time.Now()
+	d.update(func(s *status.DaemonStatus) {
+		s.Reverts++
+		s.LastRevert = &now
+	})
+
+	c := d.components()
+	err := state.Update(c.cfg.StateFile, func(s *state.State) {
+		s.Reverts++
+		s.LastRevertAt = &now
+		s.LastRevertReason = reason
+	})
+	if err != nil {
+		logger.WarnContext(ctx, "Failed to record the reverted configuration", "error", err)
+	}
+	c.notifier.Notify(notify.EventConfigReverted, fmt.Sprintf("WireGuard configuration was reverted (%s) and is being re-applied", reason))
+	d.trigger(false)
+}
+
+// reresolve looks up the endpoint hostname every interval until stop is closed, updating the peer when its address changes
+func (d *daemon) reresolve(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if !d.paused() {
+			d.components().failover.Reresolve(context.Background())
+		}
+	}
+}
+
+// handleCommand executes a control socket command
+func (d *daemon) handleCommand(ctx context.Context, req control.Request) *control.Response {
+	switch req.Command {
+	case control.CommandRefresh, control.CommandRotate:
+		if d.paused() {
+			return &control.Response{Error: "updates are paused; resume them first"}
+		}
+		if req.Command == control.CommandRotate {
+			d.trigger(true)
+			return &control.Response{OK: true, Message: "Key rotation requested"}
+		}
+		d.trigger(false)
+		return &control.Response{OK: true, Message: "Refresh requested"}
+
+	case control.CommandPause:
+		d.update(func(s *status.DaemonStatus) { s.Paused = true })
+		logger.InfoContext(ctx, "Updates paused")
+		return &control.Response{OK: true, Message: "Updates paused"}
+
+	case control.CommandResume:
+		d.update(func(s *status.DaemonStatus) { s.Paused = false })
+		logger.InfoContext(ctx, "Updates resumed")
+		d.trigger(false)
+		return &control.Response{OK: true, Message: "Updates resumed"}
+
+	case control.CommandState:
+		c := d.components()
+		report := status.CollectWith(ctx, c.cfg, d.configPath, c.cfClient)
+		d.mu.Lock()
+		daemonStatus := d.status
+		d.mu.Unlock()
+		report.Daemon = &daemonStatus
+		return &control.Response{OK: true, Status: report}
+
+	case control.CommandReload:
+		cfg, err := loadConfigWithFlags()
+		if err != nil {
+			return &control.Response{Error: fmt.Sprintf("error loading configuration: %v", err)}
+		}
+		c, err := newComponents(cfg)
+		if err != nil {
+			return &control.Response{Error: err.Error()}
+		}
+		d.mu.Lock()
+		d.pending = c
+		d.mu.Unlock()
+		d.trigger(false)
+		logger.InfoContext(ctx, "Configuration reloaded")
+		return &control.Response{OK: true, Message: "Configuration reloaded; monitor, probe, logging and control settings apply after a restart"}
+
+	default:
+		return &control.Response{Error: fmt.Sprintf("unknown command %q", req.Command)}
+	}
+}
+
+// run is the main service loop; it never returns
+func (d *daemon) run() {
+	consecutiveFailures := 0
+	maxConsecutiveFailures := 5
+	// Track state across iterations so notifications fire on changes
+	serviceDown := false
+	lastPublicKey := ""
+	ready := false
+	// woken skips the backoff once, after a backoff was cut short by a requested refresh
+	woken := false
+
+	// fail records a failed attempt so it shows up in the daemon status
+	fail := func(err error) {
+		d.update(func(s *status.DaemonStatus) {
+			s.ConsecutiveFailures = consecutiveFailures
+			s.LastError = err.Error()
+			s.NextRefresh = nil
+		})
+	}
+
+	for {
+		// Every iteration gets a correlation ID so its log lines can be followed across components
+		ctx := logging.WithCycle(context.Background(), logging.NewCycleID())
+		d.systemd.Watchdog()
+
+		c := d.applyPending(ctx)
+		cfg, cfClient, wgManager, p, notifier := c.cfg, c.cfClient, c.wgManager, c.platform, c.notifier
+
+		// While paused, only wake up to keep the watchdog fed and check for a resume
+		if d.paused() {
+			d.setActivity("Paused")
+			d.systemd.Wait(time.Hour, d.wake)
+			continue
+		}
+
+		// A forced registration requested while waiting (stale tunnel, failed probe or rotate command)
+		if d.forceRegistration.Swap(false) {
+			cfClient.InvalidateToken()
+		}
+
+		// Break the loop if we've had too many consecutive failures
+		if consecutiveFailures >= maxConsecutiveFailures && !woken {
+			backoffTime := time.Duration(math.Min(float64(consecutiveFailures-maxConsecutiveFailures+1)*2, 30)) * time.Minute
+			logger.WarnContext(ctx, "Too many consecutive failures, entering exponential backoff",
+				"failures", consecutiveFailures, "backoff", backoffTime)
+			notifier.Notify(notify.EventBackoff, fmt.Sprintf("%d consecutive failures, backing off for %v", consecutiveFailures, backoffTime))
+			d.setActivity("Backing off for %v after %d consecutive failures", backoffTime, consecutiveFailures)
+			if d.systemd.Wait(backoffTime, d.wake) {
+				// A requested refresh runs right away, and the counter is kept so another failure backs off again
+				woken = true
+				continue
+			}
+			// Reset counter after backoff, but not completely
+			consecutiveFailures = maxConsecutiveFailures - 2
+		}
+		woken = false
+
+		reconciler := service.NewReconciler(cfg, cfClient, wgManager, p, d.prober)
+		result, err := reconciler.Reconcile(ctx, service.Options{
+			// The periodic refresh always rewrites and restarts, as it also serves to recover the tunnel
+			Force:    true,
+			Progress: func(activity string) { d.setActivity("%s", activity) },
+		})
+		if err != nil {
+			var reconcileErr *service.Error
+			errors.As(err, &reconcileErr)
+
+			if reconcileErr != nil && reconcileErr.Stage == service.StageServiceCheck {
+				logger.WarnContext(ctx, "WireGuard is not running. The UDM-Pro UI-created configuration may have been disabled. "+
+					"Please check your UDM-Pro settings. Will retry in 5 minutes.",
+					"service", p.Target(), "platform", p.Name(), "error", err)
+				serviceDown = true
+				notifier.Notify(notify.EventServiceNotRunning,
+					fmt.Sprintf("WireGuard service %s is not running", p.Target()))
+				d.setActivity("WireGuard service %s is not running, retrying in 5 minutes", p.Target())
+				d.systemd.Wait(5*time.Minute, d.wake)
+				continue
+			}
+
+			consecutiveFailures++
+			fail(err)
+			logger.ErrorContext(ctx, "Error refreshing WireGuard configuration, retrying in 1 minute",
+				"error", err, "failure", consecutiveFailures, "max_failures", maxConsecutiveFailures)
+
+			switch {
+			case reconcileErr != nil && reconcileErr.Stage == service.StageAuthenticate:
+				notifier.Notify(notify.EventAuthFailure, fmt.Sprintf("Error authenticating device: %v", reconcileErr.Err))
+				d.setActivity("Authentication failed, retrying in 1 minute")
+			case reconcileErr != nil && reconcileErr.RolledBack:
+				notifier.Notify(notify.EventRollback, fmt.Sprintf("Error applying WireGuard config: %v; previous configuration restored", reconcileErr.Err))
+			}
+
+			d.systemd.Wait(time.Minute, d.wake)
+			continue
+		}
+		wgConfig, deviceToken := result.Config, result.DeviceToken
+
+		// A configuration file reverted to the keys just replaced is re-applied
+		if d.watcher != nil {
+			d.watcher.Expect(wgConfig.PrivateKey)
+		}
+
+		// Restarting the interface removed its routes
+		c.applyRouting(ctx)
+
+		// Failover starts over from the endpoint just written
+		if err := c.failover.Reset(wgConfig); err != nil {
+			logger.WarnContext(ctx, "Endpoint failover unavailable", "error", err)
+		}
+
+		// Notify about key rotation and recovery before resetting the failure state
+		if lastPublicKey != "" && lastPublicKey != wgConfig.PublicKey {
+			notifier.Notify(notify.EventKeyRotation, "Cloudflare issued new WireGuard keys and the configuration was updated")
+		}
+		lastPublicKey = wgConfig.PublicKey
+
+		if consecutiveFailures > 0 || serviceDown {
+			notifier.Notify(notify.EventRecovery, "WireGuard configuration successfully updated and applied")
+		}
+		serviceDown = false
+
+		// Reset consecutive failures counter after a successful run
+		consecutiveFailures = 0
+		if !ready {
+			d.systemd.Ready()
+			ready = true
+		}
+
+		// Schedule a refresh of the device registration (to keep it active)
+		refreshTime := time.Duration(cfg.RefreshIntervalMinutes) * time.Minute / 2
+		time.AfterFunc(refreshTime, func() {
+			if err := cfClient.RefreshDeviceRegistration(ctx, deviceToken); err != nil {
+				logger.WarnContext(ctx, "Failed to refresh device registration", "error", err)
+			} else {
+				logger.InfoContext(ctx, "Device registration refreshed successfully")
+			}
+		})
+
+		// Sleep for the refresh interval from config, or until a refresh is requested
+		logger.InfoContext(ctx, "Waiting for next configuration check", "minutes", cfg.RefreshIntervalMinutes)
+		refreshInterval := time.Duration(cfg.RefreshIntervalMinutes) * time.Minute
+		now := time.Now()
+		nextRefresh := now.Add(refreshInterval)
+		d.update(func(s *status.DaemonStatus) {
+			s.LastSuccess = &now
+			s.LastError = ""
+			s.ConsecutiveFailures = 0
+			s.NextRefresh = &nextRefresh
+		})
+		d.setActivity("Connected, next refresh at %s", nextRefresh.Format("15:04"))
+		d.systemd.Wait(refreshInterval, d.wake)
+	}
+}
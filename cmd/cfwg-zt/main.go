@@ -1,52 +1,27 @@
 package main
 
 import (
-	"fmt"
-	"io"
-	"log"
-	"math"
+	"context"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"syscall"
 	"time"
 
-	"github.com/gumbees/cfwg-zt/src/config"
-	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/control"
+	"github.com/gumbees/cfwg-zt/src/logging"
+	"github.com/gumbees/cfwg-zt/src/probe"
+	"github.com/gumbees/cfwg-zt/src/sdnotify"
 	"github.com/gumbees/cfwg-zt/src/wireguard"
-	"github.com/gumbees/cfwg-zt/src/udm"
 	"github.com/spf13/viper"
 )
 
-// setupLogging configures the application logging
-func setupLogging(debug bool) (*os.File, error) {
-	// Create log directory if it doesn't exist
-	logDir := "/var/log/cfwg-zt"
-	if _, err := os.Stat(logDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(logDir, 0755); err != nil {
-			return nil, fmt.Errorf("failed to create log directory: %w", err)
-		}
-	}
-
-	// Open log file
-	logFilePath := filepath.Join(logDir, "cfwg-zt.log")
-	logFile, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open log file: %w", err)
-	}
-
-	// Set up multi-writer to log to both file and stdout
-	multiWriter := io.MultiWriter(os.Stdout, logFile)
-	log.SetOutput(multiWriter)
-
-	// Set log flags to include timestamp and file information
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
-
-	if debug {
-		log.Println("Debug mode enabled")
-	}
+// logger is used by the service loop; each package has its own component logger
+var logger = logging.Component("loop")
 
-	return logFile, nil
+// fatal logs an error and exits; used for unrecoverable startup failures
+func fatal(msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
 }
 
 func main() {
@@ -56,45 +31,45 @@ func main() {
 
 // runService is the main function for running the service
 func runService() {
-	log.Println("Starting Cloudflare Zero Trust WireGuard Manager for UDM-Pro")
 	// Load configuration
-	cfg, err := config.LoadConfig()
+	cfg, err := loadConfigWithFlags()
 	if err != nil {
-		log.Fatalf("Error loading configuration: %v", err)
+		fatal("Error loading configuration", err)
 	}
 
-	// Setup logging
-	logFile, err := setupLogging(cfg.Debug)
-	if err != nil {
-		log.Fatalf("Error setting up logging: %v", err)
-	}
-	defer logFile.Close()
+	// Setup logging; problems fall back to stderr rather than stopping the service
+	logOutput := logging.Configure(cfg)
+	defer logOutput.Close()
+	logger.Debug("Debug logging enabled")
 
 	// Log the startup details
-	log.Printf("Version: 1.0.0")
-	log.Printf("Configuration loaded from: %s", viper.ConfigFileUsed())
-	log.Printf("Refresh interval: %d minutes", cfg.RefreshIntervalMinutes)
-	
+	logger.Info("Starting Cloudflare Zero Trust WireGuard Manager for UDM-Pro",
+		"version", "1.0.0",
+		"config", viper.ConfigFileUsed(),
+		"refresh_interval_minutes", cfg.RefreshIntervalMinutes)
+
 	// Initialize components
-	log.Println("Initializing components...")
-	cfClient, err := cloudflare.NewClient(cfg)
+	logger.Info("Initializing components")
+	c, err := newComponents(cfg)
 	if err != nil {
-		log.Fatalf("Error initializing Cloudflare client: %v", err)
+		fatal("Error initializing components", err)
 	}
 
-	wgManager := wireguard.NewManager(cfg)
-	udmClient := udm.NewClient(cfg)
-
-	// Validate that we're running on a UDM-Pro (if possible)
-	if _, err := os.Stat("/usr/bin/ubnt-systool"); os.IsNotExist(err) {
-		log.Println("Warning: This doesn't appear to be a UDM-Pro device. Some functionality may not work as expected.")
+	// Report readiness and liveness to systemd when running under a Type=notify unit
+	systemd := sdnotify.New()
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		logger.Debug("systemd watchdog enabled", "interval", interval)
 	}
 
-	// Verify that WireGuard is available
-	if err := udmClient.VerifyWireGuardAvailable(); err != nil {
-		log.Fatalf("WireGuard is not properly available on this system: %v", err)
+	// Verify that WireGuard is available to the platform backend
+	logger.Info("Using platform backend", "platform", c.platform.Name(), "target", c.platform.Target())
+	if err := c.platform.Verify(context.Background()); err != nil {
+		fatal("WireGuard is not properly available on this system", err)
 	}
 
+	// Set up the routes before the first refresh, so the kill switch holds while it runs
+	c.applyRouting(context.Background())
+
 	// Set up signal handling for graceful shutdown
 	sigs := make(chan os.Signal, 1)
 	done := make(chan bool, 1)
@@ -102,112 +77,92 @@ func runService() {
 
 	go func() {
 		sig := <-sigs
-		log.Printf("Received signal: %s, initiating shutdown...", sig)
+		logger.Info("Received signal, initiating shutdown", "signal", sig.String())
 		// Perform any necessary cleanup here
 		done <- true
 	}()
 
 	// Validate the WireGuard configuration
-	log.Println("Validating WireGuard configuration...")
-	valid, err := wgManager.ValidateConfig()
-	if err != nil {
-		log.Printf("Warning: WireGuard configuration validation error: %v", err)
-		log.Println("This might happen if you've just imported the dummy configuration.")
-		log.Println("The application will attempt to fix this by updating with proper credentials.")
-	} else if valid {
-		log.Println("WireGuard configuration validation successful.")
+	logger.Info("Validating WireGuard configuration")
+	validation, err := c.wgManager.ValidateConfig()
+	switch {
+	case err != nil:
+		logger.Warn("WireGuard configuration validation error", "error", err)
+		logger.Warn("The application will attempt to fix this by updating with proper credentials.")
+	case validation.State == wireguard.ValidationDummy:
+		logger.Info("WireGuard configuration contains dummy keys that need to be replaced")
+		logger.Info("This is normal if you just imported the dummy configuration. Keys will be updated automatically.")
+	case validation.State == wireguard.ValidationBroken:
+		logger.Warn("WireGuard configuration is invalid", "error", validation.Err())
+		logger.Warn("The application will attempt to fix this by updating with proper credentials.")
+	default:
+		logger.Info("WireGuard configuration validation successful", "public_key", validation.PublicKey)
 	}
-	
-	// Start the main service loop
-	log.Println("Starting main service loop...")
-	go func() {
-		consecutiveFailures := 0
-		maxConsecutiveFailures := 5
-
-		for {
-			// Break the loop if we've had too many consecutive failures
-			if consecutiveFailures >= maxConsecutiveFailures {
-				log.Printf("Too many consecutive failures (%d), entering exponential backoff", consecutiveFailures)
-				backoffTime := time.Duration(math.Min(float64(consecutiveFailures-maxConsecutiveFailures+1)*2, 30)) * time.Minute
-				log.Printf("Backing off for %v", backoffTime)
-				time.Sleep(backoffTime)
-				// Reset counter after backoff, but not completely
-				consecutiveFailures = maxConsecutiveFailures - 2
-			}
 
-			// Authenticate with Cloudflare Zero Trust
-			log.Println("Authenticating with Cloudflare Zero Trust...")
-			deviceToken, err := cfClient.AuthenticateDevice()
-			if err != nil {
-				consecutiveFailures++
-				log.Printf("Error authenticating device: %v, retrying in 1 minute (failure %d/%d)", 
-					err, consecutiveFailures, maxConsecutiveFailures)
-				time.Sleep(time.Minute)
-				continue
-			}
+	// Periodically probe connectivity through the tunnel; the loop also uses it to verify each update
+	var prober *probe.Prober
+	if cfg.Probe.Enabled {
+		prober = probe.New(cfg.WireGuard.InterfaceName, cfg.Probe.URL, cfg.Probe.Expect,
+			time.Duration(cfg.Probe.TimeoutSeconds)*time.Second)
+	}
 
-			// Get WireGuard configuration from Cloudflare
-			log.Println("Retrieving WireGuard configuration...")
-			wgConfig, err := cfClient.GetWireGuardConfig(deviceToken)
-			if err != nil {
-				consecutiveFailures++
-				log.Printf("Error getting WireGuard config: %v, retrying in 1 minute (failure %d/%d)", 
-					err, consecutiveFailures, maxConsecutiveFailures)
-				time.Sleep(time.Minute)
-				continue
-			}			// Check if WireGuard is running before updating config
-			isRunning, err := udmClient.IsWireGuardRunning()
-			if err != nil {
-				log.Printf("Error checking WireGuard status: %v", err)
-			}
-			
-			if !isRunning {
-				log.Printf("WireGuard is not running. The UDM-Pro UI-created configuration may have been disabled. " +
-				          "Please check your UDM-Pro settings. Will retry in 5 minutes.")
-				time.Sleep(5 * time.Minute)
-				continue
-			}
+	// Watch the configuration file for re-provisioning that reverts its keys
+	var watcher *wireguard.Watcher
+	if cfg.WireGuard.WatchConfig {
+		watcher = wireguard.NewWatcher(cfg.WireGuard.ConfigPath,
+			time.Duration(cfg.WireGuard.WatchDebounceSeconds)*time.Second, cfg.WireGuard.WatchMaxReapplies)
+	}
 
-			// Update WireGuard configuration - preserving UI-created settings
-			log.Println("Updating WireGuard configuration file with fresh authentication credentials...")
-			log.Println("Note: UI-created settings like interface address and policy-based routing will be preserved")
-			err = wgManager.UpdateConfig(wgConfig)
-			if err != nil {
-				consecutiveFailures++
-				log.Printf("Error updating WireGuard config: %v, retrying in 1 minute (failure %d/%d)", 
-					err, consecutiveFailures, maxConsecutiveFailures)
-				time.Sleep(time.Minute)
-				continue
-			}
+	d := newDaemon(c, viper.ConfigFileUsed(), systemd, prober, watcher)
+
+	// Monitor the tunnel handshake; a stale one fails over to another endpoint and then triggers an early refresh
+	stopMonitor := make(chan struct{})
+	defer close(stopMonitor)
+	if cfg.Monitor.IntervalSeconds > 0 {
+		monitor := wireguard.NewMonitor(c.wgManager,
+			time.Duration(cfg.Monitor.IntervalSeconds)*time.Second,
+			time.Duration(cfg.Monitor.HandshakeTimeoutSeconds)*time.Second)
+		go monitor.Run(stopMonitor, d.handshakeStale, d.handshakeRecovered)
+	}
+
+	// Keep the address of a resolved endpoint hostname current
+	if cfg.WireGuard.ResolveEndpoint && cfg.WireGuard.ResolveIntervalMinutes > 0 {
+		go d.reresolve(stopMonitor, time.Duration(cfg.WireGuard.ResolveIntervalMinutes)*time.Minute)
+	}
 
-			// Apply the configuration on the UDM-Pro (only restarts the service)
-			log.Println("Applying WireGuard configuration to UDM-Pro...")
-			err = udmClient.ApplyWireGuardConfig(wgConfig)
-			if err != nil {
-				consecutiveFailures++
-				log.Printf("Error applying WireGuard config: %v, retrying in 1 minute (failure %d/%d)", 
-					err, consecutiveFailures, maxConsecutiveFailures)
-				time.Sleep(time.Minute)
-				continue
+	if watcher != nil {
+		go func() {
+			if err := watcher.Run(stopMonitor, d.configReverted); err != nil {
+				logger.Warn("Not watching the WireGuard configuration", "error", err)
 			}
+		}()
+	}
 
-			// Reset consecutive failures counter after a successful run
-			consecutiveFailures = 0
-			log.Println("WireGuard configuration successfully updated and applied")			// Schedule a refresh of the device registration (to keep it active)
-			refreshTime := time.Duration(cfg.RefreshIntervalMinutes) * time.Minute / 2
-			time.AfterFunc(refreshTime, func() {
-				if err := cfClient.RefreshDeviceRegistration(deviceToken); err != nil {
-					log.Printf("Warning: Failed to refresh device registration: %v", err)
-				} else {
-					log.Println("Device registration refreshed successfully")
-				}
-			})
-			
-			// Sleep for the refresh interval from config
-			log.Printf("Next configuration check in %d minutes", cfg.RefreshIntervalMinutes)
-			time.Sleep(time.Duration(cfg.RefreshIntervalMinutes) * time.Minute)
+	if prober != nil {
+		go prober.Run(stopMonitor, time.Duration(cfg.Probe.IntervalSeconds)*time.Second, func(err error) {
+			logger.Warn("Triggering re-authentication after failed connectivity probe")
+			d.trigger(true)
+		})
+	}
+
+	// Serve the control socket for 'cfwg-zt ctl'; the daemon works without it
+	if cfg.Control.SocketPath != "" {
+		server, err := control.Listen(cfg.Control.SocketPath, d.handleCommand)
+		if err != nil {
+			logger.Warn("Control socket unavailable", "error", err)
+		} else {
+			logger.Info("Listening on control socket", "path", cfg.Control.SocketPath)
+			go server.Serve()
+			defer server.Close()
 		}
-	}()
+	}
+
+	// Start the main service loop
+	logger.Info("Starting main service loop")
+	go d.run()
+
 	<-done
-	log.Println("Shutting down...")
+	logger.Info("Shutting down")
+	systemd.Stopping()
+	d.components().notifier.Wait()
 }
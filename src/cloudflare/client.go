@@ -2,21 +2,32 @@ package cloudflare
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/logging"
+	"github.com/gumbees/cfwg-zt/src/redact"
 )
 
+var logger = logging.Component("cloudflare")
+
 // Client handles interactions with the Cloudflare Zero Trust API
 type Client struct {
 	config      *config.Config
 	httpClient  *http.Client
 	baseURL     string
+
+	// mu guards the cached token, as the daemon's control socket uses the client alongside the service loop
+	mu          sync.Mutex
 	accessToken string
 	tokenExpiry time.Time
 }
@@ -31,6 +42,44 @@ type WireGuardConfig struct {
 	PeerPublicKey    string
 	PeerPresharedKey string
 	DNS              []string
+	// Addresses are the interface addresses assigned to the device, in CIDR notation
+	Addresses []string
+	// EndpointV4 and EndpointV6 are the IP addresses behind the Endpoint hostname, when issued
+	EndpointV4 string
+	EndpointV6 string
+}
+
+// String describes the configuration without its private and preshared keys
+func (c WireGuardConfig) String() string {
+	return fmt.Sprintf("{PublicKey:%s Endpoint:%s EndpointPort:%d EndpointV4:%s EndpointV6:%s AllowedIPs:%v PeerPublicKey:%s DNS:%v Addresses:%v}",
+		c.PublicKey, c.Endpoint, c.EndpointPort, c.EndpointV4, c.EndpointV6, c.AllowedIPs, c.PeerPublicKey, c.DNS, c.Addresses)
+}
+
+// LogValue logs the configuration without its private and preshared keys
+func (c WireGuardConfig) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("public_key", c.PublicKey),
+		slog.String("endpoint", c.Endpoint),
+		slog.Int("endpoint_port", c.EndpointPort),
+		slog.String("endpoint_v4", c.EndpointV4),
+		slog.String("endpoint_v6", c.EndpointV6),
+		slog.Any("allowed_ips", c.AllowedIPs),
+		slog.String("peer_public_key", c.PeerPublicKey),
+		slog.Any("dns", c.DNS),
+		slog.Any("addresses", c.Addresses),
+	)
+}
+
+// DeviceStatus contains the state of the device as reported by Cloudflare Zero Trust
+type DeviceStatus struct {
+	Active      bool   `json:"active" yaml:"active"`
+	WarpEnabled bool   `json:"warp_enabled" yaml:"warp_enabled"`
+	LastSeen    string `json:"last_seen" yaml:"last_seen"`
+}
+
+// Connected reports whether the device is active and has WARP enabled
+func (s *DeviceStatus) Connected() bool {
+	return s.Active && s.WarpEnabled
 }
 
 // DeviceTokenResponse represents the response from Cloudflare device authentication
@@ -57,6 +106,16 @@ type WireGuardConfigResponse struct {
 		PeerPresharedKey  string   `json:"peer_preshared_key,omitempty"`
 		DNSServers        []string `json:"dns_servers"`
 		RotationExpiresAt string   `json:"rotation_expires_at"`
+
+		// EndpointV4 and EndpointV6 are the addresses of the edge behind the endpoint hostname
+		EndpointV4 string `json:"endpoint_v4"`
+		EndpointV6 string `json:"endpoint_v6"`
+
+		// InterfaceAddresses are the tunnel addresses assigned to the device
+		InterfaceAddresses struct {
+			V4 string `json:"v4"`
+			V6 string `json:"v6"`
+		} `json:"interface_addresses"`
 	} `json:"result"`
 }
 
@@ -73,10 +132,31 @@ func NewClient(cfg *config.Config) (*Client, error) {
 	}, nil
 }
 
+// CheckReachability verifies that the Cloudflare API can be reached over HTTPS
+// Any HTTP response counts as reachable; authentication is not attempted
+func (c *Client) CheckReachability(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
 // AuthenticateDevice authenticates with Cloudflare Zero Trust and returns a device token
-func (c *Client) AuthenticateDevice() (string, error) {
+func (c *Client) AuthenticateDevice(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	// Check if we have a valid token already
 	if c.accessToken != "" && time.Now().Before(c.tokenExpiry) {
+		logger.DebugContext(ctx, "Reusing cached device token", "expires_at", c.tokenExpiry)
 		return c.accessToken, nil
 	}
 
@@ -98,7 +178,7 @@ func (c *Client) AuthenticateDevice() (string, error) {
 	}
 
 	// Create the HTTP request
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(bodyJSON))
+	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewBuffer(bodyJSON))
 	if err != nil {
 		return "", fmt.Errorf("error creating request: %w", err)
 	}
@@ -130,19 +210,37 @@ func (c *Client) AuthenticateDevice() (string, error) {
 	}
 
 	// Store the token and its expiry
+	redact.Replace("cloudflare_device_token", deviceResp.Result.Token)
 	c.accessToken = deviceResp.Result.Token
 	c.tokenExpiry = expiresAt
+	logger.DebugContext(ctx, "Device registered", "device_id", deviceResp.Result.DeviceID, "expires_at", expiresAt)
 
 	return c.accessToken, nil
 }
 
+// TokenExpiry returns the expiry time of the cached device token
+// A zero time means no token has been obtained yet
+func (c *Client) TokenExpiry() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokenExpiry
+}
+
+// InvalidateToken discards the cached device token so the next AuthenticateDevice call re-authenticates
+func (c *Client) InvalidateToken() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.accessToken = ""
+	c.tokenExpiry = time.Time{}
+}
+
 // GetWireGuardConfig retrieves the WireGuard configuration from Cloudflare
-func (c *Client) GetWireGuardConfig(deviceToken string) (*WireGuardConfig, error) {
+func (c *Client) GetWireGuardConfig(ctx context.Context, deviceToken string) (*WireGuardConfig, error) {
 	// Construct the request URL
 	apiURL := fmt.Sprintf("%s/devices/warp/wireguard", c.baseURL)
 	
 	// Create the HTTP request
-	req, err := http.NewRequest("GET", apiURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error creating request: %w", err)
 	}
@@ -166,6 +264,12 @@ func (c *Client) GetWireGuardConfig(deviceToken string) (*WireGuardConfig, error
 	if !wgResp.Success {
 		return nil, fmt.Errorf("failed to get WireGuard configuration")
 	}
+	logger.DebugContext(ctx, "Received WireGuard configuration",
+		"endpoint", wgResp.Result.Endpoint, "endpoint_port", wgResp.Result.EndpointPort)
+
+	// Keep the issued keys out of logs and error output
+	redact.Replace("wireguard_private_key", wgResp.Result.ClientPrivateKey)
+	redact.Replace("wireguard_preshared_key", wgResp.Result.PeerPresharedKey)
 
 	// Transform the response to our internal WireGuardConfig structure
 	config := &WireGuardConfig{
@@ -177,23 +281,45 @@ func (c *Client) GetWireGuardConfig(deviceToken string) (*WireGuardConfig, error
 		PeerPublicKey:    wgResp.Result.PeerPublicKey,
 		PeerPresharedKey: wgResp.Result.PeerPresharedKey,
 		DNS:              wgResp.Result.DNSServers,
+		EndpointV4:       wgResp.Result.EndpointV4,
+		EndpointV6:       wgResp.Result.EndpointV6,
+		Addresses:        interfaceAddresses(wgResp.Result.InterfaceAddresses.V4, wgResp.Result.InterfaceAddresses.V6),
 	}
 
 	return config, nil
 }
 
+// interfaceAddresses turns the assigned IPv4 and IPv6 addresses into CIDRs, adding a host prefix where none is given
+func interfaceAddresses(v4, v6 string) []string {
+	var addresses []string
+	for _, address := range []struct {
+		value  string
+		prefix string
+	}{{v4, "/32"}, {v6, "/128"}} {
+		if address.value == "" {
+			continue
+		}
+		if !strings.Contains(address.value, "/") {
+			address.value += address.prefix
+		}
+		addresses = append(addresses, address.value)
+	}
+	return addresses
+}
+
 // RefreshDeviceRegistration refreshes the device registration with Cloudflare
-func (c *Client) RefreshDeviceRegistration(deviceToken string) error {
+func (c *Client) RefreshDeviceRegistration(ctx context.Context, deviceToken string) error {
 	// Construct the request URL
 	apiURL := fmt.Sprintf("%s/devices/warp/refresh", c.baseURL)
 	
 	// Create the HTTP request
-	req, err := http.NewRequest("POST", apiURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, nil)
 	if err != nil {
 		return fmt.Errorf("error creating request: %w", err)
 	}
 	
-	// Add query parameters
+	// Add query parameters; the token is registered as a secret, as request errors quote the URL
+	redact.Secret(deviceToken)
 	q := url.Values{}
 	q.Add("device_token", deviceToken)
 	req.URL.RawQuery = q.Encode()
@@ -203,7 +329,7 @@ func (c *Client) RefreshDeviceRegistration(deviceToken string) error {
 	// Send the request
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("error sending request: %w", err)
+		return fmt.Errorf("error sending request: %w", redact.Error(err))
 	}
 	defer resp.Body.Close()
 
@@ -211,21 +337,21 @@ func (c *Client) RefreshDeviceRegistration(deviceToken string) error {
 	if resp.StatusCode != http.StatusOK {
 		// Try to read response body for more details about the error
 		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("device refresh failed with status: %s, response: %s", resp.Status, string(respBody))
+		return fmt.Errorf("device refresh failed with status: %s, response: %s", resp.Status, redact.String(string(respBody)))
 	}
 
 	return nil
 }
 
 // GetDeviceStatus retrieves the current status of the device in Cloudflare Zero Trust
-func (c *Client) GetDeviceStatus(deviceToken string) (bool, error) {
+func (c *Client) GetDeviceStatus(ctx context.Context, deviceToken string) (*DeviceStatus, error) {
 	// Construct the request URL
 	apiURL := fmt.Sprintf("%s/devices/warp/status", c.baseURL)
 	
 	// Create the HTTP request
-	req, err := http.NewRequest("GET", apiURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
 	if err != nil {
-		return false, fmt.Errorf("error creating request: %w", err)
+		return nil, fmt.Errorf("error creating request: %w", err)
 	}
 	
 	req.Header.Set("Content-Type", "application/json")
@@ -234,27 +360,23 @@ func (c *Client) GetDeviceStatus(deviceToken string) (bool, error) {
 	// Send the request
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return false, fmt.Errorf("error sending request: %w", err)
+		return nil, fmt.Errorf("error sending request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// Check response
 	if resp.StatusCode == http.StatusOK {
 		var statusResp struct {
-			Success bool `json:"success"`
-			Result struct {
-				Active      bool   `json:"active"`
-				WarpEnabled bool   `json:"warp_enabled"`
-				LastSeen    string `json:"last_seen"`
-			} `json:"result"`
+			Success bool         `json:"success"`
+			Result  DeviceStatus `json:"result"`
 		}
 		
 		if err := json.NewDecoder(resp.Body).Decode(&statusResp); err != nil {
-			return false, fmt.Errorf("error decoding response: %w", err)
+			return nil, fmt.Errorf("error decoding response: %w", err)
 		}
 		
-		return statusResp.Result.Active && statusResp.Result.WarpEnabled, nil
+		return &statusResp.Result, nil
 	}
 	
-	return false, fmt.Errorf("device status check failed with status: %s", resp.Status)
+	return nil, fmt.Errorf("device status check failed with status: %s", resp.Status)
 }
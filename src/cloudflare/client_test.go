@@ -0,0 +1,130 @@
+package cloudflare
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gumbees/cfwg-zt/src/config"
+)
+
+const testPrivateKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+
+// newTestClient creates a client that talks to the test server
+func newTestClient(t *testing.T, server *httptest.Server) *Client {
+	cfg := &config.Config{}
+	cfg.CloudflareZeroTrust.ClientID = "client-id"
+	cfg.CloudflareZeroTrust.ClientSecret = "client-secret"
+
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	client.baseURL = server.URL
+	return client
+}
+
+func TestRefreshDeviceRegistrationSendsTokenInQuery(t *testing.T) {
+	const token = "device-token-0123456789"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("device_token"); got != token {
+			t.Errorf("Unexpected device_token parameter %q", got)
+		}
+	}))
+
+	client := newTestClient(t, server)
+	if err := client.RefreshDeviceRegistration(context.Background(), token); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// A failed request quotes the URL, which must not leak the token
+	server.Close()
+	err := client.RefreshDeviceRegistration(context.Background(), token)
+	if err == nil || strings.Contains(err.Error(), token) {
+		t.Errorf("Expected a redacted error, got %v", err)
+	}
+}
+
+func TestRefreshDeviceRegistrationRedactsErrorBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"success":false,"token":"echoed-token-value","client_private_key":"%s"}`, testPrivateKey)
+	}))
+	defer server.Close()
+
+	err := newTestClient(t, server).RefreshDeviceRegistration(context.Background(), "device-token-0123456789")
+	if err == nil {
+		t.Fatal("Expected error for failed refresh")
+	}
+	for _, secret := range []string{"echoed-token-value", testPrivateKey} {
+		if strings.Contains(err.Error(), secret) {
+			t.Errorf("Error leaked %q: %v", secret, err)
+		}
+	}
+	if !strings.Contains(err.Error(), "400") {
+		t.Errorf("Expected status in error, got: %v", err)
+	}
+}
+
+func TestWireGuardConfigHidesKeys(t *testing.T) {
+	cfg := &WireGuardConfig{
+		PrivateKey:       testPrivateKey,
+		PublicKey:        "client-public-key",
+		PeerPresharedKey: "FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE=",
+		Endpoint:         "engage.cloudflareclient.com",
+		EndpointPort:     2408,
+	}
+
+	var buf bytes.Buffer
+	slog.New(slog.NewJSONHandler(&buf, nil)).Info("config", "wg", cfg)
+
+	for _, output := range []string{fmt.Sprintf("%v", cfg), fmt.Sprintf("%+v", *cfg), buf.String()} {
+		if strings.Contains(output, cfg.PrivateKey) || strings.Contains(output, cfg.PeerPresharedKey) {
+			t.Errorf("Output leaked a key: %s", output)
+		}
+		if !strings.Contains(output, "engage.cloudflareclient.com") {
+			t.Errorf("Expected endpoint in output: %s", output)
+		}
+	}
+}
+
+func TestGetWireGuardConfigParsesInterfaceAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"success":true,"result":{"client_private_key":"%s","peer_public_key":"peer","endpoint":"engage.cloudflareclient.com","endpoint_port":2408,
+			"interface_addresses":{"v4":"172.16.0.2","v6":"2606:4700:110:8a36::2/128"}}}`, testPrivateKey)
+	}))
+	defer server.Close()
+
+	cfg, err := newTestClient(t, server).GetWireGuardConfig(context.Background(), "device-token-0123456789")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if fmt.Sprint(cfg.Addresses) != "[172.16.0.2/32 2606:4700:110:8a36::2/128]" {
+		t.Errorf("Unexpected addresses %v", cfg.Addresses)
+	}
+}
+
+func TestInterfaceAddresses(t *testing.T) {
+	tests := []struct {
+		v4, v6   string
+		expected []string
+	}{
+		{"", "", nil},
+		{"172.16.0.2", "", []string{"172.16.0.2/32"}},
+		{"", "2606:4700::2", []string{"2606:4700::2/128"}},
+		{"172.16.0.2/24", "2606:4700::2/64", []string{"172.16.0.2/24", "2606:4700::2/64"}},
+	}
+
+	for _, test := range tests {
+		addresses := interfaceAddresses(test.v4, test.v6)
+		if fmt.Sprint(addresses) != fmt.Sprint(test.expected) {
+			t.Errorf("interfaceAddresses(%q, %q) = %v; expected %v", test.v4, test.v6, addresses, test.expected)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// SplitTunnel holds the split tunnel lists of the account's default device settings profile
+// A profile in include mode has an include list, and one in exclude mode an exclude list
+type SplitTunnel struct {
+	Include []string
+	Exclude []string
+	// Hosts are the entries given as domains, which can't be expressed as addresses
+	Hosts []string
+}
+
+// splitTunnelEntry is an entry of a split tunnel list, which has either an address or a host
+type splitTunnelEntry struct {
+	Address     string `json:"address"`
+	Host        string `json:"host"`
+	Description string `json:"description"`
+}
+
+// GetSplitTunnel retrieves the split tunnel lists of the account's default device settings profile
+func (c *Client) GetSplitTunnel(ctx context.Context, deviceToken string) (*SplitTunnel, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/devices/policy", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+deviceToken)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("split tunnel request failed with status: %s", resp.Status)
+	}
+
+	var policyResp struct {
+		Success bool `json:"success"`
+		Result  struct {
+			Include []splitTunnelEntry `json:"include"`
+			Exclude []splitTunnelEntry `json:"exclude"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&policyResp); err != nil {
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+	if !policyResp.Success {
+		return nil, fmt.Errorf("failed to get split tunnel settings")
+	}
+
+	splitTunnel := &SplitTunnel{}
+	for _, entry := range policyResp.Result.Include {
+		splitTunnel.Include = splitTunnel.add(splitTunnel.Include, entry)
+	}
+	for _, entry := range policyResp.Result.Exclude {
+		splitTunnel.Exclude = splitTunnel.add(splitTunnel.Exclude, entry)
+	}
+	logger.DebugContext(ctx, "Received split tunnel settings",
+		"include", splitTunnel.Include, "exclude", splitTunnel.Exclude, "hosts", splitTunnel.Hosts)
+	return splitTunnel, nil
+}
+
+// add appends the address of the entry to the list, or records its host
+func (s *SplitTunnel) add(list []string, entry splitTunnelEntry) []string {
+	if entry.Address == "" {
+		if entry.Host != "" {
+			s.Hosts = append(s.Hosts, entry.Host)
+		}
+		return list
+	}
+	return append(list, entry.Address)
+}
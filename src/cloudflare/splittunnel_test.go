@@ -0,0 +1,34 @@
+package cloudflare
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetSplitTunnel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/devices/policy" || r.Header.Get("Authorization") != "Bearer device-token" {
+			t.Errorf("Unexpected request %s with %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		w.Write([]byte(`{"success":true,"result":{"exclude":[
+			{"address":"10.0.0.0/8","description":"Private"},
+			{"host":"intranet.example.com"},
+			{"address":"fd00::/8"}
+		]}}`))
+	}))
+	defer server.Close()
+
+	splitTunnel, err := newTestClient(t, server).GetSplitTunnel(context.Background(), "device-token")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(splitTunnel.Include) != 0 || strings.Join(splitTunnel.Exclude, ",") != "10.0.0.0/8,fd00::/8" {
+		t.Errorf("Unexpected lists %+v", splitTunnel)
+	}
+	if len(splitTunnel.Hosts) != 1 || splitTunnel.Hosts[0] != "intranet.example.com" {
+		t.Errorf("Expected the host entry to be kept apart, got %v", splitTunnel.Hosts)
+	}
+}
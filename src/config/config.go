@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/gumbees/cfwg-zt/src/redact"
 	"github.com/spf13/viper"
 )
 
@@ -22,33 +23,211 @@ type Config struct {
 	WireGuard struct {
 		InterfaceName string `mapstructure:"interface_name"`
 		ConfigPath    string `mapstructure:"config_path"`
+
+		// Interface settings written to a newly generated configuration
+		MTU                 int `mapstructure:"mtu"`
+		PersistentKeepalive int `mapstructure:"persistent_keepalive"`
+
+		// EndpointPreference is auto, ipv4 or ipv6
+		EndpointPreference string `mapstructure:"endpoint_preference"`
+
+		// Endpoints to fail over to when handshakes stop, and the ports to try them on
+		FallbackEndpoints []string `mapstructure:"fallback_endpoints"`
+		EndpointPorts     []int    `mapstructure:"endpoint_ports"`
+
+		// Endpoint hostname resolution, through dedicated resolvers if set
+		ResolveEndpoint        bool     `mapstructure:"resolve_endpoint"`
+		Resolvers              []string `mapstructure:"resolvers"`
+		ResolveIntervalMinutes int      `mapstructure:"resolve_interval_minutes"`
+
+		// Watching the configuration file for re-provisioning that reverts the keys
+		WatchConfig          bool `mapstructure:"watch_config"`
+		WatchDebounceSeconds int  `mapstructure:"watch_debounce_seconds"`
+		WatchMaxReapplies    int  `mapstructure:"watch_max_reapplies"`
 	} `mapstructure:"wireguard"`
 
+	// Split tunnel lists the AllowedIPs of the Cloudflare peer are computed from
+	SplitTunnel struct {
+		// Source is off to keep the AllowedIPs of the peer, account to use the account's lists, or config
+		Source string `mapstructure:"source"`
+		// Include and Exclude are CIDRs, added to the account's lists with the account source
+		Include []string `mapstructure:"include"`
+		Exclude []string `mapstructure:"exclude"`
+	} `mapstructure:"split_tunnel"`
+
 	// UDM-Pro configuration
 	UDMPro struct {
 		WireGuardServiceName string `mapstructure:"wireguard_service_name"`
 		ConfigBackupPath     string `mapstructure:"config_backup_path"`
 	} `mapstructure:"udm_pro"`
 
+	// Platform backend that brings the WireGuard interface up with a new configuration
+	Platform struct {
+		// Backend is auto, systemd, wg-quick, openwrt, hooks or unifi
+		Backend string `mapstructure:"backend"`
+
+		// Shell commands of the hooks backend
+		Hooks struct {
+			Verify    string `mapstructure:"verify"`
+			IsRunning string `mapstructure:"is_running"`
+			Apply     string `mapstructure:"apply"`
+			Restart   string `mapstructure:"restart"`
+		} `mapstructure:"hooks"`
+	} `mapstructure:"platform"`
+
+	// UniFi Network controller API, used by the unifi platform backend
+	UniFi struct {
+		URL      string `mapstructure:"url"`
+		Username string `mapstructure:"username"`
+		Password string `mapstructure:"password"`
+		Site     string `mapstructure:"site"`
+		// Network is the name or ID of the WireGuard VPN client network
+		Network string `mapstructure:"network"`
+		// CAFile is a PEM file with the certificate of the console, or the CA that issued it
+		CAFile string `mapstructure:"ca_file"`
+		// Fingerprint pins the SHA-256 fingerprint of the console's certificate, which may be self-signed
+		Fingerprint string `mapstructure:"fingerprint"`
+		// InsecureSkipVerify accepts any certificate, which exposes the admin credentials to anyone in the path
+		InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
+	} `mapstructure:"unifi"`
+
+	// Policy-based routing through the WireGuard interface
+	Routing struct {
+		Enabled bool `mapstructure:"enabled"`
+		// Table and Priority of the routing table and the rules that look it up
+		Table    int `mapstructure:"table"`
+		Priority int `mapstructure:"priority"`
+		// FwMark routes packets with the mark through the table
+		FwMark string `mapstructure:"fwmark"`
+		// Sources are subnets or incoming interfaces such as VLAN bridges, Destinations are subnets
+		Sources      []string `mapstructure:"sources"`
+		Destinations []string `mapstructure:"destinations"`
+		// KillSwitch blocks the routed traffic while the WireGuard interface is down
+		KillSwitch bool `mapstructure:"kill_switch"`
+	} `mapstructure:"routing"`
+
+	// Tunnel health monitoring configuration
+	Monitor struct {
+		IntervalSeconds         int `mapstructure:"interval_seconds"`
+		HandshakeTimeoutSeconds int `mapstructure:"handshake_timeout_seconds"`
+	} `mapstructure:"monitor"`
+
+	// Connectivity probe configuration
+	Probe struct {
+		Enabled         bool   `mapstructure:"enabled"`
+		URL             string `mapstructure:"url"`
+		Expect          string `mapstructure:"expect"`
+		IntervalSeconds int    `mapstructure:"interval_seconds"`
+		TimeoutSeconds  int    `mapstructure:"timeout_seconds"`
+	} `mapstructure:"probe"`
+
+	// State change notification configuration
+	Notifications struct {
+		ThrottleMinutes int             `mapstructure:"throttle_minutes"`
+		Webhooks        []WebhookConfig `mapstructure:"webhooks"`
+	} `mapstructure:"notifications"`
+
+	// Control socket configuration
+	Control struct {
+		SocketPath string `mapstructure:"socket_path"`
+	} `mapstructure:"control"`
+
+	// Logging configuration
+	Logging struct {
+		Level     string `mapstructure:"level"`
+		Format    string `mapstructure:"format"`
+		Output    string `mapstructure:"output"`
+		File      string `mapstructure:"file"`
+		MaxSizeMB int    `mapstructure:"max_size_mb"`
+		MaxFiles  int    `mapstructure:"max_files"`
+		Compress  bool   `mapstructure:"compress"`
+	} `mapstructure:"logging"`
+
 	// General configuration
-	RefreshIntervalMinutes int  `mapstructure:"refresh_interval_minutes"`
-	Debug                  bool `mapstructure:"debug"`
+	RefreshIntervalMinutes int    `mapstructure:"refresh_interval_minutes"`
+	StateFile              string `mapstructure:"state_file"`
+	Debug                  bool   `mapstructure:"debug"`
+}
+
+// WebhookConfig describes a single notification webhook
+type WebhookConfig struct {
+	URL      string            `mapstructure:"url"`
+	Format   string            `mapstructure:"format"`
+	Events   []string          `mapstructure:"events"`
+	Template string            `mapstructure:"template"`
+	Headers  map[string]string `mapstructure:"headers"`
 }
 
 // LoadConfig loads the application configuration from file or environment variables
 func LoadConfig() (*Config, error) {
 	// Set default configuration
 	viper.SetDefault("refresh_interval_minutes", 60) // Default refresh every 60 minutes
+	viper.SetDefault("state_file", "/var/lib/cfwg-zt/state.json")
 	viper.SetDefault("debug", false)
 	viper.SetDefault("wireguard.interface_name", "wg0")
 	viper.SetDefault("wireguard.config_path", "/etc/wireguard/wg0.conf")
+	viper.SetDefault("wireguard.mtu", 1280)
+	viper.SetDefault("wireguard.persistent_keepalive", 25)
+	viper.SetDefault("wireguard.endpoint_preference", "auto")
+	viper.SetDefault("wireguard.fallback_endpoints", []string{})
+	viper.SetDefault("wireguard.endpoint_ports", []int{2408, 500, 1701, 4500})
+	viper.SetDefault("wireguard.resolve_endpoint", true)
+	viper.SetDefault("wireguard.resolvers", []string{})
+	viper.SetDefault("wireguard.resolve_interval_minutes", 30)
+	viper.SetDefault("wireguard.watch_config", true)
+	viper.SetDefault("wireguard.watch_debounce_seconds", 2)
+	viper.SetDefault("wireguard.watch_max_reapplies", 3)
+	viper.SetDefault("split_tunnel.source", "off")
+	viper.SetDefault("split_tunnel.include", []string{})
+	viper.SetDefault("split_tunnel.exclude", []string{})
 	viper.SetDefault("udm_pro.wireguard_service_name", "wg-quick@wg0")
 	viper.SetDefault("udm_pro.config_backup_path", "/etc/wireguard/backup")
+	viper.SetDefault("platform.backend", "auto")
+	viper.SetDefault("platform.hooks.verify", "")
+	viper.SetDefault("platform.hooks.is_running", "")
+	viper.SetDefault("platform.hooks.apply", "")
+	viper.SetDefault("platform.hooks.restart", "")
+	viper.SetDefault("unifi.url", "https://127.0.0.1")
+	viper.SetDefault("unifi.username", "")
+	viper.SetDefault("unifi.password", "")
+	viper.SetDefault("unifi.site", "default")
+	viper.SetDefault("unifi.network", "")
+	viper.SetDefault("unifi.ca_file", "")
+	viper.SetDefault("unifi.fingerprint", "")
+	viper.SetDefault("unifi.insecure_skip_verify", false)
+	viper.SetDefault("routing.enabled", false)
+	viper.SetDefault("routing.table", 51820)
+	viper.SetDefault("routing.priority", 5210)
+	viper.SetDefault("routing.fwmark", "")
+	viper.SetDefault("routing.sources", []string{})
+	viper.SetDefault("routing.destinations", []string{})
+	viper.SetDefault("routing.kill_switch", false)
+	viper.SetDefault("monitor.interval_seconds", 30)
+	viper.SetDefault("monitor.handshake_timeout_seconds", 180)
+	viper.SetDefault("probe.enabled", false)
+	viper.SetDefault("probe.url", "https://www.cloudflare.com/cdn-cgi/trace")
+	viper.SetDefault("probe.expect", "warp=on")
+	viper.SetDefault("probe.interval_seconds", 300)
+	viper.SetDefault("probe.timeout_seconds", 10)
+	viper.SetDefault("notifications.throttle_minutes", 30)
+	viper.SetDefault("control.socket_path", "/run/cfwg-zt/control.sock")
+	viper.SetDefault("logging.level", "info")
+	viper.SetDefault("logging.format", "text")
+	viper.SetDefault("logging.output", "file")
+	viper.SetDefault("logging.file", "/var/log/cfwg-zt/cfwg-zt.log")
+	viper.SetDefault("logging.max_size_mb", 10)
+	viper.SetDefault("logging.max_files", 3)
+	viper.SetDefault("logging.compress", true)
 
 	// Set the config file name and paths to look for it
 	viper.SetConfigName("config") // Name of config file (without extension)
 	viper.SetConfigType("yaml")   // Config file type
 
+	// An explicit config file (set by the --config flag) takes precedence over the search paths
+	if configFile := os.Getenv("CFWG_CONFIG_FILE"); configFile != "" {
+		viper.SetConfigFile(configFile)
+	}
+
 	// Look for config in the current directory
 	viper.AddConfigPath(".")
 	
@@ -67,7 +246,8 @@ func LoadConfig() (*Config, error) {
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
 			return nil, fmt.Errorf("failed to read config file: %w", err)
 		} else {
-			fmt.Println("Config file not found. Using default values and environment variables.")
+			// Printed to stderr so machine-readable command output stays parseable
+			fmt.Fprintln(os.Stderr, "Config file not found. Using default values and environment variables.")
 		}
 	}
 
@@ -81,6 +261,10 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
+	// Keep the client secret and controller password out of logs and error output
+	redact.Replace("cloudflare_client_secret", config.CloudflareZeroTrust.ClientSecret)
+	redact.Replace("unifi_password", config.UniFi.Password)
+
 	return &config, nil
 }
 
@@ -101,14 +285,114 @@ cloudflare_zero_trust:
 wireguard:
   interface_name: "wg0"
   config_path: "/etc/wireguard/wg0.conf"
+  mtu: 1280                 # Used when the configuration is generated from scratch
+  persistent_keepalive: 25  # Seconds; added to the peer if the configuration has none (0 disables)
+  endpoint_preference: "auto"  # auto (the hostname), ipv4 or ipv6 address of the Cloudflare endpoint
+  # Endpoints to fail over to when handshakes stop, after the ones issued by Cloudflare
+  # Entries without a port are tried on each of the endpoint ports
+  fallback_endpoints: []    # e.g. ["162.159.192.1", "2606:4700:d0::a29f:c001"]
+  endpoint_ports: [2408, 500, 1701, 4500]
+  # Write the address of the endpoint hostname instead of leaving it to wg-quick at interface-up
+  resolve_endpoint: true
+  resolvers: []             # e.g. ["1.1.1.1", "9.9.9.9:53"]; empty uses the system resolver
+  resolve_interval_minutes: 30  # Re-resolve and update the running peer when the address changes (0 disables)
+  # Re-apply right away when re-provisioning reverts the keys in the configuration file
+  watch_config: true
+  watch_debounce_seconds: 2  # Wait for writes to settle before checking the file
+  watch_max_reapplies: 3     # Per hour; beyond that, reverts are left to the next refresh
+
+# Split tunnel lists the AllowedIPs of the Cloudflare peer are computed from
+split_tunnel:
+  source: "off"  # off (keep the AllowedIPs of the peer), account (the Zero Trust account's lists) or config
+  include: []    # Only route these CIDRs through the tunnel, e.g. ["10.0.0.0/8"]
+  exclude: []    # Route everything else, e.g. ["192.168.0.0/16", "fd00::/8"]
 
 # UDM-Pro specific settings
 udm_pro:
   wireguard_service_name: "wg-quick@wg0"  # Must match your interface name
   config_backup_path: "/etc/wireguard/backup"
 
+# Platform backend that applies the WireGuard configuration
+platform:
+  backend: "auto"  # auto, systemd, wg-quick, openwrt, hooks or unifi
+  # Shell commands for the hooks backend; they get the interface name as $1 and the config path as $2
+  hooks:
+    verify: ""
+    is_running: ""  # Exit status 0 means the interface is up; defaults to 'wg show'
+    apply: ""  # Defaults to the restart hook
+    restart: ""
+
+# UniFi Network controller API for the unifi platform backend, which updates
+# the WireGuard VPN client network through the controller instead of the file
+unifi:
+  url: "https://127.0.0.1"
+  username: ""  # A local admin account of the console
+  password: ""
+  site: "default"
+  network: ""  # Name or ID of the WireGuard VPN client network
+  # The console uses a self-signed certificate; pin it with its SHA-256 fingerprint, shown by
+  # openssl s_client -connect 127.0.0.1:443 </dev/null | openssl x509 -noout -fingerprint -sha256
+  fingerprint: ""
+  ca_file: ""  # Or a PEM file with the certificate, or the CA that issued it
+  insecure_skip_verify: false  # Accepts any certificate, exposing the admin password
+
+# Policy-based routing through the WireGuard interface, instead of setting it up in the UI
+routing:
+  enabled: false
+  table: 51820     # Routing table with the default route through the interface
+  priority: 5210   # Priority of the rules that look up the table
+  fwmark: ""       # Also route packets with this mark, e.g. "0xca6c"
+  sources: []      # Subnets or incoming interfaces, e.g. ["192.168.20.0/24", "br30"]
+  destinations: [] # Subnets reached through the tunnel, e.g. ["10.0.0.0/8"]
+  kill_switch: false  # Block the routed traffic while the interface is down
+
+# Tunnel health monitoring
+# A handshake older than the timeout triggers re-authentication and a config refresh
+monitor:
+  interval_seconds: 30            # How often to check the interface (0 disables monitoring)
+  handshake_timeout_seconds: 180  # WireGuard re-handshakes every 2 minutes while traffic flows
+
+# Connectivity probe through the WireGuard interface
+# A failed probe is treated like an authentication failure and triggers recovery
+probe:
+  enabled: false
+  url: "https://www.cloudflare.com/cdn-cgi/trace"
+  expect: "warp=on"       # Text the response body must contain (empty accepts any 2xx response)
+  interval_seconds: 300
+  timeout_seconds: 10
+
+# Webhook notifications for state changes
+# Events: auth_failure, backoff, rollback, key_rotation, recovery, service_not_running, config_reverted
+notifications:
+  throttle_minutes: 30  # Repeats of the same event within this window are suppressed
+  webhooks: []
+  # webhooks:
+  #   - url: "https://hooks.slack.com/services/XXX/YYY/ZZZ"
+  #     format: "slack"     # generic, slack, discord or ntfy
+  #   - url: "https://ntfy.sh/my-udm-alerts"
+  #     format: "ntfy"
+  #     events: ["auth_failure", "recovery"]  # Omit to receive all events
+  #   - url: "https://example.com/hook"
+  #     format: "generic"
+  #     template: '{"summary": {{ json .Title }}, "detail": {{ json .Message }}}'
+
+# Control socket used by 'cfwg-zt ctl' and 'cfwg-zt status' to talk to the running daemon
+control:
+  socket_path: "/run/cfwg-zt/control.sock"  # Empty disables the control socket
+
+# Logging settings
+logging:
+  level: "info"   # debug, info, warn or error (debug: true forces debug)
+  format: "text"  # text or json
+  output: "file"  # file (rotating file plus stdout), journald (stdout only), syslog or stderr
+  file: "/var/log/cfwg-zt/cfwg-zt.log"
+  max_size_mb: 10 # Rotate the log file once it reaches this size
+  max_files: 3    # Number of rotated log files to keep
+  compress: true  # Gzip rotated log files
+
 # General settings
 refresh_interval_minutes: 60  # How often to refresh authentication
+state_file: "/var/lib/cfwg-zt/state.json"  # Remembers the last working endpoint across restarts
 debug: false
 `
 
@@ -0,0 +1,182 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gumbees/cfwg-zt/src/logging"
+	"github.com/gumbees/cfwg-zt/src/status"
+)
+
+var logger = logging.Component("control")
+
+// Commands understood by the daemon
+const (
+	CommandRefresh = "refresh"
+	CommandRotate  = "rotate"
+	CommandPause   = "pause"
+	CommandResume  = "resume"
+	CommandState   = "state"
+	CommandReload  = "reload"
+)
+
+// DefaultSocketPath is used when the configuration can't be loaded
+const DefaultSocketPath = "/run/cfwg-zt/control.sock"
+
+// Commands lists every supported command
+var Commands = []string{CommandRefresh, CommandRotate, CommandPause, CommandResume, CommandState, CommandReload}
+
+// requestTimeout bounds a single request, including collecting the live status
+const requestTimeout = time.Minute
+
+// Request is sent by the client as a single JSON object per connection
+type Request struct {
+	Command string `json:"command"`
+}
+
+// Response is returned by the daemon as a single JSON object
+type Response struct {
+	OK      bool           `json:"ok"`
+	Message string         `json:"message,omitempty"`
+	Error   string         `json:"error,omitempty"`
+	Status  *status.Report `json:"status,omitempty"`
+}
+
+// Handler executes a command on behalf of a client
+type Handler func(ctx context.Context, req Request) *Response
+
+// Server serves the control protocol on a unix-domain socket
+type Server struct {
+	path     string
+	listener net.Listener
+	handler  Handler
+	wg       sync.WaitGroup
+}
+
+// Listen creates the control socket at path
+// The socket is only accessible to the daemon's user, since its commands change the tunnel
+func Listen(path string, handler Handler) (*Server, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create control socket directory: %w", err)
+	}
+
+	// A socket left behind by a crashed daemon is removed, but a live one means another daemon is running
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("control socket %s is already in use by another daemon", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale control socket: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set control socket permissions: %w", err)
+	}
+
+	return &Server{path: path, listener: listener, handler: handler}, nil
+}
+
+// Serve accepts connections until the server is closed
+func (s *Server) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warn("Failed to accept control connection", "error", err)
+			}
+			return
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+// Close stops accepting connections, waits for in-flight requests and removes the socket
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	os.Remove(s.path)
+	return err
+}
+
+// handle serves a single request
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	var req Request
+	var resp *Response
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		resp = &Response{Error: fmt.Sprintf("invalid request: %v", err)}
+	} else if !validCommand(req.Command) {
+		resp = &Response{Error: fmt.Sprintf("unknown command %q", req.Command)}
+	} else {
+		logger.Info("Control command received", "command", req.Command)
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		resp = s.handler(ctx, req)
+		cancel()
+	}
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		logger.Warn("Failed to write control response", "command", req.Command, "error", err)
+	}
+}
+
+// validCommand reports whether the command is part of the protocol
+func validCommand(command string) bool {
+	for _, known := range Commands {
+		if command == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Send sends a command to the daemon listening on the socket at path and returns its response
+// A response reporting a failure is returned as an error
+func Send(path, command string) (*Response, error) {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to daemon: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	if err := json.NewEncoder(conn).Encode(Request{Command: command}); err != nil {
+		return nil, fmt.Errorf("failed to send command: %w", err)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if !resp.OK {
+		return &resp, fmt.Errorf("daemon: %s", resp.Error)
+	}
+
+	return &resp, nil
+}
+
+// Available reports whether a control socket exists at path
+func Available(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeSocket != 0
+}
@@ -0,0 +1,118 @@
+package control
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gumbees/cfwg-zt/src/status"
+)
+
+// startServer serves a handler on a socket in a temporary directory
+func startServer(t *testing.T, handler Handler) (string, *Server) {
+	path := filepath.Join(t.TempDir(), "run", "control.sock")
+	server, err := Listen(path, handler)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return path, server
+}
+
+func TestRoundTrip(t *testing.T) {
+	var received []string
+	path, _ := startServer(t, func(ctx context.Context, req Request) *Response {
+		received = append(received, req.Command)
+		if req.Command == CommandState {
+			return &Response{OK: true, Status: &status.Report{Connected: true, Daemon: &status.DaemonStatus{PID: 42}}}
+		}
+		if req.Command == CommandRefresh {
+			return &Response{Error: "updates are paused"}
+		}
+		return &Response{OK: true, Message: "done"}
+	})
+
+	resp, err := Send(path, CommandPause)
+	if err != nil || resp.Message != "done" {
+		t.Errorf("Unexpected pause response %+v, %v", resp, err)
+	}
+
+	resp, err = Send(path, CommandState)
+	if err != nil {
+		t.Fatalf("Unexpected state error: %v", err)
+	}
+	if resp.Status == nil || !resp.Status.Connected || resp.Status.Daemon.PID != 42 {
+		t.Errorf("Unexpected state response %+v", resp.Status)
+	}
+
+	if _, err := Send(path, CommandRefresh); err == nil || !strings.Contains(err.Error(), "paused") {
+		t.Errorf("Expected handler error to be returned, got %v", err)
+	}
+
+	if strings.Join(received, ",") != "pause,state,refresh" {
+		t.Errorf("Unexpected commands received: %v", received)
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	called := false
+	path, _ := startServer(t, func(ctx context.Context, req Request) *Response {
+		called = true
+		return &Response{OK: true}
+	})
+
+	if _, err := Send(path, "self-destruct"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("Expected unknown command error, got %v", err)
+	}
+	if called {
+		t.Error("Handler should not be called for unknown commands")
+	}
+}
+
+func TestSocketPermissions(t *testing.T) {
+	path, server := startServer(t, func(ctx context.Context, req Request) *Response { return &Response{OK: true} })
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Socket not created: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected socket mode 0600, got %v", info.Mode().Perm())
+	}
+	if !Available(path) {
+		t.Error("Expected socket to be available")
+	}
+
+	server.Close()
+	if Available(path) {
+		t.Error("Expected socket to be removed on close")
+	}
+}
+
+func TestStaleAndActiveSockets(t *testing.T) {
+	path, _ := startServer(t, func(ctx context.Context, req Request) *Response { return &Response{OK: true} })
+
+	// A second daemon must not take over a live socket
+	if _, err := Listen(path, nil); err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("Expected in-use error, got %v", err)
+	}
+
+	// A socket left behind by a crashed daemon is replaced
+	stale := filepath.Join(t.TempDir(), "stale.sock")
+	listener, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatalf("Failed to create stale socket: %v", err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	server, err := Listen(stale, func(ctx context.Context, req Request) *Response { return &Response{OK: true} })
+	if err != nil {
+		t.Fatalf("Expected stale socket to be replaced, got %v", err)
+	}
+	server.Close()
+}
@@ -0,0 +1,156 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// op is the kind of change of a single line
+type op byte
+
+const (
+	opEqual  op = ' '
+	opDelete op = '-'
+	opInsert op = '+'
+)
+
+// line is one line of an edit script
+type line struct {
+	op   op
+	text string
+}
+
+// Unified returns a unified diff turning oldText into newText, with the given number of context lines
+// An empty string means the texts are identical
+func Unified(oldName, newName, oldText, newText string, context int) string {
+	if oldText == newText {
+		return ""
+	}
+
+	edits := editScript(splitLines(oldText), splitLines(newText))
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+
+	// Walk the edit script and emit a hunk for every run of changes, merging runs separated by little context
+	for start := 0; start < len(edits); {
+		if edits[start].op == opEqual {
+			start++
+			continue
+		}
+
+		// Extend the hunk while the next change is within 2*context equal lines
+		end := start
+		for i := start; i < len(edits); i++ {
+			if edits[i].op != opEqual {
+				end = i + 1
+			} else if i-end >= 2*context {
+				break
+			}
+		}
+
+		from := max(start-context, 0)
+		to := min(end+context, len(edits))
+		writeHunk(&out, edits, from, to)
+		start = to
+	}
+
+	return out.String()
+}
+
+// writeHunk writes the edits in [from, to) as a single hunk with its header
+func writeHunk(out *strings.Builder, edits []line, from, to int) {
+	// Line numbers in the header are 1-based positions in the old and new texts
+	oldStart, newStart := 1, 1
+	for _, edit := range edits[:from] {
+		if edit.op != opInsert {
+			oldStart++
+		}
+		if edit.op != opDelete {
+			newStart++
+		}
+	}
+
+	oldCount, newCount := 0, 0
+	for _, edit := range edits[from:to] {
+		if edit.op != opInsert {
+			oldCount++
+		}
+		if edit.op != opDelete {
+			newCount++
+		}
+	}
+
+	// An empty range is reported as starting at the line before it, as diff -u does
+	if oldCount == 0 {
+		oldStart--
+	}
+	if newCount == 0 {
+		newStart--
+	}
+
+	fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(oldStart, oldCount), hunkRange(newStart, newCount))
+	for _, edit := range edits[from:to] {
+		fmt.Fprintf(out, "%c%s\n", edit.op, edit.text)
+	}
+}
+
+// hunkRange formats a hunk header range, omitting a count of one
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// splitLines splits text into lines without their trailing newlines
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// editScript computes a minimal line edit script using the longest common subsequence
+// Configuration files are small, so the quadratic table is not a concern
+func editScript(a, b []string) []line {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var edits []line
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			edits = append(edits, line{opEqual, a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			edits = append(edits, line{opDelete, a[i]})
+			i++
+		default:
+			edits = append(edits, line{opInsert, b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		edits = append(edits, line{opDelete, a[i]})
+	}
+	for ; j < len(b); j++ {
+		edits = append(edits, line{opInsert, b[j]})
+	}
+
+	return edits
+}
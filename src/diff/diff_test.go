@@ -0,0 +1,59 @@
+package diff
+
+import "testing"
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		expected string
+	}{
+		{
+			name: "identical",
+			old:  "a\nb\n",
+			new:  "a\nb\n",
+		},
+		{
+			name: "single change",
+			old:  "[Interface]\nPrivateKey = old\nAddress = 10.0.0.2/32\n",
+			new:  "[Interface]\nPrivateKey = new\nAddress = 10.0.0.2/32\n",
+			expected: "--- a\n+++ b\n@@ -1,3 +1,3 @@\n" +
+				" [Interface]\n-PrivateKey = old\n+PrivateKey = new\n Address = 10.0.0.2/32\n",
+		},
+		{
+			name:     "new file",
+			old:      "",
+			new:      "a\nb\n",
+			expected: "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name:     "appended line",
+			old:      "1\n2\n3\n4\n5\n",
+			new:      "1\n2\n3\n4\n5\n6\n",
+			expected: "--- a\n+++ b\n@@ -3,3 +3,4 @@\n 3\n 4\n 5\n+6\n",
+		},
+		{
+			name: "separate hunks",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			new:  "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			expected: "--- a\n+++ b\n" +
+				"@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n" +
+				"@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n",
+		},
+		{
+			name: "merged hunks",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n",
+			new:  "one\n2\n3\n4\n5\n6\n7\neight\n",
+			expected: "--- a\n+++ b\n" +
+				"@@ -1,8 +1,8 @@\n-1\n+one\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+eight\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Unified("a", "b", tt.old, tt.new, 3); got != tt.expected {
+				t.Errorf("Unexpected diff:\n%s\nexpected:\n%s", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,433 @@
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/platform"
+	"github.com/gumbees/cfwg-zt/src/redact"
+	"github.com/gumbees/cfwg-zt/src/wireguard"
+)
+
+// Status is the outcome of a single diagnostic check
+type Status string
+
+const (
+	StatusPass Status = "pass"
+	StatusWarn Status = "warn"
+	StatusFail Status = "fail"
+)
+
+// Thresholds used by the checks
+const (
+	maxHandshakeAge      = 3 * time.Minute
+	maxBackupDirSize     = 10 * 1024 * 1024
+	placeholderSubstring = "_here"
+)
+
+// Result holds the outcome of a single diagnostic check
+type Result struct {
+	Name    string `json:"name"`
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// Report holds the outcome of all diagnostic checks
+type Report struct {
+	ConfigPath string   `json:"config_path"`
+	Results    []Result `json:"results"`
+}
+
+// Failed reports whether any check failed
+func (r *Report) Failed() bool {
+	for _, result := range r.Results {
+		if result.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteText writes a human readable version of the report
+func (r *Report) WriteText(w io.Writer) {
+	for _, result := range r.Results {
+		fmt.Fprintf(w, "[%s] %s: %s\n", strings.ToUpper(string(result.Status)), result.Name, result.Message)
+		if result.Hint != "" && result.Status != StatusPass {
+			fmt.Fprintf(w, "       hint: %s\n", result.Hint)
+		}
+	}
+}
+
+// checker runs the diagnostic checks against a loaded configuration
+type checker struct {
+	config     *config.Config
+	configPath string
+	report     *Report
+
+	// newPlatform and lookPath are replaced with fakes in tests
+	newPlatform func(cfg *config.Config) (platform.Platform, error)
+	lookPath    func(file string) (string, error)
+}
+
+// Run executes all diagnostic checks and returns the report
+// configPath is the configuration file in use, or empty if defaults and environment variables were used
+func Run(ctx context.Context, cfg *config.Config, configPath string) *Report {
+	c := &checker{
+		config:     cfg,
+		configPath: configPath,
+		report:     &Report{ConfigPath: configPath},
+		newPlatform: func(cfg *config.Config) (platform.Platform, error) {
+			return platform.New(cfg, wireguard.NewManager(cfg))
+		},
+		lookPath: exec.LookPath,
+	}
+
+	configValid := c.checkConfig()
+	c.checkFilePermissions("Config file permissions", configPath)
+	c.checkFilePermissions("WireGuard config permissions", cfg.WireGuard.ConfigPath)
+	p := c.checkPlatform(ctx)
+	c.checkBinaries(p)
+	c.checkServiceState(ctx, p)
+	c.checkEndpointDNS(ctx)
+	c.checkCloudflare(ctx, configValid)
+	c.checkWireGuardConfig()
+	c.checkHandshake()
+	c.checkBackupDir()
+
+	return c.report
+}
+
+// add records the result of a check
+func (c *checker) add(name string, status Status, message, hint string) {
+	c.report.Results = append(c.report.Results, Result{
+		Name:    name,
+		Status:  status,
+		Message: redact.String(message),
+		Hint:    hint,
+	})
+}
+
+// checkConfig verifies that the required configuration values are present
+func (c *checker) checkConfig() bool {
+	const name = "Configuration"
+	hint := "Run 'cfwg-zt config-wizard' or edit the configuration file"
+
+	required := map[string]string{
+		"cloudflare_zero_trust.client_id":     c.config.CloudflareZeroTrust.ClientID,
+		"cloudflare_zero_trust.client_secret": c.config.CloudflareZeroTrust.ClientSecret,
+		"cloudflare_zero_trust.account_id":    c.config.CloudflareZeroTrust.AccountID,
+		"wireguard.interface_name":            c.config.WireGuard.InterfaceName,
+		"wireguard.config_path":               c.config.WireGuard.ConfigPath,
+		"udm_pro.wireguard_service_name":      c.config.UDMPro.WireGuardServiceName,
+	}
+
+	var problems []string
+	for key, value := range required {
+		if value == "" {
+			problems = append(problems, key+" is empty")
+		} else if strings.HasSuffix(value, placeholderSubstring) {
+			problems = append(problems, key+" still has its placeholder value")
+		}
+	}
+	if c.config.RefreshIntervalMinutes <= 0 {
+		problems = append(problems, "refresh_interval_minutes must be positive")
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		c.add(name, StatusFail, strings.Join(problems, "; "), hint)
+		return false
+	}
+
+	source := c.configPath
+	if source == "" {
+		source = "defaults and environment variables"
+	}
+	c.add(name, StatusPass, "loaded from "+source, "")
+	return true
+}
+
+// checkFilePermissions verifies that a file holding secrets is not readable by other users
+func (c *checker) checkFilePermissions(name, path string) {
+	if path == "" {
+		c.add(name, StatusWarn, "no file in use", "Create a configuration file with 'cfwg-zt setup'")
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		c.add(name, StatusFail, fmt.Sprintf("cannot stat %s: %v", path, err),
+			"Check that the path is correct and the file exists")
+		return
+	}
+
+	mode := info.Mode().Perm()
+	if mode&0077 != 0 {
+		c.add(name, StatusWarn, fmt.Sprintf("%s has mode %04o and contains secrets", path, mode),
+			fmt.Sprintf("chmod 600 %s", path))
+		return
+	}
+
+	c.add(name, StatusPass, fmt.Sprintf("%s has mode %04o", path, mode), "")
+}
+
+// checkBinaries verifies that the commands the platform backend runs are available in PATH
+// Without a backend, only wg is checked
+func (c *checker) checkBinaries(p platform.Platform) {
+	binaries := []string{"wg"}
+	if p != nil {
+		binaries = platform.Commands(p.Name())
+	}
+	for _, binary := range binaries {
+		c.checkBinary(binary)
+	}
+}
+
+// checkBinary verifies that a command is available in PATH
+func (c *checker) checkBinary(binary string) {
+	name := fmt.Sprintf("'%s' command", binary)
+
+	path, err := c.lookPath(binary)
+	if err != nil {
+		hint := "Install it or set platform.backend to match this system"
+		if binary == "wg" || binary == "wg-quick" {
+			hint = "Install wireguard-tools or check that the UDM Pro firmware provides it"
+		}
+		c.add(name, StatusFail, "not found in PATH", hint)
+		return
+	}
+
+	c.add(name, StatusPass, "found at "+path, "")
+}
+
+// checkPlatform verifies that the platform backend has what it needs to apply the configuration
+// It returns the backend, or nil if none could be created
+func (c *checker) checkPlatform(ctx context.Context) platform.Platform {
+	name := "Platform backend"
+
+	p, err := c.newPlatform(c.config)
+	if err != nil {
+		c.add(name, StatusFail, err.Error(), "Set platform.backend to one of "+strings.Join(platform.Backends, ", "))
+		return nil
+	}
+
+	if err := p.Verify(ctx); err != nil {
+		c.add(name, StatusFail, fmt.Sprintf("%s: %v", p.Name(), err),
+			"Install wireguard-tools or set platform.backend to match this system")
+		return p
+	}
+
+	c.add(name, StatusPass, fmt.Sprintf("%s, managing %s", p.Name(), p.Target()), "")
+	return p
+}
+
+// checkServiceState verifies that the WireGuard service or interface is up
+func (c *checker) checkServiceState(ctx context.Context, p platform.Platform) {
+	name := "WireGuard service"
+	if p == nil {
+		c.add(name, StatusWarn, "skipped because there is no platform backend", "Fix platform.backend first")
+		return
+	}
+
+	isRunning, err := p.IsRunning(ctx)
+	if err != nil {
+		c.add(name, StatusFail, fmt.Sprintf("cannot query %s: %v", p.Target(), err), serviceHint(p))
+		return
+	}
+
+	if !isRunning {
+		c.add(name, StatusFail, p.Target()+" is not active", serviceHint(p))
+		return
+	}
+
+	c.add(name, StatusPass, p.Target()+" is active", "")
+}
+
+// serviceHint suggests how to bring the WireGuard interface up with the backend
+func serviceHint(p platform.Platform) string {
+	switch p.Name() {
+	case platform.BackendSystemd:
+		return "Enable the WireGuard interface in the UDM Pro UI or run 'systemctl start " + p.Target() + "'"
+	case platform.BackendWgQuick:
+		return "Run 'wg-quick up " + p.Target() + "'"
+	case platform.BackendOpenWrt:
+		return "Run 'ifup " + p.Target() + "' and check 'logread' for netifd errors"
+	default:
+		return "Check the platform.hooks commands"
+	}
+}
+
+// checkEndpointDNS verifies that the peer endpoint host resolves
+func (c *checker) checkEndpointDNS(ctx context.Context) {
+	name := "Endpoint DNS"
+
+	endpoint, err := wireguard.NewManager(c.config).PeerEndpoint()
+	if err != nil {
+		c.add(name, StatusWarn, err.Error(), "Check the [Peer] section of the WireGuard configuration")
+		return
+	}
+
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		c.add(name, StatusFail, fmt.Sprintf("invalid endpoint %q: %v", endpoint, err),
+			"The endpoint must be in host:port form")
+		return
+	}
+
+	if net.ParseIP(host) != nil {
+		c.add(name, StatusPass, fmt.Sprintf("endpoint %s is an IP address", host), "")
+		return
+	}
+
+	// Resolve the way the manager does, through the configured resolvers if any
+	resolver, err := wireguard.NewResolver(c.config.WireGuard.Resolvers)
+	if err != nil {
+		c.add(name, StatusFail, err.Error(), "Fix wireguard.resolvers in the configuration")
+		return
+	}
+	addrs, err := resolver.Lookup(ctx, host, c.config.WireGuard.EndpointPreference)
+	if err != nil {
+		hint := "Check the DNS servers configured on the UDM Pro"
+		if len(c.config.WireGuard.Resolvers) > 0 {
+			hint = "Check that the resolvers in wireguard.resolvers are reachable"
+		}
+		c.add(name, StatusFail, err.Error(), hint)
+		return
+	}
+
+	c.add(name, StatusPass, fmt.Sprintf("%s resolves to %s", host, strings.Join(addrs, ", ")), "")
+}
+
+// checkCloudflare verifies that the Cloudflare API is reachable and that the credentials are accepted
+func (c *checker) checkCloudflare(ctx context.Context, configValid bool) {
+	reachName := "Cloudflare API reachability"
+	authName := "Cloudflare authentication"
+
+	if !configValid {
+		c.add(reachName, StatusWarn, "skipped because the configuration is invalid", "Fix the configuration first")
+		c.add(authName, StatusWarn, "skipped because the configuration is invalid", "Fix the configuration first")
+		return
+	}
+
+	cfClient, err := cloudflare.NewClient(c.config)
+	if err != nil {
+		c.add(reachName, StatusFail, err.Error(), "Check the cloudflare_zero_trust section of the configuration")
+		c.add(authName, StatusWarn, "skipped because the client could not be created", "")
+		return
+	}
+
+	if err := cfClient.CheckReachability(ctx); err != nil {
+		c.add(reachName, StatusFail, err.Error(),
+			"Check that the UDM Pro can reach api.cloudflare.com: curl -I https://api.cloudflare.com")
+		c.add(authName, StatusWarn, "skipped because the API is unreachable", "Fix connectivity first")
+		return
+	}
+	c.add(reachName, StatusPass, "api.cloudflare.com is reachable", "")
+
+	if _, err := cfClient.AuthenticateDevice(ctx); err != nil {
+		c.add(authName, StatusFail, err.Error(),
+			"Verify client_id, client_secret and account_id in the Cloudflare Zero Trust dashboard")
+		return
+	}
+	c.add(authName, StatusPass, "device authenticated successfully", "")
+}
+
+// checkWireGuardConfig validates the WireGuard configuration and verifies that the dummy import keys have been replaced
+func (c *checker) checkWireGuardConfig() {
+	name := "WireGuard configuration"
+
+	report, err := wireguard.NewManager(c.config).ValidateConfig()
+	if err != nil {
+		c.add(name, StatusWarn, err.Error(), "Check wireguard.config_path in the configuration")
+		return
+	}
+
+	switch report.State {
+	case wireguard.ValidationBroken:
+		c.add(name, StatusFail, report.Err().Error(),
+			"Fix the listed settings, or restore a backup from "+c.config.UDMPro.ConfigBackupPath)
+	case wireguard.ValidationDummy:
+		c.add(name, StatusWarn, "the WireGuard configuration still contains the dummy import keys",
+			"Start the service with 'cfwg-zt start' so the keys are replaced with Cloudflare credentials")
+	default:
+		c.add(name, StatusPass, "valid, interface public key "+report.PublicKey, "")
+	}
+}
+
+// checkHandshake verifies that the interface has completed a recent handshake
+func (c *checker) checkHandshake() {
+	name := "Handshake"
+
+	latest, err := wireguard.NewManager(c.config).LatestHandshake()
+	if err != nil {
+		c.add(name, StatusWarn, err.Error(), "Check that the interface is up with 'wg show'")
+		return
+	}
+
+	if latest.IsZero() {
+		c.add(name, StatusFail, "no handshake has completed",
+			"Check that the endpoint is reachable over UDP and the keys are current")
+		return
+	}
+
+	age := time.Since(latest).Round(time.Second)
+	if age > maxHandshakeAge {
+		c.add(name, StatusWarn, fmt.Sprintf("latest handshake was %s ago", age),
+			"The tunnel may be stalled; restart it or run 'cfwg-zt start' to refresh the credentials")
+		return
+	}
+
+	c.add(name, StatusPass, fmt.Sprintf("latest handshake was %s ago", age), "")
+}
+
+// checkBackupDir verifies that the backup directory is not growing without bound
+func (c *checker) checkBackupDir() {
+	name := "Backup directory"
+	backupPath := c.config.UDMPro.ConfigBackupPath
+
+	var size int64
+	var count int
+	err := filepath.WalkDir(backupPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		count++
+		return nil
+	})
+	if os.IsNotExist(err) {
+		c.add(name, StatusPass, backupPath+" does not exist yet", "")
+		return
+	}
+	if err != nil {
+		c.add(name, StatusWarn, fmt.Sprintf("cannot read %s: %v", backupPath, err), "")
+		return
+	}
+
+	message := fmt.Sprintf("%s holds %d files (%d KiB)", backupPath, count, size/1024)
+	if size > maxBackupDirSize {
+		c.add(name, StatusWarn, message, "Remove old backups to free space on the UDM Pro")
+		return
+	}
+
+	c.add(name, StatusPass, message, "")
+}
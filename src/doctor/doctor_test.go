@@ -0,0 +1,265 @@
+package doctor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/platform"
+)
+
+// fakePlatform answers the checks with canned results
+type fakePlatform struct {
+	name       string
+	verifyErr  error
+	running    bool
+	runningErr error
+}
+
+func (f *fakePlatform) Name() string                     { return f.name }
+func (f *fakePlatform) Target() string                   { return "wg0" }
+func (f *fakePlatform) Verify(ctx context.Context) error { return f.verifyErr }
+func (f *fakePlatform) IsRunning(ctx context.Context) (bool, error) {
+	return f.running, f.runningErr
+}
+
+func (f *fakePlatform) Apply(ctx context.Context, cfg *cloudflare.WireGuardConfig) error {
+	return nil
+}
+
+func (f *fakePlatform) Restart(ctx context.Context) error {
+	return nil
+}
+
+// newTestConfig returns a complete configuration whose WireGuard configuration has the endpoint
+func newTestConfig(t *testing.T, endpoint string) *config.Config {
+	cfg := &config.Config{}
+	cfg.CloudflareZeroTrust.ClientID = "client-id"
+	cfg.CloudflareZeroTrust.ClientSecret = "client-secret"
+	cfg.CloudflareZeroTrust.AccountID = "account-id"
+	cfg.WireGuard.InterfaceName = "wg0"
+	cfg.WireGuard.ConfigPath = filepath.Join(t.TempDir(), "wg0.conf")
+	cfg.UDMPro.WireGuardServiceName = "wg-quick@wg0"
+	cfg.RefreshIntervalMinutes = 60
+
+	wgConfig := "[Interface]\nPrivateKey = private\n\n[Peer]\nPublicKey = peer\nEndpoint = " + endpoint + "\n"
+	if err := os.WriteFile(cfg.WireGuard.ConfigPath, []byte(wgConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// expected is the name and status of a result
+type expected struct {
+	name   string
+	status Status
+}
+
+func TestChecks(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name     string
+		endpoint string
+		setup    func(cfg *config.Config)
+		platform *fakePlatform
+		// platformErr fails creating the backend
+		platformErr error
+		// missing commands aren't found in PATH
+		missing []string
+		ctx     context.Context
+		check   func(ctx context.Context, c *checker)
+		want    []expected
+	}{
+		{
+			name:  "complete configuration",
+			check: func(ctx context.Context, c *checker) { c.checkConfig() },
+			want:  []expected{{"Configuration", StatusPass}},
+		},
+		{
+			name:  "placeholder configuration",
+			setup: func(cfg *config.Config) { cfg.CloudflareZeroTrust.ClientSecret = "your_client_secret_here" },
+			check: func(ctx context.Context, c *checker) { c.checkConfig() },
+			want:  []expected{{"Configuration", StatusFail}},
+		},
+		{
+			name:  "refresh interval not positive",
+			setup: func(cfg *config.Config) { cfg.RefreshIntervalMinutes = 0 },
+			check: func(ctx context.Context, c *checker) { c.checkConfig() },
+			want:  []expected{{"Configuration", StatusFail}},
+		},
+		{
+			name:     "systemd commands",
+			platform: &fakePlatform{name: platform.BackendSystemd},
+			check:    func(ctx context.Context, c *checker) { c.checkBinaries(c.checkPlatform(ctx)) },
+			want: []expected{
+				{"Platform backend", StatusPass},
+				{"'wg' command", StatusPass},
+				{"'wg-quick' command", StatusPass},
+				{"'systemctl' command", StatusPass},
+			},
+		},
+		{
+			name:     "wg-quick missing",
+			platform: &fakePlatform{name: platform.BackendWgQuick},
+			missing:  []string{"wg-quick"},
+			check:    func(ctx context.Context, c *checker) { c.checkBinaries(c.checkPlatform(ctx)) },
+			want: []expected{
+				{"Platform backend", StatusPass},
+				{"'wg' command", StatusPass},
+				{"'wg-quick' command", StatusFail},
+			},
+		},
+		{
+			name:     "openwrt commands",
+			platform: &fakePlatform{name: platform.BackendOpenWrt},
+			missing:  []string{"ubus"},
+			check:    func(ctx context.Context, c *checker) { c.checkBinaries(c.checkPlatform(ctx)) },
+			want: []expected{
+				{"Platform backend", StatusPass},
+				{"'wg' command", StatusPass},
+				{"'uci' command", StatusPass},
+				{"'ubus' command", StatusFail},
+			},
+		},
+		{
+			name:     "unifi runs no commands",
+			platform: &fakePlatform{name: platform.BackendUniFi},
+			missing:  []string{"wg"},
+			check:    func(ctx context.Context, c *checker) { c.checkBinaries(c.checkPlatform(ctx)) },
+			want:     []expected{{"Platform backend", StatusPass}},
+		},
+		{
+			name:        "unknown backend",
+			platformErr: errors.New("unknown platform backend"),
+			missing:     []string{"wg"},
+			check: func(ctx context.Context, c *checker) {
+				p := c.checkPlatform(ctx)
+				c.checkBinaries(p)
+				c.checkServiceState(ctx, p)
+			},
+			want: []expected{
+				{"Platform backend", StatusFail},
+				{"'wg' command", StatusFail},
+				{"WireGuard service", StatusWarn},
+			},
+		},
+		{
+			name:     "backend fails verification",
+			platform: &fakePlatform{name: platform.BackendWgQuick, verifyErr: errors.New("interface name not configured")},
+			check:    func(ctx context.Context, c *checker) { c.checkPlatform(ctx) },
+			want:     []expected{{"Platform backend", StatusFail}},
+		},
+		{
+			name:     "service running",
+			platform: &fakePlatform{name: platform.BackendSystemd, running: true},
+			check:    func(ctx context.Context, c *checker) { c.checkServiceState(ctx, c.checkPlatform(ctx)) },
+			want:     []expected{{"Platform backend", StatusPass}, {"WireGuard service", StatusPass}},
+		},
+		{
+			name:     "service stopped",
+			platform: &fakePlatform{name: platform.BackendSystemd},
+			check:    func(ctx context.Context, c *checker) { c.checkServiceState(ctx, c.checkPlatform(ctx)) },
+			want:     []expected{{"Platform backend", StatusPass}, {"WireGuard service", StatusFail}},
+		},
+		{
+			name:     "service state unknown",
+			platform: &fakePlatform{name: platform.BackendSystemd, runningErr: errors.New("systemctl failed")},
+			check:    func(ctx context.Context, c *checker) { c.checkServiceState(ctx, c.checkPlatform(ctx)) },
+			want:     []expected{{"Platform backend", StatusPass}, {"WireGuard service", StatusFail}},
+		},
+		{
+			name:     "endpoint is an address",
+			endpoint: "162.159.192.1:2408",
+			check:    func(ctx context.Context, c *checker) { c.checkEndpointDNS(ctx) },
+			want:     []expected{{"Endpoint DNS", StatusPass}},
+		},
+		{
+			name:     "endpoint without port",
+			endpoint: "engage.cloudflareclient.com",
+			check:    func(ctx context.Context, c *checker) { c.checkEndpointDNS(ctx) },
+			want:     []expected{{"Endpoint DNS", StatusFail}},
+		},
+		{
+			name:     "endpoint lookup canceled",
+			endpoint: "engage.cloudflareclient.com:2408",
+			ctx:      canceled,
+			check:    func(ctx context.Context, c *checker) { c.checkEndpointDNS(ctx) },
+			want:     []expected{{"Endpoint DNS", StatusFail}},
+		},
+		{
+			name: "WireGuard configuration missing",
+			setup: func(cfg *config.Config) {
+				cfg.WireGuard.ConfigPath = filepath.Join(filepath.Dir(cfg.WireGuard.ConfigPath), "missing.conf")
+			},
+			check: func(ctx context.Context, c *checker) { c.checkEndpointDNS(ctx) },
+			want:  []expected{{"Endpoint DNS", StatusWarn}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint := tt.endpoint
+			if endpoint == "" {
+				endpoint = "162.159.192.1:2408"
+			}
+			cfg := newTestConfig(t, endpoint)
+			if tt.setup != nil {
+				tt.setup(cfg)
+			}
+			missing := make(map[string]bool)
+			for _, name := range tt.missing {
+				missing[name] = true
+			}
+
+			c := &checker{
+				config: cfg,
+				report: &Report{},
+				newPlatform: func(cfg *config.Config) (platform.Platform, error) {
+					if tt.platformErr != nil {
+						return nil, tt.platformErr
+					}
+					return tt.platform, nil
+				},
+				lookPath: func(file string) (string, error) {
+					if missing[file] {
+						return "", errors.New("executable file not found in $PATH")
+					}
+					return "/usr/bin/" + file, nil
+				},
+			}
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			tt.check(ctx, c)
+
+			if len(c.report.Results) != len(tt.want) {
+				t.Fatalf("Expected %d results, got %+v", len(tt.want), c.report.Results)
+			}
+			for i, want := range tt.want {
+				got := c.report.Results[i]
+				if got.Name != want.name || got.Status != want.status {
+					t.Errorf("Result %d: expected %s %s, got %s %s (%s)", i, want.name, want.status, got.Name, got.Status, got.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestReportFailed(t *testing.T) {
+	report := &Report{Results: []Result{{Name: "a", Status: StatusPass}, {Name: "b", Status: StatusWarn}}}
+	if report.Failed() {
+		t.Error("Expected a report without failures to pass")
+	}
+
+	report.Results = append(report.Results, Result{Name: "c", Status: StatusFail})
+	if !report.Failed() {
+		t.Error("Expected a report with a failure to fail")
+	}
+}
@@ -0,0 +1,32 @@
+// Package exitcode defines the process exit codes shared by the refresh and status commands
+// A code means the same failure whichever command returns it, so scripts can rely on it
+package exitcode
+
+const (
+	// OK is returned when the configuration is up to date or applied, or the tunnel is connected
+	OK = 0
+	// Error is an unexpected error
+	Error = 1
+	// Config is an invalid or unreadable configuration
+	Config = 2
+	// Auth is a failed authentication with Cloudflare Zero Trust
+	Auth = 3
+	// Fetch is a failure to fetch the WireGuard configuration from Cloudflare
+	Fetch = 4
+	// ServiceCheck is a failure to check the state of the WireGuard service
+	ServiceCheck = 5
+	// Update is a failure to write the WireGuard configuration
+	Update = 6
+	// Apply is a failure to apply the WireGuard configuration
+	Apply = 7
+	// Verify is a failed connectivity verification through the tunnel
+	Verify = 8
+	// ServiceNotRunning is a WireGuard service that is not running
+	ServiceNotRunning = 9
+	// WireGuardConfigMissing is a missing WireGuard configuration file
+	WireGuardConfigMissing = 10
+	// DeviceStatusUnknown is a failure to get the device status from Cloudflare
+	DeviceStatusUnknown = 11
+	// DeviceInactive is a device that is not active in Cloudflare Zero Trust
+	DeviceInactive = 12
+)
@@ -0,0 +1,138 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/gumbees/cfwg-zt/src/redact"
+)
+
+// Supported output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// cycleKey is the context key holding the correlation ID of a refresh cycle
+type cycleKey struct{}
+
+// ParseLevel converts a level name (debug, info, warn, error) to a slog level
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, fmt.Errorf("invalid log level %q: %w", name, err)
+	}
+	return level, nil
+}
+
+// NewHandler creates a text or JSON handler writing to w at the given level
+// Records logged with a cycle context are annotated with the cycle ID, and secrets are redacted before reaching w
+func NewHandler(w io.Writer, format string, level slog.Level) (slog.Handler, error) {
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: redact.Attr}
+	w = redact.NewWriter(w)
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case FormatText, "":
+		handler = slog.NewTextHandler(w, options)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return nil, fmt.Errorf("unsupported log format %q (expected text or json)", format)
+	}
+
+	return &contextHandler{Handler: handler}, nil
+}
+
+// Setup installs a handler as the process-wide default logger
+// The stdlib log package is routed through the same handler
+func Setup(w io.Writer, format string, level slog.Level) error {
+	handler, err := NewHandler(w, format, level)
+	if err != nil {
+		return err
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Component returns a logger tagged with the component name
+// The logger always writes through the current default handler, so it can be created before Setup runs
+func Component(name string) *slog.Logger {
+	return slog.New(&deferredHandler{build: func(root slog.Handler) slog.Handler { return root }}).With("component", name)
+}
+
+// NewCycleID returns a short random identifier for correlating the log lines of one refresh cycle
+func NewCycleID() string {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return "00000000"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// WithCycle returns a context carrying the cycle correlation ID
+func WithCycle(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, cycleKey{}, id)
+}
+
+// CycleID returns the cycle correlation ID carried by the context, if any
+func CycleID(ctx context.Context) string {
+	id, _ := ctx.Value(cycleKey{}).(string)
+	return id
+}
+
+// contextHandler adds the cycle ID from the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := CycleID(ctx); id != "" {
+		record.AddAttrs(slog.String("cycle", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// deferredHandler resolves the default handler at log time rather than at creation time
+type deferredHandler struct {
+	build func(root slog.Handler) slog.Handler
+}
+
+func (h *deferredHandler) handler() slog.Handler {
+	return h.build(slog.Default().Handler())
+}
+
+func (h *deferredHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return slog.Default().Handler().Enabled(ctx, level)
+}
+
+func (h *deferredHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler().Handle(ctx, record)
+}
+
+func (h *deferredHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	build := h.build
+	return &deferredHandler{build: func(root slog.Handler) slog.Handler { return build(root).WithAttrs(attrs) }}
+}
+
+func (h *deferredHandler) WithGroup(name string) slog.Handler {
+	build := h.build
+	return &deferredHandler{build: func(root slog.Handler) slog.Handler { return build(root).WithGroup(name) }}
+}
@@ -0,0 +1,160 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/gumbees/cfwg-zt/src/redact"
+)
+
+// decodeLines parses JSON log output into one map per line
+func decodeLines(t *testing.T, output string) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Log line is not valid JSON: %v (%s)", err, line)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestComponentAndCycle(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	// Component loggers are created before Setup, like package-level loggers are
+	wgLogger := Component("wireguard")
+	cfLogger := Component("cloudflare")
+
+	var buf bytes.Buffer
+	if err := Setup(&buf, FormatJSON, slog.LevelInfo); err != nil {
+		t.Fatalf("Failed to set up logging: %v", err)
+	}
+
+	ctx := WithCycle(context.Background(), "abc123")
+	cfLogger.InfoContext(ctx, "Authenticating")
+	wgLogger.InfoContext(ctx, "Updated WireGuard configuration", "path", "/etc/wireguard/wg0.conf")
+	wgLogger.Info("Outside of a cycle")
+
+	records := decodeLines(t, buf.String())
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 log records, got %d", len(records))
+	}
+
+	if records[0]["component"] != "cloudflare" || records[1]["component"] != "wireguard" {
+		t.Errorf("Unexpected components: %v, %v", records[0]["component"], records[1]["component"])
+	}
+	if records[0]["cycle"] != "abc123" || records[1]["cycle"] != "abc123" {
+		t.Errorf("Expected both records to carry the cycle ID, got %v and %v", records[0]["cycle"], records[1]["cycle"])
+	}
+	if _, ok := records[2]["cycle"]; ok {
+		t.Errorf("Did not expect a cycle ID outside of a cycle")
+	}
+	if records[1]["path"] != "/etc/wireguard/wg0.conf" {
+		t.Errorf("Expected structured attribute to be preserved, got %v", records[1]["path"])
+	}
+}
+
+func TestLevelFiltering(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	var buf bytes.Buffer
+	if err := Setup(&buf, FormatText, slog.LevelWarn); err != nil {
+		t.Fatalf("Failed to set up logging: %v", err)
+	}
+
+	logger := Component("loop")
+	logger.Debug("debug message")
+	logger.Info("info message")
+	logger.Warn("warn message")
+
+	output := buf.String()
+	if strings.Contains(output, "debug message") || strings.Contains(output, "info message") {
+		t.Errorf("Expected messages below the level to be dropped, got: %s", output)
+	}
+	if !strings.Contains(output, "warn message") || !strings.Contains(output, "component=loop") {
+		t.Errorf("Expected warn message with component, got: %s", output)
+	}
+}
+
+func TestStdlibLogRouted(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	var buf bytes.Buffer
+	if err := Setup(&buf, FormatJSON, slog.LevelInfo); err != nil {
+		t.Fatalf("Failed to set up logging: %v", err)
+	}
+
+	log.Printf("legacy message")
+
+	records := decodeLines(t, buf.String())
+	if len(records) != 1 || records[0]["msg"] != "legacy message" {
+		t.Errorf("Expected stdlib log output to be routed through slog, got: %s", buf.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := map[string]slog.Level{
+		"":      slog.LevelInfo,
+		"debug": slog.LevelDebug,
+		"INFO":  slog.LevelInfo,
+		"warn":  slog.LevelWarn,
+		"error": slog.LevelError,
+	}
+
+	for name, expected := range tests {
+		level, err := ParseLevel(name)
+		if err != nil || level != expected {
+			t.Errorf("ParseLevel(%q) = %v, %v; expected %v", name, level, err, expected)
+		}
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("Expected error for unknown level")
+	}
+	if _, err := NewHandler(&bytes.Buffer{}, "xml", slog.LevelInfo); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
+
+func TestSecretsNeverReachWriter(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	const (
+		privateKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+		token      = "eyJhbGciOiJIUzI1NiJ9.device.token"
+		secret     = "client-secret-from-config"
+	)
+	redact.Secret(secret)
+
+	for _, format := range []string{FormatText, FormatJSON} {
+		var buf bytes.Buffer
+		if err := Setup(&buf, format, slog.LevelDebug); err != nil {
+			t.Fatalf("Failed to set up logging: %v", err)
+		}
+
+		logger := Component("cloudflare")
+		logger.Debug("Request", "authorization", "Bearer "+token, "device_token", token)
+		logger.Error("Refresh failed", "error", fmt.Errorf("response: {\"client_private_key\":\"%s\"}", privateKey))
+		logger.Info("Loaded credentials", "value", secret)
+		logger.Debug("Config written", "content", "[Interface]\nPrivateKey = "+privateKey+"\n")
+		log.Printf("legacy output with token=%s", token)
+
+		output := buf.String()
+		for _, leaked := range []string{privateKey, token, secret} {
+			if strings.Contains(output, leaked) {
+				t.Errorf("%s output leaked %q: %s", format, leaked, output)
+			}
+		}
+		if strings.Count(output, redact.Placeholder) < 5 {
+			t.Errorf("Expected redaction placeholders in %s output: %s", format, output)
+		}
+	}
+}
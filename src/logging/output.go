@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/gumbees/cfwg-zt/src/config"
+)
+
+// Supported log outputs
+const (
+	// OutputFile writes to a rotating log file and to stdout
+	OutputFile = "file"
+	// OutputJournald writes to stdout only, which systemd forwards to the journal
+	OutputJournald = "journald"
+	// OutputSyslog writes to the local syslog daemon
+	OutputSyslog = "syslog"
+	// OutputStderr writes to stderr only, keeping stdout free for command output
+	OutputStderr = "stderr"
+)
+
+// nopCloser is returned when the log output has nothing to close
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// Configure installs the default logger described by the logging configuration
+// Problems with the configuration never abort startup; logging degrades to stderr and the problem is logged
+// The returned closer releases the log output and should be closed on shutdown
+func Configure(cfg *config.Config) io.Closer {
+	var problems []string
+
+	level, err := ParseLevel(cfg.Logging.Level)
+	if err != nil {
+		problems = append(problems, err.Error())
+		level = slog.LevelInfo
+	}
+	if cfg.Debug {
+		level = slog.LevelDebug
+	}
+
+	w, closer, err := openOutput(cfg)
+	if err != nil {
+		problems = append(problems, err.Error())
+		w, closer = os.Stderr, nopCloser{}
+	}
+
+	if err := Setup(w, cfg.Logging.Format, level); err != nil {
+		problems = append(problems, err.Error())
+		Setup(w, FormatText, level)
+	}
+
+	for _, problem := range problems {
+		slog.Warn("Logging configuration problem, falling back", "problem", problem)
+	}
+
+	return closer
+}
+
+// openOutput opens the writer for the configured log output
+func openOutput(cfg *config.Config) (io.Writer, io.Closer, error) {
+	switch strings.ToLower(cfg.Logging.Output) {
+	case OutputFile, "":
+		file, err := NewRotatingWriter(cfg.Logging.File,
+			int64(cfg.Logging.MaxSizeMB)*1024*1024, cfg.Logging.MaxFiles, cfg.Logging.Compress)
+		if err != nil {
+			return nil, nil, err
+		}
+		return io.MultiWriter(os.Stdout, file), file, nil
+	case OutputJournald, "stdout":
+		return os.Stdout, nopCloser{}, nil
+	case OutputStderr:
+		return os.Stderr, nopCloser{}, nil
+	case OutputSyslog:
+		w, err := openSyslog()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+		return w, w, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported log output %q (expected file, journald, syslog or stderr)", cfg.Logging.Output)
+	}
+}
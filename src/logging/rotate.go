@@ -0,0 +1,192 @@
+package logging
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RotatingWriter is a log file writer that rotates the file once it reaches a maximum size
+// Rotated files are named <path>.1 (newest) to <path>.N (oldest), with a .gz suffix when compressed
+type RotatingWriter struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	compress bool
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// closed is set by Close; a file that failed to reopen after a rotation is nil without being closed
+	closed bool
+}
+
+// NewRotatingWriter opens the log file at path, creating its directory if needed
+// maxSize is in bytes and maxFiles is the number of rotated files to keep
+func NewRotatingWriter(path string, maxSize int64, maxFiles int, compress bool) (*RotatingWriter, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("log file max size must be positive")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	w := &RotatingWriter{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		compress: compress,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// open opens the current log file for appending and records its size
+func (w *RotatingWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+// Write appends to the log file, rotating first if the write would exceed the maximum size
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, fmt.Errorf("log file is closed")
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			// Logging carries on in the current file, and rotating is tried again on the next write
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file: %v\n", err)
+			if w.file == nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close closes the current log file
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// rotate shifts the rotated files up by one, moves the current file to <path>.1 and reopens it
+// The log file is reopened whether or not the rotation succeeded, so a failed rotation doesn't stop logging
+func (w *RotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %w", err)
+	}
+	w.file = nil
+
+	err := w.shift()
+	if openErr := w.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+// shift drops the oldest rotated file, shifts the rest and moves the closed log file to <path>.1
+func (w *RotatingWriter) shift() error {
+	// Drop the oldest file and shift the rest, whichever suffix they were written with
+	for i := w.maxFiles; i >= 1; i-- {
+		for _, suffix := range []string{"", ".gz"} {
+			src := w.rotatedName(i) + suffix
+			if _, err := os.Stat(src); err != nil {
+				continue
+			}
+			if i == w.maxFiles {
+				os.Remove(src)
+				continue
+			}
+			os.Rename(src, w.rotatedName(i+1)+suffix)
+		}
+	}
+
+	if w.maxFiles > 0 {
+		if err := os.Rename(w.path, w.rotatedName(1)); err != nil {
+			return fmt.Errorf("failed to rotate log file: %w", err)
+		}
+		if w.compress {
+			if err := compressFile(w.rotatedName(1)); err != nil {
+				return err
+			}
+		}
+	} else if err := os.Remove(w.path); err != nil {
+		return fmt.Errorf("failed to remove log file: %w", err)
+	}
+	return nil
+}
+
+// rotatedName returns the name of the rotated file with the given index
+func (w *RotatingWriter) rotatedName(index int) string {
+	return fmt.Sprintf("%s.%d", w.path, index)
+}
+
+// compressFile gzips path to path.gz and removes the original
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open rotated log file: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to create compressed log file: %w", err)
+	}
+
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to compress log file: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to compress log file: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("failed to compress log file: %w", err)
+	}
+
+	return os.Remove(path)
+}
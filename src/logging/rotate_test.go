@@ -0,0 +1,189 @@
+package logging
+
+import (
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gumbees/cfwg-zt/src/config"
+)
+
+func TestRotatingWriterRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "cfwg-zt.log")
+
+	w, err := NewRotatingWriter(path, 20, 2, false)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer w.Close()
+
+	for _, line := range []string{"first line 0001\n", "second line 002\n", "third line 0003\n", "fourth line 004\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "fourth line 004\n",
+		path + ".1": "third line 0003\n",
+		path + ".2": "second line 002\n",
+	}
+	for file, content := range expected {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file, err)
+		}
+		if string(data) != content {
+			t.Errorf("Unexpected content in %s: %q", file, data)
+		}
+	}
+
+	// Only max_files rotated files are kept
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected the oldest log file to be removed")
+	}
+}
+
+func TestRotatingWriterCompresses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cfwg-zt.log")
+
+	w, err := NewRotatingWriter(path, 10, 3, true)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer w.Close()
+
+	w.Write([]byte("old content\n"))
+	w.Write([]byte("new content\n"))
+
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("Expected the uncompressed rotated file to be removed")
+	}
+
+	file, err := os.Open(path + ".1.gz")
+	if err != nil {
+		t.Fatalf("Expected compressed rotated file: %v", err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("Rotated file is not gzipped: %v", err)
+	}
+	data, _ := io.ReadAll(gz)
+	if string(data) != "old content\n" {
+		t.Errorf("Unexpected compressed content: %q", data)
+	}
+}
+
+func TestRotatingWriterAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cfwg-zt.log")
+	os.WriteFile(path, []byte("existing\n"), 0640)
+
+	w, err := NewRotatingWriter(path, 1024, 1, false)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	w.Write([]byte("appended\n"))
+	w.Close()
+
+	data, _ := os.ReadFile(path)
+	if string(data) != "existing\nappended\n" {
+		t.Errorf("Expected existing content to be preserved, got %q", data)
+	}
+}
+
+func TestRotatingWriterSurvivesFailedRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cfwg-zt.log")
+
+	// A directory in the way of the rotated file makes renaming the log file fail
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocked"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	w, err := NewRotatingWriter(path, 10, 1, false)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer w.Close()
+
+	for _, line := range []string{"first line\n", "second line\n", "third line\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatalf("Expected writing to carry on after a failed rotation: %v", err)
+		}
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "first line\nsecond line\nthird line\n" {
+		t.Errorf("Unexpected content: %q", data)
+	}
+
+	// Rotating is tried again once the way is clear
+	os.RemoveAll(path + ".1")
+	w.Write([]byte("fourth line\n"))
+	rotated, _ := os.ReadFile(path + ".1")
+	if data, _ := os.ReadFile(path); string(data) != "fourth line\n" || !strings.HasSuffix(string(rotated), "third line\n") {
+		t.Errorf("Expected the log file to be rotated, got %q and %q", data, rotated)
+	}
+
+	w.Close()
+	if _, err := w.Write([]byte("closed\n")); err == nil {
+		t.Error("Expected error writing to a closed writer")
+	}
+}
+
+func TestOpenOutputErrors(t *testing.T) {
+	// A regular file where the log directory should be makes the log file impossible to create
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	os.WriteFile(blocker, nil, 0640)
+
+	cfg := &config.Config{}
+	cfg.Logging.Output = OutputFile
+	cfg.Logging.File = filepath.Join(blocker, "cfwg-zt.log")
+	cfg.Logging.MaxSizeMB = 10
+	if _, _, err := openOutput(cfg); err == nil || !strings.Contains(err.Error(), "log directory") {
+		t.Errorf("Expected log directory error, got %v", err)
+	}
+
+	cfg.Logging.Output = "carrier-pigeon"
+	if _, _, err := openOutput(cfg); err == nil {
+		t.Error("Expected error for unknown output")
+	}
+
+	cfg.Logging.Output = OutputJournald
+	if w, _, err := openOutput(cfg); err != nil || w != os.Stdout {
+		t.Errorf("Expected journald output to write to stdout, got %v", err)
+	}
+}
+
+func TestConfigureFallsBackToStderr(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	stderr := os.Stderr
+	defer func() { os.Stderr = stderr }()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	os.Stderr = w
+
+	cfg := &config.Config{}
+	cfg.Logging.Output = "carrier-pigeon"
+	cfg.Logging.Level = "verbose"
+	closer := Configure(cfg)
+	Component("loop").Info("still logging")
+	closer.Close()
+	w.Close()
+
+	data, _ := io.ReadAll(r)
+	output := string(data)
+	if !strings.Contains(output, "unsupported log output") || !strings.Contains(output, "invalid log level") {
+		t.Errorf("Expected configuration problems to be logged, got: %s", output)
+	}
+	if !strings.Contains(output, "still logging") {
+		t.Errorf("Expected logging to continue on stderr, got: %s", output)
+	}
+}
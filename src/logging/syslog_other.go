@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package logging
+
+import (
+	"fmt"
+	"io"
+)
+
+// openSyslog is not supported on this platform
+func openSyslog() (io.WriteCloser, error) {
+	return nil, fmt.Errorf("syslog is not supported on this platform")
+}
@@ -0,0 +1,302 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/logging"
+	"github.com/gumbees/cfwg-zt/src/redact"
+)
+
+var logger = logging.Component("notify")
+
+// Event identifies a state change worth notifying about
+type Event string
+
+const (
+	EventAuthFailure       Event = "auth_failure"
+	EventBackoff           Event = "backoff"
+	EventRollback          Event = "rollback"
+	EventKeyRotation       Event = "key_rotation"
+	EventRecovery          Event = "recovery"
+	EventServiceNotRunning Event = "service_not_running"
+	EventConfigReverted    Event = "config_reverted"
+)
+
+// Events lists every event a webhook can subscribe to
+var Events = []Event{
+	EventAuthFailure, EventBackoff, EventRollback, EventKeyRotation, EventRecovery, EventServiceNotRunning, EventConfigReverted,
+}
+
+// Supported webhook payload formats
+const (
+	FormatGeneric = "generic"
+	FormatSlack   = "slack"
+	FormatDiscord = "discord"
+	FormatNtfy    = "ntfy"
+)
+
+// failureEvents are the events whose throttling is cleared when the tunnel recovers
+var failureEvents = []Event{EventAuthFailure, EventBackoff, EventRollback, EventServiceNotRunning}
+
+// Notification is the data passed to webhook payloads and templates
+type Notification struct {
+	Event     Event     `json:"event"`
+	Message   string    `json:"message"`
+	Host      string    `json:"host"`
+	Interface string    `json:"interface"`
+	Time      time.Time `json:"time"`
+}
+
+// Title returns a short human readable summary of the notification
+func (n *Notification) Title() string {
+	return fmt.Sprintf("cfwg-zt on %s: %s", n.Host, strings.ReplaceAll(string(n.Event), "_", " "))
+}
+
+// webhook is a configured notification target
+type webhook struct {
+	url      string
+	format   string
+	events   map[Event]bool
+	template *template.Template
+	headers  map[string]string
+}
+
+// Notifier sends state change notifications to the configured webhooks
+type Notifier struct {
+	webhooks   []webhook
+	throttle   time.Duration
+	httpClient *http.Client
+	host       string
+	iface      string
+
+	mu       sync.Mutex
+	lastSent map[Event]time.Time
+	now      func() time.Time
+	wg       sync.WaitGroup
+}
+
+// NewNotifier creates a notifier from the configuration
+// A notifier without webhooks is valid and silently discards notifications
+func NewNotifier(cfg *config.Config) (*Notifier, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	n := &Notifier{
+		throttle:   time.Duration(cfg.Notifications.ThrottleMinutes) * time.Minute,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		host:       host,
+		iface:      cfg.WireGuard.InterfaceName,
+		lastSent:   make(map[Event]time.Time),
+		now:        time.Now,
+	}
+
+	for i, webhookCfg := range cfg.Notifications.Webhooks {
+		hook, err := newWebhook(webhookCfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid notification webhook %d: %w", i+1, err)
+		}
+		n.webhooks = append(n.webhooks, hook)
+	}
+
+	return n, nil
+}
+
+// newWebhook validates a webhook configuration and parses its template
+func newWebhook(cfg config.WebhookConfig) (webhook, error) {
+	hook := webhook{
+		url:     cfg.URL,
+		format:  cfg.Format,
+		headers: cfg.Headers,
+	}
+
+	if hook.url == "" {
+		return hook, fmt.Errorf("missing url")
+	}
+
+	switch hook.format {
+	case "":
+		hook.format = FormatGeneric
+	case FormatGeneric, FormatSlack, FormatDiscord, FormatNtfy:
+	default:
+		return hook, fmt.Errorf("unsupported format %q", hook.format)
+	}
+
+	if cfg.Template != "" {
+		if hook.format != FormatGeneric {
+			return hook, fmt.Errorf("templates are only supported for the %s format", FormatGeneric)
+		}
+		tmpl, err := template.New("webhook").Funcs(template.FuncMap{"json": toJSON}).Parse(cfg.Template)
+		if err != nil {
+			return hook, fmt.Errorf("error parsing template: %w", err)
+		}
+		hook.template = tmpl
+	}
+
+	if len(cfg.Events) > 0 {
+		hook.events = make(map[Event]bool)
+		for _, event := range cfg.Events {
+			// A misspelled event would otherwise silence the webhook without a word
+			if !slices.Contains(Events, Event(event)) {
+				return hook, fmt.Errorf("unknown event %q (expected %s)", event, eventNames())
+			}
+			hook.events[Event(event)] = true
+		}
+	}
+
+	return hook, nil
+}
+
+// eventNames returns the events as a comma separated list
+func eventNames() string {
+	names := make([]string, len(Events))
+	for i, event := range Events {
+		names[i] = string(event)
+	}
+	return strings.Join(names, ", ")
+}
+
+// toJSON encodes a value for safe embedding in templated JSON payloads
+func toJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+// Notify sends a notification for the event unless the same event was sent within the throttle window
+// Delivery happens in the background so the service loop is never blocked by a slow webhook
+func (n *Notifier) Notify(event Event, message string) {
+	if n == nil || len(n.webhooks) == 0 {
+		return
+	}
+
+	notification, ok := n.admit(event, redact.String(message))
+	if !ok {
+		return
+	}
+
+	for _, hook := range n.webhooks {
+		if hook.events != nil && !hook.events[event] {
+			continue
+		}
+
+		n.wg.Add(1)
+		go func(hook webhook) {
+			defer n.wg.Done()
+			if err := n.send(hook, notification); err != nil {
+				logger.Warn("Failed to send notification", "event", event, "format", hook.format, "error", err)
+			}
+		}(hook)
+	}
+}
+
+// Wait blocks until all in-flight notifications have been delivered
+func (n *Notifier) Wait() {
+	if n != nil {
+		n.wg.Wait()
+	}
+}
+
+// admit applies deduplication and throttling and builds the notification if it should be sent
+func (n *Notifier) admit(event Event, message string) (*Notification, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := n.now()
+	if last, ok := n.lastSent[event]; ok && now.Sub(last) < n.throttle {
+		return nil, false
+	}
+	n.lastSent[event] = now
+
+	// A recovery ends the outage, so the next failure should be reported right away
+	if event == EventRecovery {
+		for _, failure := range failureEvents {
+			delete(n.lastSent, failure)
+		}
+	}
+
+	return &Notification{
+		Event:     event,
+		Message:   message,
+		Host:      n.host,
+		Interface: n.iface,
+		Time:      now,
+	}, true
+}
+
+// send delivers a notification to a single webhook
+func (n *Notifier) send(hook webhook, notification *Notification) error {
+	body, contentType, err := hook.payload(notification)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", hook.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	if hook.format == FormatNtfy {
+		req.Header.Set("Title", notification.Title())
+		req.Header.Set("Tags", string(notification.Event))
+		if notification.Event != EventRecovery && notification.Event != EventKeyRotation {
+			req.Header.Set("Priority", "high")
+		}
+	}
+
+	for key, value := range hook.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// payload renders the request body for the webhook format
+func (hook webhook) payload(notification *Notification) ([]byte, string, error) {
+	text := fmt.Sprintf("%s\n%s", notification.Title(), notification.Message)
+
+	switch hook.format {
+	case FormatSlack:
+		data, err := json.Marshal(map[string]string{"text": text})
+		return data, "application/json", err
+	case FormatDiscord:
+		data, err := json.Marshal(map[string]string{"content": text})
+		return data, "application/json", err
+	case FormatNtfy:
+		return []byte(notification.Message), "text/plain", nil
+	default:
+		if hook.template == nil {
+			data, err := json.Marshal(notification)
+			return data, "application/json", err
+		}
+
+		var buf bytes.Buffer
+		if err := hook.template.Execute(&buf, notification); err != nil {
+			return nil, "", fmt.Errorf("error executing template: %w", err)
+		}
+		return buf.Bytes(), "application/json", nil
+	}
+}
@@ -0,0 +1,174 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gumbees/cfwg-zt/src/config"
+)
+
+// recorder is a fake webhook endpoint that records request bodies and headers
+type recorder struct {
+	mu       sync.Mutex
+	bodies   []string
+	requests []*http.Request
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bodies = append(r.bodies, string(body))
+	r.requests = append(r.requests, req)
+}
+
+func (r *recorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.bodies)
+}
+
+func newTestNotifier(t *testing.T, webhooks ...config.WebhookConfig) *Notifier {
+	cfg := &config.Config{}
+	cfg.WireGuard.InterfaceName = "wg0"
+	cfg.Notifications.ThrottleMinutes = 30
+	cfg.Notifications.Webhooks = webhooks
+
+	n, err := NewNotifier(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create notifier: %v", err)
+	}
+	n.host = "udm"
+	return n
+}
+
+func TestNotifyFormats(t *testing.T) {
+	rec := &recorder{}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	n := newTestNotifier(t,
+		config.WebhookConfig{URL: server.URL + "/generic"},
+		config.WebhookConfig{URL: server.URL + "/slack", Format: FormatSlack},
+		config.WebhookConfig{URL: server.URL + "/discord", Format: FormatDiscord},
+		config.WebhookConfig{URL: server.URL + "/ntfy", Format: FormatNtfy},
+		config.WebhookConfig{URL: server.URL + "/templated", Template: `{"alert": {{ json .Message }}, "kind": "{{ .Event }}"}`},
+	)
+
+	n.Notify(EventAuthFailure, `device "authentication" failed`)
+	n.Wait()
+
+	if rec.count() != 5 {
+		t.Fatalf("Expected 5 webhook requests, got %d", rec.count())
+	}
+
+	for i, req := range rec.requests {
+		body := rec.bodies[i]
+		switch req.URL.Path {
+		case "/generic":
+			var payload Notification
+			if err := json.Unmarshal([]byte(body), &payload); err != nil {
+				t.Fatalf("Generic payload is not valid JSON: %v", err)
+			}
+			if payload.Event != EventAuthFailure || payload.Host != "udm" || payload.Interface != "wg0" {
+				t.Errorf("Unexpected generic payload: %+v", payload)
+			}
+		case "/slack":
+			var payload map[string]string
+			if err := json.Unmarshal([]byte(body), &payload); err != nil || payload["text"] == "" {
+				t.Errorf("Unexpected Slack payload: %s", body)
+			}
+		case "/discord":
+			var payload map[string]string
+			if err := json.Unmarshal([]byte(body), &payload); err != nil || payload["content"] == "" {
+				t.Errorf("Unexpected Discord payload: %s", body)
+			}
+		case "/ntfy":
+			if body != `device "authentication" failed` || req.Header.Get("Title") == "" || req.Header.Get("Priority") != "high" {
+				t.Errorf("Unexpected ntfy request: %s %v", body, req.Header)
+			}
+		case "/templated":
+			var payload map[string]string
+			if err := json.Unmarshal([]byte(body), &payload); err != nil {
+				t.Fatalf("Templated payload is not valid JSON: %v (%s)", err, body)
+			}
+			if payload["alert"] != `device "authentication" failed` || payload["kind"] != "auth_failure" {
+				t.Errorf("Unexpected templated payload: %s", body)
+			}
+		}
+	}
+}
+
+func TestNotifyThrottle(t *testing.T) {
+	rec := &recorder{}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	n := newTestNotifier(t, config.WebhookConfig{URL: server.URL})
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	n.now = func() time.Time { return now }
+
+	// The retry loop reports the same failure every minute
+	for i := 0; i < 5; i++ {
+		n.Notify(EventAuthFailure, "failed")
+		now = now.Add(time.Minute)
+	}
+	n.Wait()
+	if rec.count() != 1 {
+		t.Fatalf("Expected repeated failures to be throttled to 1 request, got %d", rec.count())
+	}
+
+	// A recovery is always sent and clears the throttle for failures
+	n.Notify(EventRecovery, "recovered")
+	n.Notify(EventAuthFailure, "failed again")
+	n.Wait()
+	if rec.count() != 3 {
+		t.Fatalf("Expected recovery and the next failure to be sent, got %d requests", rec.count())
+	}
+
+	// After the throttle window the same event is sent again
+	now = now.Add(31 * time.Minute)
+	n.Notify(EventAuthFailure, "still failing")
+	n.Wait()
+	if rec.count() != 4 {
+		t.Fatalf("Expected a notification after the throttle window, got %d requests", rec.count())
+	}
+}
+
+func TestNotifyEventFilter(t *testing.T) {
+	rec := &recorder{}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	n := newTestNotifier(t, config.WebhookConfig{URL: server.URL, Events: []string{"recovery"}})
+	n.Notify(EventBackoff, "backing off")
+	n.Notify(EventRecovery, "recovered")
+	n.Wait()
+
+	if rec.count() != 1 {
+		t.Fatalf("Expected only the subscribed event to be sent, got %d requests", rec.count())
+	}
+}
+
+func TestNewNotifierInvalid(t *testing.T) {
+	invalid := []config.WebhookConfig{
+		{Format: FormatSlack},
+		{URL: "http://example.com", Format: "email"},
+		{URL: "http://example.com", Format: FormatSlack, Template: "{}"},
+		{URL: "http://example.com", Template: "{{ .Missing"},
+		{URL: "http://example.com", Events: []string{"auth_failure", "auth_failed"}},
+	}
+
+	for _, webhook := range invalid {
+		cfg := &config.Config{}
+		cfg.Notifications.Webhooks = []config.WebhookConfig{webhook}
+		if _, err := NewNotifier(cfg); err == nil {
+			t.Errorf("Expected error for webhook %+v", webhook)
+		}
+	}
+}
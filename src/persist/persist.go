@@ -0,0 +1,287 @@
+package persist
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Default locations on UniFi OS, where only /data survives a firmware upgrade
+const (
+	// DefaultDataDir holds the copies the boot hook restores from
+	DefaultDataDir = "/data/cfwg-zt"
+	// DefaultBootDir holds the scripts udm-boot runs on every boot
+	DefaultBootDir = "/data/on_boot.d"
+	// HookName is the name of the boot hook in the boot directory
+	HookName = "10-cfwg-zt.sh"
+)
+
+// Installed locations of the binary and the systemd unit, as the installer puts them
+const (
+	BinaryPath = "/usr/local/bin/cfwg-zt"
+	UnitPath   = "/etc/systemd/system/cfwg-zt.service"
+)
+
+// bootRunners are the systemd units that run the scripts in the boot directory
+var bootRunners = []string{
+	"/etc/systemd/system/udm-boot.service",
+	"/etc/systemd/system/udm-boot-2x.service",
+	"/lib/systemd/system/udm-boot.service",
+}
+
+// File is a file that is kept in the data directory and restored on boot
+type File struct {
+	// Name is the name of the copy in the data directory
+	Name string `json:"name"`
+	// Path is where the file is installed
+	Path string      `json:"path"`
+	Mode os.FileMode `json:"-"`
+}
+
+// Persister installs and removes the boot hook that restores cfwg-zt after a firmware upgrade
+type Persister struct {
+	// root prefixes every path, so tests can work in a temporary directory
+	root    string
+	dataDir string
+	bootDir string
+	files   []File
+}
+
+// New creates a persister for the binary, the unit and the configuration file at configPath
+func New(dataDir, bootDir, configPath string) *Persister {
+	return newPersister("", dataDir, bootDir, configPath)
+}
+
+// newPersister creates a persister that works below root
+func newPersister(root, dataDir, bootDir, configPath string) *Persister {
+	return &Persister{
+		root:    root,
+		dataDir: dataDir,
+		bootDir: bootDir,
+		files: []File{
+			{Name: "cfwg-zt", Path: BinaryPath, Mode: 0755},
+			{Name: "cfwg-zt.service", Path: UnitPath, Mode: 0644},
+			{Name: "config.yaml", Path: configPath, Mode: 0600},
+		},
+	}
+}
+
+// path returns the path below the root
+func (p *Persister) path(path string) string {
+	return filepath.Join(p.root, path)
+}
+
+// copyPath returns the path of the copy of a file in the data directory
+func (p *Persister) copyPath(f File) string {
+	return filepath.Join(p.dataDir, f.Name)
+}
+
+// hookPath returns the path of the boot hook
+func (p *Persister) hookPath() string {
+	return filepath.Join(p.bootDir, HookName)
+}
+
+// Install copies the files to the data directory and writes the boot hook
+// Running it again refreshes the copies, for example after upgrading cfwg-zt or changing its configuration
+func (p *Persister) Install() error {
+	for _, f := range p.files {
+		if _, err := os.Stat(p.path(f.Path)); err != nil {
+			return fmt.Errorf("cannot persist %s: %w", f.Path, err)
+		}
+	}
+
+	if err := os.MkdirAll(p.path(p.dataDir), 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	for _, f := range p.files {
+		if err := copyFile(p.path(f.Path), p.path(p.copyPath(f)), f.Mode); err != nil {
+			return fmt.Errorf("failed to persist %s: %w", f.Path, err)
+		}
+	}
+
+	if err := os.MkdirAll(p.path(p.bootDir), 0755); err != nil {
+		return fmt.Errorf("failed to create boot directory: %w", err)
+	}
+	if err := writeFile(p.path(p.hookPath()), []byte(p.Hook()), 0755); err != nil {
+		return fmt.Errorf("failed to write boot hook: %w", err)
+	}
+	return nil
+}
+
+// Remove deletes the boot hook and the copies in the data directory
+// Other files in the data directory are left alone, and so is the directory if any remain
+func (p *Persister) Remove() error {
+	paths := []string{p.hookPath()}
+	for _, f := range p.files {
+		paths = append(paths, p.copyPath(f))
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(p.path(path)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+
+	if err := os.Remove(p.path(p.dataDir)); err != nil && !os.IsNotExist(err) {
+		if entries, readErr := os.ReadDir(p.path(p.dataDir)); readErr == nil && len(entries) > 0 {
+			return nil
+		}
+		return fmt.Errorf("failed to remove data directory: %w", err)
+	}
+	return nil
+}
+
+// Hook returns the boot hook script
+// It restores each file that is missing, then enables and starts the service
+// Files that are present are kept, so a normal reboot never reverts a newer binary or configuration
+func (p *Persister) Hook() string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	b.WriteString("# Restores cfwg-zt after a UniFi OS firmware upgrade, which wipes everything outside of /data\n")
+	b.WriteString("# Generated by 'cfwg-zt persist install'; remove it with 'cfwg-zt persist remove'\n")
+	b.WriteString("set -e\n\n")
+
+	b.WriteString("restore() {\n")
+	b.WriteString("\t[ -e \"$2\" ] && return 0\n")
+	b.WriteString("\techo \"cfwg-zt: restoring $2\"\n")
+	b.WriteString("\tmkdir -p \"$(dirname \"$2\")\"\n")
+	b.WriteString("\tcp \"$1\" \"$2\"\n")
+	b.WriteString("\tchmod \"$3\" \"$2\"\n")
+	b.WriteString("}\n\n")
+
+	for _, f := range p.files {
+		fmt.Fprintf(&b, "restore %s %s %o\n", shellQuote(p.copyPath(f)), shellQuote(f.Path), f.Mode)
+	}
+
+	b.WriteString("\nsystemctl daemon-reload\n")
+	b.WriteString("systemctl enable --now cfwg-zt\n")
+	return b.String()
+}
+
+// Status describes what is installed
+type Status struct {
+	DataDir string `json:"data_dir"`
+	Hook    string `json:"hook"`
+	// HookInstalled is set when the boot hook exists, and HookCurrent when it matches what Install writes
+	HookInstalled bool `json:"hook_installed"`
+	HookCurrent   bool `json:"hook_current"`
+	// BootRunner is the unit that runs the boot hooks, if one is installed
+	BootRunner string       `json:"boot_runner,omitempty"`
+	Files      []FileStatus `json:"files"`
+}
+
+// FileStatus describes the copy of a file in the data directory
+type FileStatus struct {
+	File
+	Persisted bool `json:"persisted"`
+	// InSync is set when the copy matches the installed file
+	InSync bool `json:"in_sync"`
+}
+
+// Installed reports whether the hook and every copy are in place and current
+func (s *Status) Installed() bool {
+	if !s.HookInstalled || !s.HookCurrent {
+		return false
+	}
+	for _, f := range s.Files {
+		if !f.Persisted || !f.InSync {
+			return false
+		}
+	}
+	return true
+}
+
+// Status inspects the boot hook and the copies in the data directory
+func (p *Persister) Status() *Status {
+	status := &Status{DataDir: p.dataDir, Hook: p.hookPath()}
+
+	if hook, err := os.ReadFile(p.path(p.hookPath())); err == nil {
+		status.HookInstalled = true
+		status.HookCurrent = string(hook) == p.Hook()
+	}
+
+	for _, runner := range bootRunners {
+		if _, err := os.Stat(p.path(runner)); err == nil {
+			status.BootRunner = runner
+			break
+		}
+	}
+
+	for _, f := range p.files {
+		fileStatus := FileStatus{File: f}
+		if persisted, err := os.ReadFile(p.path(p.copyPath(f))); err == nil {
+			fileStatus.Persisted = true
+			installed, err := os.ReadFile(p.path(f.Path))
+			fileStatus.InSync = err == nil && bytes.Equal(installed, persisted)
+		}
+		status.Files = append(status.Files, fileStatus)
+	}
+	return status
+}
+
+// WriteText prints the status in a human-readable form
+func (s *Status) WriteText(w io.Writer) {
+	switch {
+	case !s.HookInstalled:
+		fmt.Fprintf(w, "Boot hook:    not installed (%s)\n", s.Hook)
+	case !s.HookCurrent:
+		fmt.Fprintf(w, "Boot hook:    outdated, run 'cfwg-zt persist install' (%s)\n", s.Hook)
+	default:
+		fmt.Fprintf(w, "Boot hook:    installed (%s)\n", s.Hook)
+	}
+
+	if s.BootRunner != "" {
+		fmt.Fprintf(w, "Boot runner:  %s\n", s.BootRunner)
+	} else {
+		fmt.Fprintf(w, "Boot runner:  not found, install udm-boot so the scripts in %s run on boot\n", filepath.Dir(s.Hook))
+	}
+
+	for _, f := range s.Files {
+		state := "in sync"
+		switch {
+		case !f.Persisted:
+			state = "not persisted"
+		case !f.InSync:
+			state = "differs from the installed file, run 'cfwg-zt persist install' to update"
+		}
+		fmt.Fprintf(w, "%-13s %s (%s)\n", f.Name+":", state, f.Path)
+	}
+}
+
+// copyFile copies the file at src to dst with the mode
+func copyFile(src, dst string, mode os.FileMode) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeFile(dst, data, mode)
+}
+
+// writeFile writes the file atomically, so an interrupted install never leaves a truncated copy behind
+func writeFile(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// shellQuote quotes a value for the shell
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,185 @@
+package persist
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestPersister creates a persister below a temporary root with the binary, unit and configuration installed
+func newTestPersister(t *testing.T) (*Persister, string) {
+	root := t.TempDir()
+	p := newPersister(root, DefaultDataDir, DefaultBootDir, "/etc/cfwg-zt/config.yaml")
+
+	for path, content := range map[string]string{
+		BinaryPath:                 "binary",
+		UnitPath:                   "[Unit]\n",
+		"/etc/cfwg-zt/config.yaml": "debug: false\n",
+	} {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(path)), 0755)
+		os.WriteFile(filepath.Join(root, path), []byte(content), 0644)
+	}
+	return p, root
+}
+
+func TestInstall(t *testing.T) {
+	p, root := newTestPersister(t)
+	if err := p.Install(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for name, mode := range map[string]os.FileMode{"cfwg-zt": 0755, "cfwg-zt.service": 0644, "config.yaml": 0600} {
+		info, err := os.Stat(filepath.Join(root, DefaultDataDir, name))
+		if err != nil {
+			t.Errorf("Expected %s to be persisted: %v", name, err)
+			continue
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("Expected %s to have mode %v, got %v", name, mode, info.Mode().Perm())
+		}
+	}
+
+	hook, err := os.ReadFile(filepath.Join(root, DefaultBootDir, HookName))
+	if err != nil {
+		t.Fatalf("Expected the boot hook to be written: %v", err)
+	}
+	for _, line := range []string{
+		"restore '/data/cfwg-zt/cfwg-zt' '/usr/local/bin/cfwg-zt' 755",
+		"restore '/data/cfwg-zt/cfwg-zt.service' '/etc/systemd/system/cfwg-zt.service' 644",
+		"restore '/data/cfwg-zt/config.yaml' '/etc/cfwg-zt/config.yaml' 600",
+		"systemctl enable --now cfwg-zt",
+	} {
+		if !strings.Contains(string(hook), line+"\n") {
+			t.Errorf("Expected the boot hook to contain %q:\n%s", line, hook)
+		}
+	}
+
+	// The hook must be valid shell
+	if sh, err := exec.LookPath("sh"); err == nil {
+		if output, err := exec.Command(sh, "-n", filepath.Join(root, DefaultBootDir, HookName)).CombinedOutput(); err != nil {
+			t.Errorf("Boot hook has a syntax error: %v: %s", err, output)
+		}
+	}
+
+	status := p.Status()
+	if !status.Installed() {
+		t.Errorf("Expected the status to be installed, got %+v", status)
+	}
+}
+
+func TestInstallMissingFile(t *testing.T) {
+	p, root := newTestPersister(t)
+	os.Remove(filepath.Join(root, UnitPath))
+
+	if err := p.Install(); err == nil || !strings.Contains(err.Error(), UnitPath) {
+		t.Errorf("Expected an error naming the missing unit, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, DefaultDataDir)); !os.IsNotExist(err) {
+		t.Error("Expected nothing to be persisted")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	p, root := newTestPersister(t)
+
+	status := p.Status()
+	if status.Installed() || status.HookInstalled || status.BootRunner != "" {
+		t.Errorf("Expected nothing to be installed, got %+v", status)
+	}
+
+	p.Install()
+	os.WriteFile(filepath.Join(root, "/etc/cfwg-zt/config.yaml"), []byte("debug: true\n"), 0600)
+	os.MkdirAll(filepath.Join(root, "/etc/systemd/system"), 0755)
+	os.WriteFile(filepath.Join(root, "/etc/systemd/system/udm-boot.service"), nil, 0644)
+
+	status = p.Status()
+	if status.Installed() {
+		t.Error("Expected a changed configuration to need a new install")
+	}
+	if status.BootRunner != "/etc/systemd/system/udm-boot.service" {
+		t.Errorf("Expected the boot runner to be found, got %q", status.BootRunner)
+	}
+	for _, f := range status.Files {
+		if f.InSync != (f.Name != "config.yaml") {
+			t.Errorf("Unexpected sync state for %s: %v", f.Name, f.InSync)
+		}
+	}
+
+	var text strings.Builder
+	status.WriteText(&text)
+	if !strings.Contains(text.String(), "config.yaml:  differs from the installed file") {
+		t.Errorf("Unexpected status text:\n%s", text.String())
+	}
+
+	// An outdated hook is reported
+	os.WriteFile(filepath.Join(root, DefaultBootDir, HookName), []byte("#!/bin/sh\n"), 0755)
+	if status := p.Status(); !status.HookInstalled || status.HookCurrent {
+		t.Errorf("Expected an outdated hook, got %+v", status)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	p, root := newTestPersister(t)
+	p.Install()
+
+	if err := p.Remove(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, path := range []string{DefaultDataDir, filepath.Join(DefaultBootDir, HookName)} {
+		if _, err := os.Stat(filepath.Join(root, path)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed", path)
+		}
+	}
+	// The installed files are left alone
+	if _, err := os.Stat(filepath.Join(root, BinaryPath)); err != nil {
+		t.Errorf("Expected the binary to remain: %v", err)
+	}
+
+	// Removing again is fine, and files of others in the data directory are kept
+	p.Install()
+	os.WriteFile(filepath.Join(root, DefaultDataDir, "notes.txt"), nil, 0644)
+	if err := p.Remove(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := p.Remove(); err != nil {
+		t.Fatalf("Unexpected error removing twice: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, DefaultDataDir, "notes.txt")); err != nil {
+		t.Errorf("Expected other files to be kept: %v", err)
+	}
+}
+
+func TestHookRestoresMissingFiles(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not available")
+	}
+
+	// Run the hook against the temporary root, with systemctl stubbed out
+	p, root := newTestPersister(t)
+	p.Install()
+	os.Remove(filepath.Join(root, BinaryPath))
+	os.WriteFile(filepath.Join(root, "/etc/cfwg-zt/config.yaml"), []byte("debug: true\n"), 0600)
+
+	rooted := newPersister("", filepath.Join(root, DefaultDataDir), DefaultBootDir, filepath.Join(root, "/etc/cfwg-zt/config.yaml"))
+	rooted.files[0].Path = filepath.Join(root, BinaryPath)
+	rooted.files[1].Path = filepath.Join(root, UnitPath)
+	script := "systemctl() { :; }\n" + rooted.Hook()
+
+	if output, err := exec.Command(sh, "-c", script).CombinedOutput(); err != nil {
+		t.Fatalf("Hook failed: %v: %s", err, output)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(root, BinaryPath)); err != nil || string(data) != "binary" {
+		t.Errorf("Expected the binary to be restored, got %q, %v", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(root, BinaryPath)); err == nil && info.Mode().Perm() != 0755 {
+		t.Errorf("Expected the restored binary to be executable, got %v", info.Mode().Perm())
+	}
+	// A present configuration is never reverted
+	if data, _ := os.ReadFile(filepath.Join(root, "/etc/cfwg-zt/config.yaml")); string(data) != "debug: true\n" {
+		t.Errorf("Expected the configuration to be kept, got %q", data)
+	}
+}
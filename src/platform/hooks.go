@@ -0,0 +1,103 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/config"
+)
+
+// Hooks runs the configured shell commands, for platforms none of the other backends fits
+// Each command gets the interface name as $1 and the configuration path as $2
+type Hooks struct {
+	config *config.Config
+	exec   Executor
+}
+
+// Name returns the backend name
+func (h *Hooks) Name() string {
+	return BackendHooks
+}
+
+// Target returns the interface
+func (h *Hooks) Target() string {
+	return h.config.WireGuard.InterfaceName
+}
+
+// Verify checks that a hook applies the configuration and runs the verify hook, if any
+func (h *Hooks) Verify(ctx context.Context) error {
+	if err := lookPaths(h.exec, Commands(BackendHooks)...); err != nil {
+		return err
+	}
+	hooks := h.config.Platform.Hooks
+	if hooks.Apply == "" && hooks.Restart == "" {
+		return fmt.Errorf("the hooks backend needs an apply or restart hook")
+	}
+
+	if hooks.Verify != "" {
+		if _, err := h.hook(ctx, "verify", hooks.Verify); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsRunning runs the is_running hook, which succeeds when the interface is up
+// Without the hook, the interface is up when wg can show it
+func (h *Hooks) IsRunning(ctx context.Context) (bool, error) {
+	command := h.config.Platform.Hooks.IsRunning
+	if command == "" {
+		command = `wg show "$1" >/dev/null`
+	}
+
+	output, err := h.exec.Run(ctx, "sh", h.args(command)...)
+	if err != nil {
+		if _, exited := exitStatus(err); exited {
+			return false, nil
+		}
+		return false, fmt.Errorf("is_running hook: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return true, nil
+}
+
+// Apply runs the apply hook, or the restart hook when there is none, and verifies the interface is up
+func (h *Hooks) Apply(ctx context.Context, cfg *cloudflare.WireGuardConfig) error {
+	if command := h.config.Platform.Hooks.Apply; command != "" {
+		logger.InfoContext(ctx, "Running apply hook", "interface", h.Target())
+		if _, err := h.hook(ctx, "apply", command); err != nil {
+			return err
+		}
+	} else if err := h.Restart(ctx); err != nil {
+		return err
+	}
+
+	return verifyRunning(ctx, h)
+}
+
+// Restart runs the restart hook, falling back to the apply hook
+func (h *Hooks) Restart(ctx context.Context) error {
+	name, command := "restart", h.config.Platform.Hooks.Restart
+	if command == "" {
+		name, command = "apply", h.config.Platform.Hooks.Apply
+	}
+
+	logger.InfoContext(ctx, "Running "+name+" hook", "interface", h.Target())
+	_, err := h.hook(ctx, name, command)
+	return err
+}
+
+// hook runs a hook command
+func (h *Hooks) hook(ctx context.Context, name, command string) (string, error) {
+	output, err := run(ctx, h.exec, "sh", h.args(command)...)
+	if err != nil {
+		return "", fmt.Errorf("%s hook failed: %w", name, err)
+	}
+	return output, nil
+}
+
+// args returns the sh arguments that run the command with the interface name and configuration path
+func (h *Hooks) args(command string) []string {
+	return []string{"-c", command, "cfwg-zt", h.config.WireGuard.InterfaceName, h.config.WireGuard.ConfigPath}
+}
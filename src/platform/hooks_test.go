@@ -0,0 +1,70 @@
+package platform
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const hookArgs = " cfwg-zt wg0 /etc/wireguard/wg0.conf"
+
+func TestHooksApply(t *testing.T) {
+	cfg := testConfig(BackendHooks)
+	cfg.Platform.Hooks.Apply = "/data/wg-apply.sh"
+	cfg.Platform.Hooks.IsRunning = "ip link show wg0 up"
+	f := newFakeExecutor()
+
+	h := &Hooks{config: cfg, exec: f}
+	if err := h.Apply(context.Background(), testWireGuardConfig()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectCalls(t, f, "sh -c /data/wg-apply.sh"+hookArgs, "sh -c ip link show wg0 up"+hookArgs)
+}
+
+func TestHooksApplyFallsBackToRestart(t *testing.T) {
+	cfg := testConfig(BackendHooks)
+	cfg.Platform.Hooks.Restart = "ifdown wg0; ifup wg0"
+	f := newFakeExecutor()
+
+	h := &Hooks{config: cfg, exec: f}
+	if err := h.Apply(context.Background(), testWireGuardConfig()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Without an is_running hook, wg shows whether the interface is up
+	expectCalls(t, f, "sh -c ifdown wg0; ifup wg0"+hookArgs, `sh -c wg show "$1" >/dev/null`+hookArgs)
+}
+
+func TestHooksIsRunning(t *testing.T) {
+	cfg := testConfig(BackendHooks)
+	cfg.Platform.Hooks.IsRunning = "check"
+	f := newFakeExecutor()
+	h := &Hooks{config: cfg, exec: f}
+
+	// A non-zero exit status means the interface is down
+	f.on("sh -c check"+hookArgs, result{err: exitError(1)})
+	if isRunning, err := h.IsRunning(context.Background()); isRunning || err != nil {
+		t.Errorf("IsRunning() = %v, %v; expected false, nil", isRunning, err)
+	}
+
+	f.on("sh -c check"+hookArgs, result{err: context.DeadlineExceeded})
+	if _, err := h.IsRunning(context.Background()); err == nil {
+		t.Error("Expected error for a hook that didn't run")
+	}
+}
+
+func TestHooksVerify(t *testing.T) {
+	cfg := testConfig(BackendHooks)
+	f := newFakeExecutor()
+	h := &Hooks{config: cfg, exec: f}
+
+	if err := h.Verify(context.Background()); err == nil || !strings.Contains(err.Error(), "apply or restart hook") {
+		t.Errorf("Expected a missing hook error, got %v", err)
+	}
+
+	cfg.Platform.Hooks.Restart = "restart"
+	cfg.Platform.Hooks.Verify = "test -x /data/wg-apply.sh"
+	f.on("sh -c test -x /data/wg-apply.sh"+hookArgs, result{err: exitError(1)})
+	if err := h.Verify(context.Background()); err == nil || !strings.Contains(err.Error(), "verify hook failed") {
+		t.Errorf("Expected the verify hook to fail, got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package platform
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/wireguard"
+)
+
+// openWrtPeerSection is the uci section of the Cloudflare peer; naming it keeps other peers of the interface untouched
+const openWrtPeerSection = "cfwg_zt"
+
+// openWrtStartupChecks is how many times, a second apart, the interface is checked after netifd was asked to bring it up
+const openWrtStartupChecks = 10
+
+// OpenWrt configures the interface and its Cloudflare peer through uci and has netifd reload it through ubus
+// OpenWrt doesn't read the wg-quick configuration file, so the credentials are applied to the network configuration
+type OpenWrt struct {
+	config *config.Config
+	exec   Executor
+
+	// endpoint returns the endpoint to use, the one the manager wrote to the configuration file
+	endpoint func(cfg *cloudflare.WireGuardConfig) (string, error)
+}
+
+// Name returns the backend name
+func (o *OpenWrt) Name() string {
+	return BackendOpenWrt
+}
+
+// Target returns the network interface
+func (o *OpenWrt) Target() string {
+	return o.config.WireGuard.InterfaceName
+}
+
+// Verify checks that uci and ubus are available and the interface is a WireGuard interface
+func (o *OpenWrt) Verify(ctx context.Context) error {
+	if err := lookPaths(o.exec, Commands(BackendOpenWrt)...); err != nil {
+		return err
+	}
+	if o.Target() == "" {
+		return fmt.Errorf("WireGuard interface name not configured")
+	}
+
+	proto, err := run(ctx, o.exec, "uci", "-q", "get", "network."+o.Target()+".proto")
+	if err != nil {
+		return fmt.Errorf("network interface %s not found: %w", o.Target(), err)
+	}
+	if proto != "wireguard" {
+		return fmt.Errorf("network interface %s has protocol %s instead of wireguard", o.Target(), proto)
+	}
+	return nil
+}
+
+// IsRunning asks netifd whether the interface is up
+func (o *OpenWrt) IsRunning(ctx context.Context) (bool, error) {
+	output, err := run(ctx, o.exec, "ubus", "call", "network.interface."+o.Target(), "status")
+	if err != nil {
+		return false, fmt.Errorf("error checking WireGuard interface: %w", err)
+	}
+
+	var status struct {
+		Up bool `json:"up"`
+	}
+	if err := json.Unmarshal([]byte(output), &status); err != nil {
+		return false, fmt.Errorf("failed to parse interface status: %w", err)
+	}
+	return status.Up, nil
+}
+
+// Apply writes the credentials to the network configuration, reloads it and brings the interface up
+func (o *OpenWrt) Apply(ctx context.Context, cfg *cloudflare.WireGuardConfig) error {
+	endpoint, err := o.endpoint(cfg)
+	if err != nil {
+		return err
+	}
+	host, port, err := wireguard.ParseEndpoint(endpoint, cfg.EndpointPort)
+	if err != nil {
+		return err
+	}
+
+	iface := "network." + o.Target()
+	peer := "network." + openWrtPeerSection
+	commands := [][]string{
+		{"set", iface + ".private_key=" + cfg.PrivateKey},
+	}
+	if len(cfg.Addresses) > 0 {
+		commands = append(commands, []string{"-q", "delete", iface + ".addresses"})
+		for _, address := range cfg.Addresses {
+			commands = append(commands, []string{"add_list", iface + ".addresses=" + address})
+		}
+	}
+
+	commands = append(commands,
+		[]string{"set", peer + "=wireguard_" + o.Target()},
+		[]string{"set", peer + ".description=Cloudflare Zero Trust"},
+		[]string{"set", peer + ".public_key=" + cfg.PeerPublicKey},
+		[]string{"set", peer + ".endpoint_host=" + host},
+		[]string{"set", peer + ".endpoint_port=" + strconv.Itoa(port)},
+	)
+	if cfg.PeerPresharedKey != "" {
+		commands = append(commands, []string{"set", peer + ".preshared_key=" + cfg.PeerPresharedKey})
+	} else {
+		commands = append(commands, []string{"-q", "delete", peer + ".preshared_key"})
+	}
+	if keepalive := o.config.WireGuard.PersistentKeepalive; keepalive > 0 {
+		commands = append(commands, []string{"set", peer + ".persistent_keepalive=" + strconv.Itoa(keepalive)})
+	}
+
+	// Allowed IPs are only set on a new peer, as routing is managed separately, unless the split tunnel decides them
+	setAllowedIPs := wireguard.ManagesAllowedIPs(o.config)
+	if setAllowedIPs {
+		commands = append(commands, []string{"-q", "delete", peer + ".allowed_ips"})
+	} else if _, err := run(ctx, o.exec, "uci", "-q", "get", peer+".allowed_ips"); err != nil {
+		setAllowedIPs = true
+	}
+	if setAllowedIPs {
+		for _, allowedIP := range cfg.AllowedIPs {
+			commands = append(commands, []string{"add_list", peer + ".allowed_ips=" + allowedIP})
+		}
+	}
+
+	for _, args := range commands {
+		// Quiet commands are deletes, which fail when the option doesn't exist
+		if _, err := run(ctx, o.exec, "uci", args...); err != nil && args[0] != "-q" {
+			return fmt.Errorf("failed to update network configuration: %w", err)
+		}
+	}
+	if _, err := run(ctx, o.exec, "uci", "commit", "network"); err != nil {
+		return fmt.Errorf("failed to commit network configuration: %w", err)
+	}
+
+	logger.InfoContext(ctx, "Reloading network configuration", "interface", o.Target())
+	if _, err := run(ctx, o.exec, "ubus", "call", "network", "reload"); err != nil {
+		return fmt.Errorf("failed to reload network configuration: %w", err)
+	}
+	if err := o.ubusInterface(ctx, "up"); err != nil {
+		return err
+	}
+
+	return o.waitRunning(ctx)
+}
+
+// Restart brings the interface down and up again
+func (o *OpenWrt) Restart(ctx context.Context) error {
+	logger.InfoContext(ctx, "Restarting WireGuard interface", "interface", o.Target())
+	if err := o.ubusInterface(ctx, "down"); err != nil {
+		return err
+	}
+	return o.ubusInterface(ctx, "up")
+}
+
+// ubusInterface asks netifd to bring the interface up or down
+func (o *OpenWrt) ubusInterface(ctx context.Context, action string) error {
+	if _, err := run(ctx, o.exec, "ubus", "call", "network.interface."+o.Target(), action); err != nil {
+		return fmt.Errorf("failed to bring WireGuard interface %s: %w", action, err)
+	}
+	return nil
+}
+
+// waitRunning verifies the interface came up, giving netifd, which works asynchronously, some time
+func (o *OpenWrt) waitRunning(ctx context.Context) error {
+	for i := 1; ; i++ {
+		isRunning, err := o.IsRunning(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to verify WireGuard status after restart: %w", err)
+		}
+		if isRunning {
+			return nil
+		}
+		if i == openWrtStartupChecks {
+			return fmt.Errorf("WireGuard failed to start")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
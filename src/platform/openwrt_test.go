@@ -0,0 +1,115 @@
+package platform
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/wireguard"
+)
+
+// newTestOpenWrt creates an OpenWrt backend that uses the endpoint Cloudflare issued
+func newTestOpenWrt(f *fakeExecutor) *OpenWrt {
+	return &OpenWrt{
+		config: testConfig(BackendOpenWrt),
+		exec:   f,
+		endpoint: func(cfg *cloudflare.WireGuardConfig) (string, error) {
+			return "[2606:4700:d0::a29f:c001]:500", nil
+		},
+	}
+}
+
+func TestOpenWrtApply(t *testing.T) {
+	f := newFakeExecutor()
+	f.on("uci -q get network.cfwg_zt.allowed_ips", result{err: exitError(1)})
+	f.on("ubus call network.interface.wg0 status", result{output: `{"up": false}`}, result{output: `{"up": true, "l3_device": "wg0"}`})
+
+	o := newTestOpenWrt(f)
+	cfg := testWireGuardConfig()
+	cfg.PeerPresharedKey = "FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE="
+	if err := o.Apply(context.Background(), cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expectCalls(t, f,
+		"uci -q get network.cfwg_zt.allowed_ips",
+		"uci set network.wg0.private_key=yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+		"uci -q delete network.wg0.addresses",
+		"uci add_list network.wg0.addresses=172.16.0.2/32",
+		"uci add_list network.wg0.addresses=2606:4700:110:8a36::2/128",
+		"uci set network.cfwg_zt=wireguard_wg0",
+		"uci set network.cfwg_zt.description=Cloudflare Zero Trust",
+		"uci set network.cfwg_zt.public_key=bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=",
+		"uci set network.cfwg_zt.endpoint_host=2606:4700:d0::a29f:c001",
+		"uci set network.cfwg_zt.endpoint_port=500",
+		"uci set network.cfwg_zt.preshared_key=FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE=",
+		"uci set network.cfwg_zt.persistent_keepalive=25",
+		"uci add_list network.cfwg_zt.allowed_ips=0.0.0.0/0",
+		"uci add_list network.cfwg_zt.allowed_ips=::/0",
+		"uci commit network",
+		"ubus call network reload",
+		"ubus call network.interface.wg0 up",
+		// netifd brings the interface up asynchronously
+		"ubus call network.interface.wg0 status",
+		"ubus call network.interface.wg0 status")
+}
+
+func TestOpenWrtApplyKeepsAllowedIPs(t *testing.T) {
+	f := newFakeExecutor()
+	f.on("uci -q get network.cfwg_zt.allowed_ips", result{output: "10.0.0.0/8"})
+	f.on("uci -q delete network.cfwg_zt.preshared_key", result{err: exitError(1)})
+	f.on("ubus call network.interface.wg0 status", result{output: `{"up": true}`})
+
+	if err := newTestOpenWrt(f).Apply(context.Background(), testWireGuardConfig()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, call := range f.calls {
+		if strings.Contains(call, "allowed_ips=") {
+			t.Errorf("Expected the existing allowed IPs to be kept, got %q", call)
+		}
+	}
+}
+
+func TestOpenWrtApplySplitTunnel(t *testing.T) {
+	f := newFakeExecutor()
+	f.on("ubus call network.interface.wg0 status", result{output: `{"up": true}`})
+
+	o := newTestOpenWrt(f)
+	o.config.SplitTunnel.Source = wireguard.SplitTunnelConfig
+	cfg := testWireGuardConfig()
+	cfg.AllowedIPs = []string{"10.0.0.0/8"}
+	if err := o.Apply(context.Background(), cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The allowed IPs of the split tunnel replace the existing ones
+	calls := strings.Join(f.calls, "\n")
+	if strings.Contains(calls, "uci -q get network.cfwg_zt.allowed_ips") ||
+		!strings.Contains(calls, "uci -q delete network.cfwg_zt.allowed_ips\nuci add_list network.cfwg_zt.allowed_ips=10.0.0.0/8\n") {
+		t.Errorf("Expected the allowed IPs to be replaced, got\n%s", calls)
+	}
+}
+
+func TestOpenWrtApplyFailure(t *testing.T) {
+	f := newFakeExecutor()
+	f.on("uci commit network", result{output: "uci: I/O error", err: exitError(1)})
+
+	err := newTestOpenWrt(f).Apply(context.Background(), testWireGuardConfig())
+	if err == nil || !strings.Contains(err.Error(), "failed to commit network configuration") {
+		t.Errorf("Expected a commit failure, got %v", err)
+	}
+}
+
+func TestOpenWrtVerify(t *testing.T) {
+	f := newFakeExecutor()
+	f.on("uci -q get network.wg0.proto", result{output: "wireguard\n"})
+	if err := newTestOpenWrt(f).Verify(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	f.on("uci -q get network.wg0.proto", result{output: "static\n"})
+	if err := newTestOpenWrt(f).Verify(context.Background()); err == nil || !strings.Contains(err.Error(), "protocol static") {
+		t.Errorf("Expected a protocol mismatch, got %v", err)
+	}
+}
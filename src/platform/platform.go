@@ -0,0 +1,201 @@
+package platform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/logging"
+	"github.com/gumbees/cfwg-zt/src/unifi"
+	"github.com/gumbees/cfwg-zt/src/wireguard"
+)
+
+var logger = logging.Component("platform")
+
+// Platform backends
+const (
+	// BackendAuto detects the backend, see Detect
+	BackendAuto = "auto"
+	// BackendSystemd manages a wg-quick systemd unit, as on the UDM Pro
+	BackendSystemd = "systemd"
+	// BackendWgQuick runs wg-quick up and down directly
+	BackendWgQuick = "wg-quick"
+	// BackendOpenWrt configures the interface through uci and reloads it through ubus
+	BackendOpenWrt = "openwrt"
+	// BackendHooks runs the configured shell commands
+	BackendHooks = "hooks"
+	// BackendUniFi updates the WireGuard VPN client network through the UniFi Network controller
+	BackendUniFi = "unifi"
+)
+
+// Backends lists every supported backend
+var Backends = []string{BackendAuto, BackendSystemd, BackendWgQuick, BackendOpenWrt, BackendHooks, BackendUniFi}
+
+// Platform brings the WireGuard interface up with the configuration the manager wrote
+type Platform interface {
+	// Name returns the backend name
+	Name() string
+	// Target describes what the backend manages, such as the systemd unit or the interface
+	Target() string
+	// Verify checks that the tools the backend needs are available and configured
+	Verify(ctx context.Context) error
+	// IsRunning reports whether the WireGuard interface is up
+	IsRunning(ctx context.Context) (bool, error)
+	// Apply brings the interface up with the new configuration and verifies it is running
+	Apply(ctx context.Context, cfg *cloudflare.WireGuardConfig) error
+	// Restart restarts the interface with its current configuration
+	Restart(ctx context.Context) error
+}
+
+// Rollbacker is implemented by backends that can't always be rolled back by restoring the configuration file
+type Rollbacker interface {
+	// CanRollBack reports whether restoring the configuration file and restarting brings back the previous configuration
+	CanRollBack() bool
+}
+
+// CanRollBack reports whether a failed apply on the backend can be undone by restoring the configuration file and restarting
+func CanRollBack(p Platform) bool {
+	if r, ok := p.(Rollbacker); ok {
+		return r.CanRollBack()
+	}
+	return true
+}
+
+// Executor runs commands; tests replace it with a fake
+type Executor interface {
+	// Run runs the command and returns its combined output
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+	// LookPath returns the path of the command in PATH
+	LookPath(name string) (string, error)
+}
+
+// execExecutor runs commands on the system
+type execExecutor struct{}
+
+func (execExecutor) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+func (execExecutor) LookPath(name string) (string, error) {
+	return exec.LookPath(name)
+}
+
+// New creates the configured platform backend, detecting it when the backend is auto
+func New(cfg *config.Config, wgManager *wireguard.Manager) (Platform, error) {
+	return newPlatform(cfg, wgManager, execExecutor{}, fileExists)
+}
+
+// newPlatform creates the configured backend with the executor and file check used for detection
+func newPlatform(cfg *config.Config, wgManager *wireguard.Manager, executor Executor, exists func(path string) bool) (Platform, error) {
+	backend := cfg.Platform.Backend
+	if backend == BackendAuto || backend == "" {
+		backend = detect(exists)
+		logger.Debug("Detected platform backend", "backend", backend)
+	}
+
+	switch backend {
+	case BackendSystemd:
+		return &Systemd{config: cfg, exec: executor}, nil
+	case BackendWgQuick:
+		return &WgQuick{config: cfg, exec: executor}, nil
+	case BackendOpenWrt:
+		return &OpenWrt{config: cfg, exec: executor, endpoint: wgManager.Endpoint}, nil
+	case BackendHooks:
+		return &Hooks{config: cfg, exec: executor}, nil
+	case BackendUniFi:
+		client, err := unifi.NewClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &UniFi{config: cfg, client: client, endpoint: wgManager.Endpoint}, nil
+	default:
+		return nil, fmt.Errorf("unknown platform backend %q (expected %s)", backend, strings.Join(Backends, ", "))
+	}
+}
+
+// Detect returns the backend for the system it runs on
+func Detect() string {
+	return detect(fileExists)
+}
+
+// detect picks OpenWrt when its release file exists, then systemd when it is the init system, and wg-quick otherwise
+// The UniFi and hooks backends need configuring, so they are never detected
+func detect(exists func(path string) bool) string {
+	switch {
+	case exists("/etc/openwrt_release"):
+		return BackendOpenWrt
+	case exists("/run/systemd/system"):
+		// The UDM Pro runs systemd, so it gets the backend it always had
+		return BackendSystemd
+	default:
+		return BackendWgQuick
+	}
+}
+
+// fileExists reports whether the path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Commands returns the commands the backend runs, which must be in PATH
+func Commands(backend string) []string {
+	switch backend {
+	case BackendSystemd:
+		return []string{"wg", "wg-quick", "systemctl"}
+	case BackendWgQuick:
+		return []string{"wg", "wg-quick"}
+	case BackendOpenWrt:
+		return []string{"wg", "uci", "ubus"}
+	case BackendHooks:
+		return []string{"wg", "sh"}
+	default:
+		// The UniFi controller provisions the interface itself
+		return nil
+	}
+}
+
+// lookPaths checks that each command is in PATH
+func lookPaths(executor Executor, names ...string) error {
+	for _, name := range names {
+		if _, err := executor.LookPath(name); err != nil {
+			return fmt.Errorf("'%s' command not found: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// run runs the command and includes its output in the error
+func run(ctx context.Context, executor Executor, name string, args ...string) (string, error) {
+	output, err := executor.Run(ctx, name, args...)
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// exitStatus returns the exit status of a command that ran but failed
+func exitStatus(err error) (int, bool) {
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), true
+	}
+	return 0, false
+}
+
+// verifyRunning checks that the interface came up after it was applied
+func verifyRunning(ctx context.Context, p Platform) error {
+	isRunning, err := p.IsRunning(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to verify WireGuard status after restart: %w", err)
+	}
+	if !isRunning {
+		return fmt.Errorf("WireGuard failed to start")
+	}
+	return nil
+}
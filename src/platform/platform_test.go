@@ -0,0 +1,166 @@
+package platform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/wireguard"
+)
+
+// exitError is a command that ran and exited with a non-zero status
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+
+func (e exitError) ExitCode() int { return int(e) }
+
+// result is the canned outcome of a fake command
+type result struct {
+	output string
+	err    error
+}
+
+// fakeExecutor records the commands it runs and answers them from canned results
+// Commands without a result succeed without output; a result list is used up in order, its last entry repeating
+type fakeExecutor struct {
+	results map[string][]result
+	missing map[string]bool
+	calls   []string
+}
+
+func newFakeExecutor() *fakeExecutor {
+	return &fakeExecutor{results: make(map[string][]result), missing: make(map[string]bool)}
+}
+
+// on sets the results of a command, given as it is run with its arguments joined by spaces
+func (f *fakeExecutor) on(command string, results ...result) {
+	f.results[command] = results
+}
+
+func (f *fakeExecutor) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	f.calls = append(f.calls, command)
+
+	results := f.results[command]
+	if len(results) == 0 {
+		return nil, nil
+	}
+	r := results[0]
+	if len(results) > 1 {
+		f.results[command] = results[1:]
+	}
+	return []byte(r.output), r.err
+}
+
+func (f *fakeExecutor) LookPath(name string) (string, error) {
+	if f.missing[name] {
+		return "", exec.ErrNotFound
+	}
+	return "/usr/bin/" + name, nil
+}
+
+// testConfig returns a configuration for the wg0 interface
+func testConfig(backend string) *config.Config {
+	cfg := &config.Config{}
+	cfg.WireGuard.InterfaceName = "wg0"
+	cfg.WireGuard.ConfigPath = "/etc/wireguard/wg0.conf"
+	cfg.WireGuard.PersistentKeepalive = 25
+	cfg.UDMPro.WireGuardServiceName = "wg-quick@wg0"
+	cfg.Platform.Backend = backend
+	return cfg
+}
+
+func testWireGuardConfig() *cloudflare.WireGuardConfig {
+	return &cloudflare.WireGuardConfig{
+		PrivateKey:    "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+		PeerPublicKey: "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=",
+		Addresses:     []string{"172.16.0.2/32", "2606:4700:110:8a36::2/128"},
+		AllowedIPs:    []string{"0.0.0.0/0", "::/0"},
+		Endpoint:      "engage.cloudflareclient.com",
+		EndpointPort:  2408,
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		files    []string
+		expected string
+	}{
+		{[]string{"/etc/openwrt_release"}, BackendOpenWrt},
+		{[]string{"/etc/openwrt_release", "/run/systemd/system"}, BackendOpenWrt},
+		{[]string{"/run/systemd/system", "/usr/bin/ubnt-systool"}, BackendSystemd},
+		{nil, BackendWgQuick},
+	}
+
+	for _, tt := range tests {
+		exists := func(path string) bool {
+			for _, file := range tt.files {
+				if file == path {
+					return true
+				}
+			}
+			return false
+		}
+		if got := detect(exists); got != tt.expected {
+			t.Errorf("detect() with %v = %s; expected %s", tt.files, got, tt.expected)
+		}
+	}
+}
+
+func TestNewPlatform(t *testing.T) {
+	none := func(string) bool { return false }
+	systemd := func(path string) bool { return path == "/run/systemd/system" }
+
+	tests := []struct {
+		backend  string
+		exists   func(string) bool
+		expected string
+	}{
+		{BackendAuto, systemd, BackendSystemd},
+		{"", none, BackendWgQuick},
+		{BackendSystemd, none, BackendSystemd},
+		{BackendWgQuick, systemd, BackendWgQuick},
+		{BackendOpenWrt, none, BackendOpenWrt},
+		{BackendHooks, none, BackendHooks},
+	}
+
+	for _, tt := range tests {
+		cfg := testConfig(tt.backend)
+		p, err := newPlatform(cfg, wireguard.NewManager(cfg), newFakeExecutor(), tt.exists)
+		if err != nil {
+			t.Errorf("newPlatform(%q): unexpected error %v", tt.backend, err)
+			continue
+		}
+		if p.Name() != tt.expected {
+			t.Errorf("newPlatform(%q) = %s; expected %s", tt.backend, p.Name(), tt.expected)
+		}
+	}
+
+	cfg := testConfig("launchd")
+	if _, err := newPlatform(cfg, wireguard.NewManager(cfg), newFakeExecutor(), none); err == nil {
+		t.Error("Expected error for an unknown backend")
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	if status, exited := exitStatus(fmt.Errorf("hook: %w", exitError(3))); !exited || status != 3 {
+		t.Errorf("exitStatus() = %d, %v; expected 3, true", status, exited)
+	}
+	if _, exited := exitStatus(errors.New("fork/exec: no such file")); exited {
+		t.Error("Expected a command that didn't run not to have an exit status")
+	}
+}
+
+// expectCalls fails the test unless the executor ran exactly the expected commands
+func expectCalls(t *testing.T, f *fakeExecutor, expected ...string) {
+	t.Helper()
+	if strings.Join(f.calls, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected commands:\n%s\nexpected:\n%s", strings.Join(f.calls, "\n"), strings.Join(expected, "\n"))
+	}
+}
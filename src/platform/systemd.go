@@ -0,0 +1,89 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/config"
+)
+
+// Systemd manages the wg-quick systemd unit of the interface, as on the UDM Pro
+type Systemd struct {
+	config *config.Config
+	exec   Executor
+}
+
+// Name returns the backend name
+func (s *Systemd) Name() string {
+	return BackendSystemd
+}
+
+// Target returns the systemd unit
+func (s *Systemd) Target() string {
+	return s.config.UDMPro.WireGuardServiceName
+}
+
+// Verify checks that WireGuard and systemd are available and the unit is configured
+func (s *Systemd) Verify(ctx context.Context) error {
+	if err := lookPaths(s.exec, Commands(BackendSystemd)...); err != nil {
+		return err
+	}
+	if s.config.WireGuard.InterfaceName == "" {
+		return fmt.Errorf("WireGuard interface name not configured")
+	}
+	if s.config.UDMPro.WireGuardServiceName == "" {
+		return fmt.Errorf("WireGuard service name not configured")
+	}
+	return nil
+}
+
+// IsRunning checks whether the unit is active
+func (s *Systemd) IsRunning(ctx context.Context) (bool, error) {
+	output, err := s.exec.Run(ctx, "systemctl", "is-active", s.Target())
+	state := strings.TrimSpace(string(output))
+	if err != nil {
+		// is-active fails for every state but active, which only means the service isn't running
+		switch state {
+		case "inactive", "unknown", "failed":
+			return false, nil
+		}
+		return false, fmt.Errorf("error checking WireGuard service: %w", err)
+	}
+
+	return state == "active", nil
+}
+
+// Apply restarts the unit if it is running and starts it otherwise
+func (s *Systemd) Apply(ctx context.Context, cfg *cloudflare.WireGuardConfig) error {
+	isRunning, err := s.IsRunning(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check WireGuard service status: %w", err)
+	}
+
+	if isRunning {
+		err = s.Restart(ctx)
+	} else {
+		err = s.systemctl(ctx, "start", "Starting WireGuard service")
+	}
+	if err != nil {
+		return err
+	}
+
+	return verifyRunning(ctx, s)
+}
+
+// Restart restarts the unit
+func (s *Systemd) Restart(ctx context.Context) error {
+	return s.systemctl(ctx, "restart", "Restarting WireGuard service")
+}
+
+// systemctl runs a systemctl action on the unit
+func (s *Systemd) systemctl(ctx context.Context, action, message string) error {
+	logger.InfoContext(ctx, message, "service", s.Target())
+	if _, err := run(ctx, s.exec, "systemctl", action, s.Target()); err != nil {
+		return fmt.Errorf("failed to %s WireGuard service: %w", action, err)
+	}
+	return nil
+}
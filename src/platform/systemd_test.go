@@ -0,0 +1,72 @@
+package platform
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSystemdIsRunning(t *testing.T) {
+	tests := []struct {
+		result   result
+		expected bool
+		wantErr  bool
+	}{
+		{result{output: "active\n"}, true, false},
+		{result{output: "inactive\n", err: exitError(3)}, false, false},
+		{result{output: "failed\n", err: exitError(3)}, false, false},
+		{result{output: "Failed to connect to bus\n", err: exitError(1)}, false, true},
+	}
+
+	for _, tt := range tests {
+		f := newFakeExecutor()
+		f.on("systemctl is-active wg-quick@wg0", tt.result)
+		s := &Systemd{config: testConfig(BackendSystemd), exec: f}
+
+		isRunning, err := s.IsRunning(context.Background())
+		if isRunning != tt.expected || (err != nil) != tt.wantErr {
+			t.Errorf("IsRunning() with %q = %v, %v", tt.result.output, isRunning, err)
+		}
+	}
+}
+
+func TestSystemdApply(t *testing.T) {
+	// A running unit is restarted
+	f := newFakeExecutor()
+	f.on("systemctl is-active wg-quick@wg0", result{output: "active"})
+	s := &Systemd{config: testConfig(BackendSystemd), exec: f}
+	if err := s.Apply(context.Background(), testWireGuardConfig()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectCalls(t, f, "systemctl is-active wg-quick@wg0", "systemctl restart wg-quick@wg0", "systemctl is-active wg-quick@wg0")
+
+	// A stopped unit is started
+	f = newFakeExecutor()
+	f.on("systemctl is-active wg-quick@wg0", result{output: "inactive", err: exitError(3)}, result{output: "active"})
+	s = &Systemd{config: testConfig(BackendSystemd), exec: f}
+	if err := s.Apply(context.Background(), testWireGuardConfig()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectCalls(t, f, "systemctl is-active wg-quick@wg0", "systemctl start wg-quick@wg0", "systemctl is-active wg-quick@wg0")
+
+	// A unit that doesn't come up is an error
+	f = newFakeExecutor()
+	f.on("systemctl is-active wg-quick@wg0", result{output: "failed", err: exitError(3)})
+	s = &Systemd{config: testConfig(BackendSystemd), exec: f}
+	if err := s.Apply(context.Background(), testWireGuardConfig()); err == nil || !strings.Contains(err.Error(), "failed to start") {
+		t.Errorf("Expected a start failure, got %v", err)
+	}
+}
+
+func TestSystemdVerify(t *testing.T) {
+	f := newFakeExecutor()
+	s := &Systemd{config: testConfig(BackendSystemd), exec: f}
+	if err := s.Verify(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	f.missing["wg-quick"] = true
+	if err := s.Verify(context.Background()); err == nil || !strings.Contains(err.Error(), "'wg-quick' command not found") {
+		t.Errorf("Expected missing wg-quick, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/unifi"
+	"github.com/gumbees/cfwg-zt/src/wireguard"
+)
+
+// UniFi updates the WireGuard VPN client network through the UniFi Network controller
+// The controller stays the source of truth and provisions the interface itself, so a
+// re-provisioning never brings back old keys
+type UniFi struct {
+	config *config.Config
+	client *unifi.Client
+
+	// endpoint returns the endpoint to use, the one the manager wrote to the configuration file
+	endpoint func(cfg *cloudflare.WireGuardConfig) (string, error)
+}
+
+// Name returns the backend name
+func (u *UniFi) Name() string {
+	return BackendUniFi
+}
+
+// Target returns the VPN client network
+func (u *UniFi) Target() string {
+	return u.config.UniFi.Network
+}
+
+// Verify logs in to the controller and checks that the VPN client network exists
+func (u *UniFi) Verify(ctx context.Context) error {
+	if u.config.UniFi.Network == "" {
+		return fmt.Errorf("UniFi VPN client network not configured")
+	}
+	_, err := u.client.WireGuardNetwork(ctx, u.Target())
+	return err
+}
+
+// IsRunning reports whether the VPN client network is enabled
+func (u *UniFi) IsRunning(ctx context.Context) (bool, error) {
+	network, err := u.client.WireGuardNetwork(ctx, u.Target())
+	if err != nil {
+		return false, fmt.Errorf("error checking WireGuard VPN client network: %w", err)
+	}
+	return network.Enabled(), nil
+}
+
+// Apply updates the keys and endpoint of the VPN client network, which the controller then provisions
+// A network that already has them is left alone, so the controller doesn't provision for nothing
+func (u *UniFi) Apply(ctx context.Context, cfg *cloudflare.WireGuardConfig) error {
+	endpoint, err := u.endpoint(cfg)
+	if err != nil {
+		return err
+	}
+	host, port, err := wireguard.ParseEndpoint(endpoint, cfg.EndpointPort)
+	if err != nil {
+		return err
+	}
+
+	// A network set up from an uploaded file gets the file the manager wrote
+	configFile, err := os.ReadFile(u.config.WireGuard.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to read WireGuard configuration: %w", err)
+	}
+
+	network, err := u.client.WireGuardNetwork(ctx, u.Target())
+	if err != nil {
+		return err
+	}
+
+	changed := network.ApplyWireGuard(unifi.WireGuardSettings{
+		PrivateKey:    cfg.PrivateKey,
+		PeerPublicKey: cfg.PeerPublicKey,
+		PresharedKey:  cfg.PeerPresharedKey,
+		EndpointHost:  host,
+		EndpointPort:  port,
+		ConfigFile:    configFile,
+	})
+	if changed {
+		logger.InfoContext(ctx, "Updating UniFi VPN client network", "network", u.Target(), "endpoint", endpoint)
+		if err := u.client.UpdateNetwork(ctx, network); err != nil {
+			return err
+		}
+	} else {
+		logger.InfoContext(ctx, "UniFi VPN client network is up to date", "network", u.Target())
+	}
+
+	if !network.Enabled() {
+		return fmt.Errorf("WireGuard VPN client network %s is disabled", u.Target())
+	}
+	return nil
+}
+
+// CanRollBack reports false, as the configuration lives in the controller rather than the configuration file
+func (u *UniFi) CanRollBack() bool {
+	return false
+}
+
+// Restart disables and re-enables the VPN client network, which has the controller provision it again
+func (u *UniFi) Restart(ctx context.Context) error {
+	logger.InfoContext(ctx, "Restarting UniFi VPN client network", "network", u.Target())
+	for _, enabled := range []bool{false, true} {
+		network, err := u.client.WireGuardNetwork(ctx, u.Target())
+		if err != nil {
+			return err
+		}
+		network["enabled"] = enabled
+		if err := u.client.UpdateNetwork(ctx, network); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package platform
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/unifi"
+)
+
+// newTestUniFi creates a UniFi backend against a fake controller with one WireGuard VPN client network
+// It returns the backend and the network as the controller last stored it
+func newTestUniFi(t *testing.T) (*UniFi, *unifi.Network) {
+	stored := unifi.Network{
+		"_id":                   "wg1",
+		"name":                  "Cloudflare",
+		"purpose":               "vpn-client",
+		"vpn_type":              "wireguard-client",
+		"enabled":               true,
+		"wireguard_client_mode": "file",
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/auth/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "TOKEN", Value: "session", Path: "/"})
+	})
+	mux.HandleFunc("/proxy/network/api/s/default/rest/networkconf", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"meta": map[string]string{"rc": "ok"}, "data": []unifi.Network{stored}})
+	})
+	mux.HandleFunc("/proxy/network/api/s/default/rest/networkconf/wg1", func(w http.ResponseWriter, r *http.Request) {
+		stored = unifi.Network{}
+		json.NewDecoder(r.Body).Decode(&stored)
+		w.Write([]byte(`{"meta":{"rc":"ok"},"data":[]}`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	cfg := testConfig(BackendUniFi)
+	cfg.WireGuard.ConfigPath = filepath.Join(t.TempDir(), "wg0.conf")
+	os.WriteFile(cfg.WireGuard.ConfigPath, []byte("[Interface]\n"), 0600)
+	cfg.UniFi.URL = server.URL
+	cfg.UniFi.Username = "cfwg-zt"
+	cfg.UniFi.Password = "password"
+	cfg.UniFi.Network = "Cloudflare"
+
+	client, err := unifi.NewClient(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	return &UniFi{
+		config: cfg,
+		client: client,
+		endpoint: func(cfg *cloudflare.WireGuardConfig) (string, error) {
+			return "162.159.192.1:2408", nil
+		},
+	}, &stored
+}
+
+func TestUniFiApply(t *testing.T) {
+	u, stored := newTestUniFi(t)
+	if err := u.Verify(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := u.Apply(context.Background(), testWireGuardConfig()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	network := *stored
+	if network["x_wireguard_private_key"] != "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=" ||
+		network["wireguard_client_peer_ip"] != "162.159.192.1" || network["wireguard_client_peer_port"] != float64(2408) {
+		t.Errorf("Expected the keys and endpoint to be updated, got %v", network)
+	}
+	if network["wireguard_client_configuration_file"] != "W0ludGVyZmFjZV0K" {
+		t.Errorf("Expected the configuration file to be uploaded, got %v", network["wireguard_client_configuration_file"])
+	}
+}
+
+func TestUniFiRestart(t *testing.T) {
+	u, stored := newTestUniFi(t)
+	if err := u.Restart(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if isRunning, err := u.IsRunning(context.Background()); !isRunning || err != nil {
+		t.Errorf("IsRunning() = %v, %v; expected the network to be enabled again", isRunning, err)
+	}
+
+	// Restarting doesn't bring back the keys the controller held before, so a failed apply isn't rolled back
+	if CanRollBack(u) {
+		t.Error("Expected the unifi backend not to support rollback")
+	}
+
+	(*stored)["enabled"] = false
+	if err := u.Apply(context.Background(), testWireGuardConfig()); err == nil {
+		t.Error("Expected error for a disabled network")
+	}
+}
@@ -0,0 +1,86 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/config"
+)
+
+// WgQuick brings the interface up and down with wg-quick directly, for systems without a service manager
+type WgQuick struct {
+	config *config.Config
+	exec   Executor
+}
+
+// Name returns the backend name
+func (w *WgQuick) Name() string {
+	return BackendWgQuick
+}
+
+// Target returns the interface
+func (w *WgQuick) Target() string {
+	return w.config.WireGuard.InterfaceName
+}
+
+// Verify checks that WireGuard is available and the configuration file is named after the interface
+func (w *WgQuick) Verify(ctx context.Context) error {
+	if err := lookPaths(w.exec, Commands(BackendWgQuick)...); err != nil {
+		return err
+	}
+	if w.config.WireGuard.InterfaceName == "" {
+		return fmt.Errorf("WireGuard interface name not configured")
+	}
+
+	// wg-quick names the interface after the configuration file
+	if name := strings.TrimSuffix(filepath.Base(w.config.WireGuard.ConfigPath), ".conf"); name != w.config.WireGuard.InterfaceName {
+		return fmt.Errorf("WireGuard configuration %s would bring up interface %s instead of %s",
+			w.config.WireGuard.ConfigPath, name, w.config.WireGuard.InterfaceName)
+	}
+	return nil
+}
+
+// IsRunning checks whether the interface exists
+func (w *WgQuick) IsRunning(ctx context.Context) (bool, error) {
+	output, err := w.exec.Run(ctx, "wg", "show", w.Target())
+	if err != nil {
+		if strings.Contains(string(output), "No such device") {
+			return false, nil
+		}
+		return false, fmt.Errorf("error checking WireGuard interface: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return true, nil
+}
+
+// Apply brings the interface down if it is up, and up with the new configuration
+func (w *WgQuick) Apply(ctx context.Context, cfg *cloudflare.WireGuardConfig) error {
+	if err := w.Restart(ctx); err != nil {
+		return err
+	}
+	return verifyRunning(ctx, w)
+}
+
+// Restart brings the interface down if it is up, and up again
+func (w *WgQuick) Restart(ctx context.Context) error {
+	isRunning, err := w.IsRunning(ctx)
+	if err != nil {
+		return err
+	}
+
+	configPath := w.config.WireGuard.ConfigPath
+	if isRunning {
+		logger.InfoContext(ctx, "Bringing WireGuard interface down", "interface", w.Target())
+		if _, err := run(ctx, w.exec, "wg-quick", "down", configPath); err != nil {
+			return fmt.Errorf("failed to bring WireGuard interface down: %w", err)
+		}
+	}
+
+	logger.InfoContext(ctx, "Bringing WireGuard interface up", "interface", w.Target())
+	if _, err := run(ctx, w.exec, "wg-quick", "up", configPath); err != nil {
+		return fmt.Errorf("failed to bring WireGuard interface up: %w", err)
+	}
+	return nil
+}
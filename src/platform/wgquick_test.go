@@ -0,0 +1,54 @@
+package platform
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestWgQuickApply(t *testing.T) {
+	// A running interface is brought down first
+	f := newFakeExecutor()
+	w := &WgQuick{config: testConfig(BackendWgQuick), exec: f}
+	if err := w.Apply(context.Background(), testWireGuardConfig()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectCalls(t, f,
+		"wg show wg0",
+		"wg-quick down /etc/wireguard/wg0.conf",
+		"wg-quick up /etc/wireguard/wg0.conf",
+		"wg show wg0")
+
+	// A missing interface is only brought up
+	f = newFakeExecutor()
+	f.on("wg show wg0", result{output: "Unable to access interface: No such device", err: exitError(1)}, result{output: "interface: wg0"})
+	w = &WgQuick{config: testConfig(BackendWgQuick), exec: f}
+	if err := w.Apply(context.Background(), testWireGuardConfig()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectCalls(t, f, "wg show wg0", "wg-quick up /etc/wireguard/wg0.conf", "wg show wg0")
+
+	// A failing wg-quick up is reported with its output
+	f = newFakeExecutor()
+	f.on("wg show wg0", result{output: "Unable to access interface: No such device", err: exitError(1)})
+	f.on("wg-quick up /etc/wireguard/wg0.conf", result{output: "RTNETLINK answers: Operation not permitted", err: exitError(1)})
+	w = &WgQuick{config: testConfig(BackendWgQuick), exec: f}
+	err := w.Apply(context.Background(), testWireGuardConfig())
+	if err == nil || !strings.Contains(err.Error(), "Operation not permitted") {
+		t.Errorf("Expected wg-quick output in the error, got %v", err)
+	}
+}
+
+func TestWgQuickVerify(t *testing.T) {
+	cfg := testConfig(BackendWgQuick)
+	w := &WgQuick{config: cfg, exec: newFakeExecutor()}
+	if err := w.Verify(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// wg-quick would name the interface after the file
+	cfg.WireGuard.ConfigPath = "/etc/wireguard/cloudflare.conf"
+	if err := w.Verify(context.Background()); err == nil || !strings.Contains(err.Error(), "interface cloudflare instead of wg0") {
+		t.Errorf("Expected an interface name mismatch, got %v", err)
+	}
+}
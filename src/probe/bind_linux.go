@@ -0,0 +1,20 @@
+package probe
+
+import (
+	"syscall"
+)
+
+// bindToInterface returns a dialer control function that pins sockets to iface with SO_BINDTODEVICE
+// This bypasses the routing table, so the probe only succeeds if the interface itself carries the traffic
+func bindToInterface(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
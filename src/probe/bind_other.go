@@ -0,0 +1,15 @@
+//go:build !linux
+
+package probe
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindToInterface returns a dialer control function that always fails, as SO_BINDTODEVICE is Linux-only
+func bindToInterface(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return fmt.Errorf("probing through interface %s is only supported on Linux", iface)
+	}
+}
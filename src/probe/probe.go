@@ -0,0 +1,116 @@
+package probe
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gumbees/cfwg-zt/src/logging"
+)
+
+var logger = logging.Component("probe")
+
+// Verification retries give a freshly restarted tunnel time to complete its first handshake
+const (
+	verifyAttempts   = 3
+	verifyRetryDelay = 5 * time.Second
+	maxBodySize      = 64 * 1024
+)
+
+// Prober checks connectivity by sending HTTP requests through a specific network interface
+type Prober struct {
+	httpClient *http.Client
+	iface      string
+	url        string
+	expect     string
+}
+
+// New creates a prober that requests url through iface and, if expect is set, requires it in the response body
+func New(iface, url, expect string, timeout time.Duration) *Prober {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: bindToInterface(iface),
+	}
+
+	return &Prober{
+		httpClient: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				DialContext:       dialer.DialContext,
+				DisableKeepAlives: true,
+			},
+		},
+		iface:  iface,
+		url:    url,
+		expect: expect,
+	}
+}
+
+// Probe sends a single request through the interface and checks the response
+func (p *Prober) Probe() error {
+	req, err := http.NewRequest("GET", p.url, nil)
+	if err != nil {
+		return fmt.Errorf("error creating probe request: %w", err)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("probe request through %s failed: %w", p.iface, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("probe request through %s returned status: %s", p.iface, resp.Status)
+	}
+
+	if p.expect == "" {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return fmt.Errorf("error reading probe response: %w", err)
+	}
+
+	if !strings.Contains(string(body), p.expect) {
+		return fmt.Errorf("probe response through %s does not contain %q", p.iface, p.expect)
+	}
+
+	return nil
+}
+
+// Verify probes up to a few times, waiting between attempts, and returns the last error if all fail
+func (p *Prober) Verify() error {
+	var err error
+	for attempt := 1; attempt <= verifyAttempts; attempt++ {
+		if err = p.Probe(); err == nil {
+			return nil
+		}
+		if attempt < verifyAttempts {
+			time.Sleep(verifyRetryDelay)
+		}
+	}
+	return err
+}
+
+// Run probes every interval until stop is closed and calls onFailure whenever a probe fails
+func (p *Prober) Run(stop <-chan struct{}, interval time.Duration, onFailure func(err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := p.Probe(); err != nil {
+			logger.Warn("Connectivity probe failed", "error", err)
+			onFailure(err)
+		}
+	}
+}
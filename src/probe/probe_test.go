@@ -0,0 +1,94 @@
+package probe
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// loopbackInterface returns the loopback interface name, skipping the test where interface binding is unsupported
+func loopbackInterface(t *testing.T) string {
+	if runtime.GOOS != "linux" {
+		t.Skip("interface binding is only supported on Linux")
+	}
+	return "lo"
+}
+
+func newTraceServer(status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestProbeSuccess(t *testing.T) {
+	iface := loopbackInterface(t)
+	server := newTraceServer(http.StatusOK, "fl=123\nwarp=on\ngateway=on\n")
+	defer server.Close()
+
+	prober := New(iface, server.URL, "warp=on", 5*time.Second)
+	if err := prober.Probe(); err != nil {
+		t.Fatalf("Expected probe to succeed, got: %v", err)
+	}
+}
+
+func TestProbeUnexpectedBody(t *testing.T) {
+	iface := loopbackInterface(t)
+	server := newTraceServer(http.StatusOK, "fl=123\nwarp=off\n")
+	defer server.Close()
+
+	prober := New(iface, server.URL, "warp=on", 5*time.Second)
+	if err := prober.Probe(); err == nil {
+		t.Fatal("Expected probe to fail when the response lacks the expected content")
+	}
+}
+
+func TestProbeErrorStatus(t *testing.T) {
+	iface := loopbackInterface(t)
+	server := newTraceServer(http.StatusForbidden, "blocked by policy")
+	defer server.Close()
+
+	prober := New(iface, server.URL, "", 5*time.Second)
+	if err := prober.Probe(); err == nil {
+		t.Fatal("Expected probe to fail on a non-2xx status")
+	}
+}
+
+func TestProbeWrongInterface(t *testing.T) {
+	loopbackInterface(t)
+	server := newTraceServer(http.StatusOK, "warp=on")
+	defer server.Close()
+
+	// A socket pinned to a missing interface must not fall back to the default route
+	prober := New("cfwgtest0", server.URL, "", 5*time.Second)
+	if err := prober.Probe(); err == nil {
+		t.Fatal("Expected probe through a missing interface to fail")
+	}
+}
+
+func TestRunReportsFailures(t *testing.T) {
+	iface := loopbackInterface(t)
+	server := newTraceServer(http.StatusServiceUnavailable, "")
+	defer server.Close()
+
+	prober := New(iface, server.URL, "", 5*time.Second)
+	stop := make(chan struct{})
+	failures := make(chan error, 1)
+
+	go prober.Run(stop, 10*time.Millisecond, func(err error) {
+		select {
+		case failures <- err:
+		default:
+		}
+	})
+	defer close(stop)
+
+	select {
+	case <-failures:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to report a probe failure")
+	}
+}
@@ -0,0 +1,190 @@
+package redact
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Placeholder replaces every redacted value
+const Placeholder = "[REDACTED]"
+
+// minSecretLength is the shortest registered secret that is scrubbed literally
+// Shorter values would match too much unrelated text to be useful
+const minSecretLength = 8
+
+// secretKeys matches the names of fields that hold secrets, in any of the spellings used by
+// WireGuard configs, the Cloudflare API, query strings and log attributes
+const secretKeys = `(?:privatekey|presharedkey|[a-z_]*private_key|[a-z_]*preshared_key|client_secret|secret|[a-z_]*token)`
+
+// patterns scrub secrets that can be recognized by their surroundings
+var patterns = []struct {
+	re          *regexp.Regexp
+	replacement string
+}{
+	// WireGuard and YAML style lines, also as diff lines: "PrivateKey = ..." or "-client_secret: ..."
+	{regexp.MustCompile(`(?im)^([-+]?\s*` + secretKeys + `\s*[=:]\s*)[^\s#]+`), "${1}" + Placeholder},
+	// JSON fields: "client_private_key": "..."
+	{regexp.MustCompile(`(?i)("` + secretKeys + `"\s*:\s*")(?:[^"\\]|\\.)*"`), "${1}" + Placeholder + `"`},
+	// Query parameters and log attributes: device_token=... or private_key="..."
+	{regexp.MustCompile(`(?i)\b(` + secretKeys + `=)(?:"(?:[^"\\]|\\.)*"|[^\s&"]+)`), "${1}" + Placeholder},
+	// Authorization headers: Bearer ...
+	{regexp.MustCompile(`(?i)(bearer\s+)[a-z0-9\-._~+/]+=*`), "${1}" + Placeholder},
+}
+
+// maxSecrets is how many values registered with Secret are kept; older ones are left to the patterns
+// Values registered with Replace don't count, as each role only ever holds one
+const maxSecrets = 64
+
+var (
+	mu sync.RWMutex
+	// roles holds the current value of each secret registered with Replace
+	roles = map[string]string{}
+	// secrets holds the values registered with Secret, oldest first
+	secrets []string
+	// ordered holds every registered value, longest first
+	ordered []string
+)
+
+// Secret registers a value that must never appear in logs, errors or diagnostic output
+// Registered values are scrubbed wherever they appear, regardless of their surroundings
+// Only the latest values are kept, so secrets that are rotated should be registered with Replace
+func Secret(value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < minSecretLength {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if slices.Contains(ordered, value) {
+		return
+	}
+	secrets = append(secrets, value)
+	if len(secrets) > maxSecrets {
+		secrets = slices.Delete(secrets, 0, len(secrets)-maxSecrets)
+	}
+	reorder()
+}
+
+// Replace registers value as the secret for role, such as the device token, retiring the value it replaces
+// The registry then stays the same size however often the secret is rotated
+func Replace(role, value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < minSecretLength {
+		value = ""
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if roles[role] == value {
+		return
+	}
+	if value == "" {
+		delete(roles, role)
+	} else {
+		roles[role] = value
+	}
+	reorder()
+}
+
+// reorder rebuilds the list of registered values; the caller holds mu
+func reorder() {
+	ordered = ordered[:0]
+	for _, value := range roles {
+		ordered = append(ordered, value)
+	}
+	ordered = append(ordered, secrets...)
+
+	// Replace longer secrets first so a secret containing another is fully scrubbed
+	sort.Slice(ordered, func(i, j int) bool {
+		if len(ordered[i]) != len(ordered[j]) {
+			return len(ordered[i]) > len(ordered[j])
+		}
+		return ordered[i] < ordered[j]
+	})
+	ordered = slices.Compact(ordered)
+}
+
+// String returns s with all known and recognizable secrets replaced by the placeholder
+func String(s string) string {
+	mu.RLock()
+	for _, secret := range ordered {
+		s = strings.ReplaceAll(s, secret, Placeholder)
+	}
+	mu.RUnlock()
+
+	for _, pattern := range patterns {
+		s = pattern.re.ReplaceAllString(s, pattern.replacement)
+	}
+	return s
+}
+
+// Error returns an error whose message is redacted
+// The original error stays available to errors.Is and errors.As
+func Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &redactedError{err: err}
+}
+
+type redactedError struct {
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return String(e.err.Error())
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// Attr redacts the value of a log attribute before it is encoded
+// It is meant to be used as slog.HandlerOptions.ReplaceAttr, so secrets are caught before quoting or escaping
+func Attr(groups []string, a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(String(a.Value.String()))
+	case slog.KindAny:
+		value := a.Value.Any()
+		var text string
+		if err, ok := value.(error); ok {
+			text = err.Error()
+		} else {
+			text = fmt.Sprint(value)
+		}
+		if redacted := String(text); redacted != text {
+			a.Value = slog.StringValue(redacted)
+		}
+	}
+	return a
+}
+
+// Writer redacts everything written through it before passing it on
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter returns a writer that redacts secrets before writing to w
+// Each write is redacted on its own, so callers should write whole lines or records at a time
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write redacts p and writes it to the underlying writer
+// It reports the length of p so callers aren't confused by redacted output of a different length
+func (w *Writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,427 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/logging"
+)
+
+var logger = logging.Component("routing")
+
+// killSwitchMetric is the metric of the unreachable route that takes over when the interface route is gone
+const killSwitchMetric = 4278198272
+
+// Reserved routing tables and the highest priority left to other rules
+const (
+	tableLocal   = 255
+	tableMain    = 254
+	tableDefault = 253
+	maxPriority  = 32765
+)
+
+// maxNameLength is the longest interface name Linux allows
+const maxNameLength = 15
+
+// Address family arguments of ip
+const (
+	familyIPv4 = "-4"
+	familyIPv6 = "-6"
+)
+
+// Route types; a unicast route has none
+const (
+	routeUnicast     = ""
+	routeUnreachable = "unreachable"
+)
+
+// Runner runs ip commands; tests replace it with a fake
+type Runner interface {
+	// Run runs ip with the arguments and returns its combined output
+	Run(ctx context.Context, args ...string) ([]byte, error)
+}
+
+// ipRunner runs the ip command of the system
+type ipRunner struct{}
+
+func (ipRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, "ip", args...).CombinedOutput()
+}
+
+// Command is an ip command, without the ip itself
+type Command []string
+
+// String formats the command as it is run
+func (c Command) String() string {
+	return "ip " + strings.Join(c, " ")
+}
+
+// rule is a routing policy rule that looks up the table; empty selectors match everything
+type rule struct {
+	priority int
+	from     string
+	to       string
+	iif      string
+	fwmark   string
+}
+
+// selector returns the arguments that select the traffic of the rule
+func (r rule) selector() []string {
+	var args []string
+	if r.from != "" {
+		args = append(args, "from", r.from)
+	}
+	if r.to != "" {
+		args = append(args, "to", r.to)
+	}
+	if r.iif != "" {
+		args = append(args, "iif", r.iif)
+	}
+	if r.fwmark != "" {
+		args = append(args, "fwmark", r.fwmark)
+	}
+	return args
+}
+
+// route is a default route of the table
+type route struct {
+	kind   string
+	dev    string
+	metric string
+}
+
+// Manager keeps the rules and routes that send the configured traffic through the WireGuard interface
+// Everything it manages is identified by the table, so removing it never touches other rules
+type Manager struct {
+	iface      string
+	table      string
+	priority   int
+	killSwitch bool
+	rules      map[string][]rule
+	families   []string
+	ip         Runner
+}
+
+// New creates a manager for the routing configuration
+func New(cfg *config.Config) (*Manager, error) {
+	return newManager(cfg, ipRunner{})
+}
+
+// newManager validates the routing configuration and creates a manager that runs ip through the runner
+func newManager(cfg *config.Config, runner Runner) (*Manager, error) {
+	settings := cfg.Routing
+	if settings.Table <= 0 || settings.Table == tableLocal || settings.Table == tableMain || settings.Table == tableDefault {
+		return nil, fmt.Errorf("invalid routing table %d: use a table other than local, main and default", settings.Table)
+	}
+	if settings.Priority <= 0 || settings.Priority > maxPriority {
+		return nil, fmt.Errorf("invalid routing priority %d: must be between 1 and %d", settings.Priority, maxPriority)
+	}
+
+	m := &Manager{
+		iface:      cfg.WireGuard.InterfaceName,
+		table:      strconv.Itoa(settings.Table),
+		priority:   settings.Priority,
+		killSwitch: settings.KillSwitch,
+		rules:      make(map[string][]rule),
+		ip:         runner,
+	}
+
+	// Interface and mark rules apply to every address family in use, so they are collected first
+	var anyFamily []rule
+	for _, source := range settings.Sources {
+		source = strings.TrimSpace(source)
+		if prefix, ok := parsePrefix(source); ok {
+			m.addRule(prefix, rule{priority: m.priority, from: prefix.String()})
+			continue
+		}
+		if source == "" || len(source) > maxNameLength || strings.ContainsAny(source, " /") {
+			return nil, fmt.Errorf("invalid routing source %q: expected a subnet or an interface", source)
+		}
+		anyFamily = append(anyFamily, rule{priority: m.priority, iif: source})
+	}
+
+	for _, destination := range settings.Destinations {
+		prefix, ok := parsePrefix(strings.TrimSpace(destination))
+		if !ok {
+			return nil, fmt.Errorf("invalid routing destination %q: expected a subnet", destination)
+		}
+		// The tunnel's own packets to its endpoint would be routed into the tunnel
+		if prefix.Bits() == 0 {
+			return nil, fmt.Errorf("invalid routing destination %q: route all traffic of a subnet through sources instead", destination)
+		}
+		m.addRule(prefix, rule{priority: m.priority, to: prefix.String()})
+	}
+
+	if settings.FwMark != "" {
+		mark, err := strconv.ParseUint(settings.FwMark, 0, 32)
+		if err != nil || mark == 0 {
+			return nil, fmt.Errorf("invalid routing fwmark %q", settings.FwMark)
+		}
+		anyFamily = append(anyFamily, rule{priority: m.priority, fwmark: fmt.Sprintf("0x%x", mark)})
+	}
+
+	if len(anyFamily) > 0 && len(m.rules[familyIPv4]) == 0 {
+		m.rules[familyIPv4] = nil
+	}
+	for _, family := range []string{familyIPv4, familyIPv6} {
+		if _, ok := m.rules[family]; ok {
+			m.rules[family] = append(m.rules[family], anyFamily...)
+			m.families = append(m.families, family)
+		}
+	}
+	return m, nil
+}
+
+// addRule adds a rule for the address family of the prefix
+func (m *Manager) addRule(prefix netip.Prefix, r rule) {
+	family := familyIPv4
+	if prefix.Addr().Is6() {
+		family = familyIPv6
+	}
+	m.rules[family] = append(m.rules[family], r)
+}
+
+// Plan returns the ip commands that bring the rules and routes in line with the configuration
+// Routes are added before the rules that look them up, and stale entries are deleted last
+func (m *Manager) Plan(ctx context.Context) ([]Command, error) {
+	interfaceUp := m.interfaceUp(ctx)
+	if !interfaceUp {
+		logger.DebugContext(ctx, "WireGuard interface is down, leaving out its route", "interface", m.iface)
+	}
+
+	var adds, deletes []Command
+	for _, family := range m.families {
+		routes, err := m.routes(ctx, family)
+		if err != nil {
+			return nil, err
+		}
+
+		wanted := []route{}
+		if interfaceUp {
+			wanted = append(wanted, route{dev: m.iface})
+		}
+		if m.killSwitch {
+			wanted = append(wanted, route{kind: routeUnreachable, metric: strconv.Itoa(killSwitchMetric)})
+		}
+		for _, r := range wanted {
+			if !slices.Contains(routes, r) {
+				adds = append(adds, m.routeCommand(family, "replace", r))
+			}
+		}
+		for _, r := range routes {
+			// The interface route disappears with the interface, so it is only stale when it names another one
+			if !slices.Contains(wanted, r) && !(r == route{dev: m.iface}) {
+				deletes = append(deletes, m.routeCommand(family, "del", r))
+			}
+		}
+
+		rules, err := m.currentRules(ctx, family)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range m.rules[family] {
+			if !slices.Contains(rules, r) {
+				adds = append(adds, m.ruleCommand(family, "add", r))
+			}
+		}
+		for _, r := range rules {
+			if !slices.Contains(m.rules[family], r) {
+				deletes = append(deletes, m.ruleCommand(family, "del", r))
+			}
+		}
+	}
+	return append(adds, deletes...), nil
+}
+
+// Apply runs the commands of the plan and returns them; nothing runs when everything is in place
+func (m *Manager) Apply(ctx context.Context) ([]Command, error) {
+	commands, err := m.Plan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return commands, m.run(ctx, commands)
+}
+
+// Remove deletes the rules that look up the table and the routes in it
+// Both address families are cleaned up, as the configuration may have changed since they were added
+func (m *Manager) Remove(ctx context.Context) ([]Command, error) {
+	var commands []Command
+	for _, family := range []string{familyIPv4, familyIPv6} {
+		rules, err := m.currentRules(ctx, family)
+		if err != nil {
+			// Systems without IPv6 can't list its rules
+			if family == familyIPv6 && !slices.Contains(m.families, family) {
+				continue
+			}
+			return nil, err
+		}
+		for _, r := range rules {
+			commands = append(commands, m.ruleCommand(family, "del", r))
+		}
+
+		routes, err := m.routes(ctx, family)
+		if err != nil {
+			return nil, err
+		}
+		if len(routes) > 0 {
+			commands = append(commands, Command{family, "route", "flush", "table", m.table})
+		}
+	}
+	return commands, m.run(ctx, commands)
+}
+
+// run runs the commands in order, stopping at the first that fails
+func (m *Manager) run(ctx context.Context, commands []Command) error {
+	for _, command := range commands {
+		logger.InfoContext(ctx, "Updating routing", "command", command.String())
+		if output, err := m.ip.Run(ctx, command...); err != nil {
+			return fmt.Errorf("%s: %w: %s", command, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// ruleCommand returns the command that adds or deletes the rule
+func (m *Manager) ruleCommand(family, action string, r rule) Command {
+	command := Command{family, "rule", action, "priority", strconv.Itoa(r.priority)}
+	command = append(command, r.selector()...)
+	return append(command, "lookup", m.table)
+}
+
+// routeCommand returns the command that replaces or deletes the default route
+func (m *Manager) routeCommand(family, action string, r route) Command {
+	command := Command{family, "route", action}
+	if r.kind != routeUnicast {
+		command = append(command, r.kind)
+	}
+	command = append(command, "default")
+	if r.dev != "" {
+		command = append(command, "dev", r.dev)
+	}
+	if r.metric != "" {
+		command = append(command, "metric", r.metric)
+	}
+	return append(command, "table", m.table)
+}
+
+// interfaceUp reports whether the WireGuard interface exists
+func (m *Manager) interfaceUp(ctx context.Context) bool {
+	_, err := m.ip.Run(ctx, "link", "show", "dev", m.iface)
+	return err == nil
+}
+
+// currentRules returns the rules of the address family that look up the table
+func (m *Manager) currentRules(ctx context.Context, family string) ([]rule, error) {
+	output, err := m.ip.Run(ctx, family, "rule", "show")
+	if err != nil {
+		return nil, fmt.Errorf("ip %s rule show: %w: %s", family, err, strings.TrimSpace(string(output)))
+	}
+	return parseRules(string(output), m.table), nil
+}
+
+// routes returns the default routes of the address family in the table
+func (m *Manager) routes(ctx context.Context, family string) ([]route, error) {
+	output, err := m.ip.Run(ctx, family, "route", "show", "table", m.table)
+	if err != nil {
+		// Older kernels report a table without routes as missing
+		if strings.Contains(string(output), "does not exist") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("ip %s route show table %s: %w: %s", family, m.table, err, strings.TrimSpace(string(output)))
+	}
+	return parseRoutes(string(output)), nil
+}
+
+// parseRules parses the output of 'ip rule show', keeping the rules that look up the table
+// Lines look like "5210:	from 192.168.20.0/24 lookup 51820"
+func parseRules(output, table string) []rule {
+	var rules []rule
+	for _, line := range strings.Split(output, "\n") {
+		priority, selector, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		fields := strings.Fields(selector)
+
+		r := rule{}
+		lookup := ""
+		var err error
+		if r.priority, err = strconv.Atoi(strings.TrimSpace(priority)); err != nil {
+			continue
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			value := fields[i+1]
+			switch fields[i] {
+			case "from":
+				r.from = normalizePrefix(value)
+			case "to":
+				r.to = normalizePrefix(value)
+			case "iif":
+				r.iif = value
+			case "fwmark":
+				r.fwmark = value
+			case "lookup", "table":
+				lookup = value
+			}
+		}
+		if lookup == table {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// parseRoutes parses the output of 'ip route show table', keeping the default routes
+// Lines look like "default dev wg0 scope link" and "unreachable default metric 4278198272"
+func parseRoutes(output string) []route {
+	var routes []route
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		r := route{}
+		if len(fields) > 0 && fields[0] != "default" {
+			r.kind = fields[0]
+			fields = fields[1:]
+		}
+		if len(fields) == 0 || fields[0] != "default" {
+			continue
+		}
+		for i := 1; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "dev":
+				r.dev = fields[i+1]
+			case "metric":
+				r.metric = fields[i+1]
+			}
+		}
+		routes = append(routes, r)
+	}
+	return routes
+}
+
+// parsePrefix parses a subnet or a single address
+func parsePrefix(value string) (netip.Prefix, bool) {
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		return prefix.Masked(), true
+	}
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	return netip.Prefix{}, false
+}
+
+// normalizePrefix formats a rule selector the way the configuration is parsed; ip leaves the length off single addresses
+func normalizePrefix(value string) string {
+	if value == "all" {
+		return ""
+	}
+	if prefix, ok := parsePrefix(value); ok {
+		return prefix.String()
+	}
+	return value
+}
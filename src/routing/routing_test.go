@@ -0,0 +1,200 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/gumbees/cfwg-zt/src/config"
+)
+
+// fakeIP answers ip commands from canned outputs, recording the commands that change something
+// Commands without an output succeed without one, except for 'link show' which fails when down is set
+type fakeIP struct {
+	outputs map[string]string
+	down    bool
+	changes []string
+}
+
+func newFakeIP() *fakeIP {
+	return &fakeIP{outputs: make(map[string]string)}
+}
+
+func (f *fakeIP) Run(ctx context.Context, args ...string) ([]byte, error) {
+	command := strings.Join(args, " ")
+	switch {
+	case strings.HasPrefix(command, "link show"):
+		if f.down {
+			return []byte(`Device "wg0" does not exist.`), errors.New("exit status 1")
+		}
+		return nil, nil
+	case strings.Contains(command, " show"):
+		return []byte(f.outputs[command]), nil
+	}
+	f.changes = append(f.changes, command)
+	return nil, nil
+}
+
+// mainRules is the rule list of a system without routing policy of its own
+const mainRules = "0:\tfrom all lookup local\n32766:\tfrom all lookup main\n32767:\tfrom all lookup default\n"
+
+func testConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.WireGuard.InterfaceName = "wg0"
+	cfg.Routing.Enabled = true
+	cfg.Routing.Table = 51820
+	cfg.Routing.Priority = 5210
+	cfg.Routing.Sources = []string{"192.168.20.0/24", "br30"}
+	cfg.Routing.Destinations = []string{"10.0.0.0/8"}
+	cfg.Routing.FwMark = "51820"
+	cfg.Routing.KillSwitch = true
+	return cfg
+}
+
+func newTestManager(t *testing.T, cfg *config.Config) (*Manager, *fakeIP) {
+	fake := newFakeIP()
+	m, err := newManager(cfg, fake)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return m, fake
+}
+
+func expectCommands(t *testing.T, got []Command, want ...string) {
+	t.Helper()
+	var commands []string
+	for _, command := range got {
+		commands = append(commands, strings.TrimPrefix(command.String(), "ip "))
+	}
+	if strings.Join(commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected commands:\n%s\nwant:\n%s", strings.Join(commands, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestApplyFromScratch(t *testing.T) {
+	m, fake := newTestManager(t, testConfig())
+	fake.outputs["-4 rule show"] = mainRules
+
+	commands, err := m.Apply(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectCommands(t, commands,
+		"-4 route replace default dev wg0 table 51820",
+		"-4 route replace unreachable default metric 4278198272 table 51820",
+		"-4 rule add priority 5210 from 192.168.20.0/24 lookup 51820",
+		"-4 rule add priority 5210 to 10.0.0.0/8 lookup 51820",
+		"-4 rule add priority 5210 iif br30 lookup 51820",
+		"-4 rule add priority 5210 fwmark 0xca6c lookup 51820",
+	)
+	if len(fake.changes) != len(commands) {
+		t.Errorf("Expected every command to run, ran %v", fake.changes)
+	}
+}
+
+func TestApplyIsIdempotent(t *testing.T) {
+	m, fake := newTestManager(t, testConfig())
+	fake.outputs["-4 rule show"] = "0:\tfrom all lookup local\n" +
+		"5210:\tfrom 192.168.20.0/24 lookup 51820\n" +
+		"5210:\tfrom all to 10.0.0.0/8 lookup 51820\n" +
+		"5210:\tfrom all iif br30 lookup 51820\n" +
+		"5210:\tfrom all fwmark 0xca6c lookup 51820\n" +
+		"32766:\tfrom all lookup main\n"
+	fake.outputs["-4 route show table 51820"] = "default dev wg0 scope link\nunreachable default metric 4278198272\n"
+
+	commands, err := m.Apply(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(commands) != 0 || len(fake.changes) != 0 {
+		t.Errorf("Expected nothing to change, got %v", fake.changes)
+	}
+}
+
+func TestApplyRemovesStaleEntries(t *testing.T) {
+	cfg := testConfig()
+	cfg.Routing.Sources = []string{"192.168.20.5"}
+	cfg.Routing.Destinations = nil
+	cfg.Routing.FwMark = ""
+	cfg.Routing.KillSwitch = false
+	m, fake := newTestManager(t, cfg)
+	fake.outputs["-4 rule show"] = "0:\tfrom all lookup local\n" +
+		"5210:\tfrom 192.168.20.5 lookup 51820\n" +
+		"5210:\tfrom 192.168.30.0/24 lookup 51820\n" +
+		"5300:\tfrom 192.168.40.0/24 lookup 100\n"
+	fake.outputs["-4 route show table 51820"] = "default dev wg0 scope link\nunreachable default metric 4278198272\n"
+
+	commands, err := m.Apply(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Rules of other tables are left alone
+	expectCommands(t, commands,
+		"-4 route del unreachable default metric 4278198272 table 51820",
+		"-4 rule del priority 5210 from 192.168.30.0/24 lookup 51820",
+	)
+}
+
+func TestApplyWithInterfaceDown(t *testing.T) {
+	cfg := testConfig()
+	cfg.Routing.Sources = []string{"192.168.20.0/24", "2001:db8:20::/64"}
+	cfg.Routing.Destinations = nil
+	cfg.Routing.FwMark = ""
+	m, fake := newTestManager(t, cfg)
+	fake.down = true
+
+	commands, err := m.Plan(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The kill switch keeps the sources from leaking until the interface is back
+	expectCommands(t, commands,
+		"-4 route replace unreachable default metric 4278198272 table 51820",
+		"-4 rule add priority 5210 from 192.168.20.0/24 lookup 51820",
+		"-6 route replace unreachable default metric 4278198272 table 51820",
+		"-6 rule add priority 5210 from 2001:db8:20::/64 lookup 51820",
+	)
+	if len(fake.changes) != 0 {
+		t.Errorf("Expected a plan not to change anything, got %v", fake.changes)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	m, fake := newTestManager(t, testConfig())
+	fake.outputs["-4 rule show"] = mainRules + "5210:\tfrom 192.168.20.0/24 lookup 51820\n"
+	fake.outputs["-4 route show table 51820"] = "unreachable default metric 4278198272\n"
+
+	commands, err := m.Remove(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectCommands(t, commands,
+		"-4 rule del priority 5210 from 192.168.20.0/24 lookup 51820",
+		"-4 route flush table 51820",
+	)
+}
+
+func TestNewManagerValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *config.Config)
+	}{
+		{"main table", func(cfg *config.Config) { cfg.Routing.Table = 254 }},
+		{"priority of main", func(cfg *config.Config) { cfg.Routing.Priority = 32766 }},
+		{"bad source", func(cfg *config.Config) { cfg.Routing.Sources = []string{"192.168.20.0/33"} }},
+		{"bad destination", func(cfg *config.Config) { cfg.Routing.Destinations = []string{"br30"} }},
+		{"default destination", func(cfg *config.Config) { cfg.Routing.Destinations = []string{"0.0.0.0/0"} }},
+		{"bad fwmark", func(cfg *config.Config) { cfg.Routing.FwMark = "mark" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			tt.change(cfg)
+			if _, err := newManager(cfg, newFakeIP()); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package sdnotify
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// startTimeout is the TimeoutStartSec of the unit, by which each wait before the service is ready extends the start
+const startTimeout = 5 * time.Minute
+
+// Notifier sends service state notifications to systemd over the NOTIFY_SOCKET datagram socket
+// A nil Notifier, or one created outside of systemd, silently does nothing
+type Notifier struct {
+	socket   string
+	watchdog time.Duration
+	// extend is how long the start timeout is extended while waiting before the service is ready
+	extend time.Duration
+	ready  atomic.Bool
+}
+
+// New creates a notifier from the NOTIFY_SOCKET, WATCHDOG_USEC and WATCHDOG_PID environment variables
+// It returns nil when the process is not supervised by systemd
+func New() *Notifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	return &Notifier{
+		socket:   socket,
+		watchdog: watchdogInterval(os.Getenv("WATCHDOG_USEC"), os.Getenv("WATCHDOG_PID"), os.Getpid()),
+		extend:   startTimeout,
+	}
+}
+
+// watchdogInterval parses the watchdog timeout systemd expects pings within
+// A zero duration means the watchdog is disabled or meant for another process
+func watchdogInterval(usec, pid string, self int) time.Duration {
+	if usec == "" {
+		return 0
+	}
+	if pid != "" && pid != strconv.Itoa(self) {
+		return 0
+	}
+
+	value, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || value <= 0 {
+		return 0
+	}
+	return time.Duration(value) * time.Microsecond
+}
+
+// Send writes a raw notification such as "READY=1" to the socket
+func (n *Notifier) Send(state string) error {
+	if n == nil {
+		return nil
+	}
+
+	// A leading @ denotes a socket in the abstract namespace
+	name := n.socket
+	if strings.HasPrefix(name, "@") {
+		name = "\x00" + name[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+	return nil
+}
+
+// Ready tells systemd the service has finished starting up
+func (n *Notifier) Ready() error {
+	if n == nil {
+		return nil
+	}
+	n.ready.Store(true)
+	return n.Send("READY=1")
+}
+
+// ExtendTimeout asks systemd to wait d longer, from now, for the service to finish starting up
+func (n *Notifier) ExtendTimeout(d time.Duration) error {
+	return n.Send(fmt.Sprintf("EXTEND_TIMEOUT_USEC=%d", d.Microseconds()))
+}
+
+// starting reports whether the service hasn't reported ready yet
+func (n *Notifier) starting() bool {
+	return n != nil && !n.ready.Load()
+}
+
+// Status updates the free-form status text shown by systemctl status
+func (n *Notifier) Status(format string, args ...interface{}) error {
+	return n.Send("STATUS=" + fmt.Sprintf(format, args...))
+}
+
+// Stopping tells systemd the service is shutting down
+func (n *Notifier) Stopping() error {
+	return n.Send("STOPPING=1")
+}
+
+// Watchdog pings the systemd watchdog if it is enabled
+func (n *Notifier) Watchdog() error {
+	if n == nil || n.watchdog == 0 {
+		return nil
+	}
+
+	return n.Send("WATCHDOG=1")
+}
+
+// WatchdogInterval returns the watchdog timeout, or zero if the watchdog is disabled
+func (n *Notifier) WatchdogInterval() time.Duration {
+	if n == nil {
+		return 0
+	}
+	return n.watchdog
+}
+
+// Wait blocks for d while keeping the watchdog fed, returning early when wake receives
+// It reports whether it was woken up before d elapsed
+// The caller stays responsible for pinging while doing actual work, so a hung loop is still detected
+// Before the service is ready, the start timeout is extended throughout the wait and once more when it ends,
+// so retries before the first success don't get the service killed and the attempt after the wait has the
+// full start timeout, as the first attempt had
+func (n *Notifier) Wait(d time.Duration, wake <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	var extendTick <-chan time.Time
+	if n.starting() {
+		ticker := time.NewTicker(n.extend / 2)
+		defer ticker.Stop()
+		extendTick = ticker.C
+		n.ExtendTimeout(n.extend)
+		defer n.ExtendTimeout(n.extend)
+	}
+
+	// Ping at half the watchdog interval, as recommended by sd_watchdog_enabled(3)
+	var tick <-chan time.Time
+	if interval := n.WatchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		tick = ticker.C
+		n.Watchdog()
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			return false
+		case <-wake:
+			return true
+		case <-tick:
+			n.Watchdog()
+		case <-extendTick:
+			n.ExtendTimeout(n.extend)
+		}
+	}
+}
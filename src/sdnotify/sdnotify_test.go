@@ -0,0 +1,203 @@
+package sdnotify
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listen creates a fake systemd notify socket
+func listen(t *testing.T) (string, *net.UnixConn) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to create notify socket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return path, conn
+}
+
+// receive reads the next notification from the fake socket
+func receive(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("No notification received: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotifications(t *testing.T) {
+	path, conn := listen(t)
+	t.Setenv("NOTIFY_SOCKET", path)
+	t.Setenv("WATCHDOG_USEC", "")
+
+	n := New()
+	if n == nil {
+		t.Fatal("Expected a notifier when NOTIFY_SOCKET is set")
+	}
+
+	n.Status("Applying %s", "configuration")
+	if got := receive(t, conn); got != "STATUS=Applying configuration" {
+		t.Errorf("Unexpected status notification %q", got)
+	}
+
+	n.Ready()
+	if got := receive(t, conn); got != "READY=1" {
+		t.Errorf("Unexpected ready notification %q", got)
+	}
+
+	n.Stopping()
+	if got := receive(t, conn); got != "STOPPING=1" {
+		t.Errorf("Unexpected stopping notification %q", got)
+	}
+
+	// The watchdog is disabled, so pings must not be sent
+	n.Watchdog()
+	n.Ready()
+	if got := receive(t, conn); got != "READY=1" {
+		t.Errorf("Expected watchdog ping to be skipped, got %q", got)
+	}
+}
+
+func TestWaitPingsWatchdog(t *testing.T) {
+	path, conn := listen(t)
+	t.Setenv("NOTIFY_SOCKET", path)
+	t.Setenv("WATCHDOG_USEC", "40000")
+	t.Setenv("WATCHDOG_PID", "")
+
+	n := New()
+	if n.WatchdogInterval() != 40*time.Millisecond {
+		t.Fatalf("Unexpected watchdog interval %v", n.WatchdogInterval())
+	}
+	// Once ready, waiting only pings the watchdog
+	n.Ready()
+	if got := receive(t, conn); got != "READY=1" {
+		t.Fatalf("Unexpected ready notification %q", got)
+	}
+
+	if woken := n.Wait(70*time.Millisecond, nil); woken {
+		t.Error("Expected wait to run to completion")
+	}
+
+	// One ping on entry plus at least two more at half the interval
+	for i := 0; i < 3; i++ {
+		if got := receive(t, conn); got != "WATCHDOG=1" {
+			t.Errorf("Expected watchdog ping, got %q", got)
+		}
+	}
+}
+
+func TestWaitExtendsStartTimeout(t *testing.T) {
+	path, conn := listen(t)
+	t.Setenv("NOTIFY_SOCKET", path)
+	t.Setenv("WATCHDOG_USEC", "")
+
+	// Scaled down: a 100ms start timeout, and retries waiting 3.5 times as long before the first success,
+	// like the 5-minute service check retries under the 5-minute TimeoutStartSec
+	n := New()
+	n.extend = 100 * time.Millisecond
+	extension := "EXTEND_TIMEOUT_USEC=" + strconv.FormatInt(n.extend.Microseconds(), 10)
+
+	type notification struct {
+		at    time.Time
+		state string
+	}
+	received := make(chan notification, 64)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			size, err := conn.Read(buf)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- notification{time.Now(), string(buf[:size])}
+		}
+	}()
+
+	// The start timeout runs from the start of the service, and each extension moves it to extend from its receipt
+	deadline := time.Now().Add(n.extend)
+	for attempt := 0; attempt < 2; attempt++ {
+		n.Wait(350*time.Millisecond, nil)
+	}
+	end := time.Now()
+	n.Ready()
+
+	for {
+		got := <-received
+		if got.state == "READY=1" {
+			break
+		}
+		if got.state != extension {
+			t.Fatalf("Unexpected notification %q", got.state)
+		}
+		if got.at.After(deadline) {
+			t.Fatalf("Start timeout overrun by %v before the extension", got.at.Sub(deadline))
+		}
+		deadline = got.at.Add(n.extend)
+	}
+
+	// The attempt after the last wait has the full start timeout
+	if deadline.Before(end.Add(n.extend / 2)) {
+		t.Errorf("Expected the start timeout to be extended when the wait ended, it expires %v after", deadline.Sub(end))
+	}
+
+	// Once ready, waiting doesn't extend the start timeout any more
+	n.Wait(120*time.Millisecond, nil)
+	n.Status("done")
+	if got := <-received; got.state != "STATUS=done" {
+		t.Errorf("Expected no extension once ready, got %q", got.state)
+	}
+}
+
+func TestWaitWakesEarly(t *testing.T) {
+	wake := make(chan struct{}, 1)
+	wake <- struct{}{}
+
+	var n *Notifier
+	start := time.Now()
+	if !n.Wait(time.Minute, wake) {
+		t.Error("Expected wait to report the wake-up")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Expected wait to return immediately")
+	}
+}
+
+func TestDisabledOutsideSystemd(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+
+	n := New()
+	if n != nil {
+		t.Fatal("Expected no notifier without NOTIFY_SOCKET")
+	}
+	if err := n.Ready(); err != nil {
+		t.Errorf("Expected nil notifier to be a no-op, got %v", err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	self := 1234
+	tests := []struct {
+		usec     string
+		pid      string
+		expected time.Duration
+	}{
+		{"", "", 0},
+		{"30000000", "", 30 * time.Second},
+		{"30000000", strconv.Itoa(self), 30 * time.Second},
+		{"30000000", "999", 0},
+		{"invalid", "", 0},
+		{"-5", "", 0},
+	}
+
+	for _, tt := range tests {
+		if got := watchdogInterval(tt.usec, tt.pid, self); got != tt.expected {
+			t.Errorf("watchdogInterval(%q, %q) = %v; expected %v", tt.usec, tt.pid, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/exitcode"
+	"github.com/gumbees/cfwg-zt/src/logging"
+	"github.com/gumbees/cfwg-zt/src/platform"
+	"github.com/gumbees/cfwg-zt/src/probe"
+	"github.com/gumbees/cfwg-zt/src/wireguard"
+)
+
+var logger = logging.Component("service")
+
+// Stage identifies the step of a reconcile pass
+type Stage string
+
+const (
+	StageAuthenticate Stage = "authenticate"
+	StageFetch        Stage = "fetch"
+	StageServiceCheck Stage = "service_check"
+	StageUpdate       Stage = "update"
+	StageApply        Stage = "apply"
+	StageVerify       Stage = "verify"
+)
+
+// ExitCode returns the process exit code for a failure at the stage
+func (s Stage) ExitCode() int {
+	switch s {
+	case StageAuthenticate:
+		return exitcode.Auth
+	case StageFetch:
+		return exitcode.Fetch
+	case StageServiceCheck:
+		return exitcode.ServiceCheck
+	case StageUpdate:
+		return exitcode.Update
+	case StageApply:
+		return exitcode.Apply
+	case StageVerify:
+		return exitcode.Verify
+	default:
+		return exitcode.Error
+	}
+}
+
+// ErrServiceNotRunning is reported at the service check stage when the WireGuard service is down
+var ErrServiceNotRunning = errors.New("WireGuard service is not running")
+
+// Error is returned when a reconcile pass fails
+type Error struct {
+	Stage Stage
+	Err   error
+	// RolledBack is set when a failed apply was undone by restoring the previous configuration
+	RolledBack bool
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the process exit code for the outcome of a reconcile pass
+func ExitCode(err error) int {
+	if err == nil {
+		return exitcode.OK
+	}
+
+	// A service that is down is told apart from one whose state couldn't be checked
+	if errors.Is(err, ErrServiceNotRunning) {
+		return exitcode.ServiceNotRunning
+	}
+	var reconcileErr *Error
+	if errors.As(err, &reconcileErr) {
+		return reconcileErr.Stage.ExitCode()
+	}
+	return exitcode.Error
+}
+
+// Options control a reconcile pass
+type Options struct {
+	// Force rewrites the configuration and restarts WireGuard even if the configuration is unchanged
+	Force bool
+	// DryRun computes the new configuration without writing, backing up or restarting anything
+	DryRun bool
+	// Progress, if set, is called with a short description of each step
+	Progress func(activity string)
+}
+
+// Result describes a successful reconcile pass
+type Result struct {
+	Config      *cloudflare.WireGuardConfig
+	DeviceToken string
+	// Changed reports whether the configuration was written and WireGuard restarted
+	Changed bool
+	// Current and Proposed hold the configuration file contents before and after a dry run
+	Current  string
+	Proposed string
+}
+
+// cloudflareClient is the part of the Cloudflare client a reconcile pass uses
+type cloudflareClient interface {
+	AuthenticateDevice(ctx context.Context) (string, error)
+	GetWireGuardConfig(ctx context.Context, deviceToken string) (*cloudflare.WireGuardConfig, error)
+	GetSplitTunnel(ctx context.Context, deviceToken string) (*cloudflare.SplitTunnel, error)
+	InvalidateToken()
+}
+
+// configManager is the part of the WireGuard manager a reconcile pass uses
+type configManager interface {
+	RenderConfig(cfg *cloudflare.WireGuardConfig) (string, string, error)
+	UpdateConfig(ctx context.Context, cfg *cloudflare.WireGuardConfig) error
+	Rollback(ctx context.Context) error
+	EndpointAddresses(ctx context.Context, cfg *cloudflare.WireGuardConfig) []string
+}
+
+// verifier checks that traffic passes through the tunnel
+type verifier interface {
+	Verify() error
+}
+
+// Reconciler brings the WireGuard configuration in line with the credentials issued by Cloudflare
+type Reconciler struct {
+	config    *config.Config
+	cfClient  cloudflareClient
+	wgManager configManager
+	platform  platform.Platform
+	// prober is nil when connectivity isn't verified
+	prober verifier
+}
+
+// NewReconciler creates a reconciler; prober may be nil to skip connectivity verification
+func NewReconciler(cfg *config.Config, cfClient *cloudflare.Client, wgManager *wireguard.Manager, p platform.Platform, prober *probe.Prober) *Reconciler {
+	r := &Reconciler{
+		config:    cfg,
+		cfClient:  cfClient,
+		wgManager: wgManager,
+		platform:  p,
+	}
+	// A nil prober must not become a non-nil interface
+	if prober != nil {
+		r.prober = prober
+	}
+	return r
+}
+
+// Fetch authenticates and returns the WireGuard configuration as the service applies it, with the split tunnel computed
+// The export command uses it too, so an exported configuration matches the one the service writes
+// Failures are returned as *Error identifying the stage that failed
+func (r *Reconciler) Fetch(ctx context.Context) (*cloudflare.WireGuardConfig, string, error) {
+	// Authenticate with Cloudflare Zero Trust
+	logger.InfoContext(ctx, "Authenticating with Cloudflare Zero Trust")
+	deviceToken, err := r.cfClient.AuthenticateDevice(ctx)
+	if err != nil {
+		return nil, "", &Error{Stage: StageAuthenticate, Err: err}
+	}
+
+	// Get WireGuard configuration from Cloudflare
+	logger.InfoContext(ctx, "Retrieving WireGuard configuration")
+	wgConfig, err := r.cfClient.GetWireGuardConfig(ctx, deviceToken)
+	if err != nil {
+		return nil, "", &Error{Stage: StageFetch, Err: err}
+	}
+	if err := r.applySplitTunnel(ctx, wgConfig, deviceToken); err != nil {
+		return nil, "", &Error{Stage: StageFetch, Err: err}
+	}
+	return wgConfig, deviceToken, nil
+}
+
+// Reconcile performs a single authenticate, fetch, update and apply pass
+// Failures are returned as *Error identifying the stage that failed
+func (r *Reconciler) Reconcile(ctx context.Context, opts Options) (*Result, error) {
+	progress := func(activity string) {
+		if opts.Progress != nil {
+			opts.Progress(activity)
+		}
+	}
+
+	progress("Authenticating with Cloudflare Zero Trust")
+	wgConfig, deviceToken, err := r.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Config: wgConfig, DeviceToken: deviceToken}
+
+	// A dry run stops once the new configuration is known
+	if opts.DryRun {
+		current, proposed, err := r.wgManager.RenderConfig(wgConfig)
+		if err != nil {
+			return nil, &Error{Stage: StageUpdate, Err: err}
+		}
+		result.Current, result.Proposed = current, proposed
+		logger.InfoContext(ctx, "Dry run, leaving the WireGuard configuration untouched")
+		return result, nil
+	}
+
+	// Check if WireGuard is running before updating config
+	isRunning, err := r.platform.IsRunning(ctx)
+	if err != nil {
+		return nil, &Error{Stage: StageServiceCheck, Err: err}
+	}
+	if !isRunning {
+		return nil, &Error{Stage: StageServiceCheck, Err: ErrServiceNotRunning}
+	}
+
+	// Leave a running tunnel alone when there is nothing to change
+	if !opts.Force {
+		current, next, err := r.wgManager.RenderConfig(wgConfig)
+		if err != nil {
+			return nil, &Error{Stage: StageUpdate, Err: err}
+		}
+		if current == next {
+			logger.InfoContext(ctx, "WireGuard configuration is up to date")
+			return result, nil
+		}
+	}
+
+	// Update WireGuard configuration - preserving UI-created settings
+	logger.InfoContext(ctx, "Updating WireGuard configuration file with fresh authentication credentials")
+	logger.DebugContext(ctx, "The interface address is taken from Cloudflare's assignment; other UI-created settings like policy-based routing are preserved")
+	progress("Applying WireGuard configuration")
+	if err := r.wgManager.UpdateConfig(ctx, wgConfig); err != nil {
+		return nil, &Error{Stage: StageUpdate, Err: err}
+	}
+
+	// Bring the interface up with the new configuration
+	logger.InfoContext(ctx, "Applying WireGuard configuration", "platform", r.platform.Name(), "target", r.platform.Target())
+	if err := r.platform.Apply(ctx, wgConfig); err != nil {
+		applyErr := &Error{Stage: StageApply, Err: err}
+
+		// Restarting the backend wouldn't bring the previous configuration back, so the file is left in line with it
+		if !platform.CanRollBack(r.platform) {
+			logger.WarnContext(ctx, "The platform backend can't roll back a failed apply", "platform", r.platform.Name())
+			return nil, applyErr
+		}
+
+		// Restore the previous configuration so the interface isn't left on a broken config
+		if rollbackErr := r.wgManager.Rollback(ctx); rollbackErr != nil {
+			logger.WarnContext(ctx, "Failed to roll back WireGuard config", "error", rollbackErr)
+		} else {
+			if restartErr := r.platform.Restart(ctx); restartErr != nil {
+				logger.WarnContext(ctx, "Failed to restart WireGuard with the previous config", "error", restartErr)
+			}
+			applyErr.RolledBack = true
+		}
+		return nil, applyErr
+	}
+	result.Changed = true
+
+	// Verify that traffic actually passes through the tunnel, as Zero Trust policy can still block it
+	if r.prober != nil {
+		logger.InfoContext(ctx, "Verifying connectivity through the tunnel")
+		progress("Verifying connectivity through the tunnel")
+		if err := r.prober.Verify(); err != nil {
+			// Force a new device registration on the next attempt
+			r.cfClient.InvalidateToken()
+			return nil, &Error{Stage: StageVerify, Err: err}
+		}
+	}
+
+	logger.InfoContext(ctx, "WireGuard configuration successfully updated and applied")
+	return result, nil
+}
+
+// applySplitTunnel replaces the AllowedIPs issued by Cloudflare with the ones computed from the split tunnel lists
+func (r *Reconciler) applySplitTunnel(ctx context.Context, wgConfig *cloudflare.WireGuardConfig, deviceToken string) error {
+	splitTunnel := r.config.SplitTunnel
+	include := slices.Clone(splitTunnel.Include)
+	exclude := slices.Clone(splitTunnel.Exclude)
+
+	switch splitTunnel.Source {
+	case "", wireguard.SplitTunnelOff:
+		return nil
+	case wireguard.SplitTunnelConfig:
+	case wireguard.SplitTunnelAccount:
+		account, err := r.cfClient.GetSplitTunnel(ctx, deviceToken)
+		if err != nil {
+			return fmt.Errorf("failed to get split tunnel settings: %w", err)
+		}
+		if len(account.Hosts) > 0 {
+			logger.WarnContext(ctx, "Ignoring split tunnel entries given as domains", "hosts", account.Hosts)
+		}
+		include = append(include, account.Include...)
+		exclude = append(exclude, account.Exclude...)
+	default:
+		return fmt.Errorf("unknown split tunnel source %q", splitTunnel.Source)
+	}
+
+	// Outside of a literal /0, wg-quick doesn't keep the tunnel's own packets out of the tunnel
+	exclude = append(exclude, r.wgManager.EndpointAddresses(ctx, wgConfig)...)
+
+	allowedIPs, err := wireguard.AllowedIPs(include, exclude)
+	if err != nil {
+		return fmt.Errorf("invalid split tunnel settings: %w", err)
+	}
+	logger.InfoContext(ctx, "Computed AllowedIPs from the split tunnel", "source", splitTunnel.Source, "allowed_ips", allowedIPs)
+	wgConfig.AllowedIPs = allowedIPs
+	return nil
+}
@@ -0,0 +1,261 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/exitcode"
+)
+
+// fakeCloudflare issues a fixed configuration and records whether the token was invalidated
+type fakeCloudflare struct {
+	authErr     error
+	invalidated bool
+}
+
+func (f *fakeCloudflare) AuthenticateDevice(ctx context.Context) (string, error) {
+	return "device-token", f.authErr
+}
+
+func (f *fakeCloudflare) GetWireGuardConfig(ctx context.Context, deviceToken string) (*cloudflare.WireGuardConfig, error) {
+	return &cloudflare.WireGuardConfig{
+		PrivateKey:    "new-private-key",
+		PeerPublicKey: "peer-public-key",
+		Endpoint:      "engage.cloudflareclient.com",
+		EndpointPort:  2408,
+		AllowedIPs:    []string{"0.0.0.0/0"},
+	}, nil
+}
+
+func (f *fakeCloudflare) GetSplitTunnel(ctx context.Context, deviceToken string) (*cloudflare.SplitTunnel, error) {
+	return &cloudflare.SplitTunnel{}, nil
+}
+
+func (f *fakeCloudflare) InvalidateToken() {
+	f.invalidated = true
+}
+
+// fakeManager renders current as the file on disk and next for any new configuration
+type fakeManager struct {
+	current, next string
+	updated       bool
+	rolledBack    bool
+}
+
+func (f *fakeManager) RenderConfig(cfg *cloudflare.WireGuardConfig) (string, string, error) {
+	return f.current, f.next, nil
+}
+
+func (f *fakeManager) UpdateConfig(ctx context.Context, cfg *cloudflare.WireGuardConfig) error {
+	f.updated = true
+	return nil
+}
+
+func (f *fakeManager) Rollback(ctx context.Context) error {
+	f.rolledBack = true
+	return nil
+}
+
+func (f *fakeManager) EndpointAddresses(ctx context.Context, cfg *cloudflare.WireGuardConfig) []string {
+	return []string{"162.159.192.1"}
+}
+
+// fakePlatform records the calls made to it
+type fakePlatform struct {
+	running    bool
+	applyErr   error
+	calls      []string
+	noRollback bool
+}
+
+func (f *fakePlatform) CanRollBack() bool { return !f.noRollback }
+
+func (f *fakePlatform) Name() string                     { return "fake" }
+func (f *fakePlatform) Target() string                   { return "wg0" }
+func (f *fakePlatform) Verify(ctx context.Context) error { return nil }
+func (f *fakePlatform) IsRunning(ctx context.Context) (bool, error) {
+	return f.running, nil
+}
+
+func (f *fakePlatform) Apply(ctx context.Context, cfg *cloudflare.WireGuardConfig) error {
+	f.calls = append(f.calls, "apply")
+	return f.applyErr
+}
+
+func (f *fakePlatform) Restart(ctx context.Context) error {
+	f.calls = append(f.calls, "restart")
+	return nil
+}
+
+type fakeVerifier struct {
+	err error
+}
+
+func (f *fakeVerifier) Verify() error {
+	return f.err
+}
+
+func newTestReconciler() (*Reconciler, *fakeCloudflare, *fakeManager, *fakePlatform) {
+	cf := &fakeCloudflare{}
+	manager := &fakeManager{current: "old", next: "new"}
+	p := &fakePlatform{running: true}
+	return &Reconciler{config: &config.Config{}, cfClient: cf, wgManager: manager, platform: p}, cf, manager, p
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected int
+	}{
+		{nil, exitcode.OK},
+		{errors.New("boom"), exitcode.Error},
+		{&Error{Stage: StageAuthenticate, Err: errors.New("denied")}, exitcode.Auth},
+		{&Error{Stage: StageFetch, Err: errors.New("timeout")}, exitcode.Fetch},
+		{&Error{Stage: StageServiceCheck, Err: errors.New("systemctl not found")}, exitcode.ServiceCheck},
+		{&Error{Stage: StageServiceCheck, Err: ErrServiceNotRunning}, exitcode.ServiceNotRunning},
+		{&Error{Stage: StageUpdate, Err: errors.New("read-only")}, exitcode.Update},
+		{&Error{Stage: StageApply, Err: errors.New("restart failed"), RolledBack: true}, exitcode.Apply},
+		{&Error{Stage: StageVerify, Err: errors.New("blocked")}, exitcode.Verify},
+		// Wrapped errors keep their stage
+		{fmt.Errorf("refresh: %w", &Error{Stage: StageFetch, Err: errors.New("timeout")}), exitcode.Fetch},
+	}
+
+	for _, tt := range tests {
+		if got := ExitCode(tt.err); got != tt.expected {
+			t.Errorf("ExitCode(%v) = %d; expected %d", tt.err, got, tt.expected)
+		}
+	}
+}
+
+func TestErrorUnwrap(t *testing.T) {
+	err := error(&Error{Stage: StageServiceCheck, Err: ErrServiceNotRunning})
+
+	if !errors.Is(err, ErrServiceNotRunning) {
+		t.Error("Expected the stage error to wrap the cause")
+	}
+	if err.Error() != "service_check: WireGuard service is not running" {
+		t.Errorf("Unexpected error message %q", err.Error())
+	}
+}
+
+func TestReconcileDryRun(t *testing.T) {
+	r, _, manager, p := newTestReconciler()
+
+	result, err := r.Reconcile(context.Background(), Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Current != "old" || result.Proposed != "new" || result.Changed {
+		t.Errorf("Unexpected dry run result: %+v", result)
+	}
+	if manager.updated || len(p.calls) != 0 {
+		t.Errorf("Expected a dry run not to change anything, got update %v and calls %v", manager.updated, p.calls)
+	}
+}
+
+func TestReconcileUpToDate(t *testing.T) {
+	r, _, manager, p := newTestReconciler()
+	manager.next = manager.current
+
+	result, err := r.Reconcile(context.Background(), Options{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Changed || manager.updated || len(p.calls) != 0 {
+		t.Errorf("Expected an up to date configuration to be left alone, got calls %v", p.calls)
+	}
+
+	// Forcing applies it anyway
+	result, err = r.Reconcile(context.Background(), Options{Force: true})
+	if err != nil || !result.Changed || strings.Join(p.calls, ",") != "apply" {
+		t.Errorf("Expected a forced pass to apply, got %v, calls %v", err, p.calls)
+	}
+}
+
+func TestReconcileApplyFailureRollsBack(t *testing.T) {
+	r, _, manager, p := newTestReconciler()
+	p.applyErr = errors.New("interface did not come up")
+
+	_, err := r.Reconcile(context.Background(), Options{})
+	var reconcileErr *Error
+	if !errors.As(err, &reconcileErr) || reconcileErr.Stage != StageApply || !reconcileErr.RolledBack {
+		t.Fatalf("Expected a rolled back apply failure, got %v", err)
+	}
+	if !manager.rolledBack || strings.Join(p.calls, ",") != "apply,restart" {
+		t.Errorf("Expected the previous configuration to be restored and restarted, got calls %v", p.calls)
+	}
+	if ExitCode(err) != exitcode.Apply {
+		t.Errorf("Unexpected exit code %d", ExitCode(err))
+	}
+}
+
+func TestReconcileApplyFailureWithoutRollback(t *testing.T) {
+	r, _, manager, p := newTestReconciler()
+	p.applyErr = errors.New("controller rejected the network")
+	p.noRollback = true
+
+	_, err := r.Reconcile(context.Background(), Options{})
+	var reconcileErr *Error
+	if !errors.As(err, &reconcileErr) || reconcileErr.Stage != StageApply || reconcileErr.RolledBack {
+		t.Fatalf("Expected an apply failure that wasn't rolled back, got %v", err)
+	}
+	if manager.rolledBack || strings.Join(p.calls, ",") != "apply" {
+		t.Errorf("Expected no rollback to be attempted, got calls %v", p.calls)
+	}
+}
+
+func TestReconcileVerifyFailure(t *testing.T) {
+	r, cf, _, _ := newTestReconciler()
+	r.prober = &fakeVerifier{err: errors.New("blocked by policy")}
+
+	_, err := r.Reconcile(context.Background(), Options{})
+	var reconcileErr *Error
+	if !errors.As(err, &reconcileErr) || reconcileErr.Stage != StageVerify {
+		t.Fatalf("Expected a verify failure, got %v", err)
+	}
+	// The next attempt registers the device anew
+	if !cf.invalidated {
+		t.Error("Expected the device token to be invalidated")
+	}
+}
+
+func TestReconcileAuthFailure(t *testing.T) {
+	r, cf, manager, _ := newTestReconciler()
+	cf.authErr = errors.New("invalid client secret")
+
+	_, err := r.Reconcile(context.Background(), Options{})
+	if ExitCode(err) != exitcode.Auth || manager.updated {
+		t.Errorf("Expected the pass to stop at authentication, got %v", err)
+	}
+}
+
+func TestReconcileServiceNotRunning(t *testing.T) {
+	r, _, manager, _ := newTestReconciler()
+	r.platform.(*fakePlatform).running = false
+
+	_, err := r.Reconcile(context.Background(), Options{})
+	if ExitCode(err) != exitcode.ServiceNotRunning || manager.updated {
+		t.Errorf("Expected the pass to stop at the service check, got %v", err)
+	}
+}
+
+func TestReconcileSplitTunnel(t *testing.T) {
+	r, _, _, _ := newTestReconciler()
+	r.config.SplitTunnel.Source = "config"
+	r.config.SplitTunnel.Include = []string{"162.159.192.0/24"}
+
+	result, err := r.Reconcile(context.Background(), Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The endpoint is left out of the included range
+	if strings.Join(result.Config.AllowedIPs, ", ") != "162.159.192.0/32, 162.159.192.2/31, 162.159.192.4/30, "+
+		"162.159.192.8/29, 162.159.192.16/28, 162.159.192.32/27, 162.159.192.64/26, 162.159.192.128/25" {
+		t.Errorf("Unexpected AllowedIPs: %v", result.Config.AllowedIPs)
+	}
+}
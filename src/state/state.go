@@ -0,0 +1,92 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultPath is where the daemon keeps its state unless configured otherwise
+const DefaultPath = "/var/lib/cfwg-zt/state.json"
+
+// State is what the service remembers across restarts
+type State struct {
+	// LastEndpoint is the most recent peer endpoint a handshake succeeded with
+	LastEndpoint   string     `json:"last_endpoint,omitempty"`
+	LastEndpointAt *time.Time `json:"last_endpoint_at,omitempty"`
+
+	// Reverts counts the times re-provisioning reverted the keys of the configuration file
+	Reverts          int        `json:"reverts,omitempty"`
+	LastRevertAt     *time.Time `json:"last_revert_at,omitempty"`
+	LastRevertReason string     `json:"last_revert_reason,omitempty"`
+}
+
+// mu serializes read-modify-write cycles of the state file within the process
+var mu sync.Mutex
+
+// Load reads the state file; a missing file is an empty state
+func Load(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &State{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var s State
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// Save writes the state file atomically, creating its directory if needed
+func Save(path string, s *State) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated state file behind
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
+// Update loads the state file, applies change and saves the result
+func Update(path string, change func(s *State)) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s, err := Load(path)
+	if err != nil {
+		return err
+	}
+	change(s)
+	return Save(path, s)
+}
@@ -0,0 +1,62 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadMissingFile(t *testing.T) {
+	s, err := Load(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s.LastEndpoint != "" || s.LastEndpointAt != nil {
+		t.Errorf("Expected an empty state, got %+v", s)
+	}
+}
+
+func TestUpdateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lib", "state.json")
+	now := time.Now().Truncate(time.Second)
+
+	err := Update(path, func(s *State) {
+		s.LastEndpoint = "[2606:4700:d0::a29f:c001]:500"
+		s.LastEndpointAt = &now
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	s, err := Load(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s.LastEndpoint != "[2606:4700:d0::a29f:c001]:500" || s.LastEndpointAt == nil || !s.LastEndpointAt.Equal(now) {
+		t.Errorf("Unexpected state after round trip: %+v", s)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	// No temporary files are left behind
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the state file, got %d entries", len(entries))
+	}
+}
+
+func TestLoadCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	os.WriteFile(path, []byte("{not json"), 0600)
+
+	if _, err := Load(path); err == nil {
+		t.Error("Expected error for corrupt state file")
+	}
+}
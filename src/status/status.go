@@ -0,0 +1,259 @@
+package status
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/exitcode"
+	"github.com/gumbees/cfwg-zt/src/platform"
+	"github.com/gumbees/cfwg-zt/src/redact"
+	"github.com/gumbees/cfwg-zt/src/wireguard"
+)
+
+// Failure identifies the category of problem found while collecting the status
+type Failure string
+
+const (
+	FailureNone                   Failure = ""
+	FailureConfig                 Failure = "config"
+	FailureWireGuardConfigMissing Failure = "wireguard_config_missing"
+	FailureServiceCheck           Failure = "service_check"
+	FailureServiceNotRunning      Failure = "service_not_running"
+	FailureAuth                   Failure = "auth"
+	FailureDeviceStatusUnknown    Failure = "device_status_unknown"
+	FailureDeviceInactive         Failure = "device_inactive"
+)
+
+// ExitCode returns the process exit code for the failure category
+func (f Failure) ExitCode() int {
+	switch f {
+	case FailureNone:
+		return exitcode.OK
+	case FailureConfig:
+		return exitcode.Config
+	case FailureWireGuardConfigMissing:
+		return exitcode.WireGuardConfigMissing
+	case FailureServiceCheck:
+		return exitcode.ServiceCheck
+	case FailureServiceNotRunning:
+		return exitcode.ServiceNotRunning
+	case FailureAuth:
+		return exitcode.Auth
+	case FailureDeviceStatusUnknown:
+		return exitcode.DeviceStatusUnknown
+	case FailureDeviceInactive:
+		return exitcode.DeviceInactive
+	default:
+		return exitcode.Error
+	}
+}
+
+// ServiceStatus describes the state of the WireGuard service or interface managed by the platform backend
+type ServiceStatus struct {
+	Name     string `json:"name" yaml:"name"`
+	Platform string `json:"platform" yaml:"platform"`
+	Running  bool   `json:"running" yaml:"running"`
+}
+
+// TunnelStatus describes the runtime state of the WireGuard interface
+type TunnelStatus struct {
+	LatestHandshake     *time.Time            `json:"latest_handshake,omitempty" yaml:"latest_handshake,omitempty"`
+	HandshakeAgeSeconds int64                 `json:"handshake_age_seconds,omitempty" yaml:"handshake_age_seconds,omitempty"`
+	Peers               []wireguard.PeerStats `json:"peers" yaml:"peers"`
+}
+
+// NewTunnelStatus summarizes interface stats for the status report
+// The latest handshake is the one of the Cloudflare peer, identified by its public key
+func NewTunnelStatus(stats *wireguard.InterfaceStats, peerPublicKey string) *TunnelStatus {
+	tunnel := &TunnelStatus{Peers: stats.Peers}
+	if peer := stats.Peer(peerPublicKey); peer != nil && !peer.LatestHandshake.IsZero() {
+		latest := peer.LatestHandshake
+		tunnel.LatestHandshake = &latest
+		tunnel.HandshakeAgeSeconds = int64(time.Since(latest).Seconds())
+	}
+	return tunnel
+}
+
+// DaemonStatus describes the running daemon, when the status was collected through its control socket
+type DaemonStatus struct {
+	PID                 int        `json:"pid" yaml:"pid"`
+	Activity            string     `json:"activity" yaml:"activity"`
+	Paused              bool       `json:"paused" yaml:"paused"`
+	LastSuccess         *time.Time `json:"last_success,omitempty" yaml:"last_success,omitempty"`
+	LastError           string     `json:"last_error,omitempty" yaml:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures" yaml:"consecutive_failures"`
+	NextRefresh         *time.Time `json:"next_refresh,omitempty" yaml:"next_refresh,omitempty"`
+	Reverts             int        `json:"reverts,omitempty" yaml:"reverts,omitempty"`
+	LastRevert          *time.Time `json:"last_revert,omitempty" yaml:"last_revert,omitempty"`
+}
+
+// Report is the machine-readable status of the WireGuard connection
+type Report struct {
+	ConfigPath          string                   `json:"config_path" yaml:"config_path"`
+	WireGuardConfigPath string                   `json:"wireguard_config_path" yaml:"wireguard_config_path"`
+	Service             *ServiceStatus           `json:"service,omitempty" yaml:"service,omitempty"`
+	Tunnel              *TunnelStatus            `json:"tunnel,omitempty" yaml:"tunnel,omitempty"`
+	Device              *cloudflare.DeviceStatus `json:"device,omitempty" yaml:"device,omitempty"`
+	TokenExpiry         *time.Time               `json:"token_expiry,omitempty" yaml:"token_expiry,omitempty"`
+	Connected           bool                     `json:"connected" yaml:"connected"`
+	Failure             Failure                  `json:"failure,omitempty" yaml:"failure,omitempty"`
+	Error               string                   `json:"error,omitempty" yaml:"error,omitempty"`
+	Daemon              *DaemonStatus            `json:"daemon,omitempty" yaml:"daemon,omitempty"`
+}
+
+// ExitCode returns the process exit code matching the report
+func (r *Report) ExitCode() int {
+	return r.Failure.ExitCode()
+}
+
+// fail records a failure category and its error on the report
+func (r *Report) fail(failure Failure, err error) *Report {
+	r.Failure = failure
+	if err != nil {
+		r.Error = redact.String(err.Error())
+	}
+	return r
+}
+
+// Collect gathers the status of the WireGuard connection and its Cloudflare Zero Trust device
+// Collection stops at the first failure, which is recorded on the report
+func Collect(ctx context.Context, cfg *config.Config, configPath string) *Report {
+	cfClient, err := cloudflare.NewClient(cfg)
+	if err != nil {
+		report := &Report{
+			ConfigPath:          configPath,
+			WireGuardConfigPath: cfg.WireGuard.ConfigPath,
+		}
+		return report.fail(FailureConfig, err)
+	}
+
+	return CollectWith(ctx, cfg, configPath, cfClient)
+}
+
+// CollectWith gathers the status like Collect, using an existing Cloudflare client
+// The daemon uses this so its cached device token is reused rather than registering again
+func CollectWith(ctx context.Context, cfg *config.Config, configPath string, cfClient *cloudflare.Client) *Report {
+	report := &Report{
+		ConfigPath:          configPath,
+		WireGuardConfigPath: cfg.WireGuard.ConfigPath,
+	}
+
+	// First check if the config file exists
+	if _, err := os.Stat(cfg.WireGuard.ConfigPath); os.IsNotExist(err) {
+		return report.fail(FailureWireGuardConfigMissing, err)
+	}
+
+	// Check if WireGuard is running
+	p, err := platform.New(cfg, wireguard.NewManager(cfg))
+	if err != nil {
+		return report.fail(FailureServiceCheck, err)
+	}
+	report.Service = &ServiceStatus{Name: p.Target(), Platform: p.Name()}
+	isRunning, err := p.IsRunning(ctx)
+	if err != nil {
+		return report.fail(FailureServiceCheck, err)
+	}
+	report.Service.Running = isRunning
+	if !isRunning {
+		return report.fail(FailureServiceNotRunning, nil)
+	}
+
+	// Tunnel information is best effort; the status is still meaningful without it
+	manager := wireguard.NewManager(cfg)
+	if stats, err := manager.Stats(); err == nil {
+		peerPublicKey, _ := manager.PeerPublicKey()
+		report.Tunnel = NewTunnelStatus(stats, peerPublicKey)
+	}
+
+	// Authenticate to check device status
+	deviceToken, err := cfClient.AuthenticateDevice(ctx)
+	if err != nil {
+		return report.fail(FailureAuth, err)
+	}
+	tokenExpiry := cfClient.TokenExpiry()
+	report.TokenExpiry = &tokenExpiry
+
+	// Check device status
+	device, err := cfClient.GetDeviceStatus(ctx, deviceToken)
+	if err != nil {
+		return report.fail(FailureDeviceStatusUnknown, err)
+	}
+	report.Device = device
+
+	if !device.Connected() {
+		return report.fail(FailureDeviceInactive, nil)
+	}
+
+	report.Connected = true
+	return report
+}
+
+// WriteText writes a human readable version of the report
+func (r *Report) WriteText(w io.Writer) {
+	switch r.Failure {
+	case FailureConfig:
+		fmt.Fprintf(w, "Configuration error: %s\n", r.Error)
+	case FailureWireGuardConfigMissing:
+		fmt.Fprintf(w, "WireGuard configuration file not found at %s\n", r.WireGuardConfigPath)
+		fmt.Fprintln(w, "If you created a configuration through the UDM Pro UI, make sure this application")
+		fmt.Fprintln(w, "is configured with the correct path to the UI-created WireGuard configuration file.")
+	case FailureServiceCheck:
+		fmt.Fprintf(w, "Error checking WireGuard status: %s\n", r.Error)
+	case FailureServiceNotRunning:
+		fmt.Fprintln(w, "WireGuard is not running. Please check your UDM Pro UI settings.")
+		fmt.Fprintln(w, "You may need to enable the WireGuard interface in the UDM Pro UI.")
+	case FailureAuth:
+		fmt.Fprintf(w, "Error authenticating with Cloudflare: %s\n", r.Error)
+	case FailureDeviceStatusUnknown:
+		fmt.Fprintln(w, "WireGuard is running but Cloudflare Zero Trust status is unknown")
+		fmt.Fprintf(w, "Error: %s\n", r.Error)
+	case FailureDeviceInactive:
+		fmt.Fprintln(w, "WireGuard is running but not active in Cloudflare Zero Trust")
+		fmt.Fprintln(w, "The application will attempt to reconnect automatically.")
+	case FailureNone:
+		fmt.Fprintln(w, "WireGuard is running and connected to Cloudflare Zero Trust")
+		fmt.Fprintln(w, "The UDM Pro UI-created WireGuard configuration is being maintained successfully.")
+		fmt.Fprintln(w, "You can use policy-based routing in the UDM Pro UI to route traffic through this tunnel.")
+	}
+
+	if r.Tunnel != nil {
+		if r.Tunnel.LatestHandshake != nil {
+			fmt.Fprintf(w, "Latest handshake: %s (%ds ago)\n", r.Tunnel.LatestHandshake.Format(time.RFC3339), r.Tunnel.HandshakeAgeSeconds)
+		} else {
+			fmt.Fprintln(w, "Latest handshake: never")
+		}
+		for _, peer := range r.Tunnel.Peers {
+			fmt.Fprintf(w, "Peer %s: endpoint %s, received %d bytes, sent %d bytes\n", peer.PublicKey, peer.Endpoint, peer.RxBytes, peer.TxBytes)
+		}
+	}
+	if r.TokenExpiry != nil {
+		fmt.Fprintf(w, "Device token expires: %s\n", r.TokenExpiry.Format(time.RFC3339))
+	}
+	if r.Device != nil && r.Device.LastSeen != "" {
+		fmt.Fprintf(w, "Device last seen by Cloudflare: %s\n", r.Device.LastSeen)
+	}
+
+	if r.Daemon != nil {
+		fmt.Fprintf(w, "Daemon (pid %d): %s\n", r.Daemon.PID, r.Daemon.Activity)
+		if r.Daemon.Paused {
+			fmt.Fprintln(w, "Daemon is paused; run 'cfwg-zt ctl resume' to resume updates")
+		}
+		if r.Daemon.LastSuccess != nil {
+			fmt.Fprintf(w, "Last successful update: %s\n", r.Daemon.LastSuccess.Format(time.RFC3339))
+		}
+		if r.Daemon.ConsecutiveFailures > 0 {
+			fmt.Fprintf(w, "Consecutive failures: %d (last error: %s)\n", r.Daemon.ConsecutiveFailures, r.Daemon.LastError)
+		}
+		if r.Daemon.NextRefresh != nil {
+			fmt.Fprintf(w, "Next refresh: %s\n", r.Daemon.NextRefresh.Format(time.RFC3339))
+		}
+		if r.Daemon.LastRevert != nil {
+			fmt.Fprintf(w, "Configuration reverted by re-provisioning: %d times, last at %s\n", r.Daemon.Reverts, r.Daemon.LastRevert.Format(time.RFC3339))
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package status
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/exitcode"
+	"github.com/gumbees/cfwg-zt/src/wireguard"
+)
+
+func TestFailureExitCode(t *testing.T) {
+	tests := []struct {
+		failure  Failure
+		expected int
+	}{
+		{FailureNone, exitcode.OK},
+		{FailureConfig, exitcode.Config},
+		{FailureWireGuardConfigMissing, exitcode.WireGuardConfigMissing},
+		{FailureServiceCheck, exitcode.ServiceCheck},
+		{FailureServiceNotRunning, exitcode.ServiceNotRunning},
+		{FailureAuth, exitcode.Auth},
+		{FailureDeviceStatusUnknown, exitcode.DeviceStatusUnknown},
+		{FailureDeviceInactive, exitcode.DeviceInactive},
+		{Failure("unknown"), exitcode.Error},
+	}
+
+	for _, tt := range tests {
+		if got := tt.failure.ExitCode(); got != tt.expected {
+			t.Errorf("Failure %q: expected exit code %d, got %d", tt.failure, tt.expected, got)
+		}
+		report := &Report{Failure: tt.failure}
+		if got := report.ExitCode(); got != tt.expected {
+			t.Errorf("Report with failure %q: expected exit code %d, got %d", tt.failure, tt.expected, got)
+		}
+	}
+}
+
+// jsonKeys returns the sorted keys of a JSON object
+func jsonKeys(t *testing.T, data []byte) []string {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		t.Fatalf("Invalid JSON %s: %v", data, err)
+	}
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestReportJSON(t *testing.T) {
+	handshake := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	connected := &Report{
+		ConfigPath:          "/etc/cfwg-zt/config.yaml",
+		WireGuardConfigPath: "/etc/wireguard/wg0.conf",
+		Service:             &ServiceStatus{Name: "wg-quick@wg0", Platform: "systemd", Running: true},
+		Tunnel: &TunnelStatus{
+			LatestHandshake:     &handshake,
+			HandshakeAgeSeconds: 30,
+			Peers:               []wireguard.PeerStats{{PublicKey: "peer", LatestHandshake: handshake}},
+		},
+		Device:      &cloudflare.DeviceStatus{Active: true, WarpEnabled: true, LastSeen: "2024-05-01T12:00:00Z"},
+		TokenExpiry: &handshake,
+		Connected:   true,
+		Daemon:      &DaemonStatus{PID: 42, Activity: "Idle"},
+	}
+
+	tests := []struct {
+		name   string
+		report *Report
+		keys   []string
+	}{
+		{
+			name:   "connected",
+			report: connected,
+			keys: []string{"config_path", "connected", "daemon", "device", "service", "token_expiry", "tunnel",
+				"wireguard_config_path"},
+		},
+		{
+			name:   "failure",
+			report: (&Report{ConfigPath: "/etc/cfwg-zt/config.yaml"}).fail(FailureServiceNotRunning, errors.New("inactive")),
+			keys:   []string{"config_path", "connected", "error", "failure", "wireguard_config_path"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.report)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keys := jsonKeys(t, data); !reflect.DeepEqual(keys, tt.keys) {
+				t.Errorf("Expected keys %v, got %v", tt.keys, keys)
+			}
+		})
+	}
+
+	// The nested objects use the documented field names
+	data, err := json.Marshal(connected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		t.Fatal(err)
+	}
+	nested := map[string][]string{
+		"service": {"name", "platform", "running"},
+		"tunnel":  {"handshake_age_seconds", "latest_handshake", "peers"},
+		"device":  {"active", "last_seen", "warp_enabled"},
+		"daemon":  {"activity", "consecutive_failures", "paused", "pid"},
+	}
+	for key, expected := range nested {
+		if keys := jsonKeys(t, object[key]); !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Expected %s keys %v, got %v", key, expected, keys)
+		}
+	}
+	if string(object["failure"]) != "" {
+		t.Errorf("Expected no failure on a connected report, got %s", object["failure"])
+	}
+}
+
+func TestReportFailRedactsError(t *testing.T) {
+	report := (&Report{}).fail(FailureAuth, errors.New(`authentication failed: {"client_secret":"s3cr3t-value"}`))
+
+	if report.Failure != FailureAuth || report.ExitCode() != exitcode.Auth {
+		t.Errorf("Unexpected failure %q", report.Failure)
+	}
+	if strings.Contains(report.Error, "s3cr3t-value") {
+		t.Errorf("Expected the secret to be redacted, got %q", report.Error)
+	}
+}
+
+func TestCollectFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, cfg *config.Config)
+		failure Failure
+	}{
+		{
+			name:    "missing credentials",
+			setup:   func(t *testing.T, cfg *config.Config) { cfg.CloudflareZeroTrust.ClientSecret = "" },
+			failure: FailureConfig,
+		},
+		{
+			name:    "missing WireGuard configuration",
+			failure: FailureWireGuardConfigMissing,
+		},
+		{
+			name: "unknown platform backend",
+			setup: func(t *testing.T, cfg *config.Config) {
+				if err := os.WriteFile(cfg.WireGuard.ConfigPath, []byte("[Interface]\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			failure: FailureServiceCheck,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.CloudflareZeroTrust.ClientID = "client-id"
+			cfg.CloudflareZeroTrust.ClientSecret = "client-secret"
+			cfg.WireGuard.ConfigPath = filepath.Join(t.TempDir(), "wg0.conf")
+			cfg.Platform.Backend = "unknown"
+			if tt.setup != nil {
+				tt.setup(t, cfg)
+			}
+
+			report := Collect(context.Background(), cfg, "/etc/cfwg-zt/config.yaml")
+			if report.Failure != tt.failure || report.Connected {
+				t.Fatalf("Expected failure %q, got %q (%s)", tt.failure, report.Failure, report.Error)
+			}
+			if report.WireGuardConfigPath != cfg.WireGuard.ConfigPath {
+				t.Errorf("Expected the WireGuard config path on the report, got %q", report.WireGuardConfigPath)
+			}
+
+			var text bytes.Buffer
+			report.WriteText(&text)
+			if text.Len() == 0 {
+				t.Error("Expected a text report")
+			}
+		})
+	}
+}
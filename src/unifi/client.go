@@ -0,0 +1,368 @@
+package unifi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/logging"
+	"github.com/gumbees/cfwg-zt/src/redact"
+)
+
+var logger = logging.Component("unifi")
+
+// errUnauthorized is returned by a request the controller rejected because the session expired
+var errUnauthorized = errors.New("not logged in to the UniFi controller")
+
+// csrfTokenRole registers the CSRF token as a secret; each token replaces the previous one, which the console no longer accepts
+const csrfTokenRole = "unifi_csrf_token"
+
+// Client talks to the UniFi Network application of a UniFi OS console
+type Client struct {
+	httpClient *http.Client
+	baseURL    string
+	username   string
+	password   string
+	site       string
+
+	// mu guards the session, which is kept in the cookie jar along with its CSRF token
+	mu        sync.Mutex
+	csrfToken string
+	loggedIn  bool
+}
+
+// Network is a network object of the controller
+// It is kept as a map, so fields this client doesn't know about are sent back unchanged
+type Network map[string]interface{}
+
+// ID returns the ID of the network
+func (n Network) ID() string {
+	id, _ := n["_id"].(string)
+	return id
+}
+
+// Name returns the name of the network
+func (n Network) Name() string {
+	name, _ := n["name"].(string)
+	return name
+}
+
+// Enabled reports whether the network is enabled
+func (n Network) Enabled() bool {
+	enabled, ok := n["enabled"].(bool)
+	// The controller leaves the field out of networks that have never been disabled
+	return enabled || !ok
+}
+
+// IsWireGuardClient reports whether the network is a WireGuard VPN client
+func (n Network) IsWireGuardClient() bool {
+	return n["purpose"] == "vpn-client" && n["vpn_type"] == "wireguard-client"
+}
+
+// ApplyWireGuard sets the WireGuard settings on the network and reports whether any of them changed
+func (n Network) ApplyWireGuard(settings WireGuardSettings) bool {
+	values := map[string]interface{}{
+		"x_wireguard_private_key":                settings.PrivateKey,
+		"wireguard_client_peer_public_key":       settings.PeerPublicKey,
+		"wireguard_client_peer_ip":               settings.EndpointHost,
+		"wireguard_client_peer_port":             settings.EndpointPort,
+		"wireguard_client_preshared_key_enabled": settings.PresharedKey != "",
+	}
+	if settings.PresharedKey != "" {
+		values["wireguard_client_preshared_key"] = settings.PresharedKey
+	}
+	if n["wireguard_client_mode"] == "file" && len(settings.ConfigFile) > 0 {
+		values["wireguard_client_configuration_file"] = base64.StdEncoding.EncodeToString(settings.ConfigFile)
+	}
+
+	changed := false
+	for key, value := range values {
+		if !sameValue(n[key], value) {
+			n[key] = value
+			changed = true
+		}
+	}
+	return changed
+}
+
+// WireGuardSettings are the credentials and endpoint applied to a WireGuard VPN client network
+type WireGuardSettings struct {
+	PrivateKey    string
+	PeerPublicKey string
+	PresharedKey  string
+	EndpointHost  string
+	EndpointPort  int
+	// ConfigFile replaces the uploaded configuration file of a network set up from a file
+	ConfigFile []byte
+}
+
+// response is the envelope of every controller API response
+type response struct {
+	Meta struct {
+		RC  string `json:"rc"`
+		Msg string `json:"msg"`
+	} `json:"meta"`
+	Data json.RawMessage `json:"data"`
+}
+
+// NewClient creates a client for the configured controller
+func NewClient(cfg *config.Config) (*Client, error) {
+	if cfg.UniFi.URL == "" || cfg.UniFi.Username == "" || cfg.UniFi.Password == "" {
+		return nil, fmt.Errorf("missing UniFi controller URL or credentials in configuration")
+	}
+	if _, err := url.Parse(cfg.UniFi.URL); err != nil {
+		return nil, fmt.Errorf("invalid UniFi controller URL: %w", err)
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cookie jar: %w", err)
+	}
+
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	site := cfg.UniFi.Site
+	if site == "" {
+		site = "default"
+	}
+
+	return &Client{
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Jar:     jar,
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		baseURL:  strings.TrimSuffix(cfg.UniFi.URL, "/"),
+		username: cfg.UniFi.Username,
+		password: cfg.UniFi.Password,
+		site:     site,
+	}, nil
+}
+
+// newTLSConfig returns the TLS settings for the console's certificate
+// A pinned fingerprint replaces the usual verification, so a self-signed certificate is accepted as long as it doesn't change
+func newTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.UniFi.InsecureSkipVerify}
+
+	if cfg.UniFi.CAFile != "" {
+		pem, err := os.ReadFile(cfg.UniFi.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read UniFi CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in UniFi CA file %s", cfg.UniFi.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.UniFi.Fingerprint != "" {
+		pinned, err := hex.DecodeString(strings.NewReplacer(":", "", " ", "").Replace(cfg.UniFi.Fingerprint))
+		if err != nil || len(pinned) != sha256.Size {
+			return nil, fmt.Errorf("invalid UniFi certificate fingerprint: expected a SHA-256 fingerprint in hex")
+		}
+
+		// The chain isn't verified, as the pin is on the certificate itself
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("UniFi controller sent no certificate")
+			}
+			fingerprint := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if !bytes.Equal(fingerprint[:], pinned) {
+				return fmt.Errorf("UniFi controller certificate fingerprint %X doesn't match the pinned one", fingerprint)
+			}
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// Login starts a session with the console
+func (c *Client) Login(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.login(ctx)
+}
+
+// login starts a session; the caller holds mu
+func (c *Client) login(ctx context.Context) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"username": c.username,
+		"password": c.password,
+		"remember": true,
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling request body: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/api/auth/login", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("UniFi controller login failed with status %d", resp.StatusCode)
+	}
+
+	c.csrfToken = resp.Header.Get("X-CSRF-Token")
+	redact.Replace(csrfTokenRole, c.csrfToken)
+	c.loggedIn = true
+	logger.DebugContext(ctx, "Logged in to the UniFi controller", "url", c.baseURL)
+	return nil
+}
+
+// do sends a request to the Network application, logging in first and again when the session expired
+func (c *Client) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.loggedIn {
+		if err := c.login(ctx); err != nil {
+			return err
+		}
+	}
+
+	err := c.send(ctx, method, path, body, out)
+	if errors.Is(err, errUnauthorized) {
+		logger.DebugContext(ctx, "UniFi controller session expired, logging in again")
+		if err := c.login(ctx); err != nil {
+			return err
+		}
+		err = c.send(ctx, method, path, body, out)
+	}
+	return err
+}
+
+// send sends a single request and decodes the data of the response into out
+func (c *Client) send(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		bodyJSON, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("error marshaling request body: %w", err)
+		}
+		reader = bytes.NewReader(bodyJSON)
+	}
+
+	apiURL := fmt.Sprintf("%s/proxy/network/api/s/%s/%s", c.baseURL, url.PathEscape(c.site), path)
+	req, err := http.NewRequestWithContext(ctx, method, apiURL, reader)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.csrfToken != "" {
+		req.Header.Set("X-CSRF-Token", c.csrfToken)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// The console rotates the CSRF token now and then
+	if token := resp.Header.Get("X-Updated-CSRF-Token"); token != "" {
+		redact.Replace(csrfTokenRole, token)
+		c.csrfToken = token
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		c.loggedIn = false
+		return errUnauthorized
+	}
+
+	var apiResp response
+	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		return fmt.Errorf("error decoding response (status %d): %w", resp.StatusCode, err)
+	}
+	if apiResp.Meta.RC != "ok" {
+		return fmt.Errorf("UniFi controller request failed with status %d: %s", resp.StatusCode, redact.String(apiResp.Meta.Msg))
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(apiResp.Data, out); err != nil {
+			return fmt.Errorf("error decoding response data: %w", err)
+		}
+	}
+	return nil
+}
+
+// Networks returns the networks of the site
+func (c *Client) Networks(ctx context.Context) ([]Network, error) {
+	var networks []Network
+	if err := c.do(ctx, "GET", "rest/networkconf", nil, &networks); err != nil {
+		return nil, fmt.Errorf("failed to list networks: %w", err)
+	}
+	return networks, nil
+}
+
+// WireGuardNetwork returns the WireGuard VPN client network with the name or ID
+func (c *Client) WireGuardNetwork(ctx context.Context, nameOrID string) (Network, error) {
+	networks, err := c.Networks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, network := range networks {
+		if !network.IsWireGuardClient() {
+			continue
+		}
+		if network.ID() == nameOrID || network.Name() == nameOrID {
+			return network, nil
+		}
+		names = append(names, network.Name())
+	}
+	return nil, fmt.Errorf("no WireGuard VPN client network %q on the UniFi controller (found: %s)", nameOrID, strings.Join(names, ", "))
+}
+
+// UpdateNetwork saves the network
+func (c *Client) UpdateNetwork(ctx context.Context, network Network) error {
+	if network.ID() == "" {
+		return fmt.Errorf("network %q has no ID", network.Name())
+	}
+	if err := c.do(ctx, "PUT", "rest/networkconf/"+url.PathEscape(network.ID()), network, nil); err != nil {
+		return fmt.Errorf("failed to update network %s: %w", network.Name(), err)
+	}
+	return nil
+}
+
+// sameValue compares a value decoded from JSON with one about to be encoded
+func sameValue(current, value interface{}) bool {
+	if port, ok := value.(int); ok {
+		// JSON numbers decode as float64, and the controller sometimes keeps ports as strings
+		return fmt.Sprint(current) == fmt.Sprint(port)
+	}
+	return current == value
+}
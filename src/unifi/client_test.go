@@ -0,0 +1,354 @@
+package unifi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/redact"
+)
+
+// fakeController is a minimal UniFi OS console with the Network application's networkconf endpoints
+type fakeController struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	networks []Network
+	sessions map[string]bool
+	logins   int
+	updates  int
+	// rotateCSRF has every listing hand out a new CSRF token
+	rotateCSRF bool
+	rotations  int
+}
+
+const (
+	testUsername = "cfwg-zt"
+	testPassword = "correct horse battery staple"
+	testCSRF     = "csrf-0123456789"
+)
+
+func newFakeController(t *testing.T) (*fakeController, *httptest.Server) {
+	f := &fakeController{
+		t:        t,
+		sessions: make(map[string]bool),
+		networks: []Network{
+			{"_id": "lan", "name": "Default", "purpose": "corporate"},
+			{
+				"_id":                              "wg1",
+				"name":                             "Cloudflare",
+				"purpose":                          "vpn-client",
+				"vpn_type":                         "wireguard-client",
+				"enabled":                          true,
+				"wireguard_client_mode":            "manual",
+				"wireguard_client_peer_public_key": "YOw/RK8gT3PR4ImRfpnfvJ8UTY3GfJlO6PcPbl40Tkw=",
+				"wireguard_client_peer_ip":         "162.159.192.1",
+				"wireguard_client_peer_port":       2408,
+				"x_wireguard_private_key":          "mLmL+DB1n8MfA+7Dc+vnEdZD+VffR3Li3QcJhdTLuEU=",
+				"setting_preference":               "manual",
+			},
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/auth/login", f.login)
+	mux.HandleFunc("/proxy/network/api/s/default/rest/networkconf", f.list)
+	mux.HandleFunc("/proxy/network/api/s/default/rest/networkconf/", f.update)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeController) login(w http.ResponseWriter, r *http.Request) {
+	var creds struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	json.NewDecoder(r.Body).Decode(&creds)
+	if r.Method != "POST" || creds.Username != testUsername || creds.Password != testPassword {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.logins++
+	token := "session-" + strings.Repeat("x", f.logins)
+	f.sessions[token] = true
+	http.SetCookie(w, &http.Cookie{Name: "TOKEN", Value: token, Path: "/"})
+	w.Header().Set("X-CSRF-Token", testCSRF)
+	w.Write([]byte(`{}`))
+}
+
+// authorized checks the session cookie, and the CSRF token of changes
+func (f *fakeController) authorized(w http.ResponseWriter, r *http.Request) bool {
+	cookie, err := r.Cookie("TOKEN")
+	if err != nil || !f.sessions[cookie.Value] {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"meta":{"rc":"error","msg":"api.err.LoginRequired"},"data":[]}`))
+		return false
+	}
+	if r.Method != "GET" && r.Header.Get("X-CSRF-Token") != testCSRF {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"meta":{"rc":"error","msg":"api.err.InvalidCSRF"},"data":[]}`))
+		return false
+	}
+	return true
+}
+
+func (f *fakeController) list(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.authorized(w, r) {
+		return
+	}
+	if f.rotateCSRF {
+		f.rotations++
+		w.Header().Set("X-Updated-CSRF-Token", fmt.Sprintf("csrf-rotated-%04d", f.rotations))
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"meta": map[string]string{"rc": "ok"}, "data": f.networks})
+}
+
+func (f *fakeController) update(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.authorized(w, r) {
+		return
+	}
+	if r.Method != "PUT" {
+		f.t.Errorf("Unexpected %s %s", r.Method, r.URL.Path)
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/proxy/network/api/s/default/rest/networkconf/")
+	var network Network
+	json.NewDecoder(r.Body).Decode(&network)
+	for i := range f.networks {
+		if f.networks[i].ID() == id {
+			f.networks[i] = network
+			f.updates++
+			json.NewEncoder(w).Encode(map[string]interface{}{"meta": map[string]string{"rc": "ok"}, "data": []Network{network}})
+			return
+		}
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(`{"meta":{"rc":"error","msg":"api.err.IdInvalid"},"data":[]}`))
+}
+
+// expireSessions logs every client out
+func (f *fakeController) expireSessions() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sessions = make(map[string]bool)
+}
+
+func newTestClient(t *testing.T, server *httptest.Server, password string) *Client {
+	cfg := &config.Config{}
+	cfg.UniFi.URL = server.URL + "/"
+	cfg.UniFi.Username = testUsername
+	cfg.UniFi.Password = password
+
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	return client
+}
+
+func TestWireGuardNetwork(t *testing.T) {
+	_, server := newFakeController(t)
+	client := newTestClient(t, server, testPassword)
+
+	for _, nameOrID := range []string{"Cloudflare", "wg1"} {
+		network, err := client.WireGuardNetwork(context.Background(), nameOrID)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if network.ID() != "wg1" || !network.Enabled() {
+			t.Errorf("Unexpected network %v", network)
+		}
+	}
+
+	// Other kinds of networks don't qualify
+	_, err := client.WireGuardNetwork(context.Background(), "Default")
+	if err == nil || !strings.Contains(err.Error(), "found: Cloudflare") {
+		t.Errorf("Expected the available networks in the error, got %v", err)
+	}
+}
+
+func TestUpdateNetwork(t *testing.T) {
+	f, server := newFakeController(t)
+	client := newTestClient(t, server, testPassword)
+	ctx := context.Background()
+
+	network, err := client.WireGuardNetwork(ctx, "Cloudflare")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	settings := WireGuardSettings{
+		PrivateKey:    "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+		PeerPublicKey: "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=",
+		EndpointHost:  "162.159.192.1",
+		EndpointPort:  2408,
+	}
+	if !network.ApplyWireGuard(settings) {
+		t.Fatal("Expected new keys to change the network")
+	}
+	if err := client.UpdateNetwork(ctx, network); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	stored := f.networks[1]
+	if stored["x_wireguard_private_key"] != settings.PrivateKey || stored["wireguard_client_peer_public_key"] != settings.PeerPublicKey {
+		t.Errorf("Expected the keys to be updated, got %v", stored)
+	}
+	// Fields the client doesn't know are sent back unchanged
+	if stored["setting_preference"] != "manual" || stored["wireguard_client_preshared_key_enabled"] != false {
+		t.Errorf("Unexpected network after update %v", stored)
+	}
+
+	// Applying the same settings again changes nothing
+	network, _ = client.WireGuardNetwork(ctx, "Cloudflare")
+	if network.ApplyWireGuard(settings) {
+		t.Errorf("Expected unchanged settings not to change the network")
+	}
+}
+
+func TestApplyWireGuardConfigFile(t *testing.T) {
+	network := Network{"wireguard_client_mode": "file", "wireguard_client_peer_port": "2408"}
+	network.ApplyWireGuard(WireGuardSettings{EndpointPort: 2408, ConfigFile: []byte("[Interface]\n")})
+
+	if network["wireguard_client_configuration_file"] != base64.StdEncoding.EncodeToString([]byte("[Interface]\n")) {
+		t.Errorf("Expected the configuration file to be replaced, got %v", network["wireguard_client_configuration_file"])
+	}
+	// A port kept as a string is the same port
+	if network["wireguard_client_peer_port"] != "2408" {
+		t.Errorf("Expected the port to be left alone, got %v", network["wireguard_client_peer_port"])
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	f, server := newFakeController(t)
+	client := newTestClient(t, server, testPassword)
+	ctx := context.Background()
+
+	if _, err := client.Networks(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	f.expireSessions()
+	if _, err := client.Networks(ctx); err != nil {
+		t.Fatalf("Expected the client to log in again, got %v", err)
+	}
+	if f.logins != 2 {
+		t.Errorf("Expected 2 logins, got %d", f.logins)
+	}
+}
+
+func TestCSRFTokenRotation(t *testing.T) {
+	f, server := newFakeController(t)
+	client := newTestClient(t, server, testPassword)
+	ctx := context.Background()
+
+	if _, err := client.Networks(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if output := redact.String(testCSRF); output != redact.Placeholder {
+		t.Errorf("Expected the CSRF token to be redacted, got %s", output)
+	}
+
+	// Each rotated token replaces the previous one as a secret, rather than adding to them
+	f.rotateCSRF = true
+	for i := 0; i < 3; i++ {
+		if _, err := client.Networks(ctx); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	for _, token := range []string{testCSRF, "csrf-rotated-0001", "csrf-rotated-0002"} {
+		if output := redact.String(token); output != token {
+			t.Errorf("Expected the replaced token %s to be retired, got %s", token, output)
+		}
+	}
+	if output := redact.String("csrf-rotated-0003"); output != redact.Placeholder {
+		t.Errorf("Expected the current CSRF token to be redacted, got %s", output)
+	}
+}
+
+func TestLoginFailure(t *testing.T) {
+	_, server := newFakeController(t)
+	client := newTestClient(t, server, "wrong password")
+
+	_, err := client.Networks(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "login failed with status 401") {
+		t.Errorf("Expected a login failure, got %v", err)
+	}
+}
+
+func TestNewClientRequiresCredentials(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.UniFi.URL = "https://127.0.0.1"
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("Expected error for missing credentials")
+	}
+}
+
+func TestCertificateVerification(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	fingerprint := sha256.Sum256(server.Certificate().Raw)
+	caFile := filepath.Join(t.TempDir(), "console.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	tests := []struct {
+		name    string
+		change  func(cfg *config.Config)
+		succeed bool
+	}{
+		{"self-signed certificate is rejected by default", func(cfg *config.Config) {}, false},
+		{"pinned fingerprint", func(cfg *config.Config) { cfg.UniFi.Fingerprint = fmt.Sprintf("% X", fingerprint[:]) }, true},
+		{"pinned fingerprint with colons", func(cfg *config.Config) {
+			cfg.UniFi.Fingerprint = strings.ReplaceAll(fmt.Sprintf("% x", fingerprint[:]), " ", ":")
+		}, true},
+		{"other fingerprint", func(cfg *config.Config) { cfg.UniFi.Fingerprint = strings.Repeat("ab", sha256.Size) }, false},
+		{"CA file", func(cfg *config.Config) { cfg.UniFi.CAFile = caFile }, true},
+		{"insecure", func(cfg *config.Config) { cfg.UniFi.InsecureSkipVerify = true }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.UniFi.URL = server.URL
+			cfg.UniFi.Username = testUsername
+			cfg.UniFi.Password = testPassword
+			tt.change(cfg)
+
+			client, err := NewClient(cfg)
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+			if err := client.Login(context.Background()); (err == nil) != tt.succeed {
+				t.Errorf("Login() error = %v, expected success %v", err, tt.succeed)
+			}
+		})
+	}
+
+	cfg := &config.Config{}
+	cfg.UniFi.URL = server.URL
+	cfg.UniFi.Username = testUsername
+	cfg.UniFi.Password = testPassword
+	cfg.UniFi.Fingerprint = "not hex"
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("Expected error for an invalid fingerprint")
+	}
+}
@@ -0,0 +1,191 @@
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+)
+
+// Endpoint address family preferences
+const (
+	// EndpointAuto uses the endpoint hostname issued by Cloudflare, falling back to its IPv4 and then IPv6 address
+	EndpointAuto = "auto"
+	// EndpointIPv4 uses the IPv4 address of the endpoint when Cloudflare issued one
+	EndpointIPv4 = "ipv4"
+	// EndpointIPv6 uses the IPv6 address of the endpoint when Cloudflare issued one
+	EndpointIPv6 = "ipv6"
+)
+
+// EndpointPreferences lists every supported endpoint preference
+var EndpointPreferences = []string{EndpointAuto, EndpointIPv4, EndpointIPv6}
+
+// ParseEndpoint splits an endpoint into host and port
+// It accepts host, host:port, IPv4 and IPv6 literals, and bracketed IPv6 literals with or without a port
+// defaultPort is used when the endpoint has no port of its own
+func ParseEndpoint(endpoint string, defaultPort int) (string, int, error) {
+	host, port, err := splitEndpoint(endpoint)
+	if err != nil {
+		return "", 0, err
+	}
+	if port == 0 {
+		port = defaultPort
+	}
+	if port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid endpoint %q: port must be between 1 and 65535", strings.TrimSpace(endpoint))
+	}
+
+	return host, port, nil
+}
+
+// splitEndpoint splits an endpoint into host and port, with a zero port when the endpoint has none
+func splitEndpoint(endpoint string) (string, int, error) {
+	endpoint = strings.TrimSpace(endpoint)
+	if endpoint == "" {
+		return "", 0, fmt.Errorf("empty endpoint")
+	}
+
+	host, port := endpoint, 0
+	switch {
+	case net.ParseIP(endpoint) != nil:
+		// A bare IPv6 literal can't be told apart from host:port, so literals are checked first
+	case strings.HasPrefix(endpoint, "[") && strings.HasSuffix(endpoint, "]"):
+		host = endpoint[1 : len(endpoint)-1]
+	case strings.Contains(endpoint, ":"):
+		h, p, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 65535 {
+			return "", 0, fmt.Errorf("invalid endpoint %q: port must be between 1 and 65535", endpoint)
+		}
+		host, port = h, n
+	}
+
+	if host == "" {
+		return "", 0, fmt.Errorf("invalid endpoint %q: missing host", endpoint)
+	}
+	if strings.HasPrefix(endpoint, "[") && net.ParseIP(host) == nil {
+		return "", 0, fmt.Errorf("invalid endpoint %q: only IPv6 addresses may be bracketed", endpoint)
+	}
+
+	return host, port, nil
+}
+
+// FormatEndpoint formats a host and port as an endpoint, bracketing IPv6 addresses
+func FormatEndpoint(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// SelectEndpoint returns the host and port of the peer endpoint to use for the given preference
+// A preferred address family Cloudflare issued no address for falls back to the auto selection
+func SelectEndpoint(cfg *cloudflare.WireGuardConfig, preference string) (string, int, error) {
+	issued, err := issuedEndpoints(cfg, preference)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(issued) == 0 {
+		return "", 0, fmt.Errorf("no peer endpoint in the Cloudflare configuration")
+	}
+	return ParseEndpoint(issued[0], cfg.EndpointPort)
+}
+
+// issuedEndpoints returns the endpoints Cloudflare issued, ordered by the preference
+func issuedEndpoints(cfg *cloudflare.WireGuardConfig, preference string) ([]string, error) {
+	var ordered []string
+	switch preference {
+	case EndpointAuto, "":
+		ordered = []string{cfg.Endpoint, cfg.EndpointV4, cfg.EndpointV6}
+	case EndpointIPv4:
+		ordered = []string{cfg.EndpointV4, cfg.Endpoint, cfg.EndpointV6}
+	case EndpointIPv6:
+		ordered = []string{cfg.EndpointV6, cfg.Endpoint, cfg.EndpointV4}
+	default:
+		return nil, fmt.Errorf("unknown endpoint preference %q (expected %s)", preference, strings.Join(EndpointPreferences, ", "))
+	}
+
+	var issued []string
+	for _, endpoint := range ordered {
+		if endpoint != "" {
+			issued = append(issued, endpoint)
+		}
+	}
+	return issued, nil
+}
+
+// EndpointCandidates returns every endpoint worth trying, most preferred first and without duplicates
+// The endpoints Cloudflare issued come before the fallbacks; each host is tried on its own port first
+// and then on the other ports, unless the fallback names a port of its own
+func EndpointCandidates(cfg *cloudflare.WireGuardConfig, preference string, fallbacks []string, ports []int) ([]string, error) {
+	issued, err := issuedEndpoints(cfg, preference)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []string
+	seen := make(map[string]bool)
+	add := func(host string, port int) {
+		endpoint := FormatEndpoint(host, port)
+		if !seen[endpoint] {
+			seen[endpoint] = true
+			candidates = append(candidates, endpoint)
+		}
+	}
+
+	for _, endpoint := range issued {
+		host, port, err := ParseEndpoint(endpoint, cfg.EndpointPort)
+		if err != nil {
+			return nil, err
+		}
+		add(host, port)
+		for _, p := range ports {
+			if p > 0 && p <= 65535 {
+				add(host, p)
+			}
+		}
+	}
+
+	for _, fallback := range fallbacks {
+		host, port, err := splitEndpoint(fallback)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fallback endpoint: %w", err)
+		}
+		if port != 0 {
+			add(host, port)
+			continue
+		}
+
+		// Without a port of its own, the fallback is tried on every port
+		for _, p := range append([]int{cfg.EndpointPort}, ports...) {
+			if p > 0 && p <= 65535 {
+				add(host, p)
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no peer endpoint in the Cloudflare configuration")
+	}
+	return candidates, nil
+}
+
+// withEndpoint returns a copy of the Cloudflare configuration with the selected endpoint as its Endpoint and EndpointPort
+func withEndpoint(cfg *cloudflare.WireGuardConfig, preference string) (*cloudflare.WireGuardConfig, error) {
+	host, port, err := SelectEndpoint(cfg, preference)
+	if err != nil {
+		return nil, err
+	}
+
+	return endpointConfig(cfg, host, port), nil
+}
+
+// endpointConfig returns a copy of the Cloudflare configuration with host and port as its only endpoint
+func endpointConfig(cfg *cloudflare.WireGuardConfig, host string, port int) *cloudflare.WireGuardConfig {
+	selected := *cfg
+	selected.Endpoint, selected.EndpointPort = host, port
+	selected.EndpointV4, selected.EndpointV6 = "", ""
+	return &selected
+}
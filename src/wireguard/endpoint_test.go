@@ -0,0 +1,151 @@
+package wireguard
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		host     string
+		port     int
+		invalid  bool
+	}{
+		{endpoint: "engage.cloudflareclient.com", host: "engage.cloudflareclient.com", port: 2408},
+		{endpoint: "engage.cloudflareclient.com:500", host: "engage.cloudflareclient.com", port: 500},
+		{endpoint: "162.159.192.1", host: "162.159.192.1", port: 2408},
+		{endpoint: "162.159.192.1:4500", host: "162.159.192.1", port: 4500},
+		{endpoint: "2606:4700:d0::a29f:c001", host: "2606:4700:d0::a29f:c001", port: 2408},
+		{endpoint: "[2606:4700:d0::a29f:c001]", host: "2606:4700:d0::a29f:c001", port: 2408},
+		{endpoint: "[2606:4700:d0::a29f:c001]:1701", host: "2606:4700:d0::a29f:c001", port: 1701},
+		{endpoint: " 162.159.192.1:2408 ", host: "162.159.192.1", port: 2408},
+		{endpoint: "", invalid: true},
+		{endpoint: ":2408", invalid: true},
+		{endpoint: "[engage.cloudflareclient.com]:2408", invalid: true},
+		{endpoint: "162.159.192.1:port", invalid: true},
+		{endpoint: "162.159.192.1:70000", invalid: true},
+		{endpoint: "2606:4700:d0::a29f:c001:2408:", invalid: true},
+	}
+
+	for _, test := range tests {
+		host, port, err := ParseEndpoint(test.endpoint, 2408)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("ParseEndpoint(%q) = %s, %d; expected an error", test.endpoint, host, port)
+			}
+			continue
+		}
+		if err != nil || host != test.host || port != test.port {
+			t.Errorf("ParseEndpoint(%q) = %s, %d, %v; expected %s, %d", test.endpoint, host, port, err, test.host, test.port)
+		}
+	}
+}
+
+func TestFormatEndpoint(t *testing.T) {
+	tests := map[string]struct {
+		host string
+		port int
+	}{
+		"engage.cloudflareclient.com:2408": {"engage.cloudflareclient.com", 2408},
+		"162.159.192.1:500":                {"162.159.192.1", 500},
+		"[2606:4700:d0::a29f:c001]:2408":   {"2606:4700:d0::a29f:c001", 2408},
+	}
+
+	for expected, test := range tests {
+		if endpoint := FormatEndpoint(test.host, test.port); endpoint != expected {
+			t.Errorf("FormatEndpoint(%q, %d) = %q; expected %q", test.host, test.port, endpoint, expected)
+		}
+
+		// Formatting and parsing round-trip for every form
+		host, port, err := ParseEndpoint(expected, 0)
+		if err != nil || host != test.host || port != test.port {
+			t.Errorf("ParseEndpoint(%q) = %s, %d, %v; expected %s, %d", expected, host, port, err, test.host, test.port)
+		}
+	}
+}
+
+func TestSelectEndpoint(t *testing.T) {
+	const (
+		hostname = "engage.cloudflareclient.com"
+		v4       = "162.159.192.1"
+		v6       = "2606:4700:d0::a29f:c001"
+	)
+
+	tests := []struct {
+		name       string
+		preference string
+		endpoint   string
+		v4, v6     string
+		expected   string
+		invalid    bool
+	}{
+		{name: "default uses hostname", endpoint: hostname, v4: v4, v6: v6, expected: hostname + ":2408"},
+		{name: "auto uses hostname", preference: EndpointAuto, endpoint: hostname, v4: v4, v6: v6, expected: hostname + ":2408"},
+		{name: "auto without hostname", preference: EndpointAuto, v4: v4, v6: v6, expected: v4 + ":2408"},
+		{name: "auto with only IPv6", preference: EndpointAuto, v6: v6, expected: "[" + v6 + "]:2408"},
+		{name: "ipv4", preference: EndpointIPv4, endpoint: hostname, v4: v4, v6: v6, expected: v4 + ":2408"},
+		{name: "ipv6", preference: EndpointIPv6, endpoint: hostname, v4: v4, v6: v6, expected: "[" + v6 + "]:2408"},
+		{name: "ipv6 falls back to hostname", preference: EndpointIPv6, endpoint: hostname, v4: v4, expected: hostname + ":2408"},
+		{name: "ipv4 falls back to IPv6", preference: EndpointIPv4, v6: v6, expected: "[" + v6 + "]:2408"},
+		{name: "endpoint with port", endpoint: "[" + v6 + "]:500", expected: "[" + v6 + "]:500"},
+		{name: "unknown preference", preference: "ipv5", endpoint: hostname, invalid: true},
+		{name: "no endpoint", preference: EndpointAuto, invalid: true},
+	}
+
+	for _, test := range tests {
+		cfg := testWireGuardConfig()
+		cfg.Endpoint, cfg.EndpointV4, cfg.EndpointV6 = test.endpoint, test.v4, test.v6
+
+		host, port, err := SelectEndpoint(cfg, test.preference)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.name, FormatEndpoint(host, port))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if endpoint := FormatEndpoint(host, port); endpoint != test.expected {
+			t.Errorf("%s: got %s; expected %s", test.name, endpoint, test.expected)
+		}
+	}
+}
+
+func TestRenderConfigWritesIPv6Endpoint(t *testing.T) {
+	m := newTestManager(t)
+	m.config.WireGuard.EndpointPreference = EndpointIPv6
+	cfg := testWireGuardConfig()
+	cfg.EndpointV6 = "2606:4700:d0::a29f:c001"
+	cfg.Addresses = []string{"172.16.0.2/32", "2606:4700:110:8a36::2/128"}
+
+	// Both the generated and the merged configuration bracket the address
+	_, next, err := m.RenderConfig(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(next, "Endpoint = [2606:4700:d0::a29f:c001]:2408\n") {
+		t.Errorf("Expected a bracketed IPv6 endpoint in generated config:\n%s", next)
+	}
+
+	os.WriteFile(m.config.WireGuard.ConfigPath, []byte(`[Interface]
+PrivateKey = `+DummyPrivateKey+`
+Address = 100.64.0.1/32
+
+[Peer]
+PublicKey = `+DummyPeerPublicKey+`
+Endpoint = engage.cloudflareclient.com:2408
+`), 0600)
+
+	_, next, err = m.RenderConfig(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(next, "Endpoint = [2606:4700:d0::a29f:c001]:2408\n") {
+		t.Errorf("Expected a bracketed IPv6 endpoint in merged config:\n%s", next)
+	}
+	if !strings.Contains(next, "Address = 172.16.0.2/32, 2606:4700:110:8a36::2/128\n") {
+		t.Errorf("Expected dual-stack interface addresses in merged config:\n%s", next)
+	}
+}
@@ -0,0 +1,301 @@
+package wireguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+)
+
+// Supported export formats
+const (
+	ExportWgQuick      = "wg-quick"
+	ExportJSON         = "json"
+	ExportNetworkd     = "networkd"
+	ExportNMConnection = "nmconnection"
+)
+
+// ExportFormats lists every supported export format
+var ExportFormats = []string{ExportWgQuick, ExportJSON, ExportNetworkd, ExportNMConnection}
+
+// ExportOptions are the host-specific settings of an exported configuration
+// Empty Addresses, AllowedIPs and DNS fall back to the values issued by Cloudflare
+type ExportOptions struct {
+	InterfaceName       string
+	Addresses           []string
+	AllowedIPs          []string
+	DNS                 []string
+	MTU                 int
+	PersistentKeepalive int
+	// EndpointPreference selects the endpoint address family, see EndpointPreferences
+	EndpointPreference string
+
+	// markPeer adds CloudflarePeerMarker to the peer of a wg-quick configuration
+	markPeer bool
+	// replaceAllowedIPs replaces the AllowedIPs of an existing Cloudflare peer instead of keeping them
+	replaceAllowedIPs bool
+}
+
+// ExportFile is a single file of an exported configuration
+type ExportFile struct {
+	Name    string
+	Content string
+}
+
+// Export renders the Cloudflare configuration like Export, with the endpoint the configuration file is written with
+// It shares endpoint selection and resolution with RenderConfig, so an export matches what the service writes
+func (m *Manager) Export(cfg *cloudflare.WireGuardConfig, format string, opts ExportOptions) ([]ExportFile, error) {
+	if cfg.PrivateKey == "" || cfg.PeerPublicKey == "" {
+		return nil, fmt.Errorf("incomplete WireGuard configuration from Cloudflare")
+	}
+	cfg, err := m.selectEndpoint(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return Export(cfg, format, opts)
+}
+
+// Export renders the Cloudflare configuration in the given format for use on another Linux host
+// Most formats are a single file; networkd produces a .netdev and .network pair
+func Export(cfg *cloudflare.WireGuardConfig, format string, opts ExportOptions) ([]ExportFile, error) {
+	if cfg.PrivateKey == "" || cfg.PeerPublicKey == "" {
+		return nil, fmt.Errorf("incomplete WireGuard configuration from Cloudflare")
+	}
+	cfg, err := withEndpoint(cfg, opts.EndpointPreference)
+	if err != nil {
+		return nil, err
+	}
+	if opts.InterfaceName == "" {
+		return nil, fmt.Errorf("missing interface name")
+	}
+	if len(opts.Addresses) == 0 {
+		opts.Addresses = cfg.Addresses
+	}
+	if len(opts.AllowedIPs) == 0 {
+		opts.AllowedIPs = cfg.AllowedIPs
+	}
+	if len(opts.DNS) == 0 {
+		opts.DNS = cfg.DNS
+	}
+
+	name := opts.InterfaceName
+	switch format {
+	case ExportWgQuick:
+		return []ExportFile{{name + ".conf", exportWgQuick(cfg, opts)}}, nil
+	case ExportJSON:
+		content, err := exportJSON(cfg, opts)
+		if err != nil {
+			return nil, err
+		}
+		return []ExportFile{{name + ".json", content}}, nil
+	case ExportNetworkd:
+		return []ExportFile{
+			{name + ".netdev", exportNetdev(cfg, opts)},
+			{name + ".network", exportNetwork(opts)},
+		}, nil
+	case ExportNMConnection:
+		return []ExportFile{{name + ".nmconnection", exportNMConnection(cfg, opts)}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported export format %q (expected %s)", format, strings.Join(ExportFormats, ", "))
+	}
+}
+
+// endpoint formats the peer endpoint as host:port
+func endpoint(cfg *cloudflare.WireGuardConfig) string {
+	return FormatEndpoint(cfg.Endpoint, cfg.EndpointPort)
+}
+
+// exportWgQuick renders a configuration file for wg-quick
+func exportWgQuick(cfg *cloudflare.WireGuardConfig, opts ExportOptions) string {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", cfg.PrivateKey)
+	if len(opts.Addresses) > 0 {
+		fmt.Fprintf(&b, "Address = %s\n", strings.Join(opts.Addresses, ", "))
+	}
+	if len(opts.DNS) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", strings.Join(opts.DNS, ", "))
+	}
+	if opts.MTU > 0 {
+		fmt.Fprintf(&b, "MTU = %d\n", opts.MTU)
+	}
+
+	b.WriteString("\n")
+	writeWgQuickPeer(&b, cfg, opts, opts.markPeer)
+	return b.String()
+}
+
+// writeWgQuickPeer writes the [Peer] section of a wg-quick configuration, optionally marked as the Cloudflare peer
+// Empty AllowedIPs fall back to the ones issued by Cloudflare
+func writeWgQuickPeer(b *strings.Builder, cfg *cloudflare.WireGuardConfig, opts ExportOptions, mark bool) {
+	allowedIPs := opts.AllowedIPs
+	if len(allowedIPs) == 0 {
+		allowedIPs = cfg.AllowedIPs
+	}
+
+	b.WriteString("[Peer]\n")
+	if mark {
+		b.WriteString(CloudflarePeerMarker + "\n")
+	}
+	fmt.Fprintf(b, "PublicKey = %s\n", cfg.PeerPublicKey)
+	if cfg.PeerPresharedKey != "" {
+		fmt.Fprintf(b, "PresharedKey = %s\n", cfg.PeerPresharedKey)
+	}
+	fmt.Fprintf(b, "AllowedIPs = %s\n", strings.Join(allowedIPs, ", "))
+	fmt.Fprintf(b, "Endpoint = %s\n", endpoint(cfg))
+	if opts.PersistentKeepalive > 0 {
+		fmt.Fprintf(b, "PersistentKeepalive = %d\n", opts.PersistentKeepalive)
+	}
+}
+
+// exportedConfig is the JSON export format
+type exportedConfig struct {
+	Interface struct {
+		Name       string   `json:"name"`
+		PrivateKey string   `json:"private_key"`
+		PublicKey  string   `json:"public_key"`
+		Addresses  []string `json:"addresses,omitempty"`
+		DNS        []string `json:"dns,omitempty"`
+		MTU        int      `json:"mtu,omitempty"`
+	} `json:"interface"`
+	Peer struct {
+		PublicKey           string   `json:"public_key"`
+		PresharedKey        string   `json:"preshared_key,omitempty"`
+		Endpoint            string   `json:"endpoint"`
+		AllowedIPs          []string `json:"allowed_ips"`
+		PersistentKeepalive int      `json:"persistent_keepalive,omitempty"`
+	} `json:"peer"`
+}
+
+// exportJSON renders the configuration as JSON for scripts and configuration management
+func exportJSON(cfg *cloudflare.WireGuardConfig, opts ExportOptions) (string, error) {
+	var exported exportedConfig
+	exported.Interface.Name = opts.InterfaceName
+	exported.Interface.PrivateKey = cfg.PrivateKey
+	exported.Interface.PublicKey = cfg.PublicKey
+	exported.Interface.Addresses = opts.Addresses
+	exported.Interface.DNS = opts.DNS
+	exported.Interface.MTU = opts.MTU
+	exported.Peer.PublicKey = cfg.PeerPublicKey
+	exported.Peer.PresharedKey = cfg.PeerPresharedKey
+	exported.Peer.Endpoint = endpoint(cfg)
+	exported.Peer.AllowedIPs = opts.AllowedIPs
+	exported.Peer.PersistentKeepalive = opts.PersistentKeepalive
+
+	data, err := json.MarshalIndent(exported, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("error encoding configuration: %w", err)
+	}
+	return string(data) + "\n", nil
+}
+
+// exportNetdev renders the systemd-networkd .netdev file defining the WireGuard device
+func exportNetdev(cfg *cloudflare.WireGuardConfig, opts ExportOptions) string {
+	var b strings.Builder
+	b.WriteString("[NetDev]\n")
+	fmt.Fprintf(&b, "Name=%s\n", opts.InterfaceName)
+	b.WriteString("Kind=wireguard\n")
+	if opts.MTU > 0 {
+		fmt.Fprintf(&b, "MTUBytes=%d\n", opts.MTU)
+	}
+
+	b.WriteString("\n[WireGuard]\n")
+	fmt.Fprintf(&b, "PrivateKey=%s\n", cfg.PrivateKey)
+
+	b.WriteString("\n[WireGuardPeer]\n")
+	fmt.Fprintf(&b, "PublicKey=%s\n", cfg.PeerPublicKey)
+	if cfg.PeerPresharedKey != "" {
+		fmt.Fprintf(&b, "PresharedKey=%s\n", cfg.PeerPresharedKey)
+	}
+	fmt.Fprintf(&b, "AllowedIPs=%s\n", strings.Join(opts.AllowedIPs, ","))
+	fmt.Fprintf(&b, "Endpoint=%s\n", endpoint(cfg))
+	if opts.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "PersistentKeepalive=%d\n", opts.PersistentKeepalive)
+	}
+	return b.String()
+}
+
+// exportNetwork renders the systemd-networkd .network file configuring the addresses of the device
+func exportNetwork(opts ExportOptions) string {
+	var b strings.Builder
+	b.WriteString("[Match]\n")
+	fmt.Fprintf(&b, "Name=%s\n", opts.InterfaceName)
+
+	b.WriteString("\n[Network]\n")
+	for _, address := range opts.Addresses {
+		fmt.Fprintf(&b, "Address=%s\n", address)
+	}
+	for _, dns := range opts.DNS {
+		fmt.Fprintf(&b, "DNS=%s\n", dns)
+	}
+	return b.String()
+}
+
+// exportNMConnection renders a NetworkManager keyfile connection profile
+func exportNMConnection(cfg *cloudflare.WireGuardConfig, opts ExportOptions) string {
+	var ipv4, ipv6 []string
+	for _, address := range opts.Addresses {
+		if strings.Contains(address, ":") {
+			ipv6 = append(ipv6, address)
+		} else {
+			ipv4 = append(ipv4, address)
+		}
+	}
+	var dns4, dns6 []string
+	for _, dns := range opts.DNS {
+		if strings.Contains(dns, ":") {
+			dns6 = append(dns6, dns)
+		} else {
+			dns4 = append(dns4, dns)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("[connection]\n")
+	fmt.Fprintf(&b, "id=%s\n", opts.InterfaceName)
+	b.WriteString("type=wireguard\n")
+	fmt.Fprintf(&b, "interface-name=%s\n", opts.InterfaceName)
+
+	b.WriteString("\n[wireguard]\n")
+	fmt.Fprintf(&b, "private-key=%s\n", cfg.PrivateKey)
+	if opts.MTU > 0 {
+		fmt.Fprintf(&b, "mtu=%d\n", opts.MTU)
+	}
+
+	fmt.Fprintf(&b, "\n[wireguard-peer.%s]\n", cfg.PeerPublicKey)
+	fmt.Fprintf(&b, "endpoint=%s\n", endpoint(cfg))
+	if cfg.PeerPresharedKey != "" {
+		fmt.Fprintf(&b, "preshared-key=%s\n", cfg.PeerPresharedKey)
+		b.WriteString("preshared-key-flags=0\n")
+	}
+	fmt.Fprintf(&b, "allowed-ips=%s;\n", strings.Join(opts.AllowedIPs, ";"))
+	if opts.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "persistent-keepalive=%d\n", opts.PersistentKeepalive)
+	}
+
+	writeNMIPSection(&b, "ipv4", ipv4, dns4)
+	writeNMIPSection(&b, "ipv6", ipv6, dns6)
+	return b.String()
+}
+
+// writeNMIPSection writes an [ipv4] or [ipv6] section of a NetworkManager keyfile
+func writeNMIPSection(b *strings.Builder, section string, addresses, dns []string) {
+	fmt.Fprintf(b, "\n[%s]\n", section)
+	if len(addresses) == 0 {
+		if section == "ipv6" {
+			b.WriteString("method=ignore\n")
+		} else {
+			b.WriteString("method=disabled\n")
+		}
+		return
+	}
+
+	b.WriteString("method=manual\n")
+	for i, address := range addresses {
+		fmt.Fprintf(b, "address%d=%s\n", i+1, address)
+	}
+	if len(dns) > 0 {
+		fmt.Fprintf(b, "dns=%s;\n", strings.Join(dns, ";"))
+	}
+}
@@ -0,0 +1,161 @@
+package wireguard
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// testExportOptions returns dual-stack export options
+func testExportOptions() ExportOptions {
+	return ExportOptions{
+		InterfaceName:       "cf0",
+		Addresses:           []string{"100.64.0.2/32", "2606:4700:110:8a36::2/128"},
+		MTU:                 1280,
+		PersistentKeepalive: 25,
+	}
+}
+
+func TestExportWgQuick(t *testing.T) {
+	cfg := testWireGuardConfig()
+	cfg.DNS = []string{"1.1.1.1"}
+
+	files, err := Export(cfg, ExportWgQuick, testExportOptions())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 100.64.0.2/32, 2606:4700:110:8a36::2/128
+DNS = 1.1.1.1
+MTU = 1280
+
+[Peer]
+PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=
+AllowedIPs = 0.0.0.0/0
+Endpoint = engage.cloudflareclient.com:2408
+PersistentKeepalive = 25
+`
+	if len(files) != 1 || files[0].Name != "cf0.conf" || files[0].Content != expected {
+		t.Errorf("Unexpected export %+v\nexpected:\n%s", files, expected)
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	opts := testExportOptions()
+	opts.AllowedIPs = []string{"10.0.0.0/8"}
+
+	files, err := Export(testWireGuardConfig(), ExportJSON, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var exported exportedConfig
+	if err := json.Unmarshal([]byte(files[0].Content), &exported); err != nil {
+		t.Fatalf("Export is not valid JSON: %v", err)
+	}
+	if exported.Interface.Name != "cf0" || exported.Interface.MTU != 1280 || len(exported.Interface.Addresses) != 2 {
+		t.Errorf("Unexpected interface %+v", exported.Interface)
+	}
+	if exported.Peer.Endpoint != "engage.cloudflareclient.com:2408" || exported.Peer.AllowedIPs[0] != "10.0.0.0/8" {
+		t.Errorf("Unexpected peer %+v", exported.Peer)
+	}
+}
+
+func TestExportFallsBackToAssignedAddresses(t *testing.T) {
+	cfg := testWireGuardConfig()
+	cfg.Addresses = []string{"172.16.0.2/32"}
+	opts := testExportOptions()
+	opts.Addresses = nil
+
+	files, err := Export(cfg, ExportWgQuick, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(files[0].Content, "Address = 172.16.0.2/32\n") {
+		t.Errorf("Expected the assigned address:\n%s", files[0].Content)
+	}
+}
+
+func TestExportNetworkd(t *testing.T) {
+	cfg := testWireGuardConfig()
+	cfg.PeerPresharedKey = "FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE="
+
+	files, err := Export(cfg, ExportNetworkd, testExportOptions())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(files) != 2 || files[0].Name != "cf0.netdev" || files[1].Name != "cf0.network" {
+		t.Fatalf("Expected a .netdev and .network pair, got %+v", files)
+	}
+
+	for _, expected := range []string{"Kind=wireguard", "MTUBytes=1280", "PrivateKey=" + cfg.PrivateKey, "PresharedKey=" + cfg.PeerPresharedKey, "Endpoint=engage.cloudflareclient.com:2408"} {
+		if !strings.Contains(files[0].Content, expected) {
+			t.Errorf("Expected %q in .netdev:\n%s", expected, files[0].Content)
+		}
+	}
+	for _, expected := range []string{"Name=cf0", "Address=100.64.0.2/32", "Address=2606:4700:110:8a36::2/128"} {
+		if !strings.Contains(files[1].Content, expected) {
+			t.Errorf("Expected %q in .network:\n%s", expected, files[1].Content)
+		}
+	}
+}
+
+func TestExportNMConnection(t *testing.T) {
+	opts := testExportOptions()
+	opts.DNS = []string{"1.1.1.1", "2606:4700:4700::1111"}
+
+	files, err := Export(testWireGuardConfig(), ExportNMConnection, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	content := files[0].Content
+	for _, expected := range []string{
+		"type=wireguard",
+		"[wireguard-peer.bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=]",
+		"allowed-ips=0.0.0.0/0;",
+		"[ipv4]\nmethod=manual\naddress1=100.64.0.2/32\ndns=1.1.1.1;",
+		"[ipv6]\nmethod=manual\naddress1=2606:4700:110:8a36::2/128\ndns=2606:4700:4700::1111;",
+	} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("Expected %q in keyfile:\n%s", expected, content)
+		}
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	if _, err := Export(testWireGuardConfig(), "ifupdown", testExportOptions()); err == nil {
+		t.Error("Expected error for unsupported format")
+	}
+
+	cfg := testWireGuardConfig()
+	cfg.PrivateKey = ""
+	if _, err := Export(cfg, ExportWgQuick, testExportOptions()); err == nil {
+		t.Error("Expected error for incomplete configuration")
+	}
+}
+
+func TestManagerExportMatchesRenderedConfig(t *testing.T) {
+	m := newTestManager(t)
+	m.config.WireGuard.ResolveEndpoint = true
+	lookups := 0
+	m.resolver = fakeResolver(map[string][]string{"engage.cloudflareclient.com": {"162.159.192.1"}}, &lookups)
+
+	_, rendered, err := m.RenderConfig(testWireGuardConfig())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	files, err := m.Export(testWireGuardConfig(), ExportWgQuick, testExportOptions())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Both use the resolved endpoint the service writes
+	for _, content := range []string{rendered, files[0].Content} {
+		if !strings.Contains(content, "Endpoint = 162.159.192.1:2408\n") {
+			t.Errorf("Expected the resolved endpoint:\n%s", content)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package wireguard
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/state"
+)
+
+// EndpointCandidates returns the endpoints to try for the Cloudflare configuration, most preferred first
+func (m *Manager) EndpointCandidates(cfg *cloudflare.WireGuardConfig) ([]string, error) {
+	return EndpointCandidates(cfg, m.config.WireGuard.EndpointPreference,
+		m.config.WireGuard.FallbackEndpoints, m.config.WireGuard.EndpointPorts)
+}
+
+// Endpoint returns the endpoint the configuration is written with: the last one known to work
+// if it is still a candidate, otherwise the most preferred candidate
+func (m *Manager) Endpoint(cfg *cloudflare.WireGuardConfig) (string, error) {
+	candidates, err := m.EndpointCandidates(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	if last := m.lastEndpoint(); last != "" {
+		for _, candidate := range candidates {
+			if candidate == last {
+				return last, nil
+			}
+		}
+	}
+	return candidates[0], nil
+}
+
+// selectEndpoint returns a copy of the Cloudflare configuration with the endpoint from Endpoint as its only endpoint
+// With endpoint resolution enabled, the hostname is replaced with its address, keeping the address already in use if still valid
+func (m *Manager) selectEndpoint(cfg *cloudflare.WireGuardConfig) (*cloudflare.WireGuardConfig, error) {
+	endpoint, err := m.Endpoint(cfg)
+	if err != nil {
+		return nil, err
+	}
+	current, _ := m.PeerEndpoint()
+	endpoint = m.pinEndpoint(context.Background(), endpoint, current)
+
+	host, port, err := ParseEndpoint(endpoint, cfg.EndpointPort)
+	if err != nil {
+		return nil, err
+	}
+	return endpointConfig(cfg, host, port), nil
+}
+
+// lastEndpoint returns the last endpoint known to work, or an empty string if there is none
+func (m *Manager) lastEndpoint() string {
+	if m.config.StateFile == "" {
+		return ""
+	}
+
+	s, err := state.Load(m.config.StateFile)
+	if err != nil {
+		logger.Warn("Ignoring the state file", "error", err)
+		return ""
+	}
+	return s.LastEndpoint
+}
+
+// RememberEndpoint records the endpoint as the last one known to work
+func (m *Manager) RememberEndpoint(ctx context.Context, endpoint string) error {
+	if m.config.StateFile == "" {
+		return nil
+	}
+
+	now := time.Now()
+	err := state.Update(m.config.StateFile, func(s *state.State) {
+		s.LastEndpoint = endpoint
+		s.LastEndpointAt = &now
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.DebugContext(ctx, "Remembered working endpoint", "endpoint", endpoint)
+	return nil
+}
+
+// SetPeerEndpoint changes the endpoint of a peer on the running interface without restarting it
+func (m *Manager) SetPeerEndpoint(ctx context.Context, peerPublicKey, endpoint string) error {
+	cmd := exec.CommandContext(ctx, "wg", "set", m.config.WireGuard.InterfaceName, "peer", peerPublicKey, "endpoint", endpoint)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set endpoint of WireGuard peer: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Failover moves the Cloudflare peer through the endpoint candidates while handshakes fail
+// and keeps the address of a hostname endpoint current
+// Switching happens on the running interface; the configuration file picks up the endpoint
+// once it has worked, through the state file, on the next update
+type Failover struct {
+	manager *Manager
+
+	// setEndpoint changes the peer endpoint on the interface; replaced in tests
+	setEndpoint func(ctx context.Context, peerPublicKey, endpoint string) error
+
+	mu            sync.Mutex
+	peerPublicKey string
+	candidates    []string
+	current       int
+	attempts      int
+
+	// applied is the endpoint set on the interface, which is an address when endpoints are resolved
+	applied string
+}
+
+// NewFailover creates a failover for the manager's interface
+func NewFailover(manager *Manager) *Failover {
+	return &Failover{manager: manager, setEndpoint: manager.SetPeerEndpoint}
+}
+
+// Reset starts over with the candidates of a freshly applied configuration
+func (f *Failover) Reset(cfg *cloudflare.WireGuardConfig) error {
+	candidates, err := f.manager.EndpointCandidates(cfg)
+	if err != nil {
+		return err
+	}
+	endpoint, err := f.manager.Endpoint(cfg)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.peerPublicKey = cfg.PeerPublicKey
+	f.candidates = candidates
+	f.current = 0
+	f.attempts = 0
+	f.applied, _ = f.manager.PeerEndpoint()
+	for i, candidate := range candidates {
+		if candidate == endpoint {
+			f.current = i
+		}
+	}
+	return nil
+}
+
+// Current returns the endpoint in use, or an empty string before the first Reset
+func (f *Failover) Current() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.candidates) == 0 {
+		return ""
+	}
+	return f.candidates[f.current]
+}
+
+// Next switches the peer to the next candidate
+// It returns false once every candidate has been tried since the last working one, or if switching failed
+func (f *Failover) Next(ctx context.Context) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.attempts >= len(f.candidates)-1 {
+		f.attempts = 0
+		return false
+	}
+
+	next := (f.current + 1) % len(f.candidates)
+	endpoint := f.manager.resolveEndpoint(ctx, f.candidates[next])
+	if err := f.setEndpoint(ctx, f.peerPublicKey, endpoint); err != nil {
+		logger.WarnContext(ctx, "Failed to switch endpoint", "endpoint", endpoint, "error", err)
+		return false
+	}
+
+	logger.InfoContext(ctx, "Switched to the next endpoint candidate",
+		"from", f.candidates[f.current], "to", f.candidates[next], "address", endpoint,
+		"attempt", f.attempts+1, "candidates", len(f.candidates))
+	f.current = next
+	f.attempts++
+	f.applied = endpoint
+	return true
+}
+
+// Reresolve looks up the hostname of the endpoint in use again and updates the peer when its address changed
+// It reports whether the endpoint was updated
+func (f *Failover) Reresolve(ctx context.Context) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.candidates) == 0 {
+		return false
+	}
+
+	endpoint := f.manager.pinEndpoint(ctx, f.candidates[f.current], f.applied)
+	if endpoint == f.applied {
+		return false
+	}
+
+	if err := f.setEndpoint(ctx, f.peerPublicKey, endpoint); err != nil {
+		logger.WarnContext(ctx, "Failed to update endpoint address", "endpoint", endpoint, "error", err)
+		return false
+	}
+
+	logger.InfoContext(ctx, "Endpoint address changed, updated the peer",
+		"endpoint", f.candidates[f.current], "from", f.applied, "to", endpoint)
+	f.applied = endpoint
+	return true
+}
+
+// Confirm records the endpoint in use as working, so it is used first from now on
+func (f *Failover) Confirm(ctx context.Context) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.candidates) == 0 {
+		return
+	}
+	f.attempts = 0
+
+	endpoint := f.candidates[f.current]
+	if err := f.manager.RememberEndpoint(ctx, endpoint); err != nil {
+		logger.WarnContext(ctx, "Failed to remember working endpoint", "endpoint", endpoint, "error", err)
+		return
+	}
+	logger.InfoContext(ctx, "Handshake succeeded", "endpoint", endpoint)
+}
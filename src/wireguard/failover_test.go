@@ -0,0 +1,141 @@
+package wireguard
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gumbees/cfwg-zt/src/state"
+)
+
+func TestEndpointCandidates(t *testing.T) {
+	tests := []struct {
+		name       string
+		preference string
+		v4, v6     string
+		fallbacks  []string
+		ports      []int
+		expected   []string
+	}{
+		{
+			name:     "issued endpoint only",
+			expected: []string{"engage.cloudflareclient.com:2408"},
+		},
+		{
+			name:     "issued endpoint on every port",
+			ports:    []int{2408, 500, 1701, 4500},
+			expected: []string{"engage.cloudflareclient.com:2408", "engage.cloudflareclient.com:500", "engage.cloudflareclient.com:1701", "engage.cloudflareclient.com:4500"},
+		},
+		{
+			name:       "preferred family first",
+			preference: EndpointIPv6,
+			v4:         "162.159.192.1",
+			v6:         "2606:4700:d0::a29f:c001",
+			ports:      []int{500},
+			expected: []string{
+				"[2606:4700:d0::a29f:c001]:2408", "[2606:4700:d0::a29f:c001]:500",
+				"engage.cloudflareclient.com:2408", "engage.cloudflareclient.com:500",
+				"162.159.192.1:2408", "162.159.192.1:500",
+			},
+		},
+		{
+			name:      "fallbacks after issued endpoints",
+			fallbacks: []string{"162.159.193.1", "[2606:4700:d0::a29f:c005]:1701", "engage.cloudflareclient.com"},
+			ports:     []int{500, 0, 70000},
+			expected: []string{
+				"engage.cloudflareclient.com:2408", "engage.cloudflareclient.com:500",
+				"162.159.193.1:2408", "162.159.193.1:500",
+				"[2606:4700:d0::a29f:c005]:1701",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		cfg := testWireGuardConfig()
+		cfg.EndpointV4, cfg.EndpointV6 = test.v4, test.v6
+
+		candidates, err := EndpointCandidates(cfg, test.preference, test.fallbacks, test.ports)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if fmt.Sprint(candidates) != fmt.Sprint(test.expected) {
+			t.Errorf("%s: got %v; expected %v", test.name, candidates, test.expected)
+		}
+	}
+
+	if _, err := EndpointCandidates(testWireGuardConfig(), "", []string{"[not-an-ip]"}, nil); err == nil {
+		t.Error("Expected error for invalid fallback endpoint")
+	}
+}
+
+func TestFailoverRotatesThroughCandidates(t *testing.T) {
+	m := newTestManager(t)
+	m.config.WireGuard.EndpointPorts = []int{2408, 500, 1701}
+
+	var switched []string
+	f := NewFailover(m)
+	f.setEndpoint = func(ctx context.Context, peerPublicKey, endpoint string) error {
+		if peerPublicKey != testWireGuardConfig().PeerPublicKey {
+			t.Errorf("Unexpected peer %s", peerPublicKey)
+		}
+		switched = append(switched, endpoint)
+		return nil
+	}
+
+	if f.Next(context.Background()) {
+		t.Error("Expected no failover before the first Reset")
+	}
+	if err := f.Reset(testWireGuardConfig()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Every other candidate is tried once, then the failover gives up until it is confirmed or reset
+	ctx := context.Background()
+	for f.Next(ctx) {
+	}
+	expected := []string{"engage.cloudflareclient.com:500", "engage.cloudflareclient.com:1701"}
+	if fmt.Sprint(switched) != fmt.Sprint(expected) {
+		t.Errorf("Switched to %v; expected %v", switched, expected)
+	}
+
+	// A working endpoint is remembered and used for the configuration from then on
+	f.Confirm(ctx)
+	s, err := state.Load(m.config.StateFile)
+	if err != nil || s.LastEndpoint != "engage.cloudflareclient.com:1701" {
+		t.Errorf("Expected the working endpoint in state, got %+v, %v", s, err)
+	}
+
+	_, next, err := m.RenderConfig(testWireGuardConfig())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(next, "Endpoint = engage.cloudflareclient.com:1701\n") {
+		t.Errorf("Expected the remembered endpoint in the config:\n%s", next)
+	}
+
+	if err := f.Reset(testWireGuardConfig()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if f.Current() != "engage.cloudflareclient.com:1701" {
+		t.Errorf("Expected failover to start from the remembered endpoint, got %s", f.Current())
+	}
+	if !f.Next(ctx) || f.Current() != "engage.cloudflareclient.com:2408" {
+		t.Errorf("Expected failover to wrap around, got %s", f.Current())
+	}
+}
+
+func TestRememberedEndpointIgnoredWhenNoLongerCandidate(t *testing.T) {
+	m := newTestManager(t)
+	os.WriteFile(m.config.StateFile, []byte(`{"last_endpoint": "162.159.193.1:2408"}`), 0600)
+
+	endpoint, err := m.Endpoint(testWireGuardConfig())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if endpoint != "engage.cloudflareclient.com:2408" {
+		t.Errorf("Expected the issued endpoint, got %s", endpoint)
+	}
+}
@@ -1,79 +1,162 @@
 package wireguard
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
-	"strings"
-	"text/template"
 	"time"
 
 	"github.com/gumbees/cfwg-zt/src/cloudflare"
 	"github.com/gumbees/cfwg-zt/src/config"
+	"github.com/gumbees/cfwg-zt/src/logging"
+)
+
+var logger = logging.Component("wireguard")
+
+// Keys shipped in install/dummy-wireguard.conf for the initial UDM Pro UI import
+const (
+	DummyPrivateKey    = "mLmL+DB1n8MfA+7Dc+vnEdZD+VffR3Li3QcJhdTLuEU="
+	DummyPeerPublicKey = "YOw/RK8gT3PR4ImRfpnfvJ8UTY3GfJlO6PcPbl40Tkw="
 )
 
 // Manager handles WireGuard configuration generation and management
 type Manager struct {
-	config *config.Config
+	config   *config.Config
+	resolver *Resolver
+
+	// lastBackupPath is the backup taken by the most recent UpdateConfig call, used by Rollback
+	lastBackupPath string
 }
 
 // NewManager creates a new WireGuard manager
 func NewManager(cfg *config.Config) *Manager {
-	return &Manager{config: cfg}
+	resolver, err := NewResolver(cfg.WireGuard.Resolvers)
+	if err != nil {
+		logger.Warn("Ignoring the configured resolvers, using the system resolver", "error", err)
+		resolver, _ = NewResolver(nil)
+	}
+	return &Manager{config: cfg, resolver: resolver}
 }
 
-// ValidateConfig checks if the WireGuard configuration is properly set up for Cloudflare Zero Trust
-// This is especially useful for validating that the dummy configuration was properly imported
-func (m *Manager) ValidateConfig() (bool, error) {
-	configPath := m.config.WireGuard.ConfigPath
-	
-	// Check if the configuration file exists
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		return false, fmt.Errorf("WireGuard configuration file not found at %s", configPath)
+// cloudflarePeer returns the Cloudflare [Peer] section of the WireGuard configuration
+func (m *Manager) cloudflarePeer() (configSection, error) {
+	configData, err := os.ReadFile(m.config.WireGuard.ConfigPath)
+	if err != nil {
+		return configSection{}, fmt.Errorf("failed to read WireGuard configuration: %w", err)
 	}
-	
-	// Read the configuration file
-	configData, err := os.ReadFile(configPath)
+
+	sections := parseSections(string(configData))
+	peer := findCloudflarePeer(sections, []string{DummyPeerPublicKey}, nil)
+	if peer < 0 {
+		// A single peer is the Cloudflare peer, even if nothing identifies it as such
+		peers := sectionIndexes(sections, "Peer")
+		if len(peers) != 1 {
+			return configSection{}, fmt.Errorf("no Cloudflare peer found in %s", m.config.WireGuard.ConfigPath)
+		}
+		peer = peers[0]
+	}
+	return sections[peer], nil
+}
+
+// PeerEndpoint returns the Endpoint value of the Cloudflare [Peer] section in the WireGuard configuration
+func (m *Manager) PeerEndpoint() (string, error) {
+	peer, err := m.cloudflarePeer()
 	if err != nil {
-		return false, fmt.Errorf("failed to read WireGuard configuration: %w", err)
+		return "", err
 	}
-	
-	configContent := string(configData)
-	
-	// Check for required sections
-	if !strings.Contains(configContent, "[Interface]") {
-		return false, fmt.Errorf("WireGuard configuration is missing [Interface] section")
+
+	if endpoint := peer.value("Endpoint"); endpoint != "" {
+		return endpoint, nil
 	}
-	
-	if !strings.Contains(configContent, "[Peer]") {
-		return false, fmt.Errorf("WireGuard configuration is missing [Peer] section")
+	return "", fmt.Errorf("no peer endpoint found in %s", m.config.WireGuard.ConfigPath)
+}
+
+// PeerPublicKey returns the PublicKey value of the Cloudflare [Peer] section in the WireGuard configuration
+func (m *Manager) PeerPublicKey() (string, error) {
+	peer, err := m.cloudflarePeer()
+	if err != nil {
+		return "", err
 	}
-	
-	// Check if it contains the dummy keys that need to be replaced
-	if strings.Contains(configContent, "mLmL+DB1n8MfA+7Dc+vnEdZD+VffR3Li3QcJhdTLuEU=") ||
-	   strings.Contains(configContent, "YOw/RK8gT3PR4ImRfpnfvJ8UTY3GfJlO6PcPbl40Tkw=") {
-		log.Println("WireGuard configuration contains dummy keys that need to be replaced")
-		log.Println("This is normal if you just imported the dummy configuration. Keys will be updated automatically.")
-		// Return true because even with dummy keys, the file structure is valid
-		return true, nil
+
+	if publicKey := peer.value("PublicKey"); publicKey != "" {
+		return publicKey, nil
 	}
-	
-	return true, nil
+	return "", fmt.Errorf("no peer public key found in %s", m.config.WireGuard.ConfigPath)
+}
+
+// LatestHandshake returns the time of the most recent handshake of the Cloudflare peer
+// Other peers of the interface are ignored, so they can't hide a dead tunnel to Cloudflare
+// A zero time means no handshake has happened yet
+func (m *Manager) LatestHandshake() (time.Time, error) {
+	publicKey, err := m.PeerPublicKey()
+	if err != nil {
+		return time.Time{}, err
+	}
+	stats, err := m.Stats()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	peer := stats.Peer(publicKey)
+	if peer == nil {
+		return time.Time{}, fmt.Errorf("Cloudflare peer %s is not on interface %s", publicKey, m.config.WireGuard.InterfaceName)
+	}
+	return peer.LatestHandshake, nil
+}
+
+// RenderConfig returns the current content of the WireGuard configuration file and the content UpdateConfig would write
+// The current content is empty when the file doesn't exist yet
+func (m *Manager) RenderConfig(cfg *cloudflare.WireGuardConfig) (string, string, error) {
+	configData, err := os.ReadFile(m.config.WireGuard.ConfigPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", fmt.Errorf("failed to read existing config: %w", err)
+	}
+
+	// The Cloudflare peer is recognized by an endpoint on any of the candidate hosts
+	candidates, err := m.EndpointCandidates(cfg)
+	if err != nil {
+		return "", "", err
+	}
+	hosts := endpointHosts(candidates)
+
+	// The last endpoint known to work is kept as long as it is still a candidate
+	cfg, err = m.selectEndpoint(cfg)
+	if err != nil {
+		return "", "", err
+	}
+	opts := m.renderOptions()
+
+	existingConfig := string(configData)
+	if existingConfig == "" {
+		configContent, err := buildWireGuardConfig(cfg, opts)
+		return "", configContent, err
+	}
+
+	// Preserve the settings of the existing config and only update the authentication-related fields
+	return existingConfig, mergeWithExistingConfig(existingConfig, cfg, opts, hosts), nil
 }
 
 // UpdateConfig updates the WireGuard configuration file with the provided Cloudflare configuration
 // Only updates authentication-related fields while trying to preserve existing UDM Pro UI settings
-func (m *Manager) UpdateConfig(cfg *cloudflare.WireGuardConfig) error {
+func (m *Manager) UpdateConfig(ctx context.Context, cfg *cloudflare.WireGuardConfig) error {
 	// Create backup directory if it doesn't exist
 	if err := os.MkdirAll(m.config.UDMPro.ConfigBackupPath, 0755); err != nil {
 		return fmt.Errorf("failed to create backup directory: %w", err)
 	}
 
-	// Check if an existing configuration is present
+	m.lastBackupPath = ""
 	configPath := m.config.WireGuard.ConfigPath
-	existingConfig := ""
-	hasExistingConfig := false
+
+	existingConfig, configContent, err := m.RenderConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Never replace the configuration with one wg-quick would reject
+	if err := ValidateContent(configContent, cfg.PublicKey).Err(); err != nil {
+		return fmt.Errorf("refusing to write WireGuard configuration: %w", err)
+	}
 
 	if _, err := os.Stat(configPath); err == nil {
 		// Create a backup of the existing configuration
@@ -85,27 +168,12 @@ func (m *Manager) UpdateConfig(cfg *cloudflare.WireGuardConfig) error {
 			),
 		)
 		
-		configData, err := os.ReadFile(configPath)
-		if err != nil {
-			return fmt.Errorf("failed to read existing config for backup: %w", err)
-		}
-		
-		existingConfig = string(configData)
-		hasExistingConfig = true
-		
-		if err := os.WriteFile(backupPath, configData, 0600); err != nil {
+		if err := os.WriteFile(backupPath, []byte(existingConfig), 0600); err != nil {
 			return fmt.Errorf("failed to create backup: %w", err)
 		}
 		
-		log.Printf("Created backup of WireGuard configuration at %s", backupPath)
-	}
-
-	// Generate the new configuration content
-	configContent := buildWireGuardConfig(cfg)
-	
-	// If we have an existing config, try to preserve some settings from it
-	if hasExistingConfig && len(existingConfig) > 0 {
-		configContent = mergeWithExistingConfig(existingConfig, cfg)
+		logger.InfoContext(ctx, "Created backup of WireGuard configuration", "path", backupPath)
+		m.lastBackupPath = backupPath
 	}
 	
 	// Write the new configuration
@@ -113,144 +181,53 @@ func (m *Manager) UpdateConfig(cfg *cloudflare.WireGuardConfig) error {
 		return fmt.Errorf("failed to write WireGuard configuration: %w", err)
 	}
 
-	log.Printf("Updated WireGuard configuration at %s", configPath)
+	logger.InfoContext(ctx, "Updated WireGuard configuration", "path", configPath)
 	return nil
 }
 
-// buildWireGuardConfig generates a WireGuard configuration file based on Cloudflare data
-// It preserves the existing configuration structure and only updates authentication-related fields
-func buildWireGuardConfig(cfg *cloudflare.WireGuardConfig) string {
-	// Validate the configuration
-	if cfg.PrivateKey == "" || cfg.PublicKey == "" || cfg.PeerPublicKey == "" || cfg.Endpoint == "" {
-		log.Printf("Error: Invalid WireGuard configuration, missing required fields")
-		log.Printf("PrivateKey present: %v", cfg.PrivateKey != "")
-		log.Printf("PublicKey present: %v", cfg.PublicKey != "")
-		log.Printf("PeerPublicKey present: %v", cfg.PeerPublicKey != "")
-		log.Printf("Endpoint present: %v", cfg.Endpoint != "")
-		return ""
+// Rollback restores the WireGuard configuration from the backup taken by the most recent UpdateConfig call
+func (m *Manager) Rollback(ctx context.Context) error {
+	if m.lastBackupPath == "" {
+		return fmt.Errorf("no backup available to roll back to")
 	}
 
-	wgConfigTemplate := `[Interface]
-PrivateKey = {{ .PrivateKey }}
-# Note: Address and DNS settings are now managed via the UDM Pro UI
-# The following lines are maintained for compatibility with UI-created config
-Address = 100.64.0.1/32
-{{- if .DNS }}
-DNS = {{ range $index, $dns := .DNS }}{{if $index}}, {{end}}{{ $dns }}{{end}}
-{{- end }}
-MTU = 1280
-
-[Peer]
-PublicKey = {{ .PeerPublicKey }}
-{{- if .PeerPresharedKey }}
-PresharedKey = {{ .PeerPresharedKey }}
-{{- end }}
-# AllowedIPs is now managed via the UDM Pro UI's policy-based routing
-AllowedIPs = {{ range $index, $ip := .AllowedIPs }}{{if $index}}, {{end}}{{ $ip }}{{end}}
-Endpoint = {{ .Endpoint }}:{{ .EndpointPort }}
-PersistentKeepalive = 25
-`
-
-	// Create a template and parse it
-	tmpl, err := template.New("wireguard").Parse(wgConfigTemplate)
+	backupData, err := os.ReadFile(m.lastBackupPath)
 	if err != nil {
-		log.Printf("Error creating WireGuard config template: %v", err)
-		// Return a basic configuration as fallback
-		return fmt.Sprintf(`[Interface]
-PrivateKey = %s
-Address = 100.64.0.1/32
-MTU = 1280
-Table = off
-
-[Peer]
-PublicKey = %s
-AllowedIPs = 0.0.0.0/0, ::/0
-Endpoint = %s:%d
-PersistentKeepalive = 25
-`, cfg.PrivateKey, cfg.PeerPublicKey, cfg.Endpoint, cfg.EndpointPort)
+		return fmt.Errorf("failed to read backup: %w", err)
 	}
 
-	var result strings.Builder
-	err = tmpl.Execute(&result, cfg)
-	if err != nil {
-		log.Printf("Error executing WireGuard config template: %v", err)
-		// Return a basic configuration as fallback
-		return fmt.Sprintf(`[Interface]
-PrivateKey = %s
-Address = 100.64.0.1/32
-MTU = 1280
-Table = off
-
-[Peer]
-PublicKey = %s
-AllowedIPs = 0.0.0.0/0, ::/0
-Endpoint = %s:%d
-PersistentKeepalive = 25
-`, cfg.PrivateKey, cfg.PeerPublicKey, cfg.Endpoint, cfg.EndpointPort)
+	if err := os.WriteFile(m.config.WireGuard.ConfigPath, backupData, 0600); err != nil {
+		return fmt.Errorf("failed to restore WireGuard configuration: %w", err)
 	}
-	return result.String()
+
+	logger.InfoContext(ctx, "Restored WireGuard configuration from backup", "path", m.lastBackupPath)
+	m.lastBackupPath = ""
+	return nil
 }
 
-// mergeWithExistingConfig tries to preserve settings from the existing WireGuard config
-// while updating only the authentication-related fields from Cloudflare
-func mergeWithExistingConfig(existingConfig string, cfg *cloudflare.WireGuardConfig) string {
-	lines := strings.Split(existingConfig, "\n")
-	var result strings.Builder
-	inInterface := false
-	inPeer := false
-	
-	// Process each line of the existing config
-	for _, line := range lines {
-		trimmedLine := strings.TrimSpace(line)
-		
-		if trimmedLine == "[Interface]" {
-			inInterface = true
-			inPeer = false
-			result.WriteString(line + "\n")
-			continue
-		} else if trimmedLine == "[Peer]" {
-			inInterface = false
-			inPeer = true
-			result.WriteString(line + "\n")
-			continue
-		}
-		
-		// Skip empty lines
-		if trimmedLine == "" {
-			result.WriteString(line + "\n")
-			continue
-		}
-		
-		// Handle Interface section
-		if inInterface {
-			// Update PrivateKey, keep other settings
-			if strings.HasPrefix(trimmedLine, "PrivateKey") {
-				result.WriteString("PrivateKey = " + cfg.PrivateKey + "\n")
-			} else {
-				// Keep original line
-				result.WriteString(line + "\n")
-			}
-		}
-		
-		// Handle Peer section
-		if inPeer {
-			if strings.HasPrefix(trimmedLine, "PublicKey") {
-				result.WriteString("PublicKey = " + cfg.PeerPublicKey + "\n")
-			} else if strings.HasPrefix(trimmedLine, "PresharedKey") && cfg.PeerPresharedKey != "" {
-				result.WriteString("PresharedKey = " + cfg.PeerPresharedKey + "\n")
-			} else if strings.HasPrefix(trimmedLine, "Endpoint") {
-				result.WriteString(fmt.Sprintf("Endpoint = %s:%d\n", cfg.Endpoint, cfg.EndpointPort))
-			} else {
-				// Keep original line (including AllowedIPs which is now managed via UI)
-				result.WriteString(line + "\n")
-			}
-		}
+// renderOptions returns the interface settings for the configured WireGuard interface
+// Addresses are left empty so the ones assigned by Cloudflare are used
+func (m *Manager) renderOptions() ExportOptions {
+	return ExportOptions{
+		InterfaceName:       m.config.WireGuard.InterfaceName,
+		MTU:                 m.config.WireGuard.MTU,
+		PersistentKeepalive: m.config.WireGuard.PersistentKeepalive,
+		EndpointPreference:  m.config.WireGuard.EndpointPreference,
+		replaceAllowedIPs:   ManagesAllowedIPs(m.config),
 	}
-	
-	// If we didn't find certain sections, add them
-	if !strings.Contains(existingConfig, "PersistentKeepalive") {
-		result.WriteString("PersistentKeepalive = 25\n")
+}
+
+// buildWireGuardConfig generates a complete WireGuard configuration file from the Cloudflare data
+// It shares the wg-quick renderer with the export command, so there is a single way the file is written
+func buildWireGuardConfig(cfg *cloudflare.WireGuardConfig, opts ExportOptions) (string, error) {
+	if len(cfg.Addresses) == 0 && len(opts.Addresses) == 0 {
+		logger.Warn("Cloudflare did not assign interface addresses, the generated configuration has no Address")
 	}
-	
-	return result.String()
+
+	opts.markPeer = true
+	files, err := Export(cfg, ExportWgQuick, opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to build WireGuard configuration: %w", err)
+	}
+	return files[0].Content, nil
 }
@@ -0,0 +1,136 @@
+package wireguard
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/config"
+)
+
+// newTestManager creates a manager whose WireGuard config and backups live in a temporary directory
+func newTestManager(t *testing.T) *Manager {
+	dir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.WireGuard.InterfaceName = "wg0"
+	cfg.WireGuard.ConfigPath = filepath.Join(dir, "wg0.conf")
+	cfg.WireGuard.MTU = 1280
+	cfg.WireGuard.PersistentKeepalive = 25
+	cfg.StateFile = filepath.Join(dir, "state.json")
+	cfg.UDMPro.ConfigBackupPath = filepath.Join(dir, "backup")
+	return NewManager(cfg)
+}
+
+// testWireGuardConfig returns a Cloudflare configuration with distinct values for every field
+func testWireGuardConfig() *cloudflare.WireGuardConfig {
+	return &cloudflare.WireGuardConfig{
+		PrivateKey:    "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+		PublicKey:     "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+		PeerPublicKey: "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=",
+		Endpoint:      "engage.cloudflareclient.com",
+		EndpointPort:  2408,
+		AllowedIPs:    []string{"0.0.0.0/0"},
+	}
+}
+
+func TestRenderConfigWithoutExistingFile(t *testing.T) {
+	m := newTestManager(t)
+
+	current, next, err := m.RenderConfig(testWireGuardConfig())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if current != "" {
+		t.Errorf("Expected no current content, got %q", current)
+	}
+	if !strings.Contains(next, "PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=") {
+		t.Errorf("Expected a freshly built config, got:\n%s", next)
+	}
+}
+
+func TestRenderConfigDetectsUnchanged(t *testing.T) {
+	m := newTestManager(t)
+	os.WriteFile(m.config.WireGuard.ConfigPath, []byte(`[Interface]
+PrivateKey = `+DummyPrivateKey+`
+Address = 10.0.0.2/32
+
+[Peer]
+PublicKey = `+DummyPeerPublicKey+`
+AllowedIPs = 0.0.0.0/0
+Endpoint = engage.cloudflareclient.com:2408
+PersistentKeepalive = 25
+`), 0600)
+
+	current, next, err := m.RenderConfig(testWireGuardConfig())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if current == next {
+		t.Fatal("Expected the dummy keys to be replaced")
+	}
+	if !strings.Contains(next, "Address = 10.0.0.2/32") {
+		t.Errorf("Expected UI settings to be preserved, got:\n%s", next)
+	}
+
+	// Once written, rendering the same credentials again is a no-op
+	os.WriteFile(m.config.WireGuard.ConfigPath, []byte(next), 0600)
+	current, again, err := m.RenderConfig(testWireGuardConfig())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if current != again {
+		t.Errorf("Expected unchanged config, got diff between:\n%s\nand:\n%s", current, again)
+	}
+}
+
+func TestRenderConfigUsesAssignedAddresses(t *testing.T) {
+	m := newTestManager(t)
+	m.config.WireGuard.MTU = 1420
+	m.config.WireGuard.PersistentKeepalive = 15
+	cfg := testWireGuardConfig()
+	cfg.Addresses = []string{"172.16.0.2/32", "2606:4700:110:8a36::2/128"}
+
+	_, next, err := m.RenderConfig(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, expected := range []string{"Address = 172.16.0.2/32, 2606:4700:110:8a36::2/128\n", "MTU = 1420\n", "PersistentKeepalive = 15\n"} {
+		if !strings.Contains(next, expected) {
+			t.Errorf("Expected %q in generated config:\n%s", expected, next)
+		}
+	}
+
+	// An existing configuration gets the assigned addresses in place of its own
+	os.WriteFile(m.config.WireGuard.ConfigPath, []byte(`[Interface]
+PrivateKey = `+DummyPrivateKey+`
+Address = 100.64.0.1/32
+Address = fd00::1/128
+MTU = 1280
+
+[Peer]
+PublicKey = `+DummyPeerPublicKey+`
+Endpoint = engage.cloudflareclient.com:2408
+`), 0600)
+
+	_, next, err = m.RenderConfig(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if strings.Count(next, "Address = ") != 1 || !strings.Contains(next, "Address = 172.16.0.2/32, 2606:4700:110:8a36::2/128\n") {
+		t.Errorf("Expected a single Address line with the assigned addresses:\n%s", next)
+	}
+	if !strings.Contains(next, "MTU = 1280\n") || !strings.Contains(next, "PersistentKeepalive = 15\n") {
+		t.Errorf("Expected the existing MTU and the configured keepalive:\n%s", next)
+	}
+}
+
+func TestRenderConfigRejectsIncompleteConfig(t *testing.T) {
+	cfg := testWireGuardConfig()
+	cfg.PeerPublicKey = ""
+
+	if _, _, err := newTestManager(t).RenderConfig(cfg); err == nil {
+		t.Error("Expected error for incomplete configuration")
+	}
+}
@@ -0,0 +1,216 @@
+package wireguard
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PeerStats holds the runtime state of a single WireGuard peer
+type PeerStats struct {
+	PublicKey           string    `json:"public_key" yaml:"public_key"`
+	Endpoint            string    `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	AllowedIPs          []string  `json:"allowed_ips,omitempty" yaml:"allowed_ips,omitempty"`
+	LatestHandshake     time.Time `json:"latest_handshake" yaml:"latest_handshake"`
+	RxBytes             int64     `json:"rx_bytes" yaml:"rx_bytes"`
+	TxBytes             int64     `json:"tx_bytes" yaml:"tx_bytes"`
+	PersistentKeepalive int       `json:"persistent_keepalive,omitempty" yaml:"persistent_keepalive,omitempty"`
+}
+
+// InterfaceStats holds the runtime state of a WireGuard interface as reported by 'wg show <iface> dump'
+// The interface private key is deliberately not retained
+type InterfaceStats struct {
+	PublicKey  string      `json:"public_key" yaml:"public_key"`
+	ListenPort int         `json:"listen_port" yaml:"listen_port"`
+	FwMark     string      `json:"fwmark,omitempty" yaml:"fwmark,omitempty"`
+	Peers      []PeerStats `json:"peers" yaml:"peers"`
+}
+
+// Peer returns the stats of the peer with the public key, or nil if the interface has no such peer
+func (s *InterfaceStats) Peer(publicKey string) *PeerStats {
+	for i := range s.Peers {
+		if s.Peers[i].PublicKey == publicKey {
+			return &s.Peers[i]
+		}
+	}
+	return nil
+}
+
+// ParseDump parses the output of 'wg show <iface> dump'
+// The first line describes the interface and every following line describes a peer
+func ParseDump(output string) (*InterfaceStats, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) == "" {
+		return nil, fmt.Errorf("empty wg dump output")
+	}
+
+	// Interface line: private-key public-key listen-port fwmark
+	fields := strings.Split(lines[0], "\t")
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("unexpected interface line in wg dump: %d fields", len(fields))
+	}
+
+	listenPort, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen port %q in wg dump: %w", fields[2], err)
+	}
+
+	stats := &InterfaceStats{
+		PublicKey:  dumpValue(fields[1]),
+		ListenPort: listenPort,
+		FwMark:     dumpValue(fields[3]),
+	}
+
+	// Peer lines: public-key preshared-key endpoint allowed-ips latest-handshake transfer-rx transfer-tx persistent-keepalive
+	for _, line := range lines[1:] {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 8 {
+			return nil, fmt.Errorf("unexpected peer line in wg dump: %d fields", len(fields))
+		}
+
+		peer := PeerStats{
+			PublicKey: fields[0],
+			Endpoint:  dumpValue(fields[2]),
+		}
+
+		if allowedIPs := dumpValue(fields[3]); allowedIPs != "" {
+			peer.AllowedIPs = strings.Split(allowedIPs, ",")
+		}
+
+		handshake, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latest handshake %q in wg dump: %w", fields[4], err)
+		}
+		if handshake > 0 {
+			peer.LatestHandshake = time.Unix(handshake, 0)
+		}
+
+		if peer.RxBytes, err = strconv.ParseInt(fields[5], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid rx bytes %q in wg dump: %w", fields[5], err)
+		}
+		if peer.TxBytes, err = strconv.ParseInt(fields[6], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid tx bytes %q in wg dump: %w", fields[6], err)
+		}
+
+		if keepalive := dumpValue(fields[7]); keepalive != "" {
+			if peer.PersistentKeepalive, err = strconv.Atoi(keepalive); err != nil {
+				return nil, fmt.Errorf("invalid persistent keepalive %q in wg dump: %w", fields[7], err)
+			}
+		}
+
+		stats.Peers = append(stats.Peers, peer)
+	}
+
+	return stats, nil
+}
+
+// dumpValue normalizes the placeholders wg uses for unset values to an empty string
+func dumpValue(value string) string {
+	if value == "(none)" || value == "off" {
+		return ""
+	}
+	return value
+}
+
+// Stats returns the runtime state of the configured WireGuard interface
+func (m *Manager) Stats() (*InterfaceStats, error) {
+	cmd := exec.Command("wg", "show", m.config.WireGuard.InterfaceName, "dump")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query WireGuard interface %s: %w", m.config.WireGuard.InterfaceName, err)
+	}
+
+	return ParseDump(string(output))
+}
+
+// Monitor periodically checks the WireGuard interface and reports when the handshake goes stale
+type Monitor struct {
+	manager  *Manager
+	interval time.Duration
+	timeout  time.Duration
+
+	mu    sync.Mutex
+	since time.Time
+}
+
+// NewMonitor creates a monitor that polls every interval and considers a handshake older than timeout stale
+func NewMonitor(manager *Manager, interval, timeout time.Duration) *Monitor {
+	return &Monitor{
+		manager:  manager,
+		interval: interval,
+		timeout:  timeout,
+	}
+}
+
+// Reset restarts the grace period, e.g. after the configuration has been re-applied
+func (mon *Monitor) Reset() {
+	mon.mu.Lock()
+	defer mon.mu.Unlock()
+	mon.since = time.Now()
+}
+
+// Run polls the interface until stop is closed and calls onStale whenever the handshake is older than the timeout
+// After each stale report the grace period restarts, so a new handshake has a full timeout to complete
+// onRecovered, if set, is called on the first handshake after a stale report
+func (mon *Monitor) Run(stop <-chan struct{}, onStale func(age time.Duration), onRecovered func()) {
+	mon.Reset()
+
+	ticker := time.NewTicker(mon.interval)
+	defer ticker.Stop()
+
+	// Only log the first of a run of failures so a downed interface doesn't flood the log
+	failing := false
+	stale := false
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		// Only the Cloudflare peer counts, as other peers of the interface say nothing about the tunnel
+		latest, err := mon.manager.LatestHandshake()
+		if err != nil {
+			if !failing {
+				logger.Warn("Failed to get the handshake of the Cloudflare peer", "error", err)
+			}
+			failing = true
+			continue
+		}
+		failing = false
+
+		mon.mu.Lock()
+		since := mon.since
+		mon.mu.Unlock()
+
+		if isStale, age := handshakeStale(latest, since, time.Now(), mon.timeout); isStale {
+			stale = true
+			mon.Reset()
+			onStale(age)
+		} else if stale && latest.After(since) {
+			stale = false
+			if onRecovered != nil {
+				onRecovered()
+			}
+		}
+	}
+}
+
+// handshakeStale reports whether the handshake is older than the timeout
+// Ages are measured from the later of the handshake and the start of the grace period
+func handshakeStale(latest, since, now time.Time, timeout time.Duration) (bool, time.Duration) {
+	reference := latest
+	if since.After(reference) {
+		reference = since
+	}
+
+	age := now.Sub(reference)
+	return age > timeout, age
+}
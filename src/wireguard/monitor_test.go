@@ -0,0 +1,88 @@
+package wireguard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDump(t *testing.T) {
+	dump := "cHJpdmF0ZQ==\tcHVibGlj\t51820\toff\n" +
+		"cGVlcjE=\t(none)\t162.159.192.1:2408\t0.0.0.0/0,::/0\t1700000000\t1024\t2048\t25\n" +
+		"cGVlcjI=\t(none)\t(none)\t(none)\t0\t0\t0\toff\n"
+
+	stats, err := ParseDump(dump)
+	if err != nil {
+		t.Fatalf("Failed to parse dump: %v", err)
+	}
+
+	if stats.PublicKey != "cHVibGlj" || stats.ListenPort != 51820 || stats.FwMark != "" {
+		t.Errorf("Unexpected interface stats: %+v", stats)
+	}
+
+	if len(stats.Peers) != 2 {
+		t.Fatalf("Expected 2 peers, got %d", len(stats.Peers))
+	}
+
+	peer := stats.Peers[0]
+	if peer.Endpoint != "162.159.192.1:2408" {
+		t.Errorf("Expected endpoint 162.159.192.1:2408, got %s", peer.Endpoint)
+	}
+	if len(peer.AllowedIPs) != 2 || peer.AllowedIPs[1] != "::/0" {
+		t.Errorf("Unexpected allowed IPs: %v", peer.AllowedIPs)
+	}
+	if !peer.LatestHandshake.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Unexpected latest handshake: %v", peer.LatestHandshake)
+	}
+	if peer.RxBytes != 1024 || peer.TxBytes != 2048 || peer.PersistentKeepalive != 25 {
+		t.Errorf("Unexpected transfer counters: %+v", peer)
+	}
+
+	idle := stats.Peers[1]
+	if idle.Endpoint != "" || idle.AllowedIPs != nil || !idle.LatestHandshake.IsZero() || idle.PersistentKeepalive != 0 {
+		t.Errorf("Expected idle peer to have empty values, got %+v", idle)
+	}
+
+	if stats.Peer("cGVlcjI=") != &stats.Peers[1] || stats.Peer("unknown") != nil {
+		t.Errorf("Expected peers to be looked up by public key")
+	}
+}
+
+func TestParseDumpInvalid(t *testing.T) {
+	invalid := []string{
+		"",
+		"only\ttwo",
+		"priv\tpub\tnotaport\toff",
+		"priv\tpub\t51820\toff\npeer\t(none)\t(none)",
+		"priv\tpub\t51820\toff\npeer\t(none)\t(none)\t(none)\tsoon\t0\t0\toff",
+	}
+
+	for _, dump := range invalid {
+		if _, err := ParseDump(dump); err == nil {
+			t.Errorf("Expected error parsing %q", dump)
+		}
+	}
+}
+
+func TestHandshakeStale(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	timeout := 3 * time.Minute
+
+	tests := []struct {
+		name   string
+		latest time.Time
+		since  time.Time
+		stale  bool
+	}{
+		{"recent handshake", now.Add(-time.Minute), now.Add(-time.Hour), false},
+		{"old handshake", now.Add(-5 * time.Minute), now.Add(-time.Hour), true},
+		{"old handshake within grace period", now.Add(-5 * time.Minute), now.Add(-time.Minute), false},
+		{"no handshake within grace period", time.Time{}, now.Add(-time.Minute), false},
+		{"no handshake after grace period", time.Time{}, now.Add(-5 * time.Minute), true},
+	}
+
+	for _, tt := range tests {
+		if stale, _ := handshakeStale(tt.latest, tt.since, now, timeout); stale != tt.stale {
+			t.Errorf("%s: expected stale=%v, got %v", tt.name, tt.stale, stale)
+		}
+	}
+}
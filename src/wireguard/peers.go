@@ -0,0 +1,262 @@
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+)
+
+// CloudflarePeerMarker marks the Cloudflare peer, so it can be told apart from other peers of the interface
+const CloudflarePeerMarker = "# Managed by cfwg-zt: Cloudflare Zero Trust peer"
+
+// cloudflareDomain is the domain of the endpoints Cloudflare issues
+const cloudflareDomain = "cloudflareclient.com"
+
+// configSection is a section of a WireGuard configuration file, kept line by line so it can be written back unchanged
+// The lines before the first section header form a section without a name
+type configSection struct {
+	name  string
+	lines []string
+}
+
+// parseSections splits a WireGuard configuration into its sections
+func parseSections(content string) []configSection {
+	sections := []configSection{{}}
+	for _, line := range strings.Split(strings.TrimRight(content, "\n"), "\n") {
+		trimmedLine := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmedLine, "[") && strings.HasSuffix(trimmedLine, "]") {
+			sections = append(sections, configSection{name: trimmedLine[1 : len(trimmedLine)-1]})
+		}
+		last := &sections[len(sections)-1]
+		last.lines = append(last.lines, line)
+	}
+
+	return sections
+}
+
+// lineKey returns the key of a key = value line, or an empty string for other lines
+func lineKey(line string) string {
+	key, _, found := strings.Cut(strings.TrimSpace(line), "=")
+	if !found || strings.HasPrefix(strings.TrimSpace(line), "#") {
+		return ""
+	}
+	return strings.TrimSpace(key)
+}
+
+// value returns the value of the first line with the key, compared case-insensitively like wg-quick does
+func (s configSection) value(key string) string {
+	for _, line := range s.lines {
+		if strings.EqualFold(lineKey(line), key) {
+			_, value, _ := strings.Cut(line, "=")
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// hasMarker reports whether the section carries the Cloudflare peer marker
+func (s configSection) hasMarker() bool {
+	for _, line := range s.lines {
+		if strings.TrimSpace(line) == CloudflarePeerMarker {
+			return true
+		}
+	}
+	return false
+}
+
+// sectionIndexes returns the indexes of the sections with the given name
+func sectionIndexes(sections []configSection, name string) []int {
+	var indexes []int
+	for i, section := range sections {
+		if strings.EqualFold(section.name, name) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// findCloudflarePeer returns the index of the Cloudflare [Peer] section, or -1 if there is none
+// A peer is identified by the marker comment, then by one of the known public keys,
+// then by an endpoint on one of the hosts or in the Cloudflare domain
+func findCloudflarePeer(sections []configSection, keys, hosts []string) int {
+	peers := sectionIndexes(sections, "Peer")
+
+	for _, i := range peers {
+		if sections[i].hasMarker() {
+			return i
+		}
+	}
+
+	for _, i := range peers {
+		publicKey := sections[i].value("PublicKey")
+		for _, key := range keys {
+			if key != "" && publicKey == key {
+				return i
+			}
+		}
+	}
+
+	for _, i := range peers {
+		if isCloudflareEndpoint(sections[i].value("Endpoint"), hosts) {
+			return i
+		}
+	}
+	return -1
+}
+
+// isCloudflareEndpoint reports whether the endpoint is on one of the hosts or in the Cloudflare domain
+func isCloudflareEndpoint(endpoint string, hosts []string) bool {
+	if endpoint == "" {
+		return false
+	}
+	host, _, err := splitEndpoint(endpoint)
+	if err != nil {
+		return false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == cloudflareDomain || strings.HasSuffix(host, "."+cloudflareDomain) {
+		return true
+	}
+	for _, candidate := range hosts {
+		if strings.EqualFold(host, candidate) || sameIP(host, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameIP reports whether both values are the same IP address, whatever their notation
+func sameIP(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	return ipA != nil && ipB != nil && ipA.Equal(ipB)
+}
+
+// endpointHosts returns the hosts of the endpoints
+func endpointHosts(endpoints []string) []string {
+	var hosts []string
+	for _, endpoint := range endpoints {
+		if host, _, err := splitEndpoint(endpoint); err == nil {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// mergeWithExistingConfig tries to preserve settings from the existing WireGuard config
+// while updating only the authentication-related fields and assigned addresses from Cloudflare
+// Only the Cloudflare peer is updated, see findCloudflarePeer; it is added if the configuration has none
+// The Cloudflare configuration must already carry the selected endpoint, see selectEndpoint
+func mergeWithExistingConfig(existingConfig string, cfg *cloudflare.WireGuardConfig, opts ExportOptions, hosts []string) string {
+	sections := parseSections(existingConfig)
+	peer := findCloudflarePeer(sections, []string{cfg.PeerPublicKey, DummyPeerPublicKey}, hosts)
+
+	var result strings.Builder
+	for i, section := range sections {
+		lines := section.lines
+		switch {
+		case strings.EqualFold(section.name, "Interface"):
+			lines = mergeInterface(lines, cfg)
+		case i == peer:
+			lines = mergePeer(lines, cfg, opts)
+		}
+		for _, line := range lines {
+			result.WriteString(line + "\n")
+		}
+	}
+
+	if peer < 0 {
+		result.WriteString("\n")
+		writeWgQuickPeer(&result, cfg, opts, true)
+	}
+
+	return result.String()
+}
+
+// mergeInterface updates the private key and addresses of an [Interface] section and keeps all other settings
+func mergeInterface(lines []string, cfg *cloudflare.WireGuardConfig) []string {
+	var merged []string
+	addressWritten := false
+	for _, line := range lines {
+		switch key := lineKey(line); {
+		case strings.EqualFold(key, "PrivateKey"):
+			merged = append(merged, "PrivateKey = "+cfg.PrivateKey)
+		case strings.EqualFold(key, "Address") && len(cfg.Addresses) > 0:
+			// The addresses Cloudflare assigned replace the Address lines, which may be split over several
+			if !addressWritten {
+				merged = append(merged, "Address = "+strings.Join(cfg.Addresses, ", "))
+				addressWritten = true
+			}
+		default:
+			merged = append(merged, line)
+		}
+	}
+	return merged
+}
+
+// mergePeer updates the keys and endpoint of the Cloudflare [Peer] section and keeps all other settings
+// (including AllowedIPs, which is managed via the UDM Pro UI's policy-based routing, unless the split tunnel replaces them)
+// Missing settings are added after the last setting of the section, and the section is marked as the Cloudflare peer
+func mergePeer(lines []string, cfg *cloudflare.WireGuardConfig, opts ExportOptions) []string {
+	merged := []string{lines[0]}
+	if !(configSection{lines: lines}).hasMarker() {
+		merged = append(merged, CloudflarePeerMarker)
+	}
+
+	allowedIPs := opts.AllowedIPs
+	if len(allowedIPs) == 0 {
+		allowedIPs = cfg.AllowedIPs
+	}
+
+	seen := make(map[string]bool)
+	insertAt := len(merged)
+	for _, line := range lines[1:] {
+		key := strings.ToLower(lineKey(line))
+		switch key {
+		case "allowedips":
+			if opts.replaceAllowedIPs {
+				// The computed list replaces the AllowedIPs lines, which may be split over several
+				if seen[key] {
+					continue
+				}
+				line = "AllowedIPs = " + strings.Join(allowedIPs, ", ")
+			}
+		case "publickey":
+			line = "PublicKey = " + cfg.PeerPublicKey
+		case "presharedkey":
+			if cfg.PeerPresharedKey != "" {
+				line = "PresharedKey = " + cfg.PeerPresharedKey
+			}
+		case "endpoint":
+			line = "Endpoint = " + FormatEndpoint(cfg.Endpoint, cfg.EndpointPort)
+		}
+
+		merged = append(merged, line)
+		if key != "" {
+			seen[key] = true
+			insertAt = len(merged)
+		}
+	}
+
+	var missing []string
+	if !seen["publickey"] {
+		missing = append(missing, "PublicKey = "+cfg.PeerPublicKey)
+	}
+	if !seen["presharedkey"] && cfg.PeerPresharedKey != "" {
+		missing = append(missing, "PresharedKey = "+cfg.PeerPresharedKey)
+	}
+	if !seen["allowedips"] {
+		missing = append(missing, "AllowedIPs = "+strings.Join(allowedIPs, ", "))
+	}
+	if !seen["endpoint"] {
+		missing = append(missing, "Endpoint = "+FormatEndpoint(cfg.Endpoint, cfg.EndpointPort))
+	}
+	if !seen["persistentkeepalive"] && opts.PersistentKeepalive > 0 {
+		missing = append(missing, fmt.Sprintf("PersistentKeepalive = %d", opts.PersistentKeepalive))
+	}
+
+	return slices.Insert(merged, insertAt, missing...)
+}
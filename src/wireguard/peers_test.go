@@ -0,0 +1,183 @@
+package wireguard
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// siteToSitePeer is a peer that has nothing to do with Cloudflare and must never be touched
+const siteToSitePeer = `[Peer]
+# Branch office
+PublicKey = HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=
+AllowedIPs = 192.168.50.0/24
+Endpoint = branch.example.com:51820
+`
+
+func TestMergeOnlyTouchesCloudflarePeer(t *testing.T) {
+	cloudflarePeer := `[Peer]
+PublicKey = ` + DummyPeerPublicKey + `
+AllowedIPs = 0.0.0.0/0
+Endpoint = engage.cloudflareclient.com:2408
+PersistentKeepalive = 25
+`
+	tests := []struct {
+		name     string
+		existing string
+	}{
+		{"Cloudflare peer first", "[Interface]\nPrivateKey = " + DummyPrivateKey + "\n\n" + cloudflarePeer + "\n" + siteToSitePeer},
+		{"Cloudflare peer last", "[Interface]\nPrivateKey = " + DummyPrivateKey + "\n\n" + siteToSitePeer + "\n" + cloudflarePeer},
+	}
+
+	for _, test := range tests {
+		merged := mergeWithExistingConfig(test.existing, testWireGuardConfig(), ExportOptions{PersistentKeepalive: 25}, nil)
+
+		if !strings.Contains(merged, siteToSitePeer) {
+			t.Errorf("%s: expected the other peer to be untouched:\n%s", test.name, merged)
+		}
+		if strings.Count(merged, "[Peer]") != 2 || strings.Count(merged, "PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=") != 1 {
+			t.Errorf("%s: expected exactly one Cloudflare peer:\n%s", test.name, merged)
+		}
+		if !strings.Contains(merged, "[Peer]\n"+CloudflarePeerMarker+"\nPublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=\n") {
+			t.Errorf("%s: expected the Cloudflare peer to be marked:\n%s", test.name, merged)
+		}
+		if strings.Count(merged, "PersistentKeepalive") != 1 {
+			t.Errorf("%s: expected no keepalive to be added to the other peer:\n%s", test.name, merged)
+		}
+
+		// Merging again is a no-op
+		if again := mergeWithExistingConfig(merged, testWireGuardConfig(), ExportOptions{PersistentKeepalive: 25}, nil); again != merged {
+			t.Errorf("%s: expected merging to be idempotent, got:\n%s", test.name, again)
+		}
+	}
+}
+
+func TestFindCloudflarePeer(t *testing.T) {
+	cfg := testWireGuardConfig()
+
+	tests := []struct {
+		name     string
+		config   string
+		hosts    []string
+		expected int
+	}{
+		{
+			name:     "marker wins over key and endpoint",
+			config:   siteToSitePeer + "[Peer]\nPublicKey = " + cfg.PeerPublicKey + "\n[Peer]\n" + CloudflarePeerMarker + "\nPublicKey = other\n",
+			expected: 3,
+		},
+		{
+			name:     "current key",
+			config:   siteToSitePeer + "[Peer]\nPublicKey = " + cfg.PeerPublicKey + "\nEndpoint = 203.0.113.1:2408\n",
+			expected: 2,
+		},
+		{
+			name:     "dummy key",
+			config:   siteToSitePeer + "[Peer]\npublickey = " + DummyPeerPublicKey + "\n",
+			expected: 2,
+		},
+		{
+			name:     "Cloudflare domain",
+			config:   siteToSitePeer + "[Peer]\nPublicKey = rotated\nEndpoint = engage.cloudflareclient.com:500\n",
+			expected: 2,
+		},
+		{
+			name:     "resolved candidate address",
+			config:   siteToSitePeer + "[Peer]\nPublicKey = rotated\nEndpoint = [2606:4700:d0:0::a29f:c001]:2408\n",
+			hosts:    []string{"engage.cloudflareclient.com", "2606:4700:d0::a29f:c001"},
+			expected: 2,
+		},
+		{
+			name:     "no Cloudflare peer",
+			config:   "[Interface]\nPrivateKey = key\n" + siteToSitePeer,
+			expected: -1,
+		},
+	}
+
+	for _, test := range tests {
+		sections := parseSections(test.config)
+		if peer := findCloudflarePeer(sections, []string{cfg.PeerPublicKey, DummyPeerPublicKey}, test.hosts); peer != test.expected {
+			t.Errorf("%s: got section %d; expected %d", test.name, peer, test.expected)
+		}
+	}
+}
+
+func TestMergeAddsMissingCloudflarePeer(t *testing.T) {
+	existing := "# Site-to-site tunnel\n[Interface]\nPrivateKey = " + DummyPrivateKey + "\nListenPort = 51820\n\n" + siteToSitePeer
+	merged := mergeWithExistingConfig(existing, testWireGuardConfig(), ExportOptions{PersistentKeepalive: 25}, nil)
+
+	expected := existing + `
+[Peer]
+` + CloudflarePeerMarker + `
+PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=
+AllowedIPs = 0.0.0.0/0
+Endpoint = engage.cloudflareclient.com:2408
+PersistentKeepalive = 25
+`
+	expected = strings.Replace(expected, "PrivateKey = "+DummyPrivateKey, "PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=", 1)
+	if merged != expected {
+		t.Errorf("Unexpected merge result:\n%s\nexpected:\n%s", merged, expected)
+	}
+}
+
+func TestMergeCompletesCloudflarePeer(t *testing.T) {
+	existing := "[Interface]\nPrivateKey = " + DummyPrivateKey + "\n\n[Peer]\nPublicKey = " + DummyPeerPublicKey + "\n# trailing comment\n\n" + siteToSitePeer
+	cfg := testWireGuardConfig()
+	cfg.PeerPresharedKey = "FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE="
+
+	merged := mergeWithExistingConfig(existing, cfg, ExportOptions{PersistentKeepalive: 25}, nil)
+	expected := `[Peer]
+` + CloudflarePeerMarker + `
+PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=
+PresharedKey = FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE=
+AllowedIPs = 0.0.0.0/0
+Endpoint = engage.cloudflareclient.com:2408
+PersistentKeepalive = 25
+# trailing comment
+
+` + siteToSitePeer
+	if !strings.HasSuffix(merged, expected) {
+		t.Errorf("Unexpected merge result:\n%s\nexpected to end with:\n%s", merged, expected)
+	}
+}
+
+func TestPeerEndpointFindsCloudflarePeer(t *testing.T) {
+	m := newTestManager(t)
+	os.WriteFile(m.config.WireGuard.ConfigPath, []byte("[Interface]\nPrivateKey = key\n\n"+siteToSitePeer+
+		"\n[Peer]\nPublicKey = rotated\nEndpoint = engage.cloudflareclient.com:500\n"), 0600)
+
+	endpoint, err := m.PeerEndpoint()
+	if err != nil || endpoint != "engage.cloudflareclient.com:500" {
+		t.Errorf("PeerEndpoint() = %q, %v; expected the Cloudflare peer's endpoint", endpoint, err)
+	}
+	// The handshake of this peer alone tells whether the tunnel is alive
+	if publicKey, err := m.PeerPublicKey(); err != nil || publicKey != "rotated" {
+		t.Errorf("PeerPublicKey() = %q, %v; expected the Cloudflare peer's public key", publicKey, err)
+	}
+
+	// Several unidentified peers are ambiguous
+	os.WriteFile(m.config.WireGuard.ConfigPath, []byte(siteToSitePeer+"\n"+siteToSitePeer), 0600)
+	if _, err := m.PeerEndpoint(); err == nil {
+		t.Error("Expected error when no peer can be identified")
+	}
+}
+
+func TestMergeReplacesAllowedIPs(t *testing.T) {
+	existing := "[Interface]\nPrivateKey = " + DummyPrivateKey + "\n\n[Peer]\n" + CloudflarePeerMarker +
+		"\nPublicKey = " + DummyPeerPublicKey + "\nAllowedIPs = 0.0.0.0/0\nAllowedIPs = ::/0\nEndpoint = engage.cloudflareclient.com:2408\n\n" + siteToSitePeer
+	cfg := testWireGuardConfig()
+	cfg.AllowedIPs = []string{"10.0.0.0/8", "2606:4700::/32"}
+
+	// The AllowedIPs of the Cloudflare peer are kept unless the split tunnel decides them
+	if merged := mergeWithExistingConfig(existing, cfg, ExportOptions{}, nil); !strings.Contains(merged, "AllowedIPs = 0.0.0.0/0\nAllowedIPs = ::/0\n") {
+		t.Errorf("Expected the AllowedIPs to be kept:\n%s", merged)
+	}
+
+	merged := mergeWithExistingConfig(existing, cfg, ExportOptions{replaceAllowedIPs: true}, nil)
+	if !strings.Contains(merged, "PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=\nAllowedIPs = 10.0.0.0/8, 2606:4700::/32\nEndpoint") {
+		t.Errorf("Expected the AllowedIPs to be replaced:\n%s", merged)
+	}
+	if !strings.Contains(merged, siteToSitePeer) {
+		t.Errorf("Expected the other peer to be untouched:\n%s", merged)
+	}
+}
@@ -0,0 +1,112 @@
+package wireguard
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// resolveTimeout bounds a single endpoint lookup, so a dead resolver can't hold up an update
+const resolveTimeout = 10 * time.Second
+
+// Resolver looks up endpoint hostnames, optionally through specific DNS servers
+// Dedicated servers avoid depending on DNS that is itself routed through the tunnel
+type Resolver struct {
+	lookupIP func(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// NewResolver creates a resolver that queries the given servers in turn, or the system resolver if there are none
+// Servers are IP addresses with an optional port, which defaults to 53
+func NewResolver(servers []string) (*Resolver, error) {
+	if len(servers) == 0 {
+		return &Resolver{lookupIP: net.DefaultResolver.LookupIP}, nil
+	}
+
+	addresses := make([]string, 0, len(servers))
+	for _, server := range servers {
+		host, port, err := ParseEndpoint(server, 53)
+		if err != nil {
+			return nil, fmt.Errorf("invalid resolver: %w", err)
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid resolver %q: must be an IP address", server)
+		}
+		addresses = append(addresses, FormatEndpoint(host, port))
+	}
+
+	// Every dial goes to the next server, so the retries of a lookup move on from a server that doesn't answer
+	var next atomic.Uint32
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			server := addresses[int(next.Add(1)-1)%len(addresses)]
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+	return &Resolver{lookupIP: resolver.LookupIP}, nil
+}
+
+// Lookup returns the addresses of host, those of the preferred family first
+// An IP address is returned as is
+func (r *Resolver) Lookup(ctx context.Context, host, preference string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+
+	ips, err := r.lookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+
+	var v4, v6 []string
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip.String())
+		} else {
+			v6 = append(v6, ip.String())
+		}
+	}
+	if preference == EndpointIPv6 {
+		return append(v6, v4...), nil
+	}
+	return append(v4, v6...), nil
+}
+
+// resolveEndpoint replaces the hostname of the endpoint with its address when endpoint resolution is enabled
+// If the endpoint is already an address, or the hostname doesn't resolve, it is returned unchanged
+func (m *Manager) resolveEndpoint(ctx context.Context, endpoint string) string {
+	return m.pinEndpoint(ctx, endpoint, "")
+}
+
+// pinEndpoint resolves the endpoint like resolveEndpoint, but keeps the pinned endpoint
+// as long as its address is still among those of the hostname, so round-robin DNS doesn't cause churn
+func (m *Manager) pinEndpoint(ctx context.Context, endpoint, pinned string) string {
+	if !m.config.WireGuard.ResolveEndpoint || m.resolver == nil {
+		return endpoint
+	}
+
+	host, port, err := ParseEndpoint(endpoint, 0)
+	if err != nil || net.ParseIP(host) != nil {
+		return endpoint
+	}
+
+	addresses, err := m.resolver.Lookup(ctx, host, m.config.WireGuard.EndpointPreference)
+	if err != nil || len(addresses) == 0 {
+		logger.WarnContext(ctx, "Could not resolve endpoint, using the hostname", "endpoint", endpoint, "error", err)
+		return endpoint
+	}
+
+	for _, address := range addresses {
+		if resolved := FormatEndpoint(address, port); strings.EqualFold(resolved, pinned) {
+			return pinned
+		}
+	}
+	return FormatEndpoint(addresses[0], port)
+}
@@ -0,0 +1,134 @@
+package wireguard
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// fakeResolver returns a resolver that answers from addresses and counts its lookups
+func fakeResolver(addresses map[string][]string, lookups *int) *Resolver {
+	return &Resolver{lookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+		*lookups++
+		var ips []net.IP
+		for _, address := range addresses[host] {
+			ips = append(ips, net.ParseIP(address))
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no such host")
+		}
+		return ips, nil
+	}}
+}
+
+func TestResolverLookup(t *testing.T) {
+	lookups := 0
+	r := fakeResolver(map[string][]string{
+		"engage.cloudflareclient.com": {"2606:4700:d0::a29f:c001", "162.159.192.1"},
+	}, &lookups)
+
+	tests := []struct {
+		host       string
+		preference string
+		expected   []string
+	}{
+		{"engage.cloudflareclient.com", EndpointAuto, []string{"162.159.192.1", "2606:4700:d0::a29f:c001"}},
+		{"engage.cloudflareclient.com", EndpointIPv4, []string{"162.159.192.1", "2606:4700:d0::a29f:c001"}},
+		{"engage.cloudflareclient.com", EndpointIPv6, []string{"2606:4700:d0::a29f:c001", "162.159.192.1"}},
+		{"162.159.193.1", EndpointIPv6, []string{"162.159.193.1"}},
+	}
+
+	for _, test := range tests {
+		addresses, err := r.Lookup(context.Background(), test.host, test.preference)
+		if err != nil || fmt.Sprint(addresses) != fmt.Sprint(test.expected) {
+			t.Errorf("Lookup(%q, %q) = %v, %v; expected %v", test.host, test.preference, addresses, err, test.expected)
+		}
+	}
+	if lookups != 3 {
+		t.Errorf("Expected addresses to be returned without a lookup, got %d lookups", lookups)
+	}
+
+	if _, err := r.Lookup(context.Background(), "unknown.example", EndpointAuto); err == nil {
+		t.Error("Expected error for unresolvable host")
+	}
+}
+
+func TestNewResolverValidatesServers(t *testing.T) {
+	if _, err := NewResolver([]string{"1.1.1.1", "[2606:4700:4700::1111]:53", "9.9.9.9:5353"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	for _, server := range []string{"dns.example", "1.1.1.1:0", ""} {
+		if _, err := NewResolver([]string{server}); err == nil {
+			t.Errorf("Expected error for resolver %q", server)
+		}
+	}
+}
+
+func TestRenderConfigPinsResolvedEndpoint(t *testing.T) {
+	m := newTestManager(t)
+	m.config.WireGuard.ResolveEndpoint = true
+	lookups := 0
+	addresses := map[string][]string{"engage.cloudflareclient.com": {"162.159.192.1", "162.159.192.9"}}
+	m.resolver = fakeResolver(addresses, &lookups)
+
+	_, next, err := m.RenderConfig(testWireGuardConfig())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(next, "Endpoint = 162.159.192.1:2408\n") {
+		t.Fatalf("Expected the resolved address in the config:\n%s", next)
+	}
+	os.WriteFile(m.config.WireGuard.ConfigPath, []byte(next), 0600)
+
+	// The address in use is kept while the hostname still resolves to it, whatever the order
+	addresses["engage.cloudflareclient.com"] = []string{"162.159.192.9", "162.159.192.1"}
+	if _, again, _ := m.RenderConfig(testWireGuardConfig()); again != next {
+		t.Errorf("Expected the pinned address to be kept:\n%s", again)
+	}
+
+	// A failed lookup falls back to the hostname rather than failing the update
+	delete(addresses, "engage.cloudflareclient.com")
+	if _, again, _ := m.RenderConfig(testWireGuardConfig()); !strings.Contains(again, "Endpoint = engage.cloudflareclient.com:2408\n") {
+		t.Errorf("Expected the hostname when resolution fails:\n%s", again)
+	}
+}
+
+func TestFailoverReresolve(t *testing.T) {
+	m := newTestManager(t)
+	m.config.WireGuard.ResolveEndpoint = true
+	lookups := 0
+	addresses := map[string][]string{"engage.cloudflareclient.com": {"162.159.192.1"}}
+	m.resolver = fakeResolver(addresses, &lookups)
+
+	_, next, err := m.RenderConfig(testWireGuardConfig())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	os.WriteFile(m.config.WireGuard.ConfigPath, []byte(next), 0600)
+
+	var updates []string
+	f := NewFailover(m)
+	f.setEndpoint = func(ctx context.Context, peerPublicKey, endpoint string) error {
+		updates = append(updates, endpoint)
+		return nil
+	}
+	if err := f.Reset(testWireGuardConfig()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx := context.Background()
+	if f.Reresolve(ctx) {
+		t.Error("Expected no update while the address is unchanged")
+	}
+
+	addresses["engage.cloudflareclient.com"] = []string{"162.159.192.7"}
+	if !f.Reresolve(ctx) || f.Reresolve(ctx) {
+		t.Error("Expected exactly one update after the address changed")
+	}
+	if fmt.Sprint(updates) != "[162.159.192.7:2408]" {
+		t.Errorf("Unexpected peer updates %v", updates)
+	}
+}
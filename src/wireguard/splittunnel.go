@@ -0,0 +1,201 @@
+package wireguard
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/gumbees/cfwg-zt/src/cloudflare"
+	"github.com/gumbees/cfwg-zt/src/config"
+)
+
+// Split tunnel sources
+const (
+	// SplitTunnelOff keeps the AllowedIPs of an existing peer, as set up in the UI
+	SplitTunnelOff = "off"
+	// SplitTunnelAccount uses the lists of the account's default device settings profile
+	SplitTunnelAccount = "account"
+	// SplitTunnelConfig uses the lists in the configuration
+	SplitTunnelConfig = "config"
+)
+
+// ManagesAllowedIPs reports whether the AllowedIPs of the Cloudflare peer are computed from the split tunnel lists
+func ManagesAllowedIPs(cfg *config.Config) bool {
+	return cfg.SplitTunnel.Source != "" && cfg.SplitTunnel.Source != SplitTunnelOff
+}
+
+// EndpointAddresses returns the addresses of every endpoint candidate, resolving hostnames
+// They are excluded from the computed AllowedIPs, so the tunnel's own packets aren't routed into the tunnel
+// A hostname that doesn't resolve is skipped, as it can't be excluded anyway
+func (m *Manager) EndpointAddresses(ctx context.Context, cfg *cloudflare.WireGuardConfig) []string {
+	candidates, err := m.EndpointCandidates(cfg)
+	if err != nil {
+		logger.WarnContext(ctx, "Could not list the endpoint candidates", "error", err)
+		return nil
+	}
+
+	var addresses []string
+	seen := make(map[string]bool)
+	for _, candidate := range candidates {
+		host, _, err := splitEndpoint(candidate)
+		if err != nil || seen[host] {
+			continue
+		}
+		seen[host] = true
+
+		resolved, err := m.resolver.Lookup(ctx, host, m.config.WireGuard.EndpointPreference)
+		if err != nil {
+			logger.WarnContext(ctx, "Could not resolve endpoint, it stays within the AllowedIPs", "endpoint", host, "error", err)
+			continue
+		}
+		for _, address := range resolved {
+			if !slices.Contains(addresses, address) {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+	return addresses
+}
+
+// addrRange is an inclusive range of addresses of a single address family
+type addrRange struct {
+	from netip.Addr
+	to   netip.Addr
+}
+
+// AllowedIPs returns the fewest CIDRs that cover the included ranges without the excluded ones
+// Without included ranges everything is included, so the excluded ranges are subtracted from 0.0.0.0/0 and ::/0
+func AllowedIPs(include, exclude []string) ([]string, error) {
+	if len(include) == 0 {
+		include = []string{"0.0.0.0/0", "::/0"}
+	}
+
+	included, err := parseRanges(include)
+	if err != nil {
+		return nil, err
+	}
+	excluded, err := parseRanges(exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	var allowedIPs []string
+	for _, r := range subtractRanges(mergeRanges(included), mergeRanges(excluded)) {
+		for _, prefix := range rangePrefixes(r) {
+			allowedIPs = append(allowedIPs, prefix.String())
+		}
+	}
+	if len(allowedIPs) == 0 {
+		return nil, fmt.Errorf("the split tunnel excludes every included address")
+	}
+	return allowedIPs, nil
+}
+
+// parseRanges parses CIDRs and single addresses into ranges
+func parseRanges(values []string) ([]addrRange, error) {
+	ranges := make([]addrRange, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(value)
+			if addrErr != nil {
+				return nil, fmt.Errorf("%q is not a valid CIDR or address", value)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		// A mapped prefix shorter than /96 reaches beyond the IPv4 space, so it stays IPv6
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+
+		prefix = prefix.Masked()
+		ranges = append(ranges, addrRange{from: prefix.Addr(), to: lastAddr(prefix)})
+	}
+	return ranges, nil
+}
+
+// mergeRanges sorts the ranges and joins the ones that overlap or touch
+func mergeRanges(ranges []addrRange) []addrRange {
+	ranges = slices.Clone(ranges)
+	slices.SortFunc(ranges, func(a, b addrRange) int { return a.from.Compare(b.from) })
+
+	var merged []addrRange
+	for _, r := range ranges {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			next := last.to.Next()
+			// The last address of a family has no next address, so it can only be overlapped
+			if last.from.BitLen() == r.from.BitLen() && (!next.IsValid() || r.from.Compare(next) <= 0) {
+				if r.to.Compare(last.to) > 0 {
+					last.to = r.to
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// subtractRanges removes the excluded ranges from the included ones; both must be merged
+func subtractRanges(included, excluded []addrRange) []addrRange {
+	result := included
+	for _, ex := range excluded {
+		var remaining []addrRange
+		for _, r := range result {
+			if r.from.BitLen() != ex.from.BitLen() || ex.to.Less(r.from) || r.to.Less(ex.from) {
+				remaining = append(remaining, r)
+				continue
+			}
+			if r.from.Less(ex.from) {
+				remaining = append(remaining, addrRange{from: r.from, to: ex.from.Prev()})
+			}
+			if ex.to.Less(r.to) {
+				remaining = append(remaining, addrRange{from: ex.to.Next(), to: r.to})
+			}
+		}
+		result = remaining
+	}
+	return result
+}
+
+// rangePrefixes returns the fewest CIDRs that cover the range exactly
+// Each CIDR is the largest one that starts where the previous one ended and stays within the range
+func rangePrefixes(r addrRange) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for start := r.from; ; {
+		for bits := 0; bits <= start.BitLen(); bits++ {
+			prefix := netip.PrefixFrom(start, bits)
+			end := lastAddr(prefix)
+			if prefix.Masked().Addr() != start || end.Compare(r.to) > 0 {
+				continue
+			}
+
+			prefixes = append(prefixes, prefix)
+			if end == r.to {
+				return prefixes
+			}
+			start = end.Next()
+			break
+		}
+	}
+}
+
+// lastAddr returns the last address of the prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Masked().Addr().AsSlice()
+	bits := prefix.Bits()
+	for i := range bytes {
+		if bits >= 8 {
+			bits -= 8
+			continue
+		}
+		bytes[i] |= 0xff >> bits
+		bits = 0
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
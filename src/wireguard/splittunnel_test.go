@@ -0,0 +1,124 @@
+package wireguard
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestAllowedIPs(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    string
+	}{
+		{
+			name: "everything",
+			want: "0.0.0.0/0, ::/0",
+		},
+		{
+			name:    "exclude a private range",
+			exclude: []string{"10.0.0.0/8"},
+			want: "0.0.0.0/5, 8.0.0.0/7, 11.0.0.0/8, 12.0.0.0/6, 16.0.0.0/4, 32.0.0.0/3, 64.0.0.0/2, 128.0.0.0/1, " +
+				"::/0",
+		},
+		{
+			name:    "exclude from both families",
+			exclude: []string{"0.0.0.0/1", "128.0.0.0/2", "2000::/3"},
+			want:    "192.0.0.0/2, ::/3, 4000::/2, 8000::/1",
+		},
+		{
+			name:    "exclude single addresses",
+			exclude: []string{"192.168.1.1", "192.168.1.2", "0.0.0.0/1", "128.0.0.0/2", "::/0"},
+			want:    "192.0.0.0/9, 192.128.0.0/11, 192.160.0.0/13, 192.168.0.0/24, 192.168.1.0/32, 192.168.1.3/32, 192.168.1.4/30, 192.168.1.8/29, 192.168.1.16/28, 192.168.1.32/27, 192.168.1.64/26, 192.168.1.128/25, 192.168.2.0/23, 192.168.4.0/22, 192.168.8.0/21, 192.168.16.0/20, 192.168.32.0/19, 192.168.64.0/18, 192.168.128.0/17, 192.169.0.0/16, 192.170.0.0/15, 192.172.0.0/14, 192.176.0.0/12, 192.192.0.0/10, 193.0.0.0/8, 194.0.0.0/7, 196.0.0.0/6, 200.0.0.0/5, 208.0.0.0/4, 224.0.0.0/3",
+		},
+		{
+			name:    "adjacent and overlapping includes are merged",
+			include: []string{"10.128.0.0/9", "10.0.0.0/9", "10.1.2.3", "10.1.0.0/16"},
+			want:    "10.0.0.0/8",
+		},
+		{
+			name:    "include minus exclude",
+			include: []string{"10.0.0.0/8", "2606:4700::/32"},
+			exclude: []string{"10.0.0.0/9", "192.168.0.0/16"},
+			want:    "10.128.0.0/9, 2606:4700::/32",
+		},
+		{
+			name:    "host bits and mapped addresses are normalized",
+			include: []string{"10.1.2.3/8", "::ffff:172.16.0.0/108"},
+			want:    "10.0.0.0/8, 172.16.0.0/12",
+		},
+		{
+			name:    "mapped prefixes beyond the IPv4 space stay IPv6",
+			include: []string{"::ffff:0:0/90"},
+			want:    "::ffc0:0:0/90",
+		},
+		{
+			name:    "ranges up to the last address",
+			include: []string{"255.255.255.0/24", "255.255.255.255"},
+			exclude: []string{"255.255.255.0/25"},
+			want:    "255.255.255.128/25",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AllowedIPs(tt.include, tt.exclude)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if strings.Join(got, ", ") != tt.want {
+				t.Errorf("AllowedIPs() = %s\nwant %s", strings.Join(got, ", "), tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedIPsErrors(t *testing.T) {
+	if _, err := AllowedIPs([]string{"10.0.0.0/8"}, []string{"10.0.0.0/7"}); err == nil {
+		t.Error("Expected error when everything is excluded")
+	}
+	if _, err := AllowedIPs(nil, []string{"example.com"}); err == nil {
+		t.Error("Expected error for an entry that isn't an address")
+	}
+}
+
+func TestAllowedIPsExcludeEndpoints(t *testing.T) {
+	m := newTestManager(t)
+	m.config.WireGuard.FallbackEndpoints = []string{"162.159.193.5", "[2606:4700:d1::1]:500"}
+	lookups := 0
+	m.resolver = fakeResolver(map[string][]string{
+		"engage.cloudflareclient.com": {"162.159.192.1", "2606:4700:d0::a29f:c001"},
+	}, &lookups)
+
+	endpoints := m.EndpointAddresses(context.Background(), testWireGuardConfig())
+	if strings.Join(endpoints, ", ") != "162.159.192.1, 2606:4700:d0::a29f:c001, 162.159.193.5, 2606:4700:d1::1" {
+		t.Fatalf("Unexpected endpoint addresses: %v", endpoints)
+	}
+
+	allowedIPs, err := AllowedIPs(nil, append([]string{"10.0.0.0/8"}, endpoints...))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	covered := func(address string) bool {
+		for _, allowedIP := range allowedIPs {
+			if netip.MustParsePrefix(allowedIP).Contains(netip.MustParseAddr(address)) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, endpoint := range endpoints {
+		if covered(endpoint) {
+			t.Errorf("Expected endpoint %s to be excluded from %v", endpoint, allowedIPs)
+		}
+	}
+	// Only the endpoints themselves are left out
+	for _, address := range []string{"162.159.192.0", "162.159.192.2", "2606:4700:d0::a29f:c000", "2606:4700:d1::2", "8.8.8.8"} {
+		if !covered(address) {
+			t.Errorf("Expected %s to stay within the AllowedIPs", address)
+		}
+	}
+}
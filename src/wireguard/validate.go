@@ -0,0 +1,261 @@
+package wireguard
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MTU range accepted for the interface; IPv6 needs at least 1280
+const (
+	MinMTU     = 576
+	MinMTUIPv6 = 1280
+	MaxMTU     = 9000
+)
+
+// Validation states of a WireGuard configuration
+const (
+	// ValidationValid is a configuration that can be brought up as is
+	ValidationValid = "valid"
+	// ValidationDummy is a well-formed configuration that still has the dummy import keys and needs bootstrapping
+	ValidationDummy = "dummy"
+	// ValidationBroken is a configuration wg-quick would reject or that can't work
+	ValidationBroken = "broken"
+)
+
+// keySize is the size of a Curve25519 key in bytes
+const keySize = 32
+
+// Problem is a single validation failure, located by section and key
+type Problem struct {
+	Section string `json:"section" yaml:"section"`
+	Key     string `json:"key,omitempty" yaml:"key,omitempty"`
+	Message string `json:"message" yaml:"message"`
+}
+
+// String formats the problem with its location
+func (p Problem) String() string {
+	if p.Key == "" {
+		return fmt.Sprintf("[%s] %s", p.Section, p.Message)
+	}
+	return fmt.Sprintf("[%s] %s: %s", p.Section, p.Key, p.Message)
+}
+
+// ValidationReport is the outcome of validating a WireGuard configuration
+type ValidationReport struct {
+	State string `json:"state" yaml:"state"`
+	// PublicKey is derived from the interface private key, when that is valid
+	PublicKey string    `json:"public_key,omitempty" yaml:"public_key,omitempty"`
+	DummyKeys bool      `json:"dummy_keys" yaml:"dummy_keys"`
+	Problems  []Problem `json:"problems,omitempty" yaml:"problems,omitempty"`
+}
+
+// Err returns an error listing the problems of a broken configuration, or nil otherwise
+func (r *ValidationReport) Err() error {
+	if r.State != ValidationBroken {
+		return nil
+	}
+
+	problems := make([]string, len(r.Problems))
+	for i, problem := range r.Problems {
+		problems[i] = problem.String()
+	}
+	return fmt.Errorf("invalid WireGuard configuration: %s", strings.Join(problems, "; "))
+}
+
+// ValidateConfig validates the WireGuard configuration file
+// The error is only set when the file can't be read; problems with its content are in the report
+func (m *Manager) ValidateConfig() (*ValidationReport, error) {
+	configPath := m.config.WireGuard.ConfigPath
+
+	configData, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("WireGuard configuration file not found at %s", configPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard configuration: %w", err)
+	}
+
+	return ValidateContent(string(configData), ""), nil
+}
+
+// ValidateContent validates the content of a WireGuard configuration
+// If expectedPublicKey is set, the interface private key must derive it
+func ValidateContent(content, expectedPublicKey string) *ValidationReport {
+	report := &ValidationReport{}
+	problem := func(section, key, format string, args ...interface{}) {
+		report.Problems = append(report.Problems, Problem{Section: section, Key: key, Message: fmt.Sprintf(format, args...)})
+	}
+
+	sections := parseSections(content)
+	for _, line := range sections[0].lines {
+		if lineKey(line) != "" {
+			problem("", "", "setting outside of a section: %s", strings.TrimSpace(line))
+		}
+	}
+
+	interfaces := sectionIndexes(sections, "Interface")
+	peers := sectionIndexes(sections, "Peer")
+	if len(interfaces) != 1 {
+		problem("Interface", "", "expected one [Interface] section, found %d", len(interfaces))
+	}
+	if len(peers) == 0 {
+		problem("Peer", "", "no [Peer] section")
+	}
+	for _, section := range sections[1:] {
+		if !strings.EqualFold(section.name, "Interface") && !strings.EqualFold(section.name, "Peer") {
+			problem(section.name, "", "unknown section")
+		}
+	}
+
+	for _, i := range interfaces {
+		section := sections[i]
+		if validateInterface(section, report, problem) && expectedPublicKey != "" && report.PublicKey != expectedPublicKey {
+			problem("Interface", "PrivateKey", "does not match the public key %s issued by Cloudflare", expectedPublicKey)
+		}
+		if section.value("PrivateKey") == DummyPrivateKey {
+			report.DummyKeys = true
+		}
+	}
+
+	for n, i := range peers {
+		section := sections[i]
+		validatePeer(section, fmt.Sprintf("Peer %d", n+1), problem)
+		if section.value("PublicKey") == DummyPeerPublicKey {
+			report.DummyKeys = true
+		}
+	}
+
+	switch {
+	case len(report.Problems) > 0:
+		report.State = ValidationBroken
+	case report.DummyKeys:
+		report.State = ValidationDummy
+	default:
+		report.State = ValidationValid
+	}
+	return report
+}
+
+// validateInterface checks the settings of the [Interface] section and derives its public key
+// It reports whether the private key is valid
+func validateInterface(section configSection, report *ValidationReport, problem func(section, key, format string, args ...interface{})) bool {
+	const name = "Interface"
+	keyValid := false
+
+	privateKey := section.value("PrivateKey")
+	if privateKey == "" {
+		problem(name, "PrivateKey", "missing")
+	} else if publicKey, err := PublicKey(privateKey); err != nil {
+		problem(name, "PrivateKey", "%v", err)
+	} else {
+		report.PublicKey = publicKey
+		keyValid = true
+	}
+
+	hasIPv6 := false
+	for _, address := range splitList(section.value("Address")) {
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			problem(name, "Address", "%q is not a valid CIDR", address)
+			continue
+		}
+		if ip.To4() == nil {
+			hasIPv6 = true
+		}
+	}
+
+	if value := section.value("MTU"); value != "" {
+		mtu, err := strconv.Atoi(value)
+		switch {
+		case err != nil:
+			problem(name, "MTU", "%q is not a number", value)
+		case mtu < MinMTU || mtu > MaxMTU:
+			problem(name, "MTU", "%d is outside of %d-%d", mtu, MinMTU, MaxMTU)
+		case hasIPv6 && mtu < MinMTUIPv6:
+			problem(name, "MTU", "%d is below the IPv6 minimum of %d", mtu, MinMTUIPv6)
+		}
+	}
+
+	if value := section.value("ListenPort"); value != "" {
+		if port, err := strconv.Atoi(value); err != nil || port < 0 || port > 65535 {
+			problem(name, "ListenPort", "%q is not a valid port", value)
+		}
+	}
+
+	return keyValid
+}
+
+// validatePeer checks the settings of a [Peer] section
+func validatePeer(section configSection, name string, problem func(section, key, format string, args ...interface{})) {
+	if publicKey := section.value("PublicKey"); publicKey == "" {
+		problem(name, "PublicKey", "missing")
+	} else if _, err := ParseKey(publicKey); err != nil {
+		problem(name, "PublicKey", "%v", err)
+	}
+
+	if presharedKey := section.value("PresharedKey"); presharedKey != "" {
+		if _, err := ParseKey(presharedKey); err != nil {
+			problem(name, "PresharedKey", "%v", err)
+		}
+	}
+
+	for _, allowedIP := range splitList(section.value("AllowedIPs")) {
+		if _, _, err := net.ParseCIDR(allowedIP); err != nil {
+			problem(name, "AllowedIPs", "%q is not a valid CIDR", allowedIP)
+		}
+	}
+
+	if endpoint := section.value("Endpoint"); endpoint != "" {
+		if _, _, err := ParseEndpoint(endpoint, 0); err != nil {
+			problem(name, "Endpoint", "%v", err)
+		}
+	}
+
+	if value := section.value("PersistentKeepalive"); value != "" && value != "off" {
+		if keepalive, err := strconv.Atoi(value); err != nil || keepalive < 0 || keepalive > 65535 {
+			problem(name, "PersistentKeepalive", "%q is not a number of seconds", value)
+		}
+	}
+}
+
+// splitList splits a comma-separated setting into its trimmed, non-empty values
+func splitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// ParseKey decodes a WireGuard key, which is 32 bytes in base64
+func ParseKey(key string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("not valid base64")
+	}
+	if len(decoded) != keySize {
+		return nil, fmt.Errorf("decodes to %d bytes instead of %d", len(decoded), keySize)
+	}
+	return decoded, nil
+}
+
+// PublicKey derives the public key of a WireGuard private key
+func PublicKey(privateKey string) (string, error) {
+	decoded, err := ParseKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := ecdh.X25519().NewPrivateKey(decoded)
+	if err != nil {
+		return "", fmt.Errorf("not a valid private key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
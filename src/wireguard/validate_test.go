@@ -0,0 +1,113 @@
+package wireguard
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+// validConfig is a complete configuration with the keys from testWireGuardConfig
+const validConfig = `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 172.16.0.2/32, 2606:4700:110:8a36::2/128
+ListenPort = 51820
+MTU = 1280
+
+[Peer]
+PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=
+PresharedKey = FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE=
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = [2606:4700:d0::a29f:c001]:2408
+PersistentKeepalive = 25
+`
+
+func TestPublicKey(t *testing.T) {
+	// Key pair from the wg(8) documentation
+	publicKey, err := PublicKey("yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=")
+	if err != nil || publicKey != "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=" {
+		t.Errorf("PublicKey() = %q, %v", publicKey, err)
+	}
+
+	for _, key := range []string{"", "not base64!", "c2hvcnQ=", "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmkyAnz5"} {
+		if _, err := PublicKey(key); err == nil {
+			t.Errorf("Expected error for key %q", key)
+		}
+	}
+}
+
+func TestValidateContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+		// problem is a substring of the expected problem, for broken configurations
+		problem string
+	}{
+		{name: "valid", content: validConfig, expected: ValidationValid},
+		{
+			name:     "dummy keys",
+			content:  strings.NewReplacer("yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=", DummyPrivateKey, "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=", DummyPeerPublicKey).Replace(validConfig),
+			expected: ValidationDummy,
+		},
+		{
+			name:     "dummy keys with a broken setting",
+			content:  strings.Replace(strings.Replace(validConfig, "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=", DummyPeerPublicKey, 1), "MTU = 1280", "MTU = big", 1),
+			expected: ValidationBroken,
+			problem:  "MTU",
+		},
+		{name: "missing interface", content: validConfig[strings.Index(validConfig, "[Peer]"):], expected: ValidationBroken, problem: "expected one [Interface] section"},
+		{name: "missing peer", content: validConfig[:strings.Index(validConfig, "[Peer]")], expected: ValidationBroken, problem: "no [Peer] section"},
+		{name: "unknown section", content: validConfig + "[Peers]\n", expected: ValidationBroken, problem: "[Peers] unknown section"},
+		{name: "short key", content: strings.Replace(validConfig, "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=", "c2hvcnQ=", 1), expected: ValidationBroken, problem: "[Peer 1] PublicKey: decodes to 5 bytes"},
+		{name: "bad private key", content: strings.Replace(validConfig, "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=", "%%%", 1), expected: ValidationBroken, problem: "[Interface] PrivateKey: not valid base64"},
+		{name: "bad preshared key", content: strings.Replace(validConfig, "FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE=", "psk", 1), expected: ValidationBroken, problem: "PresharedKey"},
+		{name: "bad address", content: strings.Replace(validConfig, "172.16.0.2/32", "172.16.0.2", 1), expected: ValidationBroken, problem: `Address: "172.16.0.2" is not a valid CIDR`},
+		{name: "bad allowed IPs", content: strings.Replace(validConfig, "::/0", "::/129", 1), expected: ValidationBroken, problem: "AllowedIPs"},
+		{name: "endpoint without port", content: strings.Replace(validConfig, "]:2408", "]", 1), expected: ValidationBroken, problem: "Endpoint"},
+		{name: "unbracketed IPv6 endpoint", content: strings.Replace(validConfig, "[2606:4700:d0::a29f:c001]:2408", "2606:4700:d0::a29f:c001:2408", 1), expected: ValidationBroken, problem: "Endpoint"},
+		{name: "MTU too large", content: strings.Replace(validConfig, "MTU = 1280", "MTU = 65000", 1), expected: ValidationBroken, problem: "outside of 576-9000"},
+		{name: "MTU too small for IPv6", content: strings.Replace(validConfig, "MTU = 1280", "MTU = 1200", 1), expected: ValidationBroken, problem: "IPv6 minimum"},
+		{name: "bad keepalive", content: strings.Replace(validConfig, "PersistentKeepalive = 25", "PersistentKeepalive = soon", 1), expected: ValidationBroken, problem: "PersistentKeepalive"},
+	}
+
+	for _, test := range tests {
+		report := ValidateContent(test.content, "")
+		if report.State != test.expected {
+			t.Errorf("%s: got state %s; expected %s (problems: %v)", test.name, report.State, test.expected, report.Problems)
+			continue
+		}
+		if test.problem != "" && (report.Err() == nil || !strings.Contains(report.Err().Error(), test.problem)) {
+			t.Errorf("%s: expected a problem containing %q, got %v", test.name, test.problem, report.Err())
+		}
+		if test.expected != ValidationBroken && report.Err() != nil {
+			t.Errorf("%s: unexpected error %v", test.name, report.Err())
+		}
+	}
+}
+
+func TestValidateContentChecksDerivedPublicKey(t *testing.T) {
+	report := ValidateContent(validConfig, "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=")
+	if report.State != ValidationValid || report.PublicKey != "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=" {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	report = ValidateContent(validConfig, "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=")
+	if report.State != ValidationBroken || !strings.Contains(report.Err().Error(), "does not match the public key") {
+		t.Errorf("Expected a key mismatch, got %+v", report)
+	}
+}
+
+func TestUpdateConfigRefusesInvalidConfig(t *testing.T) {
+	m := newTestManager(t)
+	existing := strings.Replace(validConfig, "Address = 172.16.0.2/32, 2606:4700:110:8a36::2/128", "Address = 172.16.0.2", 1)
+	os.WriteFile(m.config.WireGuard.ConfigPath, []byte(existing), 0600)
+
+	err := m.UpdateConfig(context.Background(), testWireGuardConfig())
+	if err == nil || !strings.Contains(err.Error(), "Address") {
+		t.Fatalf("Expected the invalid address to be refused, got %v", err)
+	}
+	if data, _ := os.ReadFile(m.config.WireGuard.ConfigPath); string(data) != existing {
+		t.Errorf("Expected the configuration to be left untouched")
+	}
+}
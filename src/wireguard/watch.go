@@ -0,0 +1,187 @@
+package wireguard
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// revertWindow is the period over which the watcher limits the number of reverts it reports
+const revertWindow = time.Hour
+
+// maxStaleKeys is how many replaced private keys the watcher remembers
+const maxStaleKeys = 8
+
+// Watcher watches the WireGuard configuration file and reports when something else, such as the
+// UniFi controller re-provisioning the interface, reverts its keys to stale or dummy values
+type Watcher struct {
+	path       string
+	debounce   time.Duration
+	maxReverts int
+
+	mu sync.Mutex
+	// current is the private key most recently applied, and stale the ones it replaced
+	current string
+	stale   []string
+	// reverts are the times of the reverts reported within the window, and limited whether the limit was logged
+	reverts []time.Time
+	limited bool
+}
+
+// NewWatcher creates a watcher that checks the file once writes to it have settled for debounce
+// At most maxReverts reverts are reported per hour, so a fight with another writer can't loop
+func NewWatcher(path string, debounce time.Duration, maxReverts int) *Watcher {
+	return &Watcher{
+		path:       filepath.Clean(path),
+		debounce:   debounce,
+		maxReverts: maxReverts,
+	}
+}
+
+// Expect records the private key that was just applied; the key it replaces becomes stale
+func (w *Watcher) Expect(privateKey string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.expect(privateKey)
+}
+
+// expect records the applied private key; the caller holds mu
+func (w *Watcher) expect(privateKey string) {
+	if privateKey == "" || privateKey == w.current {
+		return
+	}
+	if w.current != "" && w.current != DummyPrivateKey && !slices.Contains(w.stale, w.current) {
+		w.stale = append(w.stale, w.current)
+		if len(w.stale) > maxStaleKeys {
+			w.stale = w.stale[1:]
+		}
+	}
+	w.stale = slices.DeleteFunc(w.stale, func(key string) bool { return key == privateKey })
+	w.current = privateKey
+}
+
+// Check reads the configuration file and returns why its keys reverted, or an empty string if they didn't
+func (w *Watcher) Check() (string, error) {
+	configData, err := os.ReadFile(w.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read WireGuard configuration: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return revertReason(string(configData), w.stale), nil
+}
+
+// revertReason returns why the keys of the configuration are stale or dummy values, or an empty string
+func revertReason(content string, stale []string) string {
+	sections := parseSections(content)
+	for _, i := range sectionIndexes(sections, "Interface") {
+		privateKey := sections[i].value("PrivateKey")
+		switch {
+		case privateKey == DummyPrivateKey:
+			return "dummy private key"
+		case slices.Contains(stale, privateKey):
+			return "stale private key"
+		}
+	}
+	for _, i := range sectionIndexes(sections, "Peer") {
+		if sections[i].value("PublicKey") == DummyPeerPublicKey {
+			return "dummy peer public key"
+		}
+	}
+	return ""
+}
+
+// allow records a revert at now and reports whether it is within the limit
+// limitReached is only set for the first revert over the limit, so the limit is logged once
+func (w *Watcher) allow(now time.Time) (allowed, limitReached bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.reverts = slices.DeleteFunc(w.reverts, func(t time.Time) bool { return now.Sub(t) >= revertWindow })
+	if len(w.reverts) >= w.maxReverts {
+		limitReached = !w.limited
+		w.limited = true
+		return false, limitReached
+	}
+	w.reverts = append(w.reverts, now)
+	w.limited = false
+	return true, false
+}
+
+// Run watches the file until stop is closed and calls onRevert whenever its keys revert
+// The directory is watched rather than the file, so a file replaced by a rename is still seen
+func (w *Watcher) Run(stop <-chan struct{}, onRevert func(reason string)) error {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch WireGuard configuration: %w", err)
+	}
+	defer fsWatcher.Close()
+
+	if err := fsWatcher.Add(filepath.Dir(w.path)); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", filepath.Dir(w.path), err)
+	}
+
+	// Until a configuration is applied, the keys in the file are the ones to keep
+	if configData, err := os.ReadFile(w.path); err == nil {
+		sections := parseSections(string(configData))
+		if interfaces := sectionIndexes(sections, "Interface"); len(interfaces) > 0 {
+			w.mu.Lock()
+			if w.current == "" {
+				w.expect(sections[interfaces[0]].value("PrivateKey"))
+			}
+			w.mu.Unlock()
+		}
+	}
+
+	// settled fires once writes to the file have stopped for the debounce period
+	settled := time.NewTimer(w.debounce)
+	settled.Stop()
+	defer settled.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+
+		case event, ok := <-fsWatcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) == w.path && (event.Has(fsnotify.Write) || event.Has(fsnotify.Create)) {
+				settled.Reset(w.debounce)
+			}
+
+		case err, ok := <-fsWatcher.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Warn("Error watching WireGuard configuration", "error", err)
+
+		case <-settled.C:
+			reason, err := w.Check()
+			if err != nil {
+				logger.Warn("Failed to check WireGuard configuration", "error", err)
+				continue
+			}
+			if reason == "" {
+				continue
+			}
+
+			allowed, limitReached := w.allow(time.Now())
+			if !allowed {
+				if limitReached {
+					logger.Warn("WireGuard configuration keeps reverting, leaving it to the next refresh",
+						"reason", reason, "max_reverts", w.maxReverts, "window", revertWindow)
+				}
+				continue
+			}
+			onRevert(reason)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package wireguard
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	watchKey    = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	watchNewKey = "4FFCzyRVcjZ2qb2MZ1Lo6jD3nmwg2VlvNkYN6HbWvGE="
+	watchPeer   = "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo="
+)
+
+// watchConfig returns a configuration with the keys
+func watchConfig(privateKey, peerPublicKey string) string {
+	return "[Interface]\nPrivateKey = " + privateKey + "\nAddress = 172.16.0.2/32\n\n" +
+		"[Peer]\nPublicKey = " + peerPublicKey + "\nAllowedIPs = 0.0.0.0/0\nEndpoint = engage.cloudflareclient.com:2408\n"
+}
+
+func TestRevertReason(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"current keys", watchConfig(watchNewKey, watchPeer), ""},
+		{"dummy private key", watchConfig(DummyPrivateKey, watchPeer), "dummy private key"},
+		{"dummy peer", watchConfig(watchNewKey, DummyPeerPublicKey), "dummy peer public key"},
+		{"stale private key", watchConfig(watchKey, watchPeer), "stale private key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := revertReason(tt.content, []string{watchKey}); got != tt.want {
+				t.Errorf("revertReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcherExpect(t *testing.T) {
+	w := NewWatcher("/etc/wireguard/wg0.conf", time.Second, 3)
+	w.Expect(DummyPrivateKey)
+	w.Expect(watchKey)
+	w.Expect(watchNewKey)
+
+	// The dummy key is reported as such rather than remembered
+	if len(w.stale) != 1 || w.stale[0] != watchKey {
+		t.Errorf("Expected only the replaced key to be stale, got %v", w.stale)
+	}
+
+	// Going back to a replaced key makes it current again
+	w.Expect(watchKey)
+	if len(w.stale) != 1 || w.stale[0] != watchNewKey {
+		t.Errorf("Expected the current key not to be stale, got %v", w.stale)
+	}
+}
+
+func TestWatcherAllow(t *testing.T) {
+	w := NewWatcher("/etc/wireguard/wg0.conf", time.Second, 2)
+	now := time.Now()
+
+	for i, want := range []bool{true, true, false, false} {
+		allowed, limitReached := w.allow(now.Add(time.Duration(i) * time.Minute))
+		if allowed != want {
+			t.Errorf("Revert %d: allowed = %v, want %v", i+1, allowed, want)
+		}
+		// Only the first revert over the limit is logged
+		if limitReached != (i == 2) {
+			t.Errorf("Revert %d: limitReached = %v", i+1, limitReached)
+		}
+	}
+
+	// Reverts age out of the window
+	if allowed, _ := w.allow(now.Add(revertWindow)); !allowed {
+		t.Error("Expected a revert to be allowed once the window passed")
+	}
+}
+
+func TestWatcherRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wg0.conf")
+	if err := os.WriteFile(path, []byte(watchConfig(watchKey, watchPeer)), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	w := NewWatcher(path, 50*time.Millisecond, 3)
+	reverts := make(chan string, 10)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- w.Run(stop, func(reason string) { reverts <- reason }) }()
+
+	// Give the watcher time to start and pick up the keys in the file
+	time.Sleep(100 * time.Millisecond)
+	w.Expect(watchNewKey)
+
+	// Writing the current keys is not a revert
+	os.WriteFile(path, []byte(watchConfig(watchNewKey, watchPeer)), 0600)
+	select {
+	case reason := <-reverts:
+		t.Fatalf("Unexpected revert: %s", reason)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// A burst of writes back to the replaced key is a single revert
+	for i := 0; i < 3; i++ {
+		os.WriteFile(path, []byte(watchConfig(watchKey, watchPeer)), 0600)
+	}
+	select {
+	case reason := <-reverts:
+		if reason != "stale private key" {
+			t.Errorf("Unexpected reason %q", reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a revert")
+	}
+	select {
+	case reason := <-reverts:
+		t.Errorf("Expected writes to be debounced, got another revert: %s", reason)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(stop)
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}